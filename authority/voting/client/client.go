@@ -36,9 +36,9 @@ import (
 	"github.com/katzenpost/hpqc/sign"
 
 	"github.com/katzenpost/katzenpost/authority/voting/server/config"
-	"github.com/katzenpost/katzenpost/core/cert"
 	"github.com/katzenpost/katzenpost/core/log"
 	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/pki/verify"
 	"github.com/katzenpost/katzenpost/core/wire"
 	"github.com/katzenpost/katzenpost/core/wire/commands"
 )
@@ -271,7 +271,7 @@ type Client struct {
 	log       *logging.Logger
 	pool      *connector
 	verifiers []sign.PublicKey
-	threshold int
+	verifier  *verify.Verifier
 }
 
 // Post posts the node's descriptor to the PKI for the provided epoch.
@@ -320,88 +320,104 @@ func (c *Client) Post(ctx context.Context, epoch uint64, signingPrivateKey sign.
 func (c *Client) Get(ctx context.Context, epoch uint64) (*pki.Document, []byte, error) {
 	c.log.Noticef("Get(ctx, %d)", epoch)
 
+	r, err := c.fetch(ctx, epoch)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch r.ErrorCode {
+	case commands.ConsensusOk:
+	case commands.ConsensusGone:
+		return nil, nil, pki.ErrNoDocument
+	default:
+		return nil, nil, fmt.Errorf("voting/Client: Get() rejected by authority: %v", getErrorToString(r.ErrorCode))
+	}
+	return c.verify(epoch, r.Payload)
+}
+
+// GetDocumentForEpoch returns the PKI document for the provided epoch.
+func (c *Client) GetDocumentForEpoch(ctx context.Context, epoch uint64) (*pki.Document, error) {
+	c.log.Noticef("GetDocumentForEpoch(ctx, %d)", epoch)
+
+	r, err := c.fetch(ctx, epoch)
+	if err != nil {
+		return nil, err
+	}
+	switch r.ErrorCode {
+	case commands.ConsensusOk:
+	case commands.ConsensusGone:
+		return nil, pki.ErrDocumentExpired
+	case commands.ConsensusNotFound:
+		return nil, pki.ErrDocumentNotPublished
+	default:
+		return nil, fmt.Errorf("voting/Client: GetDocumentForEpoch() rejected by authority: %v", getErrorToString(r.ErrorCode))
+	}
+	doc, _, err := c.verify(epoch, r.Payload)
+	return doc, err
+}
+
+// fetch dispatches the get_consensus command for the provided epoch.
+func (c *Client) fetch(ctx context.Context, epoch uint64) (*commands.Consensus, error) {
 	// Generate a random keypair to use for the link authentication.
 	scheme := wire.DefaultScheme
 	genRand, err := seec.GenKeyPRPAES(rand.Reader, 256)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	_, linkKey := nyquistkem.GenerateKeypair(scheme, genRand)
 
-	// Initialize the TCP/IP connection, and wire session.
-	doneCh := make(chan interface{})
-	defer close(doneCh)
-
 	// Dispatch the get_consensus command.
 	resp, err := c.pool.fetchConsensus(ctx, linkKey, epoch)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
 
 	// Parse the consensus command.
 	r, ok := resp.(*commands.Consensus)
 	if !ok {
-		return nil, nil, fmt.Errorf("voting/Client: Get() unexpected reply: %T", resp)
-	}
-	switch r.ErrorCode {
-	case commands.ConsensusOk:
-	case commands.ConsensusGone:
-		return nil, nil, pki.ErrNoDocument
-	default:
-		return nil, nil, fmt.Errorf("voting/Client: Get() rejected by authority: %v", getErrorToString(r.ErrorCode))
+		return nil, fmt.Errorf("voting/Client: Get() unexpected reply: %T", resp)
 	}
+	return r, nil
+}
 
-	// Verify document signatures.
-	doc := &pki.Document{}
-	_, good, bad, err := cert.VerifyThreshold(c.verifiers, c.threshold, r.Payload)
+// verify verifies and parses the consensus document for the provided epoch.
+func (c *Client) verify(epoch uint64, payload []byte) (*pki.Document, []byte, error) {
+	// Verify document signatures and well formedness.
+	res, err := c.verifier.Verify(payload)
 	if err != nil {
-		c.log.Errorf("VerifyThreshold failure: %d good signatures, %d bad signatures: %v", len(good), len(bad), err)
+		c.log.Errorf("voting/Client: Get() invalid consensus document: %s", err)
 		return nil, nil, fmt.Errorf("voting/Client: Get() invalid consensus document: %s", err)
 	}
-	if len(good) == len(c.cfg.Authorities) {
+	if len(res.Good) == len(c.cfg.Authorities) {
 		c.log.Notice("OK, received fully signed consensus document.")
 	} else {
-		c.log.Noticef("OK, received consensus document with %d of %d signatures)", len(good), len(c.cfg.Authorities))
+		c.log.Noticef("OK, received consensus document with %d of %d signatures)", len(res.Good), len(c.cfg.Authorities))
 		for _, auth := range c.cfg.Authorities {
-			for _, badauth := range bad {
-				if badauth == auth.IdentityPublicKey {
-					c.log.Noticef("missing or invalid signature from %s", auth.Identifier)
+			id := hash.Sum256From(auth.IdentityPublicKey)
+			for _, f := range res.Failures {
+				if f.KeyHash == id {
+					c.log.Noticef("%s from %s", f.Reason, auth.Identifier)
 					break
 				}
 			}
 		}
 	}
-	doc, err = pki.ParseDocument(r.Payload)
-	if err != nil {
-		c.log.Errorf("voting/Client: Get() invalid consensus document: %s", err)
-		return nil, nil, err
-	}
-
-	err = pki.IsDocumentWellFormed(doc, c.verifiers)
-	if err != nil {
-		c.log.Errorf("voting/Client: IsDocumentWellFormed: %s", err)
-		return nil, nil, err
-	}
+	doc := res.Document
 
 	if doc.Epoch != epoch {
 		return nil, nil, fmt.Errorf("voting/Client: Get() consensus document for WRONG epoch: %v", doc.Epoch)
 	}
 	c.log.Noticef("voting/Client: Get() document:\n%s", doc)
-	return doc, r.Payload, nil
+	return doc, payload, nil
 }
 
 // Deserialize returns PKI document given the raw bytes.
 func (c *Client) Deserialize(raw []byte) (*pki.Document, error) {
-	_, _, _, err := cert.VerifyThreshold(c.verifiers, c.threshold, raw)
+	res, err := c.verifier.Verify(raw)
 	if err != nil {
 		return nil, err
 	}
-	doc, err := pki.ParseDocument(raw)
-	if err != nil {
-		fmt.Errorf("Deserialize failure: %s", err)
-	}
-	return doc, err
+	return res.Document, nil
 }
 
 // New constructs a new pki.Client instance.
@@ -421,7 +437,11 @@ func New(cfg *Config) (pki.Client, error) {
 	for i, auth := range c.cfg.Authorities {
 		c.verifiers[i] = auth.IdentityPublicKey
 	}
-	c.threshold = len(c.verifiers)/2 + 1
+	var err error
+	c.verifier, err = verify.New(c.verifiers, len(c.verifiers)/2+1)
+	if err != nil {
+		return nil, err
+	}
 	return c, nil
 }
 
@@ -40,133 +40,12 @@ import (
 	"github.com/katzenpost/katzenpost/core/epochtime"
 	"github.com/katzenpost/katzenpost/core/log"
 	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/pki/pkitest"
 	"github.com/katzenpost/katzenpost/core/sphinx/geo"
 	"github.com/katzenpost/katzenpost/core/wire"
 	"github.com/katzenpost/katzenpost/core/wire/commands"
 )
 
-type descriptor struct {
-	desc *pki.MixDescriptor
-	raw  []byte
-}
-
-func generateRandomTopology(nodes []*descriptor, layers int) [][]*pki.MixDescriptor {
-	rng := rand.NewMath()
-	nodeIndexes := rng.Perm(len(nodes))
-	topology := make([][]*pki.MixDescriptor, layers)
-	for idx, layer := 0, 0; idx < len(nodes); idx++ {
-		n := nodes[nodeIndexes[idx]]
-		topology[layer] = append(topology[layer], n.desc)
-		layer++
-		layer = layer % len(topology)
-	}
-	return topology
-}
-
-func generateMixKeys(epoch uint64) (map[uint64][]byte, error) {
-	m := make(map[uint64][]byte)
-	for i := epoch; i < epoch+3; i++ {
-		publickey, _, err := ecdh.Scheme(rand.Reader).GenerateKeyPairFromEntropy(rand.Reader)
-		if err != nil {
-			return nil, err
-		}
-		m[uint64(i)] = publickey.Bytes()
-	}
-	return m, nil
-}
-
-func generateNodes(isProvider bool, num int, epoch uint64) ([]*descriptor, error) {
-	mixes := []*descriptor{}
-	for i := 0; i < num; i++ {
-		mixIdentityPublicKey, mixIdentityPrivateKey, err := cert.Scheme.GenerateKey()
-		if err != nil {
-			return nil, err
-		}
-		mixKeys, err := generateMixKeys(epoch)
-		if err != nil {
-			return nil, err
-		}
-		var name string
-		if isProvider {
-			name = fmt.Sprintf("NSA_Spy_Satelite_Provider%d", i)
-		} else {
-			name = fmt.Sprintf("NSA_Spy_Satelite_Mix%d", i)
-		}
-
-		scheme := wire.DefaultScheme
-		_, linkPubKey, err := scheme.GenerateKeyPair()
-		if err != nil {
-			return nil, err
-		}
-
-		linkKeyBlob, err := linkPubKey.MarshalBinary()
-		if err != nil {
-			return nil, err
-		}
-
-		blob, err := mixIdentityPublicKey.MarshalBinary()
-		if err != nil {
-			return nil, err
-		}
-
-		mix := &pki.MixDescriptor{
-			Name:        name,
-			Epoch:       epoch,
-			IdentityKey: blob,
-			LinkKey:     linkKeyBlob,
-			MixKeys:     mixKeys,
-			Addresses: map[pki.Transport][]string{
-				pki.Transport("tcp4"): []string{fmt.Sprintf("127.0.0.1:%d", i+1)},
-			},
-			Kaetzchen:  nil,
-			Provider:   isProvider,
-			LoadWeight: 0,
-		}
-		signed, err := pki.SignDescriptor(mixIdentityPrivateKey, mixIdentityPublicKey, mix)
-		if err != nil {
-			return nil, err
-		}
-		desc := &descriptor{
-			raw:  []byte(signed),
-			desc: mix,
-		}
-		mixes = append(mixes, desc)
-	}
-	return mixes, nil
-}
-
-func generateMixnet(numMixes, numProviders int, epoch uint64) (*pki.Document, error) {
-	mixes, err := generateNodes(false, numMixes, epoch)
-	if err != nil {
-		return nil, err
-	}
-	providers, err := generateNodes(true, numProviders, epoch)
-	if err != nil {
-		return nil, err
-	}
-	pdescs := make([]*pki.MixDescriptor, len(providers))
-	for i, p := range providers {
-		pdescs[i] = p.desc
-	}
-	topology := generateRandomTopology(mixes, 3)
-
-	sharedRandomCommit := make(map[[pki.PublicKeyHashSize]byte][]byte)
-	doc := &pki.Document{
-		Version:            pki.DocumentVersion,
-		Epoch:              epoch,
-		GenesisEpoch:       epoch,
-		Mu:                 0.25,
-		MuMaxDelay:         4000,
-		LambdaP:            1.2,
-		LambdaPMaxDelay:    300,
-		Topology:           topology,
-		Providers:          pdescs,
-		SharedRandomCommit: sharedRandomCommit,
-		SharedRandomValue:  make([]byte, pki.SharedRandomValueLength),
-	}
-	return doc, nil
-}
-
 // multiSignTestDocument signs and serializes the document with the provided signing key.
 func multiSignTestDocument(signingKeys []sign.PrivateKey, signingPubKeys []sign.PublicKey, d *pki.Document) ([]byte, error) {
 	// Serialize the document.
@@ -195,10 +74,7 @@ func multiSignTestDocument(signingKeys []sign.PrivateKey, signingPubKeys []sign.
 }
 
 func generateDoc(epoch uint64, signingKeys []sign.PrivateKey, signingPubKeys []sign.PublicKey) ([]byte, error) {
-	// XXX
-	numMixes := len(signingKeys) - 2
-	numProviders := 2
-	doc, err := generateMixnet(numMixes, numProviders, epoch)
+	doc, err := pkitest.NewDocumentBuilder(epoch).WithProviders(2).Build()
 	if err != nil {
 		return nil, err
 	}
@@ -47,6 +47,7 @@ import (
 	"github.com/katzenpost/katzenpost/core/cert"
 	"github.com/katzenpost/katzenpost/core/epochtime"
 	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/pki/verify"
 	"github.com/katzenpost/katzenpost/core/sphinx/constants"
 	"github.com/katzenpost/katzenpost/core/sphinx/geo"
 	"github.com/katzenpost/katzenpost/core/wire"
@@ -115,6 +116,7 @@ type state struct {
 	reveals      map[uint64]map[[publicKeyHashSize]byte][]byte
 	commits      map[uint64]map[[publicKeyHashSize]byte][]byte
 	verifiers    map[[publicKeyHashSize]byte]sign.PublicKey
+	verifier     *verify.Verifier
 
 	updateCh chan interface{}
 
@@ -459,23 +461,22 @@ func (s *state) getThresholdConsensus(epoch uint64) (*pki.Document, error) {
 	if err != nil {
 		return nil, err
 	}
-	_, good, bad, err := cert.VerifyThreshold(s.getVerifiers(), s.threshold, signedConsensus)
-	for _, b := range bad {
-		s.log.Errorf("Consensus NOT signed by %x", hash.Sum256From(b))
+	res, err := s.verifier.Verify(signedConsensus)
+	if err != nil {
+		s.log.Errorf("Consensus verification failed!: %s", err)
+		return nil, fmt.Errorf("No consensus found for epoch %d", epoch)
 	}
-	for _, g := range good {
-		s.log.Noticef("Consensus signed by %x", hash.Sum256From(g))
+	for _, f := range res.Failures {
+		s.log.Errorf("Consensus NOT signed by %x: %s", f.KeyHash, f.Reason)
 	}
-	if err == nil {
-		s.log.Noticef("Consensus made for epoch %d with %d/%d signatures: %v", epoch, len(good), len(s.verifiers), ourConsensus)
-		// Persist the document to disk.
-		s.persistDocument(epoch, signedConsensus)
-		s.documents[epoch] = ourConsensus
-		return ourConsensus, nil
-	} else {
-		s.log.Errorf("VerifyThreshold failed!: %s", err)
+	for _, g := range res.Good {
+		s.log.Noticef("Consensus signed by %x", hash.Sum256From(g))
 	}
-	return nil, fmt.Errorf("No consensus found for epoch %d", epoch)
+	s.log.Noticef("Consensus made for epoch %d with %d/%d signatures: %v", epoch, len(res.Good), len(s.verifiers), ourConsensus)
+	// Persist the document to disk.
+	s.persistDocument(epoch, signedConsensus)
+	s.documents[epoch] = ourConsensus
+	return ourConsensus, nil
 }
 
 func (s *state) getVerifiers() []sign.PublicKey {
@@ -1697,15 +1698,12 @@ func (s *state) restorePersistence() error {
 			for _, epoch := range epochs {
 				epochBytes := epochToBytes(epoch)
 				if rawDoc := docsBkt.Get(epochBytes); rawDoc != nil {
-					_, _, _, err := cert.VerifyThreshold(s.getVerifiers(), s.threshold, rawDoc)
+					res, err := s.verifier.Verify(rawDoc)
 					if err != nil {
-						s.log.Errorf("Failed to verify threshold on restored document")
+						s.log.Errorf("Failed to verify restored document: %v", err)
 						break // or continue?
 					}
-					doc, err := s.doParseDocument(rawDoc)
-					if err != nil {
-						s.log.Errorf("Failed to validate persisted document: %v", err)
-					} else if doc.Epoch != epoch {
+					if doc := res.Document; doc.Epoch != epoch {
 						// The document for the wrong epoch was persisted?
 						s.log.Errorf("Persisted document has unexpected epoch: %v", doc.Epoch)
 					} else {
@@ -1780,6 +1778,10 @@ func newState(s *Server) (*state, error) {
 	}
 	st.verifiers[hash.Sum256From(s.IdentityKey())] = sign.PublicKey(s.IdentityKey())
 	st.threshold = len(st.verifiers)/2 + 1
+	var err error
+	if st.verifier, err = verify.New(st.getVerifiers(), st.threshold); err != nil {
+		return nil, err
+	}
 	st.dissenters = len(s.cfg.Authorities)/2 - 1
 
 	// Initialize the authorized peer tables.
@@ -1853,7 +1855,6 @@ func newState(s *Server) (*state, error) {
 
 	// Initialize the persistence store and restore state.
 	dbPath := filepath.Join(s.cfg.Server.DataDir, dbFile)
-	var err error
 	if st.db, err = bolt.Open(dbPath, 0600, nil); err != nil {
 		return nil, err
 	}
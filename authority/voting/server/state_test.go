@@ -42,6 +42,7 @@ import (
 	"github.com/katzenpost/katzenpost/core/epochtime"
 	"github.com/katzenpost/katzenpost/core/log"
 	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/pki/verify"
 	"github.com/katzenpost/katzenpost/core/sphinx/geo"
 	"github.com/katzenpost/katzenpost/core/wire"
 	sConfig "github.com/katzenpost/katzenpost/server/config"
@@ -86,6 +87,8 @@ func TestVote(t *testing.T) {
 			st.verifiers[hash.Sum256From(peerKeys[j].idPubKey)] = sign.PublicKey(peerKeys[j].idPubKey)
 		}
 		st.threshold = len(st.verifiers)/2 + 1
+		st.verifier, err = verify.New(st.getVerifiers(), st.threshold)
+		require.NoError(err)
 		st.dissenters = len(cfg.Authorities)/2 - 1
 
 		s := &Server{
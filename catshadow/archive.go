@@ -0,0 +1,257 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// archive.go - signed and encrypted conversation archives
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"github.com/katzenpost/hpqc/hash"
+	"github.com/katzenpost/hpqc/sign"
+	"github.com/katzenpost/hpqc/sign/ed25519"
+
+	"github.com/katzenpost/katzenpost/core/utils"
+)
+
+const (
+	archiveVersion = 1
+
+	// ArchiveSignatureSuffix is appended to the path of a conversation
+	// archive to name the file holding its detached signature.
+	ArchiveSignatureSuffix = ".sig"
+)
+
+var (
+	ErrArchiveFingerprintMismatch = errors.New("archive was not signed by the expected identity")
+	ErrArchiveInvalidSignature    = errors.New("archive signature is invalid")
+	ErrArchiveDecryptFailed       = errors.New("failed to decrypt archive")
+)
+
+// ArchivedMessage is a message of an exported conversation.
+type ArchivedMessage struct {
+	Plaintext []byte
+	Timestamp time.Time
+	Outbound  bool
+	Delivered bool
+}
+
+// ConversationArchive is the read-only export of a single conversation.
+type ConversationArchive struct {
+	Version    int
+	Nickname   string
+	ExportedAt time.Time
+
+	// ExporterKey is the public identity key of the exporter which signed
+	// the archive.
+	ExporterKey []byte
+
+	// PeerFingerprint is the hash of the contact's identity key,
+	// or all zeros if the contact did not sign its key exchange.
+	PeerFingerprint [32]byte
+
+	// Messages are sorted by Timestamp.
+	Messages []*ArchivedMessage
+}
+
+// archiveSignature is the content of the detached signature file.
+type archiveSignature struct {
+	PublicKey []byte
+	Signature []byte
+}
+
+type conversationArchiveResult struct {
+	archive *ConversationArchive
+	err     error
+}
+
+// IdentityFingerprint returns the fingerprint of the identity key which
+// signs the conversation archives exported by this Client. The Client
+// must have created its remote spool.
+func (c *Client) IdentityFingerprint() [32]byte {
+	return hash.Sum256From(c.identityPublicKey())
+}
+
+func (c *Client) identityPublicKey() sign.PublicKey {
+	return c.spoolReadDescriptor.PrivateKey.Public().(sign.PublicKey)
+}
+
+func (c *Client) doGetConversationArchive(nickname string) (*ConversationArchive, error) {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		return nil, ErrContactNotFound
+	}
+	if c.spoolReadDescriptor == nil {
+		return nil, ErrNoSpool
+	}
+	exporterKey, err := c.identityPublicKey().MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	archive := &ConversationArchive{
+		Version:     archiveVersion,
+		Nickname:    nickname,
+		ExportedAt:  c.now(),
+		ExporterKey: exporterKey,
+	}
+	archive.PeerFingerprint = contact.fingerprint()
+
+	c.conversationsMutex.Lock()
+	defer c.conversationsMutex.Unlock()
+	var messages Messages
+	for _, m := range c.conversations[nickname] {
+		messages = append(messages, m)
+	}
+	sort.Sort(messages)
+	for _, m := range messages {
+		archive.Messages = append(archive.Messages, &ArchivedMessage{
+			Plaintext: m.Plaintext,
+			Timestamp: m.Timestamp,
+			Outbound:  m.Outbound,
+			Delivered: m.Delivered,
+		})
+	}
+	return archive, nil
+}
+
+// ExportConversation writes the conversation with the contact to path,
+// encrypted with a key derived from passphrase, and a detached signature
+// by the Client's identity key over the hash of the encrypted archive to
+// path with ArchiveSignatureSuffix appended.
+func (c *Client) ExportConversation(nickname, path string, passphrase []byte) error {
+	op := &opGetConversationArchive{
+		name:         nickname,
+		responseChan: make(chan *conversationArchiveResult, 1),
+	}
+	select {
+	case <-c.HaltCh():
+		return ErrHalted
+	case c.opCh <- op:
+	}
+	var r *conversationArchiveResult
+	select {
+	case <-c.HaltCh():
+		return ErrHalted
+	case r = <-op.responseChan:
+	}
+	if r.err != nil {
+		return r.err
+	}
+	return c.writeConversationArchive(r.archive, path, passphrase)
+}
+
+func (c *Client) writeConversationArchive(archive *ConversationArchive, path string, passphrase []byte) error {
+	plaintext, err := cbor.Marshal(archive)
+	if err != nil {
+		return err
+	}
+	defer utils.ExplicitBzero(plaintext)
+	salt, err := newSalt()
+	if err != nil {
+		return err
+	}
+	key := stateKey(passphrase, salt)
+	ciphertext, err := encryptState(plaintext, key)
+	utils.ExplicitBzero(key[:])
+	if err != nil {
+		return err
+	}
+	ciphertext = append(salt, ciphertext...)
+
+	digest := hash.Sum256(ciphertext)
+	sig, err := cbor.Marshal(&archiveSignature{
+		PublicKey: archive.ExporterKey,
+		Signature: ed25519.Scheme().Sign(c.spoolReadDescriptor.PrivateKey, digest[:], nil),
+	})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, ciphertext); err != nil {
+		return err
+	}
+	return writeFileAtomic(path+ArchiveSignatureSuffix, sig)
+}
+
+// VerifyConversationArchive checks that the archive at path is unmodified
+// and signed by the identity with the given fingerprint. It does not need
+// the passphrase of the archive.
+func VerifyConversationArchive(path string, exporterFingerprint [32]byte) error {
+	ciphertext, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	rawSig, err := os.ReadFile(path + ArchiveSignatureSuffix)
+	if err != nil {
+		return err
+	}
+	sig := new(archiveSignature)
+	if err := cbor.Unmarshal(rawSig, sig); err != nil {
+		return err
+	}
+	publicKey, err := ed25519.Scheme().UnmarshalBinaryPublicKey(sig.PublicKey)
+	if err != nil {
+		return err
+	}
+	if hash.Sum256From(publicKey) != exporterFingerprint {
+		return ErrArchiveFingerprintMismatch
+	}
+	digest := hash.Sum256(ciphertext)
+	if !ed25519.Scheme().Verify(publicKey, digest[:], sig.Signature, nil) {
+		return ErrArchiveInvalidSignature
+	}
+	return nil
+}
+
+// ReadConversationArchive decrypts the archive at path. Use
+// VerifyConversationArchive to check its signature.
+func ReadConversationArchive(path string, passphrase []byte) (*ConversationArchive, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) < saltSize+nonceSize {
+		return nil, ErrArchiveDecryptFailed
+	}
+	key := stateKey(passphrase, raw[:saltSize])
+	plaintext, err := decryptState(raw[saltSize:], key)
+	utils.ExplicitBzero(key[:])
+	if err != nil {
+		return nil, ErrArchiveDecryptFailed
+	}
+	defer utils.ExplicitBzero(plaintext)
+	archive := new(ConversationArchive)
+	if err := cbor.Unmarshal(plaintext, archive); err != nil {
+		return nil, err
+	}
+	if archive.Version != archiveVersion {
+		return nil, fmt.Errorf("unsupported archive version %d", archive.Version)
+	}
+	return archive, nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmpFn := fmt.Sprintf("%s.tmp", path)
+	if err := os.WriteFile(tmpFn, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpFn, path)
+}
@@ -0,0 +1,87 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// archive_test.go - conversation archive tests
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func exportTestArchive(t *testing.T, c *Client, nickname, path string, passphrase []byte) {
+	archive, err := c.doGetConversationArchive(nickname)
+	require.NoError(t, err)
+	require.NoError(t, c.writeConversationArchive(archive, path, passphrase))
+}
+
+func TestConversationArchive(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	alice := newTestClient(t, clock)
+	addTestContact(t, alice, "bob")
+	alice.conversations["bob"] = map[MessageID]*Message{
+		MessageID{2}: {Plaintext: []byte("second"), Timestamp: clock.Now().Add(time.Minute)},
+		MessageID{1}: {Plaintext: []byte("first"), Timestamp: clock.Now(), Outbound: true, Delivered: true},
+	}
+
+	_, err := alice.doGetConversationArchive("carol")
+	require.ErrorIs(err, ErrContactNotFound)
+
+	path := filepath.Join(t.TempDir(), "bob.archive")
+	passphrase := []byte("correct horse battery staple")
+	exportTestArchive(t, alice, "bob", path, passphrase)
+
+	require.NoError(VerifyConversationArchive(path, alice.IdentityFingerprint()))
+	archive, err := ReadConversationArchive(path, passphrase)
+	require.NoError(err)
+	require.Equal("bob", archive.Nickname)
+	require.True(clock.Now().Equal(archive.ExportedAt))
+	require.Equal([32]byte{}, archive.PeerFingerprint)
+	require.Len(archive.Messages, 2)
+	require.Equal([]byte("first"), archive.Messages[0].Plaintext)
+	require.True(archive.Messages[0].Outbound)
+	require.True(archive.Messages[0].Delivered)
+	require.Equal([]byte("second"), archive.Messages[1].Plaintext)
+	require.False(archive.Messages[1].Outbound)
+
+	// A wrong passphrase does not decrypt the archive.
+	_, err = ReadConversationArchive(path, []byte("wrong"))
+	require.ErrorIs(err, ErrArchiveDecryptFailed)
+
+	// The archive must be signed by the expected identity.
+	mallory := newTestClient(t, clock)
+	require.ErrorIs(VerifyConversationArchive(path, mallory.IdentityFingerprint()), ErrArchiveFingerprintMismatch)
+
+	// The archive is keyed like the statefile.
+	raw, err := os.ReadFile(path)
+	require.NoError(err)
+	_, err = decryptState(raw[saltSize:], stateKey(passphrase, raw[:saltSize]))
+	require.NoError(err)
+
+	// Any modification of the archive is detected.
+	raw[len(raw)-1] ^= 0xff
+	require.NoError(os.WriteFile(path, raw, 0600))
+	require.ErrorIs(VerifyConversationArchive(path, alice.IdentityFingerprint()), ErrArchiveInvalidSignature)
+	_, err = ReadConversationArchive(path, passphrase)
+	require.ErrorIs(err, ErrArchiveDecryptFailed)
+}
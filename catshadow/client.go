@@ -99,6 +99,24 @@ type Client struct {
 	online     bool
 	connecting bool
 
+	// allowKeyChanged is true if messages are sent to contacts whose
+	// key changed since they were verified.
+	allowKeyChanged bool
+
+	// now returns the current time and can be replaced in tests.
+	now func() time.Time
+
+	// resync is the state of the synchronization following a resume
+	// from suspension, or nil.
+	resync          *resumeSync
+	lastResumeCheck time.Time
+
+	// connect, fetchInbox and retrySending are used to synchronize
+	// after a resume and can be replaced in tests.
+	connect      func(context.Context) (*client.Session, error)
+	fetchInbox   func() error
+	retrySending func(*Contact)
+
 	client    *client.Client
 	session   *client.Session
 	providers []*pki.MixDescriptor
@@ -114,6 +132,7 @@ type queuedSpoolCommand struct {
 	Receiver string
 	Command  []byte
 	ID       MessageID
+	Control  bool
 }
 
 // NewClientAndRemoteSpool creates and connects a new Client and creates a new
@@ -176,9 +195,13 @@ func New(logBackend *log.Backend, mixnetClient *client.Client, stateWorker *Stat
 		connMutex:           new(sync.RWMutex),
 		stateWorker:         stateWorker,
 		client:              mixnetClient,
+		now:                 time.Now,
 		log:                 logBackend.GetLogger("catshadow"),
 		logBackend:          logBackend,
 	}
+	c.connect = c.connectSession
+	c.fetchInbox = c.sendReadInbox
+	c.retrySending = c.sendMessage
 	for _, contact := range state.Contacts {
 		c.contacts[contact.id] = contact
 		c.contactNicknames[contact.Nickname] = contact
@@ -235,7 +258,7 @@ func (c *Client) initKeyExchange(contact *Contact) error {
 	if c.spoolReadDescriptor == nil {
 		return errors.New("Unable to create key exchange without a spool")
 	}
-	exchange, err := NewContactExchangeBytes(c.spoolReadDescriptor.GetWriteDescriptor(), signedKeyExchange)
+	exchange, err := newSignedContactExchangeBytes(c.spoolReadDescriptor.GetWriteDescriptor(), signedKeyExchange, c.spoolReadDescriptor.PrivateKey)
 	if err != nil {
 		return err
 	}
@@ -314,37 +337,47 @@ func (c *Client) eventSinkWorker() {
 	}
 }
 
-func (c *Client) garbageCollectConversations() {
+// garbageCollectConversations removes expired messages and returns the
+// duration until the next garbage collection and whether any message
+// was removed.
+func (c *Client) garbageCollectConversations() (time.Duration, bool) {
 	c.conversationsMutex.Lock()
 	defer c.conversationsMutex.Unlock()
+	now := c.now()
+	next := GarbageCollectionInterval
+	removed := false
 	for nickname, messages := range c.conversations {
 		contact := c.contactNicknames[nickname]
+		expiration := contact.expiration()
 		// skip contacts with message expiration disabled
-		if contact.messageExpiration == 0 {
+		if expiration == 0 {
 			continue
 		}
 		// Now > message + expiration
 		// Now - expiration > message + expiration - expiration
 		// Now - expiration > message
-		// == expiresAt.After(message.Timestamp):
-		expiresAt := time.Now().Add(-contact.messageExpiration)
+		// == expiresAt.After(message.expiryStart()):
+		expiresAt := now.Add(-expiration)
 		var lastLive *Message
 		// maintain a stable contact.LastMessage unless it's expired;
 		// that way we only update contact.LastMessage/lastLive in case
 		// it was wrong or expired:
 		if contact.LastMessage != nil {
-			if expiresAt.After(contact.LastMessage.Timestamp) {
+			if expiresAt.After(contact.LastMessage.expiryStart()) {
 				contact.LastMessage = nil
 			} else {
 				lastLive = contact.LastMessage
 			}
 		}
+		var expired []MessageID
 		for mesgID, message := range messages {
-			if expiresAt.After(message.Timestamp) {
+			if expiresAt.After(message.expiryStart()) {
 				if contact.LastMessage == message {
 					contact.LastMessage = lastLive
 				}
+				wipeMessage(message)
 				delete(messages, mesgID)
+				expired = append(expired, mesgID)
 			} else {
 				// since we aren't iterating in sorted order, we
 				// need to compare before assignment:
@@ -352,9 +385,30 @@ func (c *Client) garbageCollectConversations() {
 					lastLive = message
 					contact.LastMessage = lastLive
 				}
+				if d := message.expiryStart().Sub(expiresAt); d < next {
+					next = d
+				}
+			}
+		}
+		if len(expired) != 0 {
+			removed = true
+			c.eventCh.In() <- &MessagesExpiredEvent{
+				Nickname:   nickname,
+				MessageIDs: expired,
 			}
 		}
 	}
+	return next, removed
+}
+
+// wipeMessage clears the plaintext and metadata of a message.
+func wipeMessage(m *Message) {
+	utils.ExplicitBzero(m.Plaintext)
+	m.Timestamp = time.Time{}
+	m.DeliveredAt = time.Time{}
+	m.Outbound = false
+	m.Sent = false
+	m.Delivered = false
 }
 
 // GetPKIDocument() returns the current pki.Document or error
@@ -798,16 +852,67 @@ func (c *Client) ChangeExpiration(name string, expiration time.Duration) error {
 
 func (c *Client) doChangeExpiration(name string, expiration time.Duration) error {
 	c.conversationsMutex.Lock()
-	if contact, ok := c.contactNicknames[name]; !ok {
+	contact, ok := c.contactNicknames[name]
+	if !ok {
 		c.conversationsMutex.Unlock()
 		return ErrContactNotFound
-	} else {
-		contact.messageExpiration = expiration
 	}
+	contact.messageExpiration = expiration
 	c.conversationsMutex.Unlock()
-	c.garbageCollectConversations()
+	err := c.sendConversationSettings(contact, false)
 	c.save()
-	return nil
+	return err
+}
+
+// sendConversationSettings announces our conversation settings to the
+// contact, or answers the contact's announcement if reply is set. Nothing
+// is sent to contacts which did not advertise that they understand
+// ConversationSettings control frames.
+func (c *Client) sendConversationSettings(contact *Contact, reply bool) error {
+	if contact.IsPending || !contact.peerSettings {
+		return nil
+	}
+	convoMesgID := MessageID{}
+	_, err := rand.Reader.Read(convoMesgID[:])
+	if err != nil {
+		return err
+	}
+	control := &Message{
+		Timestamp: c.now(),
+		Outbound:  true,
+		Settings: &ConversationSettings{
+			MessageExpiration: contact.messageExpiration,
+			Reply:             reply,
+		},
+	}
+	return c.enqueueMessage(contact, convoMesgID, control, true)
+}
+
+// applyConversationSettings applies the conversation settings announced by
+// a contact, and answers with our own settings so that both sides agree on
+// the effective settings.
+func (c *Client) applyConversationSettings(nickname string, settings *ConversationSettings) {
+	c.conversationsMutex.Lock()
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		c.conversationsMutex.Unlock()
+		return
+	}
+	contact.peerExpiration = settings.MessageExpiration
+	contact.peerSettings = true
+	expiration := contact.expiration()
+	c.conversationsMutex.Unlock()
+	c.log.Debugf("Contact %s changed message expiration to %s", nickname, settings.MessageExpiration)
+	if !settings.Reply {
+		if err := c.sendConversationSettings(contact, true); err != nil {
+			c.log.Errorf("failed to send conversation settings to %s: %s", nickname, err)
+		}
+	}
+	c.save()
+	c.eventCh.In() <- &ExpirationChangedEvent{
+		Nickname:   nickname,
+		Expiration: expiration,
+	}
 }
 
 func (c *Client) save() {
@@ -907,14 +1012,15 @@ func (c *Client) doSendMessage(convoMesgID MessageID, nickname string, message [
 		}
 		return
 	}
+	if c.keyChangeBlocked(contact) {
+		c.log.Warningf("Holding message to contact %s until its changed key is accepted or verified", nickname)
+	}
 	outMessage := Message{
 		Plaintext: message,
-		Timestamp: time.Now(),
+		Timestamp: c.now(),
 		Outbound:  true,
 	}
-
-	serialized, err := cbor.Marshal(outMessage)
-	if err != nil {
+	if err := c.enqueueMessage(contact, convoMesgID, &outMessage, false); err != nil {
 		c.eventCh.In() <- &MessageNotSentEvent{
 			Nickname:  nickname,
 			MessageID: convoMesgID,
@@ -922,36 +1028,44 @@ func (c *Client) doSendMessage(convoMesgID MessageID, nickname string, message [
 		}
 		return
 	}
+
+	// update the conversation history
+	c.conversationsMutex.Lock()
+	_, ok = c.conversations[nickname]
+	if !ok {
+		c.conversations[nickname] = make(map[MessageID]*Message)
+	}
+	c.conversations[nickname][convoMesgID] = &outMessage
+	c.contactNicknames[nickname].LastMessage = &outMessage
+	c.conversationsMutex.Unlock()
+	c.save()
+}
+
+// enqueueMessage encrypts the message for the contact and enqueues it for sending.
+func (c *Client) enqueueMessage(contact *Contact, convoMesgID MessageID, outMessage *Message, control bool) error {
+	serialized, err := cbor.Marshal(outMessage)
+	if err != nil {
+		return err
+	}
 	contact.ratchetMutex.Lock()
 	ciphertext, err := contact.ratchet.Encrypt(nil, serialized)
+	contact.ratchetMutex.Unlock()
 	if err != nil {
 		c.log.Errorf("failed to encrypt: %s", err)
-		contact.ratchetMutex.Unlock()
-		c.eventCh.In() <- &MessageNotSentEvent{
-			Nickname:  nickname,
-			MessageID: convoMesgID,
-			Err:       err,
-		}
-		return
+		return err
 	}
-	contact.ratchetMutex.Unlock()
 
 	cfg := c.client.GetConfig()
 	appendCmd, err := common.AppendToSpool(contact.spoolWriteDescriptor.ID, ciphertext, cfg.SphinxGeometry)
 	if err != nil {
 		c.log.Errorf("failed to compute spool append command: %s", err)
-		c.eventCh.In() <- &MessageNotSentEvent{
-			Nickname:  nickname,
-			MessageID: convoMesgID,
-			Err:       err,
-		}
-		return
+		return err
 	}
 
 	// enqueue the message for sending
 	item := &queuedSpoolCommand{Receiver: contact.spoolWriteDescriptor.Receiver,
 		Provider: contact.spoolWriteDescriptor.Provider,
-		Command:  appendCmd, ID: convoMesgID}
+		Command:  appendCmd, ID: convoMesgID, Control: control}
 	if _, err := contact.outbound.Peek(); err == ErrQueueEmpty {
 		// no messages already queued, so call sendMessage immediately
 		c.connMutex.RLock()
@@ -962,33 +1076,27 @@ func (c *Client) doSendMessage(convoMesgID MessageID, nickname string, message [
 	}
 	if err := contact.outbound.Push(item); err != nil {
 		c.log.Debugf("Failed to enqueue message!")
-		c.eventCh.In() <- &MessageNotSentEvent{
-			Nickname:  nickname,
-			MessageID: convoMesgID,
-			Err:       err,
-		}
-		return
-	}
-
-	// update the conversation history
-	c.conversationsMutex.Lock()
-	_, ok = c.conversations[nickname]
-	if !ok {
-		c.conversations[nickname] = make(map[MessageID]*Message)
+		return err
 	}
-	c.conversations[nickname][convoMesgID] = &outMessage
-	c.contactNicknames[nickname].LastMessage = &outMessage
-	c.conversationsMutex.Unlock()
-	c.save()
+	return nil
 }
 
 func (c *Client) sendMessage(contact *Contact) {
+	if c.keyChangeBlocked(contact) {
+		c.log.Debugf("Not sending to contact %s, key changed since it was verified", contact.Nickname)
+		return
+	}
 	// Transmit the oldest message on tip of queue; it will be Pop'd upon ACK
 	cmd, err := contact.outbound.Peek()
 	if err == ErrQueueEmpty {
 		c.log.Debugf("No messages to send for contact: %s", contact.Nickname)
 		return
 	}
+	if c.session == nil {
+		// retransmitted once reconnected
+		c.log.Debugf("Not sending to contact %s while offline", contact.Nickname)
+		return
+	}
 
 	// XXX: unfortunately this command does not tell us when to expect the message delivery to have occurred even though minclient knows it...
 	mesgID, err := c.session.SendReliableMessage(cmd.Receiver, cmd.Provider, cmd.Command)
@@ -1000,35 +1108,38 @@ func (c *Client) sendMessage(contact *Contact) {
 	c.sendMap.Store(*mesgID, &SentMessageDescriptor{
 		Nickname:  contact.Nickname,
 		MessageID: cmd.ID,
+		Control:   cmd.Control,
 	})
 }
 
-func (c *Client) sendReadInbox() {
+func (c *Client) sendReadInbox() error {
 	// apparently never checks to see if the spool has been made first...
 	if c.spoolReadDescriptor == nil {
 		c.log.Errorf("Should not sendReadInbox before the remote spool was made...")
-		return
+		return ErrNoSpool
 	}
 	sequence := c.spoolReadDescriptor.ReadOffset
 	cmd, err := common.ReadFromSpool(c.spoolReadDescriptor.ID, sequence, c.spoolReadDescriptor.PrivateKey)
 	if err != nil {
-		c.fatalErrCh <- errors.New("failed to compose spool read command")
-		return
+		err = errors.New("failed to compose spool read command")
+		c.fatalErrCh <- err
+		return err
 	}
 	mesgID, err := c.session.SendUnreliableMessage(c.spoolReadDescriptor.Receiver, c.spoolReadDescriptor.Provider, cmd)
 	switch err.(type) {
 	case *minclient.PKIError:
 		c.session.ForceFetchPKI()
-		return
+		return err
 	case nil:
 	default:
 		c.log.Errorf("sendReadInbox failure: %v", err)
-		return
+		return err
 	}
 	c.log.Debug("Message enqueued for reading remote spool %x:%d, message-ID: %x", c.spoolReadDescriptor.ID, sequence, mesgID)
 	var a MessageID
 	binary.BigEndian.PutUint32(a[:4], sequence)
 	c.sendMap.Store(*mesgID, &ReadMessageDescriptor{MessageID: a})
+	return nil
 }
 
 func (c *Client) garbageCollectSendMap(gcEvent *client.MessageIDGarbageCollected) {
@@ -1065,6 +1176,9 @@ func (c *Client) handleSent(sentEvent *client.MessageSentEvent) {
 				// keep track of the MessageID that has not been ACK'd yet
 				contact.ackID = *sentEvent.MessageID
 			}
+			if tp.Control {
+				return
+			}
 
 			c.log.Debugf("MessageSentEvent for %x", *sentEvent.MessageID)
 			c.setMessageSent(tp.Nickname, tp.MessageID)
@@ -1119,6 +1233,10 @@ func (c *Client) handleReply(replyEvent *client.MessageReplyEvent) {
 					// try to send the next message, if one exists
 					defer c.sendMessage(contact)
 				}
+				if tp.Control {
+					c.save()
+					return
+				}
 				c.log.Debugf("Sending MessageDeliveredEvent for %s", tp.Nickname)
 				c.setMessageDelivered(tp.Nickname, tp.MessageID)
 				c.save()
@@ -1131,13 +1249,16 @@ func (c *Client) handleReply(replyEvent *client.MessageReplyEvent) {
 			_, err := cbor.UnmarshalFirst(replyEvent.Payload, &spoolResponse)
 			if err != nil {
 				c.log.Errorf("Could not deserialize SpoolResponse to ReadInbox ID %d: %s", tp.MessageID, err)
+				if c.resync != nil {
+					c.failSync(err)
+				}
 				return
 			}
 			if !spoolResponse.IsOK() {
 				// no new messages were returned
 				c.log.Debugf("Spool response ID %d status error: %s for SpoolID %x",
 					spoolResponse.MessageID, spoolResponse.Status, spoolResponse.SpoolID)
-
+				c.onInboxRead(false)
 				return
 			}
 			// is a valid response to the tip of our spool, so increment the pointer
@@ -1159,6 +1280,7 @@ func (c *Client) handleReply(replyEvent *client.MessageReplyEvent) {
 					for _, contact := range c.contacts {
 						if contact.IsPending {
 							c.log.Warning("received message we could not decrypt while key exchange pending, delaying spool read descriptor increment")
+							c.onInboxRead(false)
 							return
 						}
 					}
@@ -1173,6 +1295,7 @@ func (c *Client) handleReply(replyEvent *client.MessageReplyEvent) {
 				// in all other cases, advance the spool read descriptor
 				c.spoolReadDescriptor.IncrementOffset()
 				c.save()
+				c.onInboxRead(true)
 			default:
 				panic("received spool response for MessageID not requested yet")
 			}
@@ -1212,11 +1335,7 @@ func (c *Client) doWipeConversation(nickname string) error {
 	}
 
 	for k, m := range c.conversations[nickname] {
-		utils.ExplicitBzero(m.Plaintext)
-		m.Timestamp = time.Time{}
-		m.Outbound = false
-		m.Sent = false
-		m.Delivered = false
+		wipeMessage(m)
 		delete(c.conversations[nickname], k)
 	}
 	delete(c.conversations, nickname)
@@ -1289,10 +1408,11 @@ func (c *Client) decryptMessage(messageID *[cConstants.MessageIDLength]byte, cip
 				}
 
 				message.Plaintext = plaintext[4 : 4+payloadLen]
-				message.Timestamp = time.Now()
+				message.Timestamp = c.now()
 
 			}
 			message.Outbound = false
+			message.DeliveredAt = c.now()
 			break
 		default:
 			// every other type of error indicates an invalid message
@@ -1300,6 +1420,10 @@ func (c *Client) decryptMessage(messageID *[cConstants.MessageIDLength]byte, cip
 			return err
 		}
 	}
+	if decrypted && message.Settings != nil {
+		c.applyConversationSettings(nickname, message.Settings)
+		return nil
+	}
 	if decrypted {
 		convoMesgID := MessageID{}
 		_, err = rand.Reader.Read(convoMesgID[:])
@@ -1318,6 +1442,9 @@ func (c *Client) decryptMessage(messageID *[cConstants.MessageIDLength]byte, cip
 		c.conversationsMutex.Unlock()
 		c.save()
 
+		if c.resync != nil {
+			c.resync.received++
+		}
 		c.eventCh.In() <- &MessageReceivedEvent{
 			Nickname:  nickname,
 			Message:   message.Plaintext,
@@ -1350,6 +1477,7 @@ func (c *Client) setMessageDelivered(nickname string, msgId MessageID) bool {
 	if ch, ok := c.conversations[nickname]; ok {
 		if m, ok := ch[msgId]; ok {
 			m.Delivered = true
+			m.DeliveredAt = c.now()
 			return true
 		}
 	}
@@ -83,8 +83,7 @@ func reloadCatshadowState(t *testing.T, stateFile string) *Client {
 	var catShadowClient *Client
 
 	passphrase := []byte("")
-	key := stretchKey(passphrase)
-	state, err := decryptStateFile(stateFile, key)
+	state, err := decryptStateFile(stateFile, passphrase)
 	require.NoError(err)
 
 	logBackend, err := log.New(cfg.Logging.File, cfg.Logging.Level, cfg.Logging.Disable)
@@ -24,11 +24,20 @@ import (
 	"path/filepath"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/fxamacker/cbor/v2"
+	"gopkg.in/eapache/channels.v1"
+
+	ecdh "github.com/katzenpost/hpqc/nike/x25519"
+	"github.com/katzenpost/hpqc/rand"
+	"github.com/katzenpost/hpqc/sign/ed25519"
 	"github.com/katzenpost/katzenpost/client"
 	"github.com/katzenpost/katzenpost/client/config"
-	"github.com/katzenpost/hpqc/rand"
 	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/core/sphinx/geo"
+	memspoolclient "github.com/katzenpost/katzenpost/memspool/client"
+	"github.com/katzenpost/katzenpost/memspool/common"
 	"github.com/stretchr/testify/require"
 )
 
@@ -82,3 +91,210 @@ func TestBlobStorage(t *testing.T) {
 	require.Error(err, ErrBlobNotFound)
 	stateWorker.Halt()
 }
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	return f.now
+}
+
+func newTestClient(t *testing.T, clock *fakeClock) *Client {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	stateWorker, err := NewStateWriter(logBackend.GetLogger("catshadow_state"), createRandomStateFile(t), []byte(""))
+	require.NoError(err)
+	stateWorker.Start()
+	t.Cleanup(stateWorker.Halt)
+	kClient, err := client.New(&config.Config{
+		Logging:        &config.Logging{Disable: true, Level: "ERROR"},
+		SphinxGeometry: geo.GeometryFromUserForwardPayloadLength(ecdh.Scheme(rand.Reader), 2000, true, 5),
+	})
+	require.NoError(err)
+	t.Cleanup(kClient.Shutdown)
+	_, identityKey, err := ed25519.Scheme().GenerateKey()
+	require.NoError(err)
+
+	return &Client{
+		client:             kClient,
+		eventCh:            channels.NewInfiniteChannel(),
+		blob:               make(map[string][]byte),
+		contacts:           make(map[uint64]*Contact),
+		contactNicknames:   make(map[string]*Contact),
+		conversations:      make(map[string]map[MessageID]*Message),
+		conversationsMutex: new(sync.Mutex),
+		blobMutex:          new(sync.Mutex),
+		connMutex:          new(sync.RWMutex),
+		opCh:               make(chan interface{}, 8),
+		sendMap:            new(sync.Map),
+		stateWorker:        stateWorker,
+		now:                clock.Now,
+		logBackend:         logBackend,
+		log:                logBackend.GetLogger("catshadow"),
+
+		spoolReadDescriptor: &memspoolclient.SpoolReadDescriptor{PrivateKey: identityKey},
+	}
+}
+
+func addTestContact(t *testing.T, c *Client, nickname string) *Contact {
+	contact, err := NewContact(nickname, uint64(len(c.contacts)), []byte("secret"))
+	require.NoError(t, err)
+	c.contacts[contact.id] = contact
+	c.contactNicknames[nickname] = contact
+	return contact
+}
+
+func pairTestContacts(t *testing.T, a, b *Contact) {
+	require := require.New(t)
+
+	akx, err := a.ratchet.CreateKeyExchange()
+	require.NoError(err)
+	bkx, err := b.ratchet.CreateKeyExchange()
+	require.NoError(err)
+	require.NoError(a.ratchet.ProcessKeyExchange(bkx))
+	require.NoError(b.ratchet.ProcessKeyExchange(akx))
+	a.IsPending = false
+	b.IsPending = false
+	a.spoolWriteDescriptor = &memspoolclient.SpoolWriteDescriptor{ID: [12]byte{1}, Receiver: "spool", Provider: "provider"}
+	b.spoolWriteDescriptor = &memspoolclient.SpoolWriteDescriptor{ID: [12]byte{2}, Receiver: "spool", Provider: "provider"}
+}
+
+// deliverQueued delivers the messages queued for the contact to the client
+// the contact stands for, and returns how many were delivered.
+func deliverQueued(t *testing.T, contact *Contact, to *Client) int {
+	n := 0
+	for {
+		item, err := contact.outbound.Pop()
+		if err == ErrQueueEmpty {
+			return n
+		}
+		require.NoError(t, err)
+		req := new(common.SpoolRequest)
+		require.NoError(t, req.Unmarshal(item.Command))
+		require.NoError(t, to.decryptMessage(&[16]byte{}, req.Message))
+		n++
+	}
+}
+
+func nextEvent(t *testing.T, c *Client) interface{} {
+	select {
+	case ev := <-c.eventCh.Out():
+		return ev
+	case <-time.After(time.Second):
+		require.FailNow(t, "timeout waiting for event")
+	}
+	return nil
+}
+
+func TestDisappearingMessages(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	alice := newTestClient(t, clock)
+	bob := newTestClient(t, clock)
+	aliceBob := addTestContact(t, alice, "bob")
+	bobAlice := addTestContact(t, bob, "alice")
+	pairTestContacts(t, aliceBob, bobAlice)
+
+	// Nothing is announced to a contact which did not advertise that it
+	// understands conversation settings.
+	require.NoError(alice.doChangeExpiration("bob", time.Hour))
+	require.Equal(0, deliverQueued(t, aliceBob, bob))
+	aliceBob.peerSettings = true
+
+	// Alice enables disappearing messages and announces it to Bob
+	// whose own setting is longer. Receiving the announcement tells Bob
+	// that Alice understands conversation settings.
+	require.NoError(alice.doChangeExpiration("bob", time.Hour))
+	require.Equal(1, deliverQueued(t, aliceBob, bob))
+	ev := nextEvent(t, bob)
+	require.Equal(&ExpirationChangedEvent{Nickname: "alice", Expiration: time.Hour}, ev)
+	require.Equal(MessageExpirationDuration, bobAlice.messageExpiration)
+	require.Equal(time.Hour, bobAlice.expiration())
+	require.Len(bob.conversations["alice"], 0)
+	require.True(bobAlice.peerSettings)
+
+	// Bob answers with his own setting, which Alice does not answer.
+	require.Equal(1, deliverQueued(t, bobAlice, alice))
+	ev = nextEvent(t, alice)
+	require.Equal(&ExpirationChangedEvent{Nickname: "bob", Expiration: time.Hour}, ev)
+	require.Equal(MessageExpirationDuration, aliceBob.peerExpiration)
+	require.Equal(0, deliverQueued(t, aliceBob, bob))
+
+	// Alice sends a message which is delivered, the clock starts.
+	plaintext := []byte("hello bob")
+	sent := &Message{Plaintext: append([]byte{}, plaintext...), Timestamp: clock.Now(), Outbound: true}
+	sentID := MessageID{1}
+	alice.conversations["bob"] = map[MessageID]*Message{sentID: sent}
+	clock.now = clock.now.Add(time.Minute)
+	require.True(alice.setMessageDelivered("bob", sentID))
+
+	serialized, err := cbor.Marshal(sent)
+	require.NoError(err)
+	ciphertext, err := aliceBob.ratchet.Encrypt(nil, serialized)
+	require.NoError(err)
+	clock.now = clock.now.Add(time.Minute)
+	require.NoError(bob.decryptMessage(&[16]byte{}, ciphertext))
+	ev = nextEvent(t, bob)
+	require.IsType(&MessageReceivedEvent{}, ev)
+	require.Len(bob.conversations["alice"], 1)
+	var received *Message
+	var receivedID MessageID
+	for id, m := range bob.conversations["alice"] {
+		receivedID, received = id, m
+	}
+	require.Equal(plaintext, received.Plaintext)
+
+	// Alice's copy expires first since it was delivered earlier.
+	clock.now = clock.now.Add(time.Hour - time.Second)
+	next, removed := alice.garbageCollectConversations()
+	require.True(removed)
+	require.Len(alice.conversations["bob"], 0)
+	require.Nil(aliceBob.LastMessage)
+	require.Equal(make([]byte, len(plaintext)), sent.Plaintext)
+	require.Equal(GarbageCollectionInterval, next)
+	ev = nextEvent(t, alice)
+	require.Equal(&MessagesExpiredEvent{Nickname: "bob", MessageIDs: []MessageID{sentID}}, ev)
+
+	next, removed = bob.garbageCollectConversations()
+	require.False(removed)
+	require.Len(bob.conversations["alice"], 1)
+	require.Equal(time.Second, next)
+
+	clock.now = clock.now.Add(2 * time.Second)
+	_, removed = bob.garbageCollectConversations()
+	require.True(removed)
+	require.Len(bob.conversations["alice"], 0)
+	require.Equal(make([]byte, len(plaintext)), received.Plaintext)
+	ev = nextEvent(t, bob)
+	require.Equal(&MessagesExpiredEvent{Nickname: "alice", MessageIDs: []MessageID{receivedID}}, ev)
+}
+
+func TestContactExpirationPersistence(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	contact, err := NewContact("alice", 1, []byte("secret"))
+	require.NoError(err)
+	contact.messageExpiration = 0
+	contact.peerExpiration = 5 * time.Minute
+	require.Equal(5*time.Minute, contact.expiration())
+
+	blob, err := contact.MarshalBinary()
+	require.NoError(err)
+	loaded := new(Contact)
+	require.NoError(loaded.UnmarshalBinary(blob))
+	require.Equal(time.Duration(0), loaded.messageExpiration)
+	require.Equal(5*time.Minute, loaded.peerExpiration)
+	require.False(loaded.peerSettings)
+	require.Equal(5*time.Minute, loaded.expiration())
+
+	loaded.messageExpiration = time.Minute
+	require.Equal(time.Minute, loaded.expiration())
+	loaded.peerExpiration = 0
+	require.Equal(time.Minute, loaded.expiration())
+}
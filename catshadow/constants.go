@@ -33,4 +33,17 @@ const (
 	// GarbageCollectionInterval is the time interval between garbage collecting
 	// old messages.
 	GarbageCollectionInterval = 120 * time.Minute
+
+	// ResumeCheckInterval is the time interval between checks of the wall
+	// clock for a jump indicating that the host was suspended.
+	ResumeCheckInterval = 10 * time.Second
+
+	// ResumeGapThreshold is the amount of time by which the wall clock has
+	// to jump beyond ResumeCheckInterval to be considered a resume from
+	// suspension.
+	ResumeGapThreshold = time.Minute
+
+	// ResumeSyncTimeout is the maximum duration of the reconnection and
+	// remote spool synchronization following a resume from suspension.
+	ResumeSyncTimeout = 2 * time.Minute
 )
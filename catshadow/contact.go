@@ -24,6 +24,9 @@ import (
 
 	"github.com/fxamacker/cbor/v2"
 	"github.com/katzenpost/hpqc/rand"
+	"github.com/katzenpost/hpqc/sign"
+	"github.com/katzenpost/hpqc/sign/ed25519"
+
 	cConstants "github.com/katzenpost/katzenpost/client/constants"
 	ratchet "github.com/katzenpost/katzenpost/doubleratchet"
 	memspoolClient "github.com/katzenpost/katzenpost/memspool/client"
@@ -32,6 +35,16 @@ import (
 type contactExchange struct {
 	SpoolWriteDescriptor *memspoolClient.SpoolWriteDescriptor
 	KeyExchange          []byte
+
+	// IdentityKey is the public identity key of the sender and
+	// Signature its signature of KeyExchange, they are absent in
+	// exchanges sent by older clients.
+	IdentityKey []byte `cbor:",omitempty"`
+	Signature   []byte `cbor:",omitempty"`
+
+	// ConversationSettings is set if the sender understands
+	// ConversationSettings control frames.
+	ConversationSettings bool `cbor:",omitempty"`
 }
 
 // NewContactExchangeBytes returns serialized contact exchange information.
@@ -39,6 +52,25 @@ func NewContactExchangeBytes(spoolWriteDescriptor *memspoolClient.SpoolWriteDesc
 	exchange := contactExchange{
 		SpoolWriteDescriptor: spoolWriteDescriptor,
 		KeyExchange:          keyExchange,
+		ConversationSettings: true,
+	}
+	return cbor.Marshal(exchange)
+}
+
+// newSignedContactExchangeBytes returns serialized contact exchange
+// information which binds the key exchange to the identity key of
+// identityPrivKey.
+func newSignedContactExchangeBytes(spoolWriteDescriptor *memspoolClient.SpoolWriteDescriptor, keyExchange []byte, identityPrivKey sign.PrivateKey) ([]byte, error) {
+	identityKey, err := identityPrivKey.Public().(sign.PublicKey).MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	exchange := contactExchange{
+		SpoolWriteDescriptor: spoolWriteDescriptor,
+		KeyExchange:          keyExchange,
+		IdentityKey:          identityKey,
+		Signature:            ed25519.Scheme().Sign(identityPrivKey, keyExchange, nil),
+		ConversationSettings: true,
 	}
 	return cbor.Marshal(exchange)
 }
@@ -48,6 +80,16 @@ func parseContactExchangeBytes(contactExchangeBytes []byte) (*contactExchange, e
 	if _, err := cbor.UnmarshalFirst(contactExchangeBytes, &exchange); err != nil {
 		return nil, err
 	}
+	if exchange.IdentityKey == nil && exchange.Signature == nil {
+		return exchange, nil
+	}
+	identityKey, err := ed25519.Scheme().UnmarshalBinaryPublicKey(exchange.IdentityKey)
+	if err != nil {
+		return nil, err
+	}
+	if !ed25519.Scheme().Verify(identityKey, exchange.KeyExchange, exchange.Signature, nil) {
+		return nil, ErrInvalidExchangeSignature
+	}
 	return exchange, nil
 }
 
@@ -64,7 +106,11 @@ type serializedContact struct {
 	Outbound             *Queue
 	SharedSecret         []byte
 	SpoolWriteDescriptor *memspoolClient.SpoolWriteDescriptor
+	IdentityKey          []byte
 	MessageExpiration    time.Duration
+	PeerExpiration       time.Duration
+	PeerSettings         bool
+	Verification         Verification
 }
 
 type boundExchange struct {
@@ -119,6 +165,10 @@ type Contact struct {
 	// which we must write to in order to send this contact a message.
 	spoolWriteDescriptor *memspoolClient.SpoolWriteDescriptor
 
+	// identityKey is the public identity key which signed the last key
+	// exchange of the contact, it is nil if the contact did not sign it.
+	identityKey []byte
+
 	// sharedSecret is the passphrase used to add the contact.
 	sharedSecret []byte
 
@@ -132,6 +182,16 @@ type Contact struct {
 
 	// messageExpiration is the duration after which conversation history is cleared
 	messageExpiration time.Duration
+
+	// peerExpiration is the message expiration announced by the contact
+	peerExpiration time.Duration
+
+	// peerSettings is set if the contact understands ConversationSettings
+	// control frames, older clients would show them as empty messages
+	peerSettings bool
+
+	// verification is the identity verification of the contact by the user
+	verification Verification
 }
 
 // NewContact creates a new Contact or returns an error.
@@ -159,6 +219,15 @@ func (c *Contact) ID() uint64 {
 	return c.id
 }
 
+// expiration returns the effective message expiration, which is the
+// shorter of our own and the contact's announced expiration.
+func (c *Contact) expiration() time.Duration {
+	if c.peerExpiration != 0 && (c.messageExpiration == 0 || c.peerExpiration < c.messageExpiration) {
+		return c.peerExpiration
+	}
+	return c.messageExpiration
+}
+
 // MarshalBinary does what you expect and returns
 // a serialized Contact.
 func (c *Contact) MarshalBinary() ([]byte, error) {
@@ -181,8 +250,12 @@ func (c *Contact) MarshalBinary() ([]byte, error) {
 		Ratchet:              ratchetBlob,
 		SharedSecret:         c.sharedSecret,
 		SpoolWriteDescriptor: c.spoolWriteDescriptor,
+		IdentityKey:          c.identityKey,
 		Outbound:             c.outbound,
 		MessageExpiration:    c.messageExpiration,
+		PeerExpiration:       c.peerExpiration,
+		PeerSettings:         c.peerSettings,
+		Verification:         c.verification,
 	}
 	return cbor.Marshal(s)
 }
@@ -213,8 +286,12 @@ func (c *Contact) UnmarshalBinary(data []byte) error {
 	c.ratchet = r
 	c.sharedSecret = s.SharedSecret
 	c.spoolWriteDescriptor = s.SpoolWriteDescriptor
+	c.identityKey = s.IdentityKey
 	c.outbound = s.Outbound
 	c.messageExpiration = s.MessageExpiration
+	c.peerExpiration = s.PeerExpiration
+	c.peerSettings = s.PeerSettings
+	c.verification = s.Verification
 	if c.IsPending {
 		c.pandaShutdownChan = make(chan interface{})
 		c.reunionShutdownChan = make(chan struct{})
@@ -19,10 +19,13 @@
 package catshadow
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/awnumar/memguard"
 	"github.com/fxamacker/cbor/v2"
@@ -34,6 +37,7 @@ import (
 	"github.com/katzenpost/hpqc/sign/ed25519"
 
 	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/utils"
 	"github.com/katzenpost/katzenpost/core/worker"
 	"github.com/katzenpost/katzenpost/memspool/client"
 )
@@ -41,10 +45,24 @@ import (
 const (
 	keySize   = 32
 	nonceSize = 24
+	saltSize  = 16
+
+	// stateFileVersion is the version of the statefile format, which is
+	// the stateFileMagic, the version, the argon2id salt and the
+	// secretbox nonce and ciphertext. The legacy version 0 format is
+	// only the nonce and ciphertext, keyed by an unsalted argon2i key.
+	stateFileVersion = 1
 )
 
 var (
 	DecryptStateFailed = errors.New("failed to decrypted statefile")
+
+	// ErrInvalidPassphrase is the error returned when changing the
+	// passphrase of a statefile given the wrong current passphrase.
+	ErrInvalidPassphrase = errors.New("invalid statefile passphrase")
+
+	stateFileMagic     = []byte("CSSF")
+	stateFileHeaderLen = len(stateFileMagic) + 1 + saltSize
 )
 
 // State is the struct type representing the Client's state
@@ -75,8 +93,35 @@ type StateWriter struct {
 	stateCh   chan *memguard.LockedBuffer
 	stateFile string
 
+	// keyLock guards the key and salt, and the statefile while they
+	// change.
+	keyLock sync.Mutex
+
 	// TODO: memguard.LockedBuffer
-	key *[32]byte
+	key  *[32]byte
+	salt []byte
+
+	// BucketSize, if non-zero, pads the serialized state to a multiple
+	// of BucketSize bytes so that the statefile size only reveals the
+	// bucket the state falls in.
+	BucketSize int
+
+	// BackupCount, if non-zero, is the number of previous statefiles
+	// kept as backups, from which LoadStateWriter restores the newest
+	// one if the statefile is corrupted. LoadStateWriter takes it from
+	// WithBackupCount.
+	BackupCount int
+}
+
+// StateWriterOption is an option of LoadStateWriter and NewStateWriter.
+type StateWriterOption func(*StateWriter)
+
+// WithBackupCount sets the BackupCount of the StateWriter, which also
+// applies when LoadStateWriter rewrites the statefile.
+func WithBackupCount(n int) StateWriterOption {
+	return func(w *StateWriter) {
+		w.BackupCount = n
+	}
 }
 
 func encryptState(state []byte, key *[32]byte) ([]byte, error) {
@@ -91,6 +136,9 @@ func encryptState(state []byte, key *[32]byte) ([]byte, error) {
 }
 
 func decryptState(ciphertext []byte, key *[32]byte) ([]byte, error) {
+	if len(ciphertext) < nonceSize {
+		return nil, DecryptStateFailed
+	}
 	nonce := [nonceSize]byte{}
 	copy(nonce[:], ciphertext[:nonceSize])
 	ciphertext = ciphertext[nonceSize:]
@@ -101,6 +149,7 @@ func decryptState(ciphertext []byte, key *[32]byte) ([]byte, error) {
 	return plaintext, nil
 }
 
+// stretchKey derives the key of a legacy version 0 statefile.
 func stretchKey(passphrase []byte) *[32]byte {
 	secret := argon2.Key(passphrase, nil, 3, 32*1024, 4, keySize)
 	key := [keySize]byte{}
@@ -108,15 +157,63 @@ func stretchKey(passphrase []byte) *[32]byte {
 	return &key
 }
 
-func decryptStateFile(stateFile string, key *[32]byte) (*State, error) {
+// stateKey derives the key of a statefile from the passphrase and the
+// salt of the statefile.
+func stateKey(passphrase, salt []byte) *[32]byte {
+	secret := argon2.IDKey(passphrase, salt, 3, 32*1024, 4, keySize)
+	key := [keySize]byte{}
+	copy(key[:], secret)
+	utils.ExplicitBzero(secret)
+	return &key
+}
+
+func newSalt() ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Reader.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
+
+// readStateFile decrypts the statefile, and returns the plaintext and
+// the salt and key of the statefile. The salt is nil if the statefile
+// is in the legacy version 0 format.
+func readStateFile(stateFile string, passphrase []byte) ([]byte, []byte, *[32]byte, error) {
 	rawFile, err := os.ReadFile(stateFile)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
+	if len(rawFile) >= stateFileHeaderLen && bytes.HasPrefix(rawFile, stateFileMagic) {
+		if version := rawFile[len(stateFileMagic)]; version != stateFileVersion {
+			return nil, nil, nil, fmt.Errorf("unsupported statefile version %d", version)
+		}
+		salt := rawFile[len(stateFileMagic)+1 : stateFileHeaderLen]
+		key := stateKey(passphrase, salt)
+		plaintext, err := decryptState(rawFile[stateFileHeaderLen:], key)
+		if err == nil {
+			return plaintext, append([]byte{}, salt...), key, nil
+		}
+		// The nonce of a legacy statefile may happen to look like
+		// a header.
+	}
+	key := stretchKey(passphrase)
 	plaintext, err := decryptState(rawFile, key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return plaintext, nil, key, nil
+}
+
+func decryptStateFile(stateFile string, passphrase []byte) (*State, error) {
+	plaintext, _, _, err := readStateFile(stateFile, passphrase)
 	if err != nil {
 		return nil, err
 	}
+	return unmarshalState(plaintext)
+}
+
+func unmarshalState(plaintext []byte) (*State, error) {
+	var err error
 	state := new(State)
 	state.SpoolReadDescriptor = new(client.SpoolReadDescriptor)
 	_, state.SpoolReadDescriptor.PrivateKey, err = ed25519.Scheme().GenerateKey()
@@ -129,14 +226,105 @@ func decryptStateFile(stateFile string, key *[32]byte) (*State, error) {
 	return state, nil
 }
 
-func encryptStateFile(stateFile string, state []byte, key *[32]byte) error {
-	outFn := stateFile
-	tmpFn := fmt.Sprintf("%s.tmp", stateFile)
-	backupFn := fmt.Sprintf("%s~", stateFile)
+// backupFile returns the name of the nth backup of the statefile, the
+// newest backup being the first.
+func backupFile(stateFile string, n int) string {
+	return fmt.Sprintf("%s.%d", stateFile, n)
+}
+
+// rotateBackups shifts the backups of the statefile by one, discarding
+// the oldest, and links the statefile as the first backup, such that
+// there always is a statefile.
+func rotateBackups(stateFile string, backupCount int) error {
+	for n := backupCount + 1; ; n++ {
+		if err := os.Remove(backupFile(stateFile, n)); err != nil {
+			if os.IsNotExist(err) {
+				break
+			}
+			return err
+		}
+	}
+	for n := backupCount - 1; n > 0; n-- {
+		if err := os.Rename(backupFile(stateFile, n), backupFile(stateFile, n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Remove(backupFile(stateFile, 1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(stateFile, backupFile(stateFile, 1)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// backupFiles returns the names of the existing backups of the statefile.
+func backupFiles(stateFile string) []string {
+	var files []string
+	if _, err := os.Stat(stateFile + "~"); err == nil {
+		files = append(files, stateFile+"~")
+	}
+	for n := 1; ; n++ {
+		fn := backupFile(stateFile, n)
+		if _, err := os.Stat(fn); err != nil {
+			return files
+		}
+		files = append(files, fn)
+	}
+}
+
+// reencryptBackups re-encrypts the backups of the statefile which decrypt
+// with passphrase under the given salt and key, and removes those which
+// fail to authenticate under it, so that no backup is left under a
+// previous passphrase or in the legacy format. Backups which can not be
+// read or are truncated are left in place.
+func reencryptBackups(log *logging.Logger, stateFile string, passphrase []byte, salt []byte, key *[32]byte) error {
+	for _, fn := range backupFiles(stateFile) {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			log.Warningf("Leaving backup %s which can not be read: %s", fn, err)
+			continue
+		}
+		if fi.Size() < int64(stateFileHeaderLen+nonceSize+secretbox.Overhead) {
+			log.Warningf("Leaving truncated backup %s", fn)
+			continue
+		}
+		plaintext, _, _, err := readStateFile(fn, passphrase)
+		switch err {
+		case nil:
+		case DecryptStateFailed:
+			log.Noticef("Removing backup %s which is not encrypted with the previous passphrase", fn)
+			if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		default:
+			log.Warningf("Leaving backup %s which can not be read: %s", fn, err)
+			continue
+		}
+		tmpFn := fmt.Sprintf("%s.tmp", fn)
+		err = writeTempStateFile(tmpFn, plaintext, salt, key)
+		utils.ExplicitBzero(plaintext)
+		if err != nil {
+			return err
+		}
+		// backups may be hard links to the statefile, so they are
+		// replaced rather than written in place
+		if err := os.Rename(tmpFn, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeTempStateFile encrypts the state and writes it to tmpFn.
+func writeTempStateFile(tmpFn string, state []byte, salt []byte, key *[32]byte) error {
 	ciphertext, err := encryptState(state, key)
 	if err != nil {
 		return err
 	}
+	header := append(append(append([]byte{}, stateFileMagic...), stateFileVersion), salt...)
+	ciphertext = append(header, ciphertext...)
 	out, err := os.OpenFile(tmpFn, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
 		return err
@@ -149,9 +337,31 @@ func encryptStateFile(stateFile string, state []byte, key *[32]byte) error {
 	if err != nil {
 		return err
 	}
-	if err := os.Rename(outFn, backupFn); err != nil && !os.IsNotExist(err) {
+	return out.Close()
+}
+
+// encryptStateFile atomically replaces the statefile, keeping the
+// previous one as a backup. If backupCount is zero the previous statefile
+// is kept with a "~" suffix, otherwise the last backupCount statefiles
+// are kept with numbered suffixes.
+func encryptStateFile(stateFile string, state []byte, salt []byte, key *[32]byte, backupCount int) error {
+	tmpFn := fmt.Sprintf("%s.tmp", stateFile)
+	backupFn := fmt.Sprintf("%s~", stateFile)
+	if err := writeTempStateFile(tmpFn, state, salt, key); err != nil {
+		return err
+	}
+	if backupCount > 0 {
+		if err := rotateBackups(stateFile, backupCount); err != nil {
+			return err
+		}
+	} else if err := os.Rename(stateFile, backupFn); err != nil && !os.IsNotExist(err) {
 		return err
 	}
+	return replaceStateFile(stateFile, tmpFn)
+}
+
+// replaceStateFile atomically replaces the statefile with tmpFn.
+func replaceStateFile(stateFile, tmpFn string) error {
 	dirFn := filepath.Dir(stateFile)
 	dir, err := os.Open(dirFn)
 	if err != nil {
@@ -160,7 +370,7 @@ func encryptStateFile(stateFile string, state []byte, key *[32]byte) error {
 	if err := dir.Sync(); err != nil {
 		return err
 	}
-	if err := os.Rename(tmpFn, outFn); err != nil {
+	if err := os.Rename(tmpFn, stateFile); err != nil {
 		return err
 	}
 	if err := dir.Sync(); err != nil {
@@ -169,36 +379,190 @@ func encryptStateFile(stateFile string, state []byte, key *[32]byte) error {
 	return dir.Close()
 }
 
+// restoreStateFile replaces a corrupted statefile with the given state
+// without rotating the backups, keeping the corrupted statefile aside
+// with a ".corrupt" suffix.
+func restoreStateFile(stateFile string, state []byte, salt []byte, key *[32]byte) error {
+	tmpFn := fmt.Sprintf("%s.tmp", stateFile)
+	if err := writeTempStateFile(tmpFn, state, salt, key); err != nil {
+		return err
+	}
+	if err := os.Rename(stateFile, stateFile+".corrupt"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return replaceStateFile(stateFile, tmpFn)
+}
+
+// restoreCandidates returns the backups of the statefile to restore from,
+// newest first.
+func restoreCandidates(stateFile string, backupCount int) []string {
+	var numbered []string
+	for n := 1; ; n++ {
+		fn := backupFile(stateFile, n)
+		if _, err := os.Stat(fn); err != nil {
+			break
+		}
+		numbered = append(numbered, fn)
+	}
+	if _, err := os.Stat(stateFile + "~"); err != nil {
+		return numbered
+	}
+	// the "~" backup is the newest unless numbered backups are kept
+	if backupCount > 0 {
+		return append(numbered, stateFile+"~")
+	}
+	return append([]string{stateFile + "~"}, numbered...)
+}
+
+// VerifyStateFile checks that the statefile at path decrypts with the
+// passphrase and decodes, without loading it.
+func VerifyStateFile(path string, passphrase []byte) error {
+	plaintext, _, _, err := readStateFile(path, passphrase)
+	if err != nil {
+		return err
+	}
+	defer utils.ExplicitBzero(plaintext)
+	var state CBORState
+	_, err = cbor.UnmarshalFirst(plaintext, &state)
+	return err
+}
+
+// loadStateFile decrypts and decodes the statefile like readStateFile.
+func loadStateFile(stateFile string, passphrase []byte) (*State, []byte, []byte, *[32]byte, error) {
+	plaintext, salt, key, err := readStateFile(stateFile, passphrase)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	state, err := unmarshalState(plaintext)
+	if err != nil {
+		utils.ExplicitBzero(plaintext)
+		return nil, nil, nil, nil, err
+	}
+	return state, plaintext, salt, key, nil
+}
+
 // LoadStateWriter decrypts the given stateFile and returns the State
-// as well as a new StateWriter.
-func LoadStateWriter(log *logging.Logger, stateFile string, passphrase []byte) (*StateWriter, *State, error) {
+// as well as a new StateWriter. If the statefile fails to decrypt or
+// decode, the newest backup which does is restored instead, and the
+// corrupted statefile is kept aside. A statefile in the legacy format is
+// rewritten in the current format, together with its backups.
+func LoadStateWriter(log *logging.Logger, stateFile string, passphrase []byte, opts ...StateWriterOption) (*StateWriter, *State, error) {
 	worker := &StateWriter{
 		log:       log,
 		stateCh:   make(chan *memguard.LockedBuffer),
 		stateFile: stateFile,
 	}
-	key := stretchKey(passphrase)
-	state, err := decryptStateFile(stateFile, key)
+	for _, opt := range opts {
+		opt(worker)
+	}
+	state, plaintext, salt, key, err := loadStateFile(stateFile, passphrase)
+	restore := false
+	if err != nil {
+		for _, fn := range restoreCandidates(stateFile, worker.BackupCount) {
+			var backupErr error
+			state, plaintext, salt, key, backupErr = loadStateFile(fn, passphrase)
+			if backupErr == nil {
+				log.Warningf("Failed to load the statefile, restoring backup %s: %s", fn, err)
+				err = nil
+				restore = true
+				break
+			}
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	defer utils.ExplicitBzero(plaintext)
+	migrate := salt == nil
+	if migrate {
+		log.Notice("Migrating the statefile to the current format")
+		salt, err = newSalt()
+		if err != nil {
+			return nil, nil, err
+		}
+		key = stateKey(passphrase, salt)
+	}
+	switch {
+	case restore:
+		err = restoreStateFile(stateFile, plaintext, salt, key)
+	case migrate:
+		err = encryptStateFile(stateFile, plaintext, salt, key, worker.BackupCount)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
+	if migrate {
+		if err := reencryptBackups(log, stateFile, passphrase, salt, key); err != nil {
+			return nil, nil, err
+		}
+	}
 	worker.key = key
+	worker.salt = salt
 	return worker, state, nil
 }
 
 // NewStateWriter is a constructor for StateWriter which is to be used when creating
 // the statefile for the first time.
-func NewStateWriter(log *logging.Logger, stateFile string, passphrase []byte) (*StateWriter, error) {
-	key := stretchKey(passphrase)
+func NewStateWriter(log *logging.Logger, stateFile string, passphrase []byte, opts ...StateWriterOption) (*StateWriter, error) {
+	salt, err := newSalt()
+	if err != nil {
+		return nil, err
+	}
 	worker := &StateWriter{
 		log:       log,
 		stateCh:   make(chan *memguard.LockedBuffer),
 		stateFile: stateFile,
-		key:       key,
+		key:       stateKey(passphrase, salt),
+		salt:      salt,
+	}
+	for _, opt := range opts {
+		opt(worker)
 	}
 	return worker, nil
 }
 
+// ChangePassphrase changes the passphrase of the statefile from
+// oldPassphrase to newPassphrase, rewriting the statefile and its backups
+// with a new salt. It returns ErrInvalidPassphrase if oldPassphrase is
+// not the current passphrase.
+func (w *StateWriter) ChangePassphrase(oldPassphrase, newPassphrase []byte) error {
+	w.keyLock.Lock()
+	defer w.keyLock.Unlock()
+
+	oldKey := stateKey(oldPassphrase, w.salt)
+	if subtle.ConstantTimeCompare(oldKey[:], w.key[:]) != 1 {
+		return ErrInvalidPassphrase
+	}
+	rawFile, err := os.ReadFile(w.stateFile)
+	if err != nil {
+		return err
+	}
+	if len(rawFile) < stateFileHeaderLen {
+		return DecryptStateFailed
+	}
+	plaintext, err := decryptState(rawFile[stateFileHeaderLen:], w.key)
+	if err != nil {
+		return err
+	}
+	defer utils.ExplicitBzero(plaintext)
+
+	salt, err := newSalt()
+	if err != nil {
+		return err
+	}
+	key := stateKey(newPassphrase, salt)
+	if err := encryptStateFile(w.stateFile, plaintext, salt, key, w.BackupCount); err != nil {
+		return err
+	}
+	if err := reencryptBackups(w.log, w.stateFile, oldPassphrase, salt, key); err != nil {
+		return err
+	}
+	utils.ExplicitBzero(w.key[:])
+	w.key = key
+	w.salt = salt
+	return nil
+}
+
 // Start starts the StateWriter's worker goroutine.
 func (w *StateWriter) Start() {
 	w.log.Debug("StateWriter starting worker")
@@ -206,7 +570,25 @@ func (w *StateWriter) Start() {
 }
 
 func (w *StateWriter) writeState(payload []byte) error {
-	return encryptStateFile(w.stateFile, payload, w.key)
+	if w.BucketSize > 0 {
+		payload = padState(payload, w.BucketSize)
+		defer utils.ExplicitBzero(payload)
+	}
+	w.keyLock.Lock()
+	defer w.keyLock.Unlock()
+	return encryptStateFile(w.stateFile, payload, w.salt, w.key, w.BackupCount)
+}
+
+// padState returns a copy of state padded with zeros to a multiple of
+// bucketSize. The padding is ignored when decoding the state.
+func padState(state []byte, bucketSize int) []byte {
+	size := (len(state) + bucketSize - 1) / bucketSize * bucketSize
+	if size == 0 {
+		size = bucketSize
+	}
+	padded := make([]byte, size)
+	copy(padded, state)
+	return padded
 }
 
 func (w *StateWriter) worker() {
@@ -0,0 +1,306 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// disk_test.go - statefile tests
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"os"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/op/go-logging.v1"
+
+	"github.com/katzenpost/katzenpost/core/log"
+)
+
+func newTestStateLogger(t *testing.T) *logging.Logger {
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(t, err)
+	return logBackend.GetLogger("catshadow_state")
+}
+
+func newTestStateWriter(t *testing.T, stateFile string, passphrase []byte) *StateWriter {
+	w, err := NewStateWriter(newTestStateLogger(t), stateFile, passphrase)
+	require.NoError(t, err)
+	return w
+}
+
+func writeTestState(t *testing.T, w *StateWriter, blob []byte) {
+	serialized, err := cbor.Marshal(&State{Blob: map[string][]byte{"blob": blob}})
+	require.NoError(t, err)
+	require.NoError(t, w.writeState(serialized))
+}
+
+func TestStateFileBucketSize(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	stateFile := createRandomStateFile(t)
+	w := newTestStateWriter(t, stateFile, []byte("passphrase"))
+	w.BucketSize = 4096
+
+	sizes := []int{}
+	for _, blob := range [][]byte{{}, make([]byte, 100), make([]byte, 3000)} {
+		writeTestState(t, w, blob)
+
+		fi, err := os.Stat(stateFile)
+		require.NoError(err)
+		sizes = append(sizes, int(fi.Size()))
+
+		loaded, err := decryptStateFile(stateFile, []byte("passphrase"))
+		require.NoError(err)
+		require.Equal(blob, loaded.Blob["blob"])
+	}
+	require.Equal(sizes[0], sizes[1])
+	require.Equal(sizes[0], sizes[2])
+
+	require.Len(padState(make([]byte, 4096), 4096), 4096)
+	require.Len(padState(make([]byte, 4097), 4096), 8192)
+}
+
+func TestStateFileLegacyMigration(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// A legacy statefile is only the nonce and ciphertext.
+	stateFile := createRandomStateFile(t)
+	passphrase := []byte("passphrase")
+	serialized, err := cbor.Marshal(&State{Blob: map[string][]byte{"blob": []byte("legacy")}})
+	require.NoError(err)
+	ciphertext, err := encryptState(serialized, stretchKey(passphrase))
+	require.NoError(err)
+	require.NoError(os.WriteFile(stateFile, ciphertext, 0600))
+
+	_, _, err = LoadStateWriter(newTestStateLogger(t), stateFile, []byte("wrong"))
+	require.ErrorIs(err, DecryptStateFailed)
+
+	w, state, err := LoadStateWriter(newTestStateLogger(t), stateFile, passphrase)
+	require.NoError(err)
+	require.Equal([]byte("legacy"), state.Blob["blob"])
+	require.Len(w.salt, saltSize)
+
+	// The statefile is rewritten in the current format.
+	raw, err := os.ReadFile(stateFile)
+	require.NoError(err)
+	require.Equal(append(append([]byte{}, stateFileMagic...), stateFileVersion), raw[:len(stateFileMagic)+1])
+	require.Equal(w.salt, raw[len(stateFileMagic)+1:stateFileHeaderLen])
+	_, err = decryptState(raw, stretchKey(passphrase))
+	require.Error(err)
+
+	// So is the backup of the legacy statefile.
+	raw, err = os.ReadFile(stateFile + "~")
+	require.NoError(err)
+	_, err = decryptState(raw, stretchKey(passphrase))
+	require.Error(err)
+	state, err = decryptStateFile(stateFile+"~", passphrase)
+	require.NoError(err)
+	require.Equal([]byte("legacy"), state.Blob["blob"])
+
+	writeTestState(t, w, []byte("current"))
+	_, state, err = LoadStateWriter(w.log, stateFile, passphrase)
+	require.NoError(err)
+	require.Equal([]byte("current"), state.Blob["blob"])
+
+	// The rewrite keeps the configured number of numbered backups, all of
+	// which are migrated.
+	stateFile = createRandomStateFile(t)
+	require.NoError(os.WriteFile(stateFile, ciphertext, 0600))
+	require.NoError(os.WriteFile(backupFile(stateFile, 1), ciphertext, 0600))
+	w, _, err = LoadStateWriter(newTestStateLogger(t), stateFile, passphrase, WithBackupCount(2))
+	require.NoError(err)
+	require.Equal(2, w.BackupCount)
+	_, err = os.Stat(stateFile + "~")
+	require.True(os.IsNotExist(err))
+	for n := 1; n <= 2; n++ {
+		raw, err = os.ReadFile(backupFile(stateFile, n))
+		require.NoError(err)
+		_, err = decryptState(raw, stretchKey(passphrase))
+		require.Error(err)
+		require.Equal(w.salt, raw[len(stateFileMagic)+1:stateFileHeaderLen])
+		require.NoError(VerifyStateFile(backupFile(stateFile, n), passphrase))
+	}
+}
+
+func TestStateFileSalt(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// The same passphrase yields different keys for different statefiles.
+	passphrase := []byte("passphrase")
+	a := newTestStateWriter(t, createRandomStateFile(t), passphrase)
+	b := newTestStateWriter(t, createRandomStateFile(t), passphrase)
+	require.NotEqual(a.salt, b.salt)
+	require.NotEqual(a.key, b.key)
+
+	writeTestState(t, a, []byte("a"))
+	_, err := decryptStateFile(a.stateFile, []byte("wrong"))
+	require.ErrorIs(err, DecryptStateFailed)
+
+	// An unknown version is rejected.
+	raw, err := os.ReadFile(a.stateFile)
+	require.NoError(err)
+	raw[len(stateFileMagic)] = stateFileVersion + 1
+	require.NoError(os.WriteFile(a.stateFile, raw, 0600))
+	_, err = decryptStateFile(a.stateFile, passphrase)
+	require.ErrorContains(err, "unsupported statefile version")
+}
+
+func TestStateFileChangePassphrase(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	stateFile := createRandomStateFile(t)
+	w := newTestStateWriter(t, stateFile, []byte("old"))
+	w.BackupCount = 3
+	writeTestState(t, w, []byte("first"))
+	writeTestState(t, w, []byte("blob"))
+	other := newTestStateWriter(t, createRandomStateFile(t), []byte("other"))
+	writeTestState(t, other, []byte("other"))
+	otherRaw, err := os.ReadFile(other.stateFile)
+	require.NoError(err)
+	require.NoError(os.WriteFile(backupFile(stateFile, 2), otherRaw, 0600))
+	require.NoError(os.WriteFile(stateFile+"~", []byte("garbage"), 0600))
+	oldSalt := w.salt
+
+	require.ErrorIs(w.ChangePassphrase([]byte("wrong"), []byte("new")), ErrInvalidPassphrase)
+	require.NoError(w.ChangePassphrase([]byte("old"), []byte("new")))
+	require.NotEqual(oldSalt, w.salt)
+
+	_, err = decryptStateFile(stateFile, []byte("old"))
+	require.ErrorIs(err, DecryptStateFailed)
+	state, err := decryptStateFile(stateFile, []byte("new"))
+	require.NoError(err)
+	require.Equal([]byte("blob"), state.Blob["blob"])
+
+	// The backups are re-encrypted, and those which fail to authenticate
+	// under the old passphrase are removed.
+	for n := 1; n <= 2; n++ {
+		require.ErrorIs(VerifyStateFile(backupFile(stateFile, n), []byte("old")), DecryptStateFailed)
+		require.NoError(VerifyStateFile(backupFile(stateFile, n), []byte("new")))
+	}
+	state, err = decryptStateFile(backupFile(stateFile, 2), []byte("new"))
+	require.NoError(err)
+	require.Equal([]byte("first"), state.Blob["blob"])
+	_, err = os.Stat(backupFile(stateFile, 3))
+	require.True(os.IsNotExist(err))
+
+	// A truncated backup is left in place.
+	truncated, err := os.ReadFile(stateFile + "~")
+	require.NoError(err)
+	require.Equal([]byte("garbage"), truncated)
+
+	// Subsequent writes use the new passphrase.
+	writeTestState(t, w, []byte("updated"))
+	_, state, err = LoadStateWriter(w.log, stateFile, []byte("new"))
+	require.NoError(err)
+	require.Equal([]byte("updated"), state.Blob["blob"])
+}
+
+func TestStateFileBackups(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	stateFile := createRandomStateFile(t)
+	passphrase := []byte("passphrase")
+	w := newTestStateWriter(t, stateFile, passphrase)
+	w.BackupCount = 3
+
+	// Rotation never keeps more than BackupCount backups.
+	for i := 0; i < 5; i++ {
+		writeTestState(t, w, []byte{byte(i)})
+	}
+	for n := 1; n <= 3; n++ {
+		require.NoError(VerifyStateFile(backupFile(stateFile, n), passphrase))
+		state, err := decryptStateFile(backupFile(stateFile, n), passphrase)
+		require.NoError(err)
+		require.Equal([]byte{byte(4 - n)}, state.Blob["blob"])
+	}
+	_, err := os.Stat(backupFile(stateFile, 4))
+	require.True(os.IsNotExist(err))
+	_, err = os.Stat(stateFile + "~")
+	require.True(os.IsNotExist(err))
+
+	w.BackupCount = 2
+	writeTestState(t, w, []byte{5})
+	_, err = os.Stat(backupFile(stateFile, 3))
+	require.True(os.IsNotExist(err))
+
+	require.NoError(VerifyStateFile(stateFile, passphrase))
+	require.ErrorIs(VerifyStateFile(stateFile, []byte("wrong")), DecryptStateFailed)
+
+	// A corrupted statefile is restored from the newest valid backup.
+	raw, err := os.ReadFile(stateFile)
+	require.NoError(err)
+	raw[len(raw)-1] ^= 0xff
+	require.NoError(os.WriteFile(stateFile, raw, 0600))
+	require.NoError(os.WriteFile(backupFile(stateFile, 1), []byte("garbage"), 0600))
+	require.Error(VerifyStateFile(stateFile, passphrase))
+
+	_, _, err = LoadStateWriter(newTestStateLogger(t), stateFile, []byte("wrong"))
+	require.ErrorIs(err, DecryptStateFailed)
+
+	w, state, err := LoadStateWriter(newTestStateLogger(t), stateFile, passphrase)
+	require.NoError(err)
+	require.Equal([]byte{3}, state.Blob["blob"])
+	require.NoError(VerifyStateFile(stateFile, passphrase))
+
+	// The corrupted statefile is kept aside, and the backups are not
+	// rotated.
+	corrupted, err := os.ReadFile(stateFile + ".corrupt")
+	require.NoError(err)
+	require.Equal(raw, corrupted)
+	garbage, err := os.ReadFile(backupFile(stateFile, 1))
+	require.NoError(err)
+	require.Equal([]byte("garbage"), garbage)
+	state, err = decryptStateFile(backupFile(stateFile, 2), passphrase)
+	require.NoError(err)
+	require.Equal([]byte{3}, state.Blob["blob"])
+	_, err = os.Stat(stateFile + "~")
+	require.True(os.IsNotExist(err))
+
+	// Without valid backups loading fails.
+	require.NoError(os.WriteFile(stateFile, []byte("garbage"), 0600))
+	require.NoError(os.Remove(backupFile(stateFile, 2)))
+	_, _, err = LoadStateWriter(w.log, stateFile, passphrase)
+	require.ErrorIs(err, DecryptStateFailed)
+}
+
+func TestStateFileRestoreTilde(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Without numbered backups the "~" backup is restored.
+	stateFile := createRandomStateFile(t)
+	passphrase := []byte("passphrase")
+	w := newTestStateWriter(t, stateFile, passphrase)
+	writeTestState(t, w, []byte{1})
+	writeTestState(t, w, []byte{2})
+	raw, err := os.ReadFile(stateFile)
+	require.NoError(err)
+	raw[len(raw)-1] ^= 0xff
+	require.NoError(os.WriteFile(stateFile, raw, 0600))
+
+	_, state, err := LoadStateWriter(newTestStateLogger(t), stateFile, passphrase)
+	require.NoError(err)
+	require.Equal([]byte{1}, state.Blob["blob"])
+	require.NoError(VerifyStateFile(stateFile, passphrase))
+	require.NoError(VerifyStateFile(stateFile+"~", passphrase))
+	corrupted, err := os.ReadFile(stateFile + ".corrupt")
+	require.NoError(err)
+	require.Equal(raw, corrupted)
+}
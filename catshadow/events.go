@@ -87,3 +87,53 @@ type MessageReceivedEvent struct {
 	// Timestamp is the time the message was received.
 	Timestamp time.Time
 }
+
+// MessagesExpiredEvent is the event signaling that messages of a
+// conversation have expired and were removed.
+type MessagesExpiredEvent struct {
+	// Nickname is the nickname of the contact whose conversation expired.
+	Nickname string
+	// MessageIDs are the keys of the removed messages.
+	MessageIDs []MessageID
+}
+
+// ExpirationChangedEvent is the event signaling that a contact changed
+// the message expiration of the conversation.
+type ExpirationChangedEvent struct {
+	// Nickname is the nickname of the contact.
+	Nickname string
+	// Expiration is the effective message expiration of the conversation.
+	Expiration time.Duration
+}
+
+// SyncCompletedEvent is the event signaling that the client has caught
+// up with its remote spool after resuming from suspension.
+type SyncCompletedEvent struct {
+	// Gap is the duration for which the client was suspended.
+	Gap time.Duration
+	// Received is the number of messages received while synchronizing.
+	Received int
+	// Retried is the number of contacts whose pending outbound
+	// message was retransmitted.
+	Retried int
+}
+
+// SyncDegradedEvent is the event signaling that the synchronization
+// after resuming from suspension failed. The client keeps running and
+// will catch up at its regular pace once connected.
+type SyncDegradedEvent struct {
+	// Gap is the duration for which the client was suspended.
+	Gap time.Duration
+	// Err is the reason the synchronization failed.
+	Err error
+}
+
+// VerificationChangedEvent is the event signaling that the identity
+// verification of a contact changed, either by the user or because the
+// key of a verified contact changed.
+type VerificationChangedEvent struct {
+	// Nickname is the nickname of the contact.
+	Nickname string
+	// Verification is the new identity verification of the contact.
+	Verification Verification
+}
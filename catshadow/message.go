@@ -29,6 +29,10 @@ type SentMessageDescriptor struct {
 
 	// MessageID is the key in the conversation map referencing a specific message.
 	MessageID MessageID
+
+	// Control is true if the message is a control frame which is not
+	// part of the conversation history.
+	Control bool
 }
 
 // ReadMessageDescriptor is used to track Spool Read Responses
@@ -44,6 +48,34 @@ type Message struct {
 	Outbound  bool
 	Sent      bool
 	Delivered bool
+
+	// DeliveredAt is the time the message was delivered to the remote
+	// spool, or received from it, and starts the expiration clock.
+	DeliveredAt time.Time
+
+	// Settings is set if the message is a control frame carrying the
+	// sender's conversation settings instead of a Plaintext.
+	Settings *ConversationSettings
+}
+
+// ConversationSettings are the per conversation settings a client
+// announces to its contact.
+type ConversationSettings struct {
+	// MessageExpiration is the duration after which messages disappear,
+	// or 0 if disabled.
+	MessageExpiration time.Duration
+
+	// Reply is set if the settings answer the contact's announcement,
+	// replies are not answered again.
+	Reply bool `cbor:",omitempty"`
+}
+
+// expiryStart returns the time from which the message expiration is counted.
+func (m *Message) expiryStart() time.Time {
+	if !m.DeliveredAt.IsZero() {
+		return m.DeliveredAt
+	}
+	return m.Timestamp
 }
 
 type Messages []*Message
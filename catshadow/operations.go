@@ -22,7 +22,8 @@ import (
 	"context"
 	"time"
 
-	"github.com/katzenpost/katzenpost/memspool/client"
+	"github.com/katzenpost/katzenpost/client"
+	memspoolclient "github.com/katzenpost/katzenpost/memspool/client"
 )
 
 type opOnline struct {
@@ -40,7 +41,7 @@ type opCreateSpool struct {
 }
 
 type opUpdateSpool struct {
-	descriptor   *client.SpoolReadDescriptor
+	descriptor   *memspoolclient.SpoolReadDescriptor
 	responseChan chan error
 }
 
@@ -86,10 +87,44 @@ type opGetConversation struct {
 	responseChan chan Messages
 }
 
+type opGetConversationArchive struct {
+	name         string
+	responseChan chan *conversationArchiveResult
+}
+
+type opGetVerification struct {
+	name         string
+	responseChan chan *verificationResult
+}
+
+type opMarkVerified struct {
+	name         string
+	method       string
+	responseChan chan error
+}
+
+type opRekeyContact struct {
+	name         string
+	sharedSecret []byte
+	responseChan chan error
+}
+
+type opAcceptKeyChange struct {
+	name         string
+	responseChan chan error
+}
+
 type opRestartSending struct {
 	contact *Contact
 }
 
+type opResume struct{}
+
+type opResumeSync struct {
+	session *client.Session
+	err     error
+}
+
 type opWipeConversation struct {
 	name         string
 	responseChan chan error
@@ -104,5 +139,5 @@ type opGetSpoolProviders struct {
 }
 
 type opSpoolWriteDescriptor struct {
-	responseChan chan *client.SpoolWriteDescriptor
+	responseChan chan *memspoolclient.SpoolWriteDescriptor
 }
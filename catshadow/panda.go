@@ -146,9 +146,12 @@ func (c *Client) processPANDAUpdate(update *panda.PandaUpdate) {
 			return
 		}
 		contact.spoolWriteDescriptor = exchange.SpoolWriteDescriptor
+		contact.identityKey = exchange.IdentityKey
+		contact.peerSettings = exchange.ConversationSettings
 		contact.IsPending = false
 		c.log.Info("Double ratchet key exchange completed!")
 		contact.sharedSecret = nil
+		c.updateVerification(contact)
 		c.eventCh.In() <- &KeyExchangeCompletedEvent{
 			Nickname: contact.Nickname,
 		}
@@ -0,0 +1,195 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// resume.go - reconnection and synchronization after suspension
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/katzenpost/katzenpost/client"
+)
+
+// ErrSyncTimeout is the error reported when the synchronization after
+// resuming from suspension does not complete within ResumeSyncTimeout.
+var ErrSyncTimeout = errors.New("Synchronization timed out")
+
+// resumeSync is the state of the synchronization following a resume
+// from suspension.
+type resumeSync struct {
+	gap      time.Duration
+	deadline time.Time
+	received int
+	retried  int
+}
+
+// Resume notifies the client that the application resumed from
+// suspension, causing it to reconnect and to synchronize with its remote
+// spool immediately rather than waiting for the wall clock check to
+// notice. The outcome is reported with a SyncCompletedEvent or a
+// SyncDegradedEvent.
+func (c *Client) Resume() {
+	select {
+	case <-c.HaltCh():
+	case c.opCh <- &opResume{}:
+	}
+}
+
+// checkResume compares the wall clock against the time of the previous
+// check and returns the suspension gap and true if the host was
+// suspended in between. It also expires a synchronization in progress.
+func (c *Client) checkResume() (time.Duration, bool) {
+	// Strip the monotonic clock reading, which does not advance while
+	// the host is suspended.
+	now := c.now().Round(0)
+	last := c.lastResumeCheck
+	c.lastResumeCheck = now
+
+	if c.resync != nil && now.After(c.resync.deadline) {
+		c.failSync(ErrSyncTimeout)
+	}
+	if last.IsZero() {
+		return 0, false
+	}
+	gap := now.Sub(last)
+	if gap <= ResumeCheckInterval+ResumeGapThreshold {
+		return 0, false
+	}
+	return gap, true
+}
+
+// beginResync starts reconnecting the client after a resume and returns
+// true if the current session is being replaced.
+func (c *Client) beginResync(gap time.Duration) bool {
+	if c.resync != nil {
+		c.log.Debugf("Resumed after %s while already synchronizing", gap)
+		return false
+	}
+	c.connMutex.RLock()
+	online := c.online
+	c.connMutex.RUnlock()
+	if !online {
+		c.log.Debugf("Resumed after %s while offline, not synchronizing", gap)
+		return false
+	}
+
+	c.log.Infof("Resumed after %s, reconnecting", gap)
+	c.resync = &resumeSync{
+		gap:      gap,
+		deadline: c.now().Round(0).Add(ResumeSyncTimeout),
+	}
+
+	// The session is only ever replaced by the worker, the new one is
+	// established in the background and installed by doResumeSync.
+	c.connMutex.Lock()
+	if c.session != nil {
+		c.session.Shutdown()
+	}
+	c.session = nil
+	c.online = false
+	c.connecting = true
+	c.connMutex.Unlock()
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), ResumeSyncTimeout)
+		defer cancel()
+		s, err := c.connect(ctx)
+		select {
+		case <-c.HaltCh():
+			if s != nil {
+				s.Shutdown()
+			}
+		case c.opCh <- &opResumeSync{session: s, err: err}:
+		}
+	}()
+	return true
+}
+
+// connectSession establishes a new session and waits for the PKI
+// document to arrive. It does not modify the state of the Client.
+func (c *Client) connectSession(ctx context.Context) (*client.Session, error) {
+	s, err := c.client.NewTOFUSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.WaitForDocument(ctx); err != nil {
+		s.Shutdown()
+		return nil, err
+	}
+	return s, nil
+}
+
+// doResumeSync is called by the worker once reconnected, it installs
+// the new session and retransmits the pending outbound messages before
+// draining the remote spool.
+func (c *Client) doResumeSync(op *opResumeSync) {
+	c.connMutex.Lock()
+	c.connecting = false
+	if op.err == nil {
+		c.session = op.session
+		c.online = true
+	}
+	c.connMutex.Unlock()
+
+	if c.resync == nil {
+		return
+	}
+	if op.err != nil {
+		c.failSync(op.err)
+		return
+	}
+	for _, contact := range c.contacts {
+		if contact.IsPending {
+			continue
+		}
+		if _, err := contact.outbound.Peek(); err == nil {
+			c.retrySending(contact)
+			c.resync.retried++
+		}
+	}
+	if err := c.fetchInbox(); err != nil {
+		c.failSync(err)
+	}
+}
+
+// onInboxRead is called upon a reply to a remote spool read; more is
+// false if the tip of the spool was reached.
+func (c *Client) onInboxRead(more bool) {
+	if c.resync == nil {
+		return
+	}
+	if !more {
+		c.log.Infof("Synchronized after resume, %d messages received", c.resync.received)
+		c.eventCh.In() <- &SyncCompletedEvent{
+			Gap:      c.resync.gap,
+			Received: c.resync.received,
+			Retried:  c.resync.retried,
+		}
+		c.resync = nil
+		return
+	}
+	if err := c.fetchInbox(); err != nil {
+		c.failSync(err)
+	}
+}
+
+func (c *Client) failSync(err error) {
+	c.log.Errorf("Synchronization after resume failed: %s", err)
+	c.eventCh.In() <- &SyncDegradedEvent{Gap: c.resync.gap, Err: err}
+	c.resync = nil
+}
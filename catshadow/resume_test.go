@@ -0,0 +1,230 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// resume_test.go - resume synchronization tests
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/client"
+	cConstants "github.com/katzenpost/katzenpost/client/constants"
+	"github.com/katzenpost/katzenpost/memspool/common"
+)
+
+// fakeResume records the resume synchronization steps of a Client.
+type fakeResume struct {
+	steps      []string
+	connectErr error
+	reads      []*[cConstants.MessageIDLength]byte
+}
+
+func newTestResumeClient(t *testing.T, clock *fakeClock, f *fakeResume) *Client {
+	c := newTestClient(t, clock)
+	c.online = true
+	c.lastResumeCheck = clock.Now()
+
+	c.connect = func(context.Context) (*client.Session, error) {
+		f.steps = append(f.steps, "reconnect")
+		return nil, f.connectErr
+	}
+	c.fetchInbox = func() error {
+		f.steps = append(f.steps, fmt.Sprintf("fetch %d", c.spoolReadDescriptor.ReadOffset))
+		id := &[cConstants.MessageIDLength]byte{byte(len(f.reads))}
+		f.reads = append(f.reads, id)
+		c.sendMap.Store(*id, &ReadMessageDescriptor{})
+		return nil
+	}
+	c.retrySending = func(contact *Contact) {
+		f.steps = append(f.steps, "retry "+contact.Nickname)
+	}
+	return c
+}
+
+// suspend advances the clock by gap and runs the worker resume handling.
+func suspend(t *testing.T, c *Client, clock *fakeClock, gap time.Duration) {
+	clock.now = clock.now.Add(gap)
+	g, ok := c.checkResume()
+	require.True(t, ok)
+	require.Equal(t, gap, g)
+	require.True(t, c.beginResync(g))
+
+	select {
+	case op := <-c.opCh:
+		c.doResumeSync(op.(*opResumeSync))
+	case <-time.After(time.Second):
+		require.FailNow(t, "timeout waiting for reconnection")
+	}
+}
+
+func spoolReply(t *testing.T, id *[cConstants.MessageIDLength]byte, offset uint32, message []byte) *client.MessageReplyEvent {
+	resp := &common.SpoolResponse{MessageID: offset, Message: message, Status: common.StatusOK}
+	if message == nil {
+		resp.Status = "spool is empty"
+	}
+	payload, err := resp.Marshal()
+	require.NoError(t, err)
+	return &client.MessageReplyEvent{MessageID: id, Payload: payload}
+}
+
+func TestResumeSync(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	f := &fakeResume{}
+	alice := newTestResumeClient(t, clock, f)
+	bob := newTestClient(t, clock)
+	aliceBob := addTestContact(t, alice, "bob")
+	bobAlice := addTestContact(t, bob, "alice")
+	pairTestContacts(t, aliceBob, bobAlice)
+	carol := addTestContact(t, alice, "carol")
+	require.NoError(aliceBob.outbound.Push(&queuedSpoolCommand{ID: MessageID{1}}))
+	require.NoError(carol.outbound.Push(&queuedSpoolCommand{ID: MessageID{2}}))
+
+	// Regular wall clock checks are not a resume.
+	clock.now = clock.now.Add(ResumeCheckInterval)
+	_, ok := alice.checkResume()
+	require.False(ok)
+
+	suspend(t, alice, clock, 8*time.Hour)
+	// carol is pending a key exchange.
+	require.Equal([]string{"reconnect", "retry bob", "fetch 0"}, f.steps)
+
+	// Messages spooled while suspended are fetched until the tip of
+	// the spool is reached.
+	for i := 0; i < 2; i++ {
+		serialized, err := cbor.Marshal(&Message{Plaintext: []byte("hello alice"), Timestamp: clock.Now()})
+		require.NoError(err)
+		ciphertext, err := bobAlice.ratchet.Encrypt(nil, serialized)
+		require.NoError(err)
+		alice.handleReply(spoolReply(t, f.reads[i], uint32(i), ciphertext))
+		require.IsType(&MessageReceivedEvent{}, nextEvent(t, alice))
+	}
+	require.Equal([]string{"reconnect", "retry bob", "fetch 0", "fetch 1", "fetch 2"}, f.steps)
+	alice.handleReply(spoolReply(t, f.reads[2], 2, nil))
+	require.Equal(&SyncCompletedEvent{Gap: 8 * time.Hour, Received: 2, Retried: 1}, nextEvent(t, alice))
+	require.Nil(alice.resync)
+	require.Equal(uint32(2), alice.spoolReadDescriptor.ReadOffset)
+
+	// Regular spool reads no longer fetch eagerly.
+	id := &[cConstants.MessageIDLength]byte{0xff}
+	alice.sendMap.Store(*id, &ReadMessageDescriptor{})
+	alice.handleReply(spoolReply(t, id, 2, nil))
+	require.Len(f.steps, 5)
+}
+
+func TestResumeSyncDegraded(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	f := &fakeResume{connectErr: errors.New("provider unreachable")}
+	c := newTestResumeClient(t, clock, f)
+
+	suspend(t, c, clock, time.Hour)
+	require.Equal(&SyncDegradedEvent{Gap: time.Hour, Err: f.connectErr}, nextEvent(t, c))
+	require.Nil(c.resync)
+	require.False(c.online)
+	require.False(c.connecting)
+
+	// A synchronization which does not complete times out.
+	c.online = true
+	f.connectErr = nil
+	suspend(t, c, clock, 2*time.Hour)
+	require.Equal([]string{"reconnect", "reconnect", "fetch 0"}, f.steps)
+	require.False(c.beginResync(time.Hour))
+	for i := time.Duration(0); i <= ResumeSyncTimeout; i += ResumeCheckInterval {
+		clock.now = clock.now.Add(ResumeCheckInterval)
+		_, ok := c.checkResume()
+		require.False(ok)
+	}
+	require.Equal(&SyncDegradedEvent{Gap: 2 * time.Hour, Err: ErrSyncTimeout}, nextEvent(t, c))
+	require.Nil(c.resync)
+
+	// No synchronization is attempted while offline.
+	c.online = false
+	clock.now = clock.now.Add(time.Hour)
+	gap, ok := c.checkResume()
+	require.True(ok)
+	require.False(c.beginResync(gap))
+	require.Len(f.steps, 3)
+}
+
+func TestResumeWhileSending(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	alice := newTestClient(t, clock)
+	bob := newTestClient(t, clock)
+	aliceBob := addTestContact(t, alice, "bob")
+	bobAlice := addTestContact(t, bob, "alice")
+	pairTestContacts(t, aliceBob, bobAlice)
+	require.NoError(aliceBob.outbound.Push(&queuedSpoolCommand{ID: MessageID{1}}))
+
+	retried := make(chan string, 1)
+	alice.online = true
+	alice.connect = func(context.Context) (*client.Session, error) {
+		return nil, nil
+	}
+	alice.fetchInbox = func() error {
+		alice.onInboxRead(false)
+		return nil
+	}
+	alice.retrySending = func(contact *Contact) {
+		alice.sendMessage(contact)
+		retried <- contact.Nickname
+	}
+	alice.Go(alice.worker)
+	t.Cleanup(func() {
+		alice.Halt()
+		alice.Wait()
+	})
+
+	// Keep sends in flight while the session is being replaced.
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case alice.opCh <- &opRestartSending{contact: aliceBob}:
+			}
+		}
+	}()
+
+	for i := 0; i < 10; i++ {
+		alice.Resume()
+		select {
+		case nickname := <-retried:
+			require.Equal("bob", nickname)
+		case <-time.After(time.Second):
+			require.FailNow("timeout waiting for retransmission")
+		}
+		require.IsType(&SyncCompletedEvent{}, nextEvent(t, alice))
+	}
+	_, err := aliceBob.outbound.Peek()
+	require.NoError(err)
+}
@@ -101,8 +101,11 @@ func (c *Client) processReunionUpdate(update *rClient.ReunionUpdate) {
 		}
 		// XXX: should purge the reunionResults now...
 		contact.keyExchange = nil
+		contact.identityKey = exchange.IdentityKey
+		contact.peerSettings = exchange.ConversationSettings
 		contact.IsPending = false
 		c.log.Info("Reunion double ratchet key exchange completed by exchange %v!", update.ExchangeID)
+		c.updateVerification(contact)
 		c.eventCh.In() <- &KeyExchangeCompletedEvent{
 			Nickname: contact.Nickname,
 		}
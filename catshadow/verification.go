@@ -0,0 +1,332 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// verification.go - contact identity verification
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/katzenpost/hpqc/hash"
+	"github.com/katzenpost/hpqc/rand"
+
+	ratchet "github.com/katzenpost/katzenpost/doubleratchet"
+)
+
+var (
+	ErrKeyNotChanged            = errors.New("Contact key did not change since it was verified")
+	ErrOutboundQueued           = errors.New("Cannot rekey contact with messages queued for sending")
+	ErrNoIdentityKey            = errors.New("Contact did not sign its key exchange with an identity key")
+	ErrInvalidExchangeSignature = errors.New("Invalid contact exchange signature")
+)
+
+// VerificationState is the identity verification state of a Contact.
+type VerificationState uint8
+
+const (
+	// Unverified is the state of a contact whose identity was not
+	// verified by the user.
+	Unverified VerificationState = iota
+
+	// Verified is the state of a contact whose identity was verified
+	// by the user.
+	Verified
+
+	// KeyChanged is the state of a verified contact whose identity key
+	// changed since the user verified it.
+	KeyChanged
+)
+
+// String returns a human readable VerificationState.
+func (s VerificationState) String() string {
+	switch s {
+	case Unverified:
+		return "unverified"
+	case Verified:
+		return "verified"
+	case KeyChanged:
+		return "key changed"
+	default:
+		return fmt.Sprintf("[invalid VerificationState: %d]", uint8(s))
+	}
+}
+
+// Verification is the identity verification of a Contact.
+type Verification struct {
+	State VerificationState
+
+	// VerifiedAt is when the user verified the contact, it is zero if
+	// the contact is Unverified.
+	VerifiedAt time.Time
+
+	// Method is how the user verified the contact, such as "in person"
+	// or "qr code".
+	Method string
+
+	// Fingerprint is the contact fingerprint which the user verified.
+	Fingerprint [32]byte
+}
+
+type verificationResult struct {
+	verification Verification
+	err          error
+}
+
+// fingerprint returns the hash of the contact's identity key, or all
+// zeros if the contact did not sign its key exchange. The identity key
+// signs the contact's key exchanges and conversation archives, so the
+// fingerprint is the contact's IdentityFingerprint and does not change
+// when the contact is rekeyed.
+func (c *Contact) fingerprint() [32]byte {
+	if c.identityKey == nil {
+		return [32]byte{}
+	}
+	return hash.Sum256(c.identityKey)
+}
+
+// SetAllowKeyChanged sets whether messages are sent to contacts whose key
+// changed since they were verified. By default such messages are queued
+// and only sent once the user verifies the contact again or accepts the
+// key change. It must be called before Start.
+func (c *Client) SetAllowKeyChanged(allow bool) {
+	c.allowKeyChanged = allow
+}
+
+// GetVerification returns the identity verification of a contact.
+func (c *Client) GetVerification(nickname string) (Verification, error) {
+	op := &opGetVerification{
+		name:         nickname,
+		responseChan: make(chan *verificationResult, 1),
+	}
+	select {
+	case <-c.HaltCh():
+		return Verification{}, ErrHalted
+	case c.opCh <- op:
+	}
+	select {
+	case <-c.HaltCh():
+		return Verification{}, ErrHalted
+	case r := <-op.responseChan:
+		return r.verification, r.err
+	}
+}
+
+func (c *Client) doGetVerification(nickname string) (Verification, error) {
+	c.conversationsMutex.Lock()
+	defer c.conversationsMutex.Unlock()
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		return Verification{}, ErrContactNotFound
+	}
+	return contact.verification, nil
+}
+
+// MarkVerified marks the current identity of a contact as verified by
+// the user with the given method.
+func (c *Client) MarkVerified(nickname, method string) error {
+	op := &opMarkVerified{
+		name:         nickname,
+		method:       method,
+		responseChan: make(chan error, 1),
+	}
+	select {
+	case <-c.HaltCh():
+		return ErrHalted
+	case c.opCh <- op:
+	}
+	select {
+	case <-c.HaltCh():
+		return ErrHalted
+	case err := <-op.responseChan:
+		return err
+	}
+}
+
+func (c *Client) doMarkVerified(nickname, method string) error {
+	c.conversationsMutex.Lock()
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		c.conversationsMutex.Unlock()
+		return ErrContactNotFound
+	}
+	if contact.IsPending {
+		c.conversationsMutex.Unlock()
+		return ErrPendingKeyExchange
+	}
+	if contact.identityKey == nil {
+		c.conversationsMutex.Unlock()
+		return ErrNoIdentityKey
+	}
+	fingerprint := contact.fingerprint()
+	wasBlocked := c.keyChangeBlocked(contact)
+	contact.verification = Verification{
+		State:       Verified,
+		VerifiedAt:  c.now(),
+		Method:      method,
+		Fingerprint: fingerprint,
+	}
+	c.conversationsMutex.Unlock()
+	c.log.Infof("Contact %s verified %s", nickname, method)
+	c.verificationChanged(contact, wasBlocked)
+	return nil
+}
+
+// AcceptKeyChange accepts the changed key of a contact without verifying
+// it, the contact becomes Unverified.
+func (c *Client) AcceptKeyChange(nickname string) error {
+	op := &opAcceptKeyChange{
+		name:         nickname,
+		responseChan: make(chan error, 1),
+	}
+	select {
+	case <-c.HaltCh():
+		return ErrHalted
+	case c.opCh <- op:
+	}
+	select {
+	case <-c.HaltCh():
+		return ErrHalted
+	case err := <-op.responseChan:
+		return err
+	}
+}
+
+func (c *Client) doAcceptKeyChange(nickname string) error {
+	c.conversationsMutex.Lock()
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		c.conversationsMutex.Unlock()
+		return ErrContactNotFound
+	}
+	if contact.verification.State != KeyChanged {
+		c.conversationsMutex.Unlock()
+		return ErrKeyNotChanged
+	}
+	wasBlocked := c.keyChangeBlocked(contact)
+	contact.verification = Verification{State: Unverified}
+	c.conversationsMutex.Unlock()
+	c.log.Infof("Accepted key change of contact %s", nickname)
+	c.verificationChanged(contact, wasBlocked)
+	return nil
+}
+
+// RekeyContact starts a new key exchange with a paired contact using the
+// given shared secret. The contact is pending until the exchange
+// completes, and keeps its verification: a verified contact stays
+// verified if it signs the new exchange with the same identity key, and
+// becomes KeyChanged otherwise.
+func (c *Client) RekeyContact(nickname string, sharedSecret []byte) error {
+	op := &opRekeyContact{
+		name:         nickname,
+		sharedSecret: sharedSecret,
+		responseChan: make(chan error, 1),
+	}
+	select {
+	case <-c.HaltCh():
+		return ErrHalted
+	case c.opCh <- op:
+	}
+	select {
+	case <-c.HaltCh():
+		return ErrHalted
+	case err := <-op.responseChan:
+		return err
+	}
+}
+
+func (c *Client) doRekeyContact(nickname string, sharedSecret []byte) error {
+	contact, ok := c.contactNicknames[nickname]
+	if !ok {
+		return ErrContactNotFound
+	}
+	if contact.IsPending {
+		return ErrPendingKeyExchange
+	}
+	// queued messages are encrypted with the ratchet being replaced
+	if _, err := contact.outbound.Peek(); err != ErrQueueEmpty {
+		return ErrOutboundQueued
+	}
+	r, err := ratchet.InitRatchet(rand.Reader)
+	if err != nil {
+		return err
+	}
+	contact.ratchetMutex.Lock()
+	ratchet.DestroyRatchet(contact.ratchet)
+	contact.ratchet = r
+	contact.ratchetMutex.Unlock()
+	contact.IsPending = true
+	contact.sharedSecret = sharedSecret
+	contact.keyExchange = nil
+	contact.pandaKeyExchange = nil
+	contact.pandaResult = ""
+	contact.pandaShutdownChan = make(chan interface{})
+	contact.reunionShutdownChan = make(chan struct{})
+	c.save()
+	c.log.Infof("Rekeying contact %s", nickname)
+
+	c.connMutex.RLock()
+	defer c.connMutex.RUnlock()
+	if !c.online {
+		return nil
+	}
+	if err := c.initKeyExchange(contact); err != nil {
+		return err
+	}
+	return c.doPANDAExchange(contact)
+}
+
+// updateVerification is called when the key exchange with a contact
+// completed, and marks a verified contact whose identity key changed.
+func (c *Client) updateVerification(contact *Contact) {
+	if contact.verification.State != Verified {
+		return
+	}
+	if contact.fingerprint() == contact.verification.Fingerprint {
+		return
+	}
+	c.conversationsMutex.Lock()
+	contact.verification.State = KeyChanged
+	c.conversationsMutex.Unlock()
+	c.log.Warningf("Key of verified contact %s changed", contact.Nickname)
+	c.verificationChanged(contact, false)
+}
+
+// verificationChanged saves the verification of a contact, notifies the
+// UI and resumes sending to the contact if it was blocked.
+func (c *Client) verificationChanged(contact *Contact, wasBlocked bool) {
+	c.save()
+	c.eventCh.In() <- &VerificationChangedEvent{
+		Nickname:     contact.Nickname,
+		Verification: contact.verification,
+	}
+	if !wasBlocked {
+		return
+	}
+	c.connMutex.RLock()
+	online := c.online
+	c.connMutex.RUnlock()
+	if online {
+		c.retrySending(contact)
+	}
+}
+
+// keyChangeBlocked returns true if no messages are sent to the contact
+// because its key changed since it was verified.
+func (c *Client) keyChangeBlocked(contact *Contact) bool {
+	return contact.verification.State == KeyChanged && !c.allowKeyChanged
+}
@@ -0,0 +1,256 @@
+// SPDX-License-Identifier: AGPL-3.0-or-later
+//
+// verification_test.go - contact identity verification tests
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package catshadow
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/hpqc/hash"
+	"github.com/katzenpost/hpqc/sign/ed25519"
+
+	memspoolclient "github.com/katzenpost/katzenpost/memspool/client"
+	panda "github.com/katzenpost/katzenpost/panda/crypto"
+)
+
+func verificationEvent(t *testing.T, c *Client, nickname string, state VerificationState) Verification {
+	ev, ok := nextEvent(t, c).(*VerificationChangedEvent)
+	require.True(t, ok)
+	require.Equal(t, nickname, ev.Nickname)
+	require.Equal(t, state, ev.Verification.State)
+	return ev.Verification
+}
+
+// exchangeTestContacts completes the key exchange of the pending contacts
+// a and b of the clients ca and cb like PANDA does, and returns the events
+// of ca up to the completion of the exchange.
+func exchangeTestContacts(t *testing.T, ca, cb *Client, a, b *Contact) []interface{} {
+	require := require.New(t)
+
+	akx, err := a.ratchet.CreateKeyExchange()
+	require.NoError(err)
+	bkx, err := b.ratchet.CreateKeyExchange()
+	require.NoError(err)
+	aExchange, err := newSignedContactExchangeBytes(ca.spoolReadDescriptor.GetWriteDescriptor(), akx, ca.spoolReadDescriptor.PrivateKey)
+	require.NoError(err)
+	bExchange, err := newSignedContactExchangeBytes(cb.spoolReadDescriptor.GetWriteDescriptor(), bkx, cb.spoolReadDescriptor.PrivateKey)
+	require.NoError(err)
+	ca.processPANDAUpdate(&panda.PandaUpdate{ID: a.id, Result: bExchange})
+	cb.processPANDAUpdate(&panda.PandaUpdate{ID: b.id, Result: aExchange})
+	require.False(a.IsPending)
+	require.False(b.IsPending)
+
+	var events []interface{}
+	for {
+		ev := nextEvent(t, ca)
+		events = append(events, ev)
+		if _, ok := ev.(*KeyExchangeCompletedEvent); ok {
+			break
+		}
+	}
+	_, ok := nextEvent(t, cb).(*KeyExchangeCompletedEvent)
+	require.True(ok)
+	return events
+}
+
+// rekeyTestContacts rekeys the paired contacts a and b of the clients ca
+// and cb, see exchangeTestContacts.
+func rekeyTestContacts(t *testing.T, ca, cb *Client, a, b *Contact) []interface{} {
+	require.NoError(t, ca.doRekeyContact(a.Nickname, []byte("new secret")))
+	require.NoError(t, cb.doRekeyContact(b.Nickname, []byte("new secret")))
+	require.True(t, a.IsPending)
+	require.True(t, b.IsPending)
+	return exchangeTestContacts(t, ca, cb, a, b)
+}
+
+// newTestIdentity replaces the identity key of the client, like creating
+// a new remote spool does.
+func newTestIdentity(t *testing.T, c *Client) {
+	_, privKey, err := ed25519.Scheme().GenerateKey()
+	require.NoError(t, err)
+	c.spoolReadDescriptor = &memspoolclient.SpoolReadDescriptor{PrivateKey: privKey}
+}
+
+func TestContactVerification(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	alice := newTestClient(t, clock)
+	bob := newTestClient(t, clock)
+	aliceBob := addTestContact(t, alice, "bob")
+	bobAlice := addTestContact(t, bob, "alice")
+	var retried []string
+	alice.retrySending = func(contact *Contact) {
+		retried = append(retried, contact.Nickname)
+	}
+
+	v, err := alice.doGetVerification("bob")
+	require.NoError(err)
+	require.Equal(Verification{State: Unverified}, v)
+	_, err = alice.doGetVerification("carol")
+	require.ErrorIs(err, ErrContactNotFound)
+
+	// A contact pending the key exchange can not be verified or rekeyed.
+	require.ErrorIs(alice.doMarkVerified("bob", "in person"), ErrPendingKeyExchange)
+	require.ErrorIs(alice.doMarkVerified("carol", "in person"), ErrContactNotFound)
+	require.ErrorIs(alice.doRekeyContact("bob", []byte("secret")), ErrPendingKeyExchange)
+	require.ErrorIs(alice.doRekeyContact("carol", []byte("secret")), ErrContactNotFound)
+
+	// The fingerprint of the contact is the fingerprint of the identity
+	// key of the peer.
+	require.Len(exchangeTestContacts(t, alice, bob, aliceBob, bobAlice), 1)
+	fingerprint := aliceBob.fingerprint()
+	require.Equal(bob.IdentityFingerprint(), fingerprint)
+	require.Equal(alice.IdentityFingerprint(), bobAlice.fingerprint())
+	require.True(aliceBob.peerSettings)
+	require.NoError(alice.doMarkVerified("bob", "in person"))
+	v = verificationEvent(t, alice, "bob", Verified)
+	require.Equal(Verification{
+		State:       Verified,
+		VerifiedAt:  clock.Now(),
+		Method:      "in person",
+		Fingerprint: fingerprint,
+	}, v)
+	require.False(alice.keyChangeBlocked(aliceBob))
+
+	// Rekeying with the same identity key keeps the contact verified.
+	require.Len(rekeyTestContacts(t, alice, bob, aliceBob, bobAlice), 1)
+	require.Equal(Verified, aliceBob.verification.State)
+	require.Equal(fingerprint, aliceBob.fingerprint())
+
+	// A changed identity key blocks sending until the change is
+	// accepted.
+	newTestIdentity(t, bob)
+	events := rekeyTestContacts(t, alice, bob, aliceBob, bobAlice)
+	require.Len(events, 2)
+	ev, ok := events[0].(*VerificationChangedEvent)
+	require.True(ok)
+	require.Equal(KeyChanged, ev.Verification.State)
+	require.Equal(fingerprint, ev.Verification.Fingerprint)
+	require.Equal(bob.IdentityFingerprint(), aliceBob.fingerprint())
+	require.True(alice.keyChangeBlocked(aliceBob))
+
+	// Messages to the contact are held back rather than dropped.
+	alice.online = true
+	alice.doSendMessage(MessageID{1}, "bob", []byte("hello"))
+	_, err = aliceBob.outbound.Peek()
+	require.NoError(err)
+	require.Contains(alice.conversations["bob"], MessageID{1})
+	require.Empty(retried)
+
+	alice.allowKeyChanged = true
+	require.False(alice.keyChangeBlocked(aliceBob))
+	alice.allowKeyChanged = false
+
+	// Accepting the change sends the held messages.
+	require.NoError(alice.doAcceptKeyChange("bob"))
+	verificationEvent(t, alice, "bob", Unverified)
+	require.False(alice.keyChangeBlocked(aliceBob))
+	require.ErrorIs(alice.doAcceptKeyChange("bob"), ErrKeyNotChanged)
+	require.Equal([]string{"bob"}, retried)
+
+	// The contact can not be rekeyed while messages are queued.
+	require.ErrorIs(alice.doRekeyContact("bob", []byte("secret")), ErrOutboundQueued)
+	require.Equal(1, deliverQueued(t, aliceBob, bob))
+	received, ok := nextEvent(t, bob).(*MessageReceivedEvent)
+	require.True(ok)
+	require.Equal([]byte("hello"), received.Message)
+
+	// An unverified contact does not become KeyChanged.
+	alice.online = false
+	newTestIdentity(t, bob)
+	require.Len(rekeyTestContacts(t, alice, bob, aliceBob, bobAlice), 1)
+	require.Equal(Unverified, aliceBob.verification.State)
+
+	// Verifying the new key also sends the held messages.
+	require.NoError(alice.doMarkVerified("bob", "qr code"))
+	verificationEvent(t, alice, "bob", Verified)
+	newTestIdentity(t, bob)
+	require.Len(rekeyTestContacts(t, alice, bob, aliceBob, bobAlice), 2)
+	alice.online = true
+	alice.doSendMessage(MessageID{2}, "bob", []byte("again"))
+	require.Equal([]string{"bob"}, retried)
+	clock.now = clock.now.Add(time.Hour)
+	require.NoError(alice.doMarkVerified("bob", "in person"))
+	v = verificationEvent(t, alice, "bob", Verified)
+	require.Equal(clock.Now(), v.VerifiedAt)
+	require.Equal(aliceBob.fingerprint(), v.Fingerprint)
+	require.False(alice.keyChangeBlocked(aliceBob))
+	require.Equal([]string{"bob", "bob"}, retried)
+}
+
+func TestContactExchangeSignature(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	c := newTestClient(t, &fakeClock{now: time.Unix(1700000000, 0)})
+	desc := c.spoolReadDescriptor.GetWriteDescriptor()
+	blob, err := newSignedContactExchangeBytes(desc, []byte("key exchange"), c.spoolReadDescriptor.PrivateKey)
+	require.NoError(err)
+	exchange, err := parseContactExchangeBytes(blob)
+	require.NoError(err)
+	require.Equal(c.IdentityFingerprint(), hash.Sum256(exchange.IdentityKey))
+	require.True(exchange.ConversationSettings)
+
+	// A key exchange which is not signed by the identity key is rejected.
+	exchange.KeyExchange = []byte("forged exchange")
+	blob, err = cbor.Marshal(exchange)
+	require.NoError(err)
+	_, err = parseContactExchangeBytes(blob)
+	require.ErrorIs(err, ErrInvalidExchangeSignature)
+
+	// Older clients do not sign their key exchange, their contacts can
+	// not be verified.
+	blob, err = NewContactExchangeBytes(desc, []byte("key exchange"))
+	require.NoError(err)
+	exchange, err = parseContactExchangeBytes(blob)
+	require.NoError(err)
+	require.Nil(exchange.IdentityKey)
+	contact := addTestContact(t, c, "bob")
+	contact.IsPending = false
+	require.ErrorIs(c.doMarkVerified("bob", "in person"), ErrNoIdentityKey)
+}
+
+func TestContactVerificationPersistence(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	contact, err := NewContact("bob", 1, []byte("secret"))
+	require.NoError(err)
+	contact.verification = Verification{
+		State:       KeyChanged,
+		VerifiedAt:  time.Unix(1700000000, 0),
+		Method:      "in person",
+		Fingerprint: [32]byte{1, 2, 3},
+	}
+	contact.identityKey = []byte("identity key")
+
+	blob, err := contact.MarshalBinary()
+	require.NoError(err)
+	loaded := new(Contact)
+	require.NoError(loaded.UnmarshalBinary(blob))
+	require.Equal(contact.verification.State, loaded.verification.State)
+	require.True(contact.verification.VerifiedAt.Equal(loaded.verification.VerifiedAt))
+	require.Equal(contact.verification.Method, loaded.verification.Method)
+	require.Equal(contact.verification.Fingerprint, loaded.verification.Fingerprint)
+	require.Equal(contact.fingerprint(), loaded.fingerprint())
+}
@@ -51,8 +51,26 @@ func (c *Client) worker() {
 
 	gcMessagestimer := time.NewTimer(GarbageCollectionInterval)
 	defer gcMessagestimer.Stop()
+	garbageCollect := func() {
+		next, removed := c.garbageCollectConversations()
+		if removed {
+			c.save()
+		}
+		gcMessagestimer.Reset(next)
+	}
+
+	resumeTicker := time.NewTicker(ResumeCheckInterval)
+	defer resumeTicker.Stop()
+	c.lastResumeCheck = c.now().Round(0)
 
 	isConnected := false
+	resume := func(gap time.Duration) {
+		if c.beginResync(gap) {
+			// The session is being replaced, wait for the new one.
+			isConnected = false
+			readInboxTimer.Reset(maxDuration)
+		}
+	}
 	for {
 		var qo interface{}
 		select {
@@ -62,8 +80,11 @@ func (c *Client) worker() {
 			c.save()
 			return
 		case <-gcMessagestimer.C:
-			c.garbageCollectConversations()
-			gcMessagestimer.Reset(GarbageCollectionInterval)
+			garbageCollect()
+		case <-resumeTicker.C:
+			if gap, ok := c.checkResume(); ok {
+				resume(gap)
+			}
 		case <-readInboxTimer.C:
 			if isConnected {
 				c.log.Debug("READING INBOX")
@@ -105,6 +126,16 @@ func (c *Client) worker() {
 				c.doGetExpiration(op.name, op.responseChan)
 			case *opChangeExpiration:
 				op.responseChan <- c.doChangeExpiration(op.name, op.expiration)
+				garbageCollect()
+			case *opGetVerification:
+				verification, err := c.doGetVerification(op.name)
+				op.responseChan <- &verificationResult{verification: verification, err: err}
+			case *opMarkVerified:
+				op.responseChan <- c.doMarkVerified(op.name, op.method)
+			case *opAcceptKeyChange:
+				op.responseChan <- c.doAcceptKeyChange(op.name)
+			case *opRekeyContact:
+				op.responseChan <- c.doRekeyContact(op.name, op.sharedSecret)
 			case *opRestartSending:
 				c.sendMessage(op.contact)
 			case *opSendMessage:
@@ -113,6 +144,13 @@ func (c *Client) worker() {
 				op.responseChan <- c.contactNicknames
 			case *opGetConversation:
 				c.doGetConversation(op.name, op.responseChan)
+			case *opGetConversationArchive:
+				archive, err := c.doGetConversationArchive(op.name)
+				op.responseChan <- &conversationArchiveResult{archive: archive, err: err}
+			case *opResume:
+				resume(c.now().Round(0).Sub(c.lastResumeCheck))
+			case *opResumeSync:
+				c.doResumeSync(op)
 			case *opWipeConversation:
 				op.responseChan <- c.doWipeConversation(op.name)
 			case *opGetPKIDocument:
@@ -142,7 +180,10 @@ func (c *Client) worker() {
 					c.log.Debug("ConnectionStatusEvent: Connected: Setting readInboxTimer to %s", readInboxInterval)
 					readInboxTimer.Reset(readInboxInterval)
 					isConnected = event.IsConnected
-					c.restartSending()
+					if c.resync == nil {
+						// otherwise retransmitted by doResumeSync
+						c.restartSending()
+					}
 					c.restartKeyExchanges()
 					c.eventCh.In() <- event
 					continue
@@ -166,6 +207,7 @@ func (c *Client) worker() {
 				readInboxInterval := c.getReadInboxInterval()
 				c.log.Debug("NewDocumentEvent: Setting readInboxTimer to %s", readInboxInterval)
 				readInboxTimer.Reset(readInboxInterval)
+				garbageCollect()
 				continue
 			default:
 				c.fatalErrCh <- fmt.Errorf("bug, received unknown event from client EventSink: %v", event)
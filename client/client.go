@@ -75,18 +75,26 @@ func PKIBootstrap(ctx context.Context, c *Client, linkKey kem.PrivateKey) (pki.C
 	return pkiClient, doc, nil
 }
 
-// SelectProvider returns a provider descriptor or error.
+// SelectProvider returns a provider descriptor or error. Providers which
+// advertise that they are saturated are avoided unless all of them are.
 func SelectProvider(doc *pki.Document) (*pki.MixDescriptor, error) {
 	// Pick a Provider that supports TrustOnFirstUse
 	providers := []*pki.MixDescriptor{}
+	available := []*pki.MixDescriptor{}
 	for _, provider := range doc.Providers {
 		if provider.AuthenticationType == pki.TrustOnFirstUseAuth {
 			providers = append(providers, provider)
+			if !provider.IsSaturated() {
+				available = append(available, provider)
+			}
 		}
 	}
 	if len(providers) == 0 {
 		return nil, errors.New("no Providers supporting tofu-authenticated connections found in the consensus")
 	}
+	if len(available) > 0 {
+		providers = available
+	}
 	provider := providers[rand.NewMath().Intn(len(providers))]
 	return provider, nil
 }
@@ -104,6 +112,9 @@ func New(cfg *config.Config) (*Client, error) {
 	}
 
 	c.log.Noticef("😼 Katzenpost is still pre-alpha.  DO NOT DEPEND ON IT FOR STRONG SECURITY OR ANONYMITY. 😼")
+	if c.cfg.SphinxGeometry != nil {
+		c.log.Noticef("Sphinx Geometry: %s", c.cfg.SphinxGeometry.Summary())
+	}
 
 	// Start the fatal error watcher.
 	go func() {
@@ -0,0 +1,50 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/core/pki"
+)
+
+func TestSelectProvider(t *testing.T) {
+	require := require.New(t)
+
+	busy := &pki.MixDescriptor{
+		Name:               "busy",
+		Provider:           true,
+		AuthenticationType: pki.TrustOnFirstUseAuth,
+		MaxPacketRate:      1024,
+		Utilization:        pki.UtilizationSaturated,
+	}
+	idle := &pki.MixDescriptor{
+		Name:               "idle",
+		Provider:           true,
+		AuthenticationType: pki.TrustOnFirstUseAuth,
+		MaxPacketRate:      1024,
+		Utilization:        pki.UtilizationLow,
+	}
+	closed := &pki.MixDescriptor{
+		Name:               "closed",
+		Provider:           true,
+		AuthenticationType: pki.OutOfBandAuth,
+	}
+
+	doc := &pki.Document{Providers: []*pki.MixDescriptor{busy, idle, closed}}
+	for i := 0; i < 32; i++ {
+		provider, err := SelectProvider(doc)
+		require.NoError(err)
+		require.Equal(idle, provider)
+	}
+
+	// Saturated Providers are used if there is nothing else.
+	doc.Providers = []*pki.MixDescriptor{busy, closed}
+	provider, err := SelectProvider(doc)
+	require.NoError(err)
+	require.Equal(busy, provider)
+
+	doc.Providers = []*pki.MixDescriptor{closed}
+	_, err = SelectProvider(doc)
+	require.Error(err)
+}
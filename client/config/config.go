@@ -95,6 +95,12 @@ type Debug struct {
 	// PreferedTransports is a list of the transports will be used to make
 	// outgoing network connections, with the most prefered first.
 	PreferedTransports []pki.Transport
+
+	// EnableLinkCover enables sending every command to the Provider at
+	// the rate given by the LambdaP parameters of the PKI document, with
+	// padded NoOp commands taking the place of missing real commands, so
+	// that the rate of commands does not reveal the real traffic.
+	EnableLinkCover bool
 }
 
 func (d *Debug) fixup() {
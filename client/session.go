@@ -145,6 +145,7 @@ func NewSession(
 		PreferedTransports:  cfg.Debug.PreferedTransports,
 		MessagePollInterval: time.Duration(cfg.Debug.PollingInterval) * time.Millisecond,
 		EnableTimeSync:      false, // Be explicit about it.
+		EnableLinkCover:     cfg.Debug.EnableLinkCover,
 	}
 
 	s.timerQ.Go(s.timerQ.worker)
@@ -0,0 +1,122 @@
+// capacity.go - Self-reported node capacity hints.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// Capacity hints are self-reported by Providers and can not be verified by
+// anyone else. They are optional and deliberately coarse: a precise or
+// frequently changing figure would tell an observer how much traffic a
+// Provider carries, which helps correlate users with their Provider. Hence
+// the packet rate is rounded down to a power of two, utilization is
+// published as one of a few bands, and both only change when a new
+// descriptor is published, once per epoch.
+//
+// Providers derive the utilization band from the number of currently
+// connected clients, as there is no configured limit on clients to derive
+// it from. The band therefore reveals a coarse count of the Provider's
+// users: with the network send rate limit and the advertised packet rate
+// anyone can tell in which of three ranges it lies. Operators who do not
+// want to reveal this should not set a MaxPacketRate.
+
+// MaxAdvertisedPacketRate is the largest MaxPacketRate that a well formed
+// descriptor may advertise.
+const MaxAdvertisedPacketRate = 1 << 20
+
+// UtilizationBand is a coarse, self-reported estimate of how busy a
+// Provider is.
+type UtilizationBand uint8
+
+const (
+	// UtilizationUnknown means that the utilization is not advertised.
+	UtilizationUnknown UtilizationBand = iota
+
+	// UtilizationLow means that less than half of the capacity is used.
+	UtilizationLow
+
+	// UtilizationHigh means that at least half of the capacity is used.
+	UtilizationHigh
+
+	// UtilizationSaturated means that the expected load meets or exceeds
+	// the capacity.
+	UtilizationSaturated
+)
+
+// String returns a human readable UtilizationBand.
+func (b UtilizationBand) String() string {
+	switch b {
+	case UtilizationUnknown:
+		return "unknown"
+	case UtilizationLow:
+		return "low"
+	case UtilizationHigh:
+		return "high"
+	case UtilizationSaturated:
+		return "saturated"
+	default:
+		return fmt.Sprintf("[invalid UtilizationBand: %d]", uint8(b))
+	}
+}
+
+// CoarsePacketRate returns the packet rate rounded down to a power of two
+// and capped at MaxAdvertisedPacketRate, suitable for MaxPacketRate.
+func CoarsePacketRate(rate uint64) uint64 {
+	if rate == 0 {
+		return 0
+	}
+	if rate >= MaxAdvertisedPacketRate {
+		return MaxAdvertisedPacketRate
+	}
+	return 1 << (bits.Len64(rate) - 1)
+}
+
+// UtilizationFor returns the UtilizationBand for the expected load and the
+// capacity, both in packets per second.
+func UtilizationFor(load, capacity uint64) UtilizationBand {
+	switch {
+	case capacity == 0:
+		return UtilizationUnknown
+	case load >= capacity:
+		return UtilizationSaturated
+	case load >= capacity/2:
+		return UtilizationHigh
+	default:
+		return UtilizationLow
+	}
+}
+
+// IsSaturated returns true if the descriptor advertises that the node
+// is saturated.
+func (d *MixDescriptor) IsSaturated() bool {
+	return d.Utilization == UtilizationSaturated
+}
+
+// sanitizeCapacity strips or caps implausible capacity hints. They are
+// only hints, so a descriptor which gets them wrong is still usable.
+func sanitizeCapacity(d *MixDescriptor) {
+	if !d.Provider {
+		d.MaxPacketRate = 0
+		d.Utilization = UtilizationUnknown
+		return
+	}
+	d.MaxPacketRate = CoarsePacketRate(d.MaxPacketRate)
+	if d.Utilization > UtilizationSaturated || d.MaxPacketRate == 0 {
+		d.Utilization = UtilizationUnknown
+	}
+}
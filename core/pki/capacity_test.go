@@ -0,0 +1,176 @@
+// capacity_test.go - Capacity hint tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/require"
+
+	ecdh "github.com/katzenpost/hpqc/nike/x25519"
+	"github.com/katzenpost/hpqc/rand"
+
+	"github.com/katzenpost/katzenpost/core/cert"
+)
+
+// descriptorV0 is the MixDescriptor as known to nodes which predate the
+// capacity hints.
+type descriptorV0 struct {
+	Name               string
+	Epoch              uint64
+	IdentityKey        []byte
+	Signature          *cert.Signature `cbor:"-"`
+	LinkKey            []byte
+	MixKeys            map[uint64][]byte
+	Addresses          map[Transport][]string
+	Kaetzchen          map[string]map[string]interface{} `cbor:"omitempty"`
+	Provider           bool
+	LoadWeight         uint8
+	AuthenticationType string
+	Version            string
+}
+
+func genCapacityDescriptor(require *require.Assertions) *MixDescriptor {
+	d := &MixDescriptor{
+		Name:     "provider.example.net",
+		Epoch:    debugTestEpoch,
+		Provider: true,
+		Version:  DescriptorVersion,
+		Addresses: map[Transport][]string{
+			TransportTCPv4: []string{"192.0.2.1:4242"},
+		},
+		MixKeys: make(map[uint64][]byte),
+	}
+	identityPub, _, err := cert.Scheme.GenerateKey()
+	require.NoError(err)
+	d.IdentityKey, err = identityPub.MarshalBinary()
+	require.NoError(err)
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err)
+	d.LinkKey = linkKey.Public().Bytes()
+	for e := uint64(debugTestEpoch); e < debugTestEpoch+3; e++ {
+		mixKey, err := ecdh.NewKeypair(rand.Reader)
+		require.NoError(err)
+		d.MixKeys[e] = mixKey.Public().Bytes()
+	}
+	return d
+}
+
+func TestCoarsePacketRate(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	require.Equal(uint64(0), CoarsePacketRate(0))
+	require.Equal(uint64(1), CoarsePacketRate(1))
+	require.Equal(uint64(512), CoarsePacketRate(1000))
+	require.Equal(uint64(1024), CoarsePacketRate(1024))
+	require.Equal(uint64(MaxAdvertisedPacketRate), CoarsePacketRate(1<<40))
+}
+
+func TestUtilizationFor(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	require.Equal(UtilizationUnknown, UtilizationFor(10, 0))
+	require.Equal(UtilizationLow, UtilizationFor(0, 100))
+	require.Equal(UtilizationLow, UtilizationFor(49, 100))
+	require.Equal(UtilizationHigh, UtilizationFor(50, 100))
+	require.Equal(UtilizationSaturated, UtilizationFor(100, 100))
+	require.Equal(UtilizationSaturated, UtilizationFor(1000, 100))
+}
+
+func TestDescriptorCapacityValidation(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	d := genCapacityDescriptor(require)
+	require.NoError(IsDescriptorWellFormed(d, debugTestEpoch))
+
+	d.MaxPacketRate = 1024
+	d.Utilization = UtilizationSaturated
+	require.NoError(IsDescriptorWellFormed(d, debugTestEpoch))
+	require.True(d.IsSaturated())
+
+	// Implausible hints are capped or stripped, the descriptor remains
+	// usable.
+	d.MaxPacketRate = 1000
+	require.NoError(IsDescriptorWellFormed(d, debugTestEpoch))
+	require.Equal(uint64(512), d.MaxPacketRate)
+	require.Equal(UtilizationSaturated, d.Utilization)
+	d.MaxPacketRate = MaxAdvertisedPacketRate << 1
+	require.NoError(IsDescriptorWellFormed(d, debugTestEpoch))
+	require.Equal(uint64(MaxAdvertisedPacketRate), d.MaxPacketRate)
+
+	d.MaxPacketRate = 1024
+	d.Utilization = UtilizationSaturated + 1
+	require.NoError(IsDescriptorWellFormed(d, debugTestEpoch))
+	require.Equal(uint64(1024), d.MaxPacketRate)
+	require.Equal(UtilizationUnknown, d.Utilization)
+
+	d.MaxPacketRate = 0
+	d.Utilization = UtilizationLow
+	require.NoError(IsDescriptorWellFormed(d, debugTestEpoch))
+	require.Equal(UtilizationUnknown, d.Utilization)
+
+	// Mixes do not advertise capacity.
+	d.Provider = false
+	d.Kaetzchen = nil
+	d.MaxPacketRate = 1024
+	d.Utilization = UtilizationHigh
+	require.NoError(IsDescriptorWellFormed(d, debugTestEpoch))
+	require.Zero(d.MaxPacketRate)
+	require.Equal(UtilizationUnknown, d.Utilization)
+}
+
+func TestDescriptorCapacityCompatibility(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	// Without capacity hints the serialization is unchanged.
+	d := genCapacityDescriptor(require)
+	raw, err := ccbor.Marshal((*mixdescriptor)(d))
+	require.NoError(err)
+	old := descriptorV0{
+		Name:        d.Name,
+		Epoch:       d.Epoch,
+		IdentityKey: d.IdentityKey,
+		LinkKey:     d.LinkKey,
+		MixKeys:     d.MixKeys,
+		Addresses:   d.Addresses,
+		Provider:    d.Provider,
+		Version:     d.Version,
+	}
+	rawOld, err := ccbor.Marshal(&old)
+	require.NoError(err)
+	require.Equal(rawOld, raw)
+
+	// Older nodes ignore the capacity hints.
+	d.MaxPacketRate = 4096
+	d.Utilization = UtilizationHigh
+	raw, err = ccbor.Marshal((*mixdescriptor)(d))
+	require.NoError(err)
+	old = descriptorV0{}
+	require.NoError(cbor.Unmarshal(raw, &old))
+	require.Equal(d.Name, old.Name)
+	require.Equal(d.MixKeys, old.MixKeys)
+
+	// The capacity hints survive a round trip.
+	dd := new(MixDescriptor)
+	require.NoError(cbor.Unmarshal(raw, (*mixdescriptor)(dd)))
+	require.Equal(uint64(4096), dd.MaxPacketRate)
+	require.Equal(UtilizationHigh, dd.Utilization)
+}
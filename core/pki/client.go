@@ -11,6 +11,11 @@ type Client interface {
 	// Get returns the PKI document along with the raw serialized form for the provided epoch.
 	Get(ctx context.Context, epoch uint64) (*Document, []byte, error)
 
+	// GetDocumentForEpoch returns the PKI document for the provided epoch.
+	// ErrDocumentNotPublished is returned if the document was not published
+	// yet, and ErrDocumentExpired if it is no longer retained.
+	GetDocumentForEpoch(ctx context.Context, epoch uint64) (*Document, error)
+
 	// Post posts the node's descriptor to the PKI for the provided epoch.
 	Post(ctx context.Context, epoch uint64, signingPrivateKey sign.PrivateKey, signingPublicKey sign.PublicKey, d *MixDescriptor) error
 
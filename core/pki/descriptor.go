@@ -19,9 +19,11 @@
 package pki
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"strconv"
 
 	"github.com/fxamacker/cbor/v2"
@@ -42,12 +44,17 @@ import (
 
 const (
 	DescriptorVersion = "v0"
+
+	// MaxDescriptorSignatures is the maximum number of signatures
+	// attached to a MixDescriptor.
+	MaxDescriptorSignatures = 4
 )
 
 var (
 	ErrNoSignature       = errors.New("MixDescriptor has no signature")
 	ErrInvalidSignature  = errors.New("MixDescriptor has an invalid signature")
-	ErrTooManySignatures = errors.New("MixDescriptor has more than one signature")
+	ErrTooManySignatures = errors.New("MixDescriptor has too many signatures")
+	ErrUnknownSigner     = errors.New("MixDescriptor has a signature by an unknown key")
 )
 
 // MixDescriptor is a description of a given Mix or Provider (node).
@@ -61,8 +68,10 @@ type MixDescriptor struct {
 	// IdentityKey is the node's identity (signing) key.
 	IdentityKey []byte
 
-	// Signature is the raw cert.Signature over the serialized MixDescriptor
-	Signature *cert.Signature `cbor:"-"`
+	// Signatures are the raw cert.Signatures over the serialized
+	// MixDescriptor, sorted by signer. One of them is by the IdentityKey,
+	// the others are by additional keys such as an operator key.
+	Signatures []*cert.Signature `cbor:"-"`
 
 	// LinkKey is the node's wire protocol public key.
 	LinkKey []byte
@@ -84,6 +93,14 @@ type MixDescriptor struct {
 	// LoadWeight is the node's load balancing weight (unused).
 	LoadWeight uint8
 
+	// MaxPacketRate is the self-reported number of packets per second a
+	// Provider can handle, rounded down to a power of two, or 0 if not
+	// advertised. See capacity.go for the privacy considerations.
+	MaxPacketRate uint64 `cbor:",omitempty"`
+
+	// Utilization is the self-reported coarse utilization of a Provider.
+	Utilization UtilizationBand `cbor:",omitempty"`
+
 	// AuthenticationType is the authentication mechanism required
 	AuthenticationType string
 
@@ -133,12 +150,10 @@ func (d *MixDescriptor) UnmarshalBinary(data []byte) error {
 	if err != nil {
 		return err
 	}
-	switch len(sigs) {
-	case 0:
+	switch {
+	case len(sigs) == 0:
 		return ErrNoSignature
-	case 1:
-		// must have only 1 signature
-	default:
+	case len(sigs) > MaxDescriptorSignatures:
 		return ErrTooManySignatures
 	}
 
@@ -147,10 +162,84 @@ func (d *MixDescriptor) UnmarshalBinary(data []byte) error {
 	if err != nil {
 		return err
 	}
-	d.Signature = &sigs[0]
+	idPubKey, err := cert.Scheme.UnmarshalBinaryPublicKey(d.IdentityKey)
+	if err != nil {
+		return err
+	}
+	if _, err = cert.Verify(idPubKey, data); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	d.Signatures = make([]*cert.Signature, 0, len(sigs))
+	for i := range sigs {
+		d.Signatures = append(d.Signatures, &sigs[i])
+	}
+	sortSignatures(d.Signatures)
+	return nil
+}
+
+// Signature returns the signature by the IdentityKey or nil.
+func (d *MixDescriptor) Signature() *cert.Signature {
+	id := hash.Sum256(d.IdentityKey)
+	for _, sig := range d.Signatures {
+		if sig.PublicKeySum256 == id {
+			return sig
+		}
+	}
+	return nil
+}
+
+// Verify returns nil if the descriptor is signed by its IdentityKey.
+func (d *MixDescriptor) Verify() error {
+	if d.Signature() == nil {
+		return ErrNoSignature
+	}
+	idPubKey, err := cert.Scheme.UnmarshalBinaryPublicKey(d.IdentityKey)
+	if err != nil {
+		return err
+	}
+	raw, err := d.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if _, err = cert.Verify(idPubKey, raw); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	return nil
+}
+
+// VerifyAll returns nil if every signature attached to the descriptor
+// is by one of the verifiers and is valid. The IdentityKey has to be
+// among the verifiers if it is to be accepted.
+func (d *MixDescriptor) VerifyAll(verifiers []sign.PublicKey) error {
+	if len(d.Signatures) == 0 {
+		return ErrNoSignature
+	}
+	raw, err := d.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	byHash := make(map[[hash.HashSize]byte]sign.PublicKey)
+	for _, v := range verifiers {
+		byHash[hash.Sum256From(v)] = v
+	}
+	for _, sig := range d.Signatures {
+		verifier, ok := byHash[sig.PublicKeySum256]
+		if !ok {
+			return fmt.Errorf("%w: %x", ErrUnknownSigner, sig.PublicKeySum256)
+		}
+		if _, err = cert.Verify(verifier, raw); err != nil {
+			return fmt.Errorf("%w: %x: %v", ErrInvalidSignature, sig.PublicKeySum256, err)
+		}
+	}
 	return nil
 }
 
+func sortSignatures(sigs []*cert.Signature) {
+	sort.Slice(sigs, func(i, j int) bool {
+		return bytes.Compare(sigs[i].PublicKeySum256[:], sigs[j].PublicKeySum256[:]) < 0
+	})
+}
+
 // MarshalBinary implmements encoding.BinaryMarshaler
 func (d *MixDescriptor) MarshalBinary() ([]byte, error) {
 	// reconstruct a serialized certificate from the detached Signature
@@ -159,10 +248,10 @@ func (d *MixDescriptor) MarshalBinary() ([]byte, error) {
 		return nil, err
 	}
 
-	// If the descriptor was signed, add the Signature
+	// If the descriptor was signed, add the Signatures
 	signatures := make(map[[32]byte]cert.Signature)
-	if d.Signature != nil {
-		signatures[hash.Sum256(d.IdentityKey)] = *d.Signature
+	for _, sig := range d.Signatures {
+		signatures[sig.PublicKeySum256] = *sig
 	}
 	certified := cert.Certificate{
 		Version:    cert.CertVersion,
@@ -194,32 +283,52 @@ func SignDescriptor(signer sign.PrivateKey, verifier sign.PublicKey, desc *MixDe
 		return nil, err
 	}
 
-	// Update Signature field of desc
+	// Update Signatures field of desc
 	idPublic := hash.Sum256From(verifier)
 	sig, err := cert.GetSignature(idPublic[:], signed)
 	if err != nil {
 		return nil, err
 	}
-	desc.Signature = sig
+	desc.Signatures = []*cert.Signature{sig}
 	return signed, nil
 }
 
-// VerifyDescriptor parses a self-signed MixDescriptor and returns an instance
-// of MixDescriptor or error
-func VerifyDescriptor(rawDesc []byte) (*MixDescriptor, error) {
-	// make a MixDescriptor and initialize throwaway concrete instances so
-	// that rawDesc will deserialize into the right type
-	d := new(MixDescriptor)
-	idPubKey, _, err := cert.Scheme.GenerateKey()
+// CoSignDescriptor adds a signature by an additional key, such as an
+// operator key, to the descriptor signed with SignDescriptor and returns
+// the serialized descriptor.
+func CoSignDescriptor(signer sign.PrivateKey, verifier sign.PublicKey, desc *MixDescriptor) ([]byte, error) {
+	if len(desc.Signatures) == 0 {
+		return nil, ErrNoSignature
+	}
+	rawDesc, err := desc.MarshalBinary()
 	if err != nil {
 		return nil, err
 	}
-	d.IdentityKey, err = idPubKey.MarshalBinary()
+	signed, err := cert.SignMulti(signer, verifier, rawDesc)
 	if err != nil {
 		return nil, err
 	}
-	d.LinkKey = []byte{}
-	err = d.UnmarshalBinary(rawDesc)
+	sigs, err := cert.GetSignatures(signed)
+	if err != nil {
+		return nil, err
+	}
+	if len(sigs) > MaxDescriptorSignatures {
+		return nil, ErrTooManySignatures
+	}
+	desc.Signatures = make([]*cert.Signature, 0, len(sigs))
+	for i := range sigs {
+		desc.Signatures = append(desc.Signatures, &sigs[i])
+	}
+	sortSignatures(desc.Signatures)
+	return signed, nil
+}
+
+// VerifyDescriptor parses a self-signed MixDescriptor and returns an instance
+// of MixDescriptor or error. ErrInvalidSignature is returned if the
+// descriptor is not signed by its own IdentityKey.
+func VerifyDescriptor(rawDesc []byte) (*MixDescriptor, error) {
+	d := new(MixDescriptor)
+	err := d.UnmarshalBinary(rawDesc)
 	if err != nil {
 		return nil, err
 	}
@@ -242,7 +351,8 @@ func GetVerifierFromDescriptor(rawDesc []byte) (sign.PublicKey, error) {
 
 // IsDescriptorWellFormed validates the descriptor and returns a descriptive
 // error iff there are any problems that would make it unusable as part of
-// a PKI Document.
+// a PKI Document. Implausible capacity hints are stripped from the
+// descriptor rather than rejected.
 func IsDescriptorWellFormed(d *MixDescriptor, epoch uint64) error {
 	if d.Name == "" {
 		return fmt.Errorf("Descriptor missing Name")
@@ -327,6 +437,7 @@ func IsDescriptorWellFormed(d *MixDescriptor, epoch uint64) error {
 	if len(d.Addresses[TransportTCPv4]) == 0 {
 		return fmt.Errorf("Descriptor contains no TCPv4 addresses")
 	}
+	sanitizeCapacity(d)
 	if !d.Provider {
 		if d.Kaetzchen != nil {
 			return fmt.Errorf("Descriptor contains Kaetzchen when a mix")
@@ -19,11 +19,15 @@ package pki
 import (
 	"testing"
 
+	"github.com/fxamacker/cbor/v2"
+
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"github.com/katzenpost/hpqc/hash"
 	ecdh "github.com/katzenpost/hpqc/nike/x25519"
 	"github.com/katzenpost/hpqc/rand"
+	"github.com/katzenpost/hpqc/sign"
 
 	"github.com/katzenpost/katzenpost/core/cert"
 	"github.com/katzenpost/katzenpost/core/wire"
@@ -107,3 +111,190 @@ func TestDescriptor(t *testing.T) {
 		require.Equal(v, vv, "MixKeys[%v]", k)
 	}
 }
+
+func TestDescriptorSignature(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	identityPub, identityPriv, err := cert.Scheme.GenerateKey()
+	require.NoError(err)
+	otherPub, otherPriv, err := cert.Scheme.GenerateKey()
+	require.NoError(err)
+
+	newDescriptor := func() *MixDescriptor {
+		d := &MixDescriptor{
+			Name:    "nitrogen.example.net",
+			Epoch:   debugTestEpoch,
+			Version: DescriptorVersion,
+			Addresses: map[Transport][]string{
+				TransportTCPv4: []string{"192.0.2.1:4242"},
+			},
+			LinkKey: []byte{},
+		}
+		d.IdentityKey, err = identityPub.MarshalBinary()
+		require.NoError(err)
+		return d
+	}
+
+	vectors := []struct {
+		name string
+		raw  func() []byte
+		err  error
+	}{
+		{
+			name: "valid",
+			raw: func() []byte {
+				signed, err := SignDescriptor(identityPriv, identityPub, newDescriptor())
+				require.NoError(err)
+				return signed
+			},
+		},
+		{
+			name: "tampered certified",
+			raw: func() []byte {
+				signed, err := SignDescriptor(identityPriv, identityPub, newDescriptor())
+				require.NoError(err)
+				c := new(cert.Certificate)
+				require.NoError(cbor.Unmarshal(signed, c))
+				d := new(mixdescriptor)
+				require.NoError(cbor.Unmarshal(c.Certified, d))
+				d.Name = "oxygen.example.net"
+				c.Certified, err = cbor.Marshal(d)
+				require.NoError(err)
+				tampered, err := c.Marshal()
+				require.NoError(err)
+				return tampered
+			},
+			err: ErrInvalidSignature,
+		},
+		{
+			name: "wrong key",
+			raw: func() []byte {
+				signed, err := SignDescriptor(otherPriv, otherPub, newDescriptor())
+				require.NoError(err)
+				return signed
+			},
+			err: ErrInvalidSignature,
+		},
+		{
+			name: "unsigned",
+			raw: func() []byte {
+				unsigned, err := newDescriptor().MarshalBinary()
+				require.NoError(err)
+				return unsigned
+			},
+			err: ErrNoSignature,
+		},
+		{
+			name: "co-signed",
+			raw: func() []byte {
+				d := newDescriptor()
+				_, err := SignDescriptor(identityPriv, identityPub, d)
+				require.NoError(err)
+				signed, err := CoSignDescriptor(otherPriv, otherPub, d)
+				require.NoError(err)
+				return signed
+			},
+		},
+		{
+			name: "too many signatures",
+			raw: func() []byte {
+				signed, err := SignDescriptor(identityPriv, identityPub, newDescriptor())
+				require.NoError(err)
+				for i := 0; i < MaxDescriptorSignatures; i++ {
+					pub, priv, err := cert.Scheme.GenerateKey()
+					require.NoError(err)
+					signed, err = cert.SignMulti(priv, pub, signed)
+					require.NoError(err)
+				}
+				return signed
+			},
+			err: ErrTooManySignatures,
+		},
+	}
+
+	for _, v := range vectors {
+		raw := v.raw()
+
+		d := new(MixDescriptor)
+		err := d.UnmarshalBinary(raw)
+		require.ErrorIs(err, v.err, v.name)
+
+		dd, err := VerifyDescriptor(raw)
+		require.ErrorIs(err, v.err, v.name)
+		if v.err == nil {
+			require.Equal("nitrogen.example.net", dd.Name, v.name)
+			require.NotNil(dd.Signature(), v.name)
+		} else {
+			require.Nil(dd, v.name)
+		}
+	}
+}
+
+func TestDescriptorCoSign(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	identityPub, identityPriv, err := cert.Scheme.GenerateKey()
+	require.NoError(err)
+	operatorPub, operatorPriv, err := cert.Scheme.GenerateKey()
+	require.NoError(err)
+
+	d := &MixDescriptor{
+		Name:    "oxygen.example.net",
+		Epoch:   debugTestEpoch,
+		Version: DescriptorVersion,
+		LinkKey: []byte{},
+	}
+	d.IdentityKey, err = identityPub.MarshalBinary()
+	require.NoError(err)
+
+	_, err = CoSignDescriptor(operatorPriv, operatorPub, d)
+	require.ErrorIs(err, ErrNoSignature)
+
+	// A single signer.
+	signed, err := SignDescriptor(identityPriv, identityPub, d)
+	require.NoError(err)
+	dd := new(MixDescriptor)
+	require.NoError(dd.UnmarshalBinary(signed))
+	require.Len(dd.Signatures, 1)
+	require.Equal(hash.Sum256From(identityPub), dd.Signature().PublicKeySum256)
+	require.NoError(dd.Verify())
+	require.NoError(dd.VerifyAll([]sign.PublicKey{identityPub}))
+	require.NoError(dd.VerifyAll([]sign.PublicKey{identityPub, operatorPub}))
+	require.ErrorIs(dd.VerifyAll([]sign.PublicKey{operatorPub}), ErrUnknownSigner)
+
+	// Two signers.
+	signed, err = CoSignDescriptor(operatorPriv, operatorPub, d)
+	require.NoError(err)
+	require.Len(d.Signatures, 2)
+	dd = new(MixDescriptor)
+	require.NoError(dd.UnmarshalBinary(signed))
+	require.Equal(d.Signatures, dd.Signatures)
+	require.Equal(d.Signature(), dd.Signature())
+	require.NoError(dd.Verify())
+	require.NoError(dd.VerifyAll([]sign.PublicKey{identityPub, operatorPub}))
+	require.ErrorIs(dd.VerifyAll([]sign.PublicKey{identityPub}), ErrUnknownSigner)
+
+	// The round trip preserves all of the signatures.
+	raw, err := dd.MarshalBinary()
+	require.NoError(err)
+	require.Equal(signed, raw)
+
+	// Only the identity key signature is required to be valid upon
+	// deserialization, the others are checked by VerifyAll.
+	for _, sig := range dd.Signatures {
+		if sig != dd.Signature() {
+			sig.Payload = make([]byte, len(sig.Payload))
+		}
+	}
+	raw, err = dd.MarshalBinary()
+	require.NoError(err)
+	ddd := new(MixDescriptor)
+	require.NoError(ddd.UnmarshalBinary(raw))
+	require.NoError(ddd.Verify())
+	require.ErrorIs(ddd.VerifyAll([]sign.PublicKey{identityPub, operatorPub}), ErrInvalidSignature)
+
+	ddd.Signature().Payload = make([]byte, len(ddd.Signature().Payload))
+	require.ErrorIs(ddd.Verify(), ErrInvalidSignature)
+}
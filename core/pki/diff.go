@@ -0,0 +1,331 @@
+// diff.go - Document and MixDescriptor differences.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"github.com/katzenpost/hpqc/hash"
+)
+
+// FieldChange is the change of a single field.
+type FieldChange struct {
+	// Field is the name of the field, with the map key in brackets for
+	// the entries of a map.
+	Field string
+
+	// Old is the old value, or empty if the field was added.
+	Old string
+
+	// New is the new value, or empty if the field was removed.
+	New string
+}
+
+// String returns a human readable FieldChange.
+func (c *FieldChange) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.Field, orNone(c.Old), orNone(c.New))
+}
+
+// NodeDiff describes a node which was added to, removed from or modified
+// between two Documents.
+type NodeDiff struct {
+	// IdentityHash is the hash of the node's IdentityKey.
+	IdentityHash [hash.HashSize]byte
+
+	// Name is the node's Name.
+	Name string
+
+	// Layer is the node's topology layer, or LayerProvider.
+	Layer uint8
+
+	// Changes are the changed descriptor fields of a modified node.
+	Changes []FieldChange `cbor:",omitempty"`
+}
+
+// String returns a human readable NodeDiff.
+func (n *NodeDiff) String() string {
+	layer := fmt.Sprintf("layer %d", n.Layer)
+	if n.Layer == LayerProvider {
+		layer = "provider"
+	}
+	return fmt.Sprintf("%s (%x) %s", n.Name, n.IdentityHash[:8], layer)
+}
+
+// DocumentDiff describes the changes between two Documents.
+type DocumentDiff struct {
+	// OldEpoch is the Epoch of the old Document.
+	OldEpoch uint64
+
+	// NewEpoch is the Epoch of the new Document.
+	NewEpoch uint64
+
+	// Parameters are the changed network parameters.
+	Parameters []FieldChange
+
+	// Added are the nodes only present in the new Document.
+	Added []NodeDiff
+
+	// Removed are the nodes only present in the old Document.
+	Removed []NodeDiff
+
+	// Modified are the nodes whose descriptor or layer changed.
+	Modified []NodeDiff
+}
+
+// IsEmpty returns true if the Documents do not differ other than by Epoch.
+func (d *DocumentDiff) IsEmpty() bool {
+	return len(d.Parameters) == 0 && len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0
+}
+
+// String returns a human readable DocumentDiff.
+func (d *DocumentDiff) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Epoch %d -> %d\n", d.OldEpoch, d.NewEpoch)
+	if len(d.Parameters) > 0 {
+		b.WriteString("Parameters:\n")
+		for _, c := range d.Parameters {
+			fmt.Fprintf(&b, "  %s\n", c.String())
+		}
+	}
+	for _, n := range d.Added {
+		fmt.Fprintf(&b, "+ %s\n", n.String())
+	}
+	for _, n := range d.Removed {
+		fmt.Fprintf(&b, "- %s\n", n.String())
+	}
+	for _, n := range d.Modified {
+		fmt.Fprintf(&b, "~ %s\n", n.String())
+		for _, c := range n.Changes {
+			fmt.Fprintf(&b, "    %s\n", c.String())
+		}
+	}
+	return b.String()
+}
+
+type documentDiff DocumentDiff
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+func (d *DocumentDiff) MarshalBinary() ([]byte, error) {
+	return ccbor.Marshal((*documentDiff)(d))
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler.
+func (d *DocumentDiff) UnmarshalBinary(data []byte) error {
+	return cbor.Unmarshal(data, (*documentDiff)(d))
+}
+
+// DiffDocuments returns the changes from the old to the new Document.
+// The Documents are not modified.
+func DiffDocuments(old, cur *Document) *DocumentDiff {
+	d := &DocumentDiff{
+		OldEpoch:   old.Epoch,
+		NewEpoch:   cur.Epoch,
+		Parameters: diffParameters(old, cur),
+	}
+
+	oldNodes, newNodes := documentNodes(old), documentNodes(cur)
+	for id, n := range newNodes {
+		o, ok := oldNodes[id]
+		if !ok {
+			d.Added = append(d.Added, n.diff(id, nil))
+			continue
+		}
+		changes := DiffDescriptors(o.desc, n.desc)
+		if o.layer != n.layer {
+			changes = append([]FieldChange{{
+				Field: "Layer",
+				Old:   layerString(o.layer),
+				New:   layerString(n.layer),
+			}}, changes...)
+		}
+		if len(changes) > 0 {
+			d.Modified = append(d.Modified, n.diff(id, changes))
+		}
+	}
+	for id, o := range oldNodes {
+		if _, ok := newNodes[id]; !ok {
+			d.Removed = append(d.Removed, o.diff(id, nil))
+		}
+	}
+	sortNodeDiffs(d.Added)
+	sortNodeDiffs(d.Removed)
+	sortNodeDiffs(d.Modified)
+	return d
+}
+
+// DiffDescriptors returns the changes from the old to the new
+// descriptor of a node, ignoring the Epoch and Signatures which change
+// whenever a descriptor is published. The descriptors are not modified.
+func DiffDescriptors(old, cur *MixDescriptor) []FieldChange {
+	var changes []FieldChange
+	changed := func(field, o, n string) {
+		if o != n {
+			changes = append(changes, FieldChange{Field: field, Old: o, New: n})
+		}
+	}
+	changedBytes := func(field string, o, n []byte) {
+		if !bytes.Equal(o, n) {
+			changes = append(changes, FieldChange{Field: field, Old: shortHex(o), New: shortHex(n)})
+		}
+	}
+
+	changed("Name", old.Name, cur.Name)
+	changedBytes("LinkKey", old.LinkKey, cur.LinkKey)
+
+	for _, t := range unionKeys(old.Addresses, cur.Addresses) {
+		changed(fmt.Sprintf("Addresses[%s]", t), sortedList(old.Addresses[t]), sortedList(cur.Addresses[t]))
+	}
+
+	for _, e := range unionKeys(old.MixKeys, cur.MixKeys) {
+		changedBytes(fmt.Sprintf("MixKeys[%d]", e), old.MixKeys[e], cur.MixKeys[e])
+	}
+
+	for _, capa := range unionKeys(old.Kaetzchen, cur.Kaetzchen) {
+		changed(fmt.Sprintf("Kaetzchen[%s]", capa), paramsString(old.Kaetzchen[capa]), paramsString(cur.Kaetzchen[capa]))
+	}
+
+	changed("Provider", fmt.Sprint(old.Provider), fmt.Sprint(cur.Provider))
+	changed("LoadWeight", fmt.Sprint(old.LoadWeight), fmt.Sprint(cur.LoadWeight))
+	changed("MaxPacketRate", fmt.Sprint(old.MaxPacketRate), fmt.Sprint(cur.MaxPacketRate))
+	changed("Utilization", old.Utilization.String(), cur.Utilization.String())
+	changed("AuthenticationType", old.AuthenticationType, cur.AuthenticationType)
+	changed("Version", old.Version, cur.Version)
+	return changes
+}
+
+func diffParameters(old, cur *Document) []FieldChange {
+	var changes []FieldChange
+	changed := func(field string, o, n interface{}) {
+		os, ns := fmt.Sprint(o), fmt.Sprint(n)
+		if os != ns {
+			changes = append(changes, FieldChange{Field: field, Old: os, New: ns})
+		}
+	}
+
+	changed("SendRatePerMinute", old.SendRatePerMinute, cur.SendRatePerMinute)
+	changed("Mu", old.Mu, cur.Mu)
+	changed("MuMaxDelay", old.MuMaxDelay, cur.MuMaxDelay)
+	changed("LambdaP", old.LambdaP, cur.LambdaP)
+	changed("LambdaPMaxDelay", old.LambdaPMaxDelay, cur.LambdaPMaxDelay)
+	changed("LambdaL", old.LambdaL, cur.LambdaL)
+	changed("LambdaLMaxDelay", old.LambdaLMaxDelay, cur.LambdaLMaxDelay)
+	changed("LambdaD", old.LambdaD, cur.LambdaD)
+	changed("LambdaDMaxDelay", old.LambdaDMaxDelay, cur.LambdaDMaxDelay)
+	changed("LambdaM", old.LambdaM, cur.LambdaM)
+	changed("LambdaMMaxDelay", old.LambdaMMaxDelay, cur.LambdaMMaxDelay)
+	if !bytes.Equal(old.SphinxGeometryHash, cur.SphinxGeometryHash) {
+		changes = append(changes, FieldChange{
+			Field: "SphinxGeometryHash",
+			Old:   shortHex(old.SphinxGeometryHash),
+			New:   shortHex(cur.SphinxGeometryHash),
+		})
+	}
+	changed("Version", old.Version, cur.Version)
+	return changes
+}
+
+type documentNode struct {
+	desc  *MixDescriptor
+	layer uint8
+}
+
+func (n *documentNode) diff(id [hash.HashSize]byte, changes []FieldChange) NodeDiff {
+	return NodeDiff{
+		IdentityHash: id,
+		Name:         n.desc.Name,
+		Layer:        n.layer,
+		Changes:      changes,
+	}
+}
+
+func documentNodes(doc *Document) map[[hash.HashSize]byte]*documentNode {
+	nodes := make(map[[hash.HashSize]byte]*documentNode)
+	for layer, descs := range doc.Topology {
+		for _, desc := range descs {
+			nodes[hash.Sum256(desc.IdentityKey)] = &documentNode{desc: desc, layer: uint8(layer)}
+		}
+	}
+	for _, desc := range doc.Providers {
+		nodes[hash.Sum256(desc.IdentityKey)] = &documentNode{desc: desc, layer: LayerProvider}
+	}
+	return nodes
+}
+
+func sortNodeDiffs(nodes []NodeDiff) {
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Name != nodes[j].Name {
+			return nodes[i].Name < nodes[j].Name
+		}
+		return bytes.Compare(nodes[i].IdentityHash[:], nodes[j].IdentityHash[:]) < 0
+	})
+}
+
+func unionKeys[K Transport | uint64 | string, V any](a, b map[K]V) []K {
+	keys := make([]K, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+func sortedList(l []string) string {
+	if len(l) == 0 {
+		return ""
+	}
+	s := append([]string{}, l...)
+	sort.Strings(s)
+	return "[" + strings.Join(s, " ") + "]"
+}
+
+// paramsString relies upon fmt printing maps sorted by key.
+func paramsString(params map[string]interface{}) string {
+	if params == nil {
+		return ""
+	}
+	return fmt.Sprintf("%v", params)
+}
+
+func shortHex(b []byte) string {
+	if len(b) > 8 {
+		return fmt.Sprintf("%x...", b[:8])
+	}
+	return fmt.Sprintf("%x", b)
+}
+
+func layerString(layer uint8) string {
+	if layer == LayerProvider {
+		return "provider"
+	}
+	return fmt.Sprint(layer)
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
@@ -0,0 +1,225 @@
+// diff_test.go - Document and MixDescriptor difference tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/hpqc/hash"
+)
+
+func genDiffDescriptor(name string, provider bool) *MixDescriptor {
+	d := &MixDescriptor{
+		Name:        name,
+		Epoch:       debugTestEpoch,
+		IdentityKey: []byte("identity " + name),
+		LinkKey:     []byte("link " + name),
+		Provider:    provider,
+		Addresses: map[Transport][]string{
+			TransportTCPv4: []string{"192.0.2.1:4242", "192.0.2.2:4242"},
+		},
+		MixKeys: map[uint64][]byte{
+			debugTestEpoch:     []byte(fmt.Sprintf("mix key %s 0", name)),
+			debugTestEpoch + 1: []byte(fmt.Sprintf("mix key %s 1", name)),
+		},
+		Version: DescriptorVersion,
+	}
+	if provider {
+		d.Kaetzchen = map[string]map[string]interface{}{
+			"echo":  {"endpoint": "+echo"},
+			"spool": {"endpoint": "+spool"},
+		}
+	}
+	return d
+}
+
+// cloneDescriptor returns a deep copy of the descriptor fields compared
+// by DiffDescriptors.
+func cloneDescriptor(d *MixDescriptor) *MixDescriptor {
+	c := *d
+	c.Addresses = make(map[Transport][]string)
+	for t, a := range d.Addresses {
+		c.Addresses[t] = append([]string{}, a...)
+	}
+	c.MixKeys = make(map[uint64][]byte)
+	for e, k := range d.MixKeys {
+		c.MixKeys[e] = append([]byte{}, k...)
+	}
+	if d.Kaetzchen != nil {
+		c.Kaetzchen = make(map[string]map[string]interface{})
+		for capa, params := range d.Kaetzchen {
+			c.Kaetzchen[capa] = make(map[string]interface{})
+			for k, v := range params {
+				c.Kaetzchen[capa][k] = v
+			}
+		}
+	}
+	return &c
+}
+
+func genDiffDocument() *Document {
+	return &Document{
+		Epoch:             debugTestEpoch,
+		SendRatePerMinute: 100,
+		Mu:                0.001,
+		MuMaxDelay:        9000,
+		LambdaP:           0.002,
+		LambdaPMaxDelay:   1000,
+		Topology: [][]*MixDescriptor{
+			{genDiffDescriptor("mix1", false), genDiffDescriptor("mix2", false)},
+			{genDiffDescriptor("mix3", false)},
+		},
+		Providers: []*MixDescriptor{
+			genDiffDescriptor("provider1", true),
+		},
+		Version: DocumentVersion,
+	}
+}
+
+func cloneDocument(d *Document) *Document {
+	c := *d
+	c.Topology = make([][]*MixDescriptor, len(d.Topology))
+	for l, descs := range d.Topology {
+		for _, desc := range descs {
+			c.Topology[l] = append(c.Topology[l], cloneDescriptor(desc))
+		}
+	}
+	c.Providers = nil
+	for _, desc := range d.Providers {
+		c.Providers = append(c.Providers, cloneDescriptor(desc))
+	}
+	return &c
+}
+
+func TestDiffDocumentsUnchanged(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	old := genDiffDocument()
+	cur := cloneDocument(old)
+	cur.Epoch++
+
+	// Map and address ordering is irrelevant, as are the descriptor
+	// epoch and signatures.
+	mix1 := cur.Topology[0][0]
+	mix1.Addresses[TransportTCPv4] = []string{"192.0.2.2:4242", "192.0.2.1:4242"}
+	mix1.Epoch++
+
+	diff := DiffDocuments(old, cur)
+	require.True(diff.IsEmpty())
+	require.Equal(uint64(debugTestEpoch), diff.OldEpoch)
+	require.Equal(uint64(debugTestEpoch+1), diff.NewEpoch)
+	require.Equal(fmt.Sprintf("Epoch %d -> %d\n", debugTestEpoch, debugTestEpoch+1), diff.String())
+}
+
+func TestDiffDocuments(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	old := genDiffDocument()
+	cur := cloneDocument(old)
+
+	// Parameters.
+	cur.LambdaP = 0.004
+	cur.MuMaxDelay = 10000
+
+	// A mix is removed, another is added and one moves layer.
+	mix2 := old.Topology[0][1]
+	mix3 := cur.Topology[1][0]
+	mix4 := genDiffDescriptor("mix4", false)
+	cur.Topology = [][]*MixDescriptor{
+		{cur.Topology[0][0], mix3},
+		{mix4},
+	}
+
+	// Field level changes.
+	mix1 := cur.Topology[0][0]
+	mix1.Addresses[TransportTCPv4] = []string{"192.0.2.3:4242"}
+	mix1.Addresses[TransportTCPv6] = []string{"[2001:db8::1]:4242"}
+	delete(mix1.MixKeys, debugTestEpoch)
+	mix1.MixKeys[debugTestEpoch+2] = []byte("mix key mix1 2")
+	mix1.LoadWeight = 3
+
+	provider1 := cur.Providers[0]
+	delete(provider1.Kaetzchen, "spool")
+	provider1.Kaetzchen["echo"]["miau"] = 23
+	provider1.Kaetzchen["keyserver"] = map[string]interface{}{"endpoint": "+keys"}
+
+	oldCopy, curCopy := cloneDocument(old), cloneDocument(cur)
+
+	diff := DiffDocuments(old, cur)
+	require.False(diff.IsEmpty())
+
+	require.Equal([]FieldChange{
+		{Field: "MuMaxDelay", Old: "9000", New: "10000"},
+		{Field: "LambdaP", Old: "0.002", New: "0.004"},
+	}, diff.Parameters)
+
+	require.Equal([]NodeDiff{{IdentityHash: hash.Sum256(mix4.IdentityKey), Name: "mix4", Layer: 1}}, diff.Added)
+	require.Equal([]NodeDiff{{IdentityHash: hash.Sum256(mix2.IdentityKey), Name: "mix2", Layer: 0}}, diff.Removed)
+
+	require.Len(diff.Modified, 3)
+	require.Equal("mix1", diff.Modified[0].Name)
+	require.Equal(hash.Sum256(mix1.IdentityKey), diff.Modified[0].IdentityHash)
+	require.Equal([]FieldChange{
+		{Field: "Addresses[tcp4]", Old: "[192.0.2.1:4242 192.0.2.2:4242]", New: "[192.0.2.3:4242]"},
+		{Field: "Addresses[tcp6]", Old: "", New: "[[2001:db8::1]:4242]"},
+		{Field: fmt.Sprintf("MixKeys[%d]", debugTestEpoch), Old: shortHex(old.Topology[0][0].MixKeys[debugTestEpoch]), New: ""},
+		{Field: fmt.Sprintf("MixKeys[%d]", debugTestEpoch+2), Old: "", New: shortHex([]byte("mix key mix1 2"))},
+		{Field: "LoadWeight", Old: "0", New: "3"},
+	}, diff.Modified[0].Changes)
+
+	require.Equal("mix3", diff.Modified[1].Name)
+	require.Equal(uint8(0), diff.Modified[1].Layer)
+	require.Equal([]FieldChange{{Field: "Layer", Old: "1", New: "0"}}, diff.Modified[1].Changes)
+
+	require.Equal("provider1", diff.Modified[2].Name)
+	require.Equal(uint8(LayerProvider), diff.Modified[2].Layer)
+	require.Equal([]FieldChange{
+		{Field: "Kaetzchen[echo]", Old: "map[endpoint:+echo]", New: "map[endpoint:+echo miau:23]"},
+		{Field: "Kaetzchen[keyserver]", Old: "", New: "map[endpoint:+keys]"},
+		{Field: "Kaetzchen[spool]", Old: "map[endpoint:+spool]", New: ""},
+	}, diff.Modified[2].Changes)
+
+	s := diff.String()
+	require.Contains(s, "Parameters:\n  MuMaxDelay: 9000 -> 10000\n  LambdaP: 0.002 -> 0.004\n")
+	require.Contains(s, fmt.Sprintf("+ mix4 (%x) layer 1\n", diff.Added[0].IdentityHash[:8]))
+	require.Contains(s, fmt.Sprintf("- mix2 (%x) layer 0\n", diff.Removed[0].IdentityHash[:8]))
+	require.Contains(s, "    Layer: 1 -> 0\n")
+	require.Contains(s, "    Addresses[tcp6]: <none> -> [[2001:db8::1]:4242]\n")
+	require.Contains(s, fmt.Sprintf("~ provider1 (%x) provider\n", diff.Modified[2].IdentityHash[:8]))
+
+	// The diff survives a round trip.
+	blob, err := diff.MarshalBinary()
+	require.NoError(err)
+	decoded := new(DocumentDiff)
+	require.NoError(decoded.UnmarshalBinary(blob))
+	require.Equal(diff, decoded)
+
+	// The reverse diff swaps additions and removals.
+	reverse := DiffDocuments(cur, old)
+	require.Equal(diff.Added, reverse.Removed)
+	require.Equal(diff.Removed, reverse.Added)
+
+	// The documents are not modified by diffing, and diffing is
+	// repeatable.
+	require.Equal(oldCopy, old)
+	require.Equal(curCopy, cur)
+	require.Equal(diff, DiffDocuments(old, cur))
+}
@@ -50,6 +50,14 @@ var (
 	// for a given epoch.
 	ErrNoDocument = errors.New("pki: requested epoch will never get a document")
 
+	// ErrDocumentNotPublished is the error returned when the document for a
+	// given epoch has not been published yet.
+	ErrDocumentNotPublished = errors.New("pki: document not published yet")
+
+	// ErrDocumentExpired is the error returned when the document for a given
+	// epoch is no longer retained.
+	ErrDocumentExpired = errors.New("pki: document is no longer retained")
+
 	// ErrInvalidPostEpoch is the error returned when the server rejects a
 	// descriptor upload for a given epoch due to time reasons.
 	ErrInvalidPostEpoch = errors.New("pki: post for epoch will never succeeed")
@@ -14,66 +14,20 @@
 // You should have received a copy of the GNU Affero General Public License
 // along with this program.  If not, see <http://www.gnu.org/licenses/>.
 
-package pki
+package pki_test
 
 import (
 	"bytes"
-	"crypto/rand"
-	"encoding/binary"
-	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 
-	ecdh "github.com/katzenpost/hpqc/nike/x25519"
-
 	"github.com/katzenpost/katzenpost/core/cert"
-	"github.com/katzenpost/katzenpost/core/wire"
+	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/pki/pkitest"
 )
 
-func genDescriptor(require *require.Assertions, idx int, provider bool) (*MixDescriptor, []byte) {
-	d := new(MixDescriptor)
-	d.Name = fmt.Sprintf("gen%d.example.net", idx)
-	d.Addresses = map[Transport][]string{
-		TransportTCPv4: []string{fmt.Sprintf("192.0.2.%d:4242", idx)},
-	}
-	d.Provider = provider
-	d.Epoch = debugTestEpoch
-	d.Version = DescriptorVersion
-	d.LoadWeight = 23
-
-	identityPub, identityPriv, err := cert.Scheme.GenerateKey()
-	require.NoError(err)
-
-	d.IdentityKey, err = identityPub.MarshalBinary()
-	require.NoError(err)
-
-	scheme := wire.DefaultScheme
-	linkKey, _, err := scheme.GenerateKeyPair()
-	require.NoError(err)
-	d.LinkKey, err = linkKey.MarshalBinary()
-	require.NoError(err)
-	d.MixKeys = make(map[uint64][]byte)
-	for e := debugTestEpoch; e < debugTestEpoch+3; e++ {
-		mPriv, err := ecdh.NewKeypair(rand.Reader)
-		require.NoError(err, "[%d]: ecdh.NewKeypair()", e)
-		d.MixKeys[uint64(e)] = mPriv.Public().Bytes()
-	}
-	if provider {
-		d.Kaetzchen = make(map[string]map[string]interface{})
-		d.Kaetzchen["miau"] = map[string]interface{}{
-			"endpoint":  "+miau",
-			"miauCount": idx,
-		}
-	}
-	err = IsDescriptorWellFormed(d, debugTestEpoch)
-	require.NoError(err, "IsDescriptorWellFormed(good)")
-
-	signed, err := SignDescriptor(identityPriv, identityPub, d)
-	require.NoError(err, "SignDescriptor()")
-
-	return d, []byte(signed)
-}
+const debugTestEpoch = 0xFFFFFFFF
 
 func TestDocument(t *testing.T) {
 	t.Parallel()
@@ -83,59 +37,21 @@ func TestDocument(t *testing.T) {
 	idPub, k, err := cert.Scheme.GenerateKey()
 	require.NoError(err)
 
-	testSendRate := uint64(3)
-	sharedRandomCommit := make([]byte, SharedRandomLength)
-	binary.BigEndian.PutUint64(sharedRandomCommit[:8], debugTestEpoch)
-
 	// Generate a Document.
-	doc := &Document{
-		Epoch:              debugTestEpoch,
-		GenesisEpoch:       debugTestEpoch,
-		SendRatePerMinute:  testSendRate,
-		Topology:           make([][]*MixDescriptor, 3),
-		Mu:                 0.42,
-		MuMaxDelay:         23,
-		LambdaP:            0.69,
-		LambdaPMaxDelay:    17,
-		SharedRandomCommit: make(map[[PublicKeyHashSize]byte][]byte),
-		SharedRandomReveal: make(map[[PublicKeyHashSize]byte][]byte),
-		SharedRandomValue:  make([]byte, SharedRandomValueLength),
-		Version:            DocumentVersion,
-	}
-	idx := 1
-	for l := 0; l < 3; l++ {
-		for i := 0; i < 5; i++ {
-			provider := false
-			_, rawDesc := genDescriptor(require, idx, provider)
-			d := new(MixDescriptor)
-			err := d.UnmarshalBinary(rawDesc)
-			require.NoError(err)
-			foo, err := d.MarshalBinary()
-			require.NoError(err)
-			require.True(bytes.Equal(foo, rawDesc))
-			doc.Topology[l] = append(doc.Topology[l], d)
-			idx++
-		}
-	}
-	for i := 0; i < 3; i++ {
-		provider := true
-		_, rawDesc := genDescriptor(require, idx, provider)
-		d := new(MixDescriptor)
-		err := d.UnmarshalBinary(rawDesc)
-		require.NoError(err)
-		foo, err := d.MarshalBinary()
-		require.NoError(err)
-		require.True(bytes.Equal(foo, rawDesc))
-		doc.Providers = append(doc.Providers, d)
-		idx++
-	}
+	doc, err := pkitest.NewDocumentBuilder(debugTestEpoch).
+		WithMixLayers(3, 5).
+		WithProviders(3).
+		WithKaetzchen("miau", map[string]interface{}{"miauCount": 1}).
+		Build()
+	require.NoError(err)
+	testSendRate := doc.SendRatePerMinute
 
 	// Serialize and sign.
-	signed, err := SignDocument(k, idPub, doc)
+	signed, err := pki.SignDocument(k, idPub, doc)
 	require.NoError(err, "SignDocument()")
 
 	// Validate and deserialize.
-	ddoc, err := ParseDocument(signed)
+	ddoc, err := pki.ParseDocument(signed)
 	require.NoError(err, "ParseDocument()")
 	require.Equal(doc.Epoch, ddoc.Epoch, "ParseDocument(): Epoch")
 	require.Equal(doc.SendRatePerMinute, testSendRate, "ParseDocument(): SendRatePerMinute")
@@ -160,7 +76,7 @@ func TestDocument(t *testing.T) {
 	// but it seems SPHINCS+ uses randomness?
 	tmpDocBytes := signed
 	for i := 0; i < 4; i++ {
-		tmpDoc, err := ParseDocument(tmpDocBytes)
+		tmpDoc, err := pki.ParseDocument(tmpDocBytes)
 		require.Equal(nil, err)
 		require.Equal(ddoc, tmpDoc)
 		tmpDocBytes, err := tmpDoc.MarshalBinary()
@@ -176,9 +92,9 @@ func TestDocument(t *testing.T) {
 			require.NoError(err)
 			rawDesc, err := node.MarshalBinary()
 			require.NoError(err)
-			_, err = VerifyDescriptor(rawDesc)
+			_, err = pki.VerifyDescriptor(rawDesc)
 			require.NoError(err)
-			_, err = VerifyDescriptor(otherDesc)
+			_, err = pki.VerifyDescriptor(otherDesc)
 			require.NoError(err)
 			require.True(bytes.Equal(otherDesc, rawDesc)) // require the serialization be the same
 		}
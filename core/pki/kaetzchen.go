@@ -0,0 +1,163 @@
+// kaetzchen.go - Strict Kaetzchen parameter validation.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"fmt"
+
+	"github.com/katzenpost/katzenpost/core/sphinx/constants"
+)
+
+// MaxUnknownKaetzchenParamsSize is the maximum size of the serialized
+// parameters of a Kaetzchen capability without a schema.
+const MaxUnknownKaetzchenParamsSize = 1024
+
+// ParamKind is the kind of a Kaetzchen parameter value.
+type ParamKind uint8
+
+const (
+	// ParamString is a text string.
+	ParamString ParamKind = iota
+
+	// ParamBytes is a byte string.
+	ParamBytes
+
+	// ParamInt is a signed or unsigned integer.
+	ParamInt
+
+	// ParamBool is a boolean.
+	ParamBool
+)
+
+// String returns a human readable ParamKind.
+func (k ParamKind) String() string {
+	switch k {
+	case ParamString:
+		return "string"
+	case ParamBytes:
+		return "bytes"
+	case ParamInt:
+		return "int"
+	case ParamBool:
+		return "bool"
+	default:
+		return fmt.Sprintf("[invalid ParamKind: %d]", uint8(k))
+	}
+}
+
+// ParamSpec describes a Kaetzchen parameter.
+type ParamSpec struct {
+	// Kind is the kind of the parameter value.
+	Kind ParamKind
+
+	// MaxLength is the maximum length of a ParamString or ParamBytes
+	// value.
+	MaxLength int
+
+	// Required is true if the parameter must be present.
+	Required bool
+}
+
+// KaetzchenParamSchema maps the allowed parameter keys of a Kaetzchen
+// capability to their ParamSpec.
+type KaetzchenParamSchema map[string]ParamSpec
+
+var endpointParam = ParamSpec{
+	Kind:      ParamString,
+	MaxLength: constants.RecipientIDLength,
+	Required:  true,
+}
+
+// KaetzchenParamSchemas are the schemas of the known Kaetzchen
+// capabilities.
+var KaetzchenParamSchemas = map[string]KaetzchenParamSchema{
+	"echo":          {"endpoint": endpointParam},
+	"spool":         {"endpoint": endpointParam},
+	"talek_replica": {"endpoint": endpointParam},
+}
+
+// IsDescriptorWellFormedStrict validates the descriptor like
+// IsDescriptorWellFormed, and additionally validates the parameters of
+// each Kaetzchen capability against its schema. Parameters of
+// capabilities without a schema are limited to
+// MaxUnknownKaetzchenParamsSize bytes when serialized. If schemas is nil,
+// KaetzchenParamSchemas is used.
+func IsDescriptorWellFormedStrict(d *MixDescriptor, epoch uint64, schemas map[string]KaetzchenParamSchema) error {
+	if err := IsDescriptorWellFormed(d, epoch); err != nil {
+		return err
+	}
+	if schemas == nil {
+		schemas = KaetzchenParamSchemas
+	}
+	for capa, params := range d.Kaetzchen {
+		if err := validateKaetzchenParams(capa, params, schemas[capa]); err != nil {
+			return fmt.Errorf("Descriptor contains invalid Kaetzchen block: %v", err)
+		}
+	}
+	return nil
+}
+
+func validateKaetzchenParams(capa string, params map[string]interface{}, schema KaetzchenParamSchema) error {
+	if schema == nil {
+		b, err := ccbor.Marshal(params)
+		if err != nil {
+			return fmt.Errorf("capability '%v' parameters can not be serialized: %v", capa, err)
+		}
+		if len(b) > MaxUnknownKaetzchenParamsSize {
+			return fmt.Errorf("capability '%v' parameters exceed max size: %v > %v", capa, len(b), MaxUnknownKaetzchenParamsSize)
+		}
+		return nil
+	}
+
+	for key, spec := range schema {
+		if _, ok := params[key]; !ok && spec.Required {
+			return fmt.Errorf("capability '%v' missing parameter '%v'", capa, key)
+		}
+	}
+	for key, v := range params {
+		spec, ok := schema[key]
+		if !ok {
+			return fmt.Errorf("capability '%v' has unknown parameter '%v'", capa, key)
+		}
+		var length int
+		switch v := v.(type) {
+		case string:
+			if spec.Kind != ParamString {
+				return fmt.Errorf("capability '%v' parameter '%v' is a string, expected %v", capa, key, spec.Kind)
+			}
+			length = len(v)
+		case []byte:
+			if spec.Kind != ParamBytes {
+				return fmt.Errorf("capability '%v' parameter '%v' is bytes, expected %v", capa, key, spec.Kind)
+			}
+			length = len(v)
+		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+			if spec.Kind != ParamInt {
+				return fmt.Errorf("capability '%v' parameter '%v' is an int, expected %v", capa, key, spec.Kind)
+			}
+		case bool:
+			if spec.Kind != ParamBool {
+				return fmt.Errorf("capability '%v' parameter '%v' is a bool, expected %v", capa, key, spec.Kind)
+			}
+		default:
+			return fmt.Errorf("capability '%v' parameter '%v' has invalid type: %T", capa, key, v)
+		}
+		if length > spec.MaxLength {
+			return fmt.Errorf("capability '%v' parameter '%v' exceeds max length: %v > %v", capa, key, length, spec.MaxLength)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+// kaetzchen_test.go - Strict Kaetzchen parameter validation tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKaetzchenParamSchema(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	schemas := map[string]KaetzchenParamSchema{
+		"echo": KaetzchenParamSchemas["echo"],
+		"keyserver": {
+			"endpoint":  endpointParam,
+			"publicKey": {Kind: ParamBytes, MaxLength: 32, Required: true},
+			"maxKeys":   {Kind: ParamInt},
+			"readOnly":  {Kind: ParamBool},
+		},
+	}
+
+	vectors := []struct {
+		name      string
+		kaetzchen map[string]map[string]interface{}
+		ok        bool
+		reason    string
+	}{
+		{
+			name: "valid",
+			kaetzchen: map[string]map[string]interface{}{
+				"echo": {"endpoint": "+echo"},
+				"keyserver": {
+					"endpoint":  "+keys",
+					"publicKey": make([]byte, 32),
+					"maxKeys":   uint64(23),
+					"readOnly":  true,
+				},
+			},
+			ok: true,
+		},
+		{
+			name: "optional parameters omitted",
+			kaetzchen: map[string]map[string]interface{}{
+				"keyserver": {"endpoint": "+keys", "publicKey": make([]byte, 32)},
+			},
+			ok: true,
+		},
+		{
+			name: "missing required parameter",
+			kaetzchen: map[string]map[string]interface{}{
+				"keyserver": {"endpoint": "+keys"},
+			},
+			reason: "missing parameter",
+		},
+		{
+			name: "unknown parameter",
+			kaetzchen: map[string]map[string]interface{}{
+				"echo": {"endpoint": "+echo", "miauCount": 23},
+			},
+			reason: "unknown parameter",
+		},
+		{
+			name: "string instead of int",
+			kaetzchen: map[string]map[string]interface{}{
+				"keyserver": {"endpoint": "+keys", "publicKey": make([]byte, 32), "maxKeys": "23"},
+			},
+			reason: "is a string, expected int",
+		},
+		{
+			name: "int instead of bool",
+			kaetzchen: map[string]map[string]interface{}{
+				"keyserver": {"endpoint": "+keys", "publicKey": make([]byte, 32), "readOnly": 1},
+			},
+			reason: "is an int, expected bool",
+		},
+		{
+			name: "string instead of bytes",
+			kaetzchen: map[string]map[string]interface{}{
+				"keyserver": {"endpoint": "+keys", "publicKey": strings.Repeat("a", 32)},
+			},
+			reason: "is a string, expected bytes",
+		},
+		{
+			name: "nested map",
+			kaetzchen: map[string]map[string]interface{}{
+				"keyserver": {"endpoint": "+keys", "publicKey": map[string]interface{}{"a": 1}},
+			},
+			reason: "invalid type",
+		},
+		{
+			name: "oversized bytes",
+			kaetzchen: map[string]map[string]interface{}{
+				"keyserver": {"endpoint": "+keys", "publicKey": make([]byte, 33)},
+			},
+			reason: "exceeds max length",
+		},
+		{
+			name: "unknown capability",
+			kaetzchen: map[string]map[string]interface{}{
+				"miau": {"endpoint": "+miau", "name": strings.Repeat("a", 900)},
+			},
+			ok: true,
+		},
+		{
+			name: "oversized unknown capability",
+			kaetzchen: map[string]map[string]interface{}{
+				"miau": {"endpoint": "+miau", "name": strings.Repeat("a", MaxUnknownKaetzchenParamsSize)},
+			},
+			reason: "exceed max size",
+		},
+	}
+
+	for _, v := range vectors {
+		d := genCapacityDescriptor(require)
+		d.Kaetzchen = v.kaetzchen
+		require.NoError(IsDescriptorWellFormed(d, debugTestEpoch), v.name)
+		err := IsDescriptorWellFormedStrict(d, debugTestEpoch, schemas)
+		if v.ok {
+			require.NoError(err, v.name)
+		} else {
+			require.ErrorContains(err, v.reason, v.name)
+		}
+	}
+
+	// The built-in schemas are used by default.
+	d := genCapacityDescriptor(require)
+	d.Kaetzchen = map[string]map[string]interface{}{
+		"spool": {"endpoint": "+spool"},
+	}
+	require.NoError(IsDescriptorWellFormedStrict(d, debugTestEpoch, nil))
+	d.Kaetzchen["spool"]["endpoint"] = 23
+	require.Error(IsDescriptorWellFormedStrict(d, debugTestEpoch, nil))
+}
@@ -0,0 +1,393 @@
+// pkitest.go - Consensus document test fixtures.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package pkitest builds well formed consensus documents for tests.
+//
+// All keys of a built document are derived from the builder's seed, so a
+// builder configured the same way always builds the same nodes. The only
+// exception are the node identity keys, as the Sphincs+ keys of
+// cert.Scheme can not be derived from a seed, they are generated once per
+// process for every seed and node name instead.
+package pkitest
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/katzenpost/hpqc/hash"
+	"github.com/katzenpost/hpqc/nike"
+	ecdh "github.com/katzenpost/hpqc/nike/x25519"
+	"github.com/katzenpost/hpqc/rand"
+	"github.com/katzenpost/hpqc/sign"
+
+	"github.com/katzenpost/katzenpost/core/cert"
+	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/wire"
+)
+
+const (
+	// DefaultSeed is the seed used to derive the keys unless WithSeed
+	// is called.
+	DefaultSeed = "katzenpost pkitest"
+
+	// MixKeyEpochs is the number of epochs, starting with the document
+	// epoch, that every node has a mix key for.
+	MixKeyEpochs = 3
+
+	mixPort = 4242
+)
+
+// mixKeyScheme is the NIKE used by the Sphinx packet format.
+var mixKeyScheme nike.Scheme = ecdh.Scheme(rand.Reader)
+
+type identity struct {
+	pub  sign.PublicKey
+	priv sign.PrivateKey
+}
+
+var (
+	identitiesLock sync.Mutex
+	identities     = make(map[string]*identity)
+)
+
+// DescriptorOption modifies a descriptor before it is signed.
+type DescriptorOption func(*pki.MixDescriptor)
+
+// WithLoadWeight sets the LoadWeight of a descriptor.
+func WithLoadWeight(weight uint8) DescriptorOption {
+	return func(d *pki.MixDescriptor) {
+		d.LoadWeight = weight
+	}
+}
+
+// WithCapacity sets the capacity hints of a provider descriptor.
+func WithCapacity(maxPacketRate uint64, utilization pki.UtilizationBand) DescriptorOption {
+	return func(d *pki.MixDescriptor) {
+		d.MaxPacketRate = maxPacketRate
+		d.Utilization = utilization
+	}
+}
+
+// WithAddresses replaces the addresses of a descriptor.
+func WithAddresses(addresses map[pki.Transport][]string) DescriptorOption {
+	return func(d *pki.MixDescriptor) {
+		d.Addresses = addresses
+	}
+}
+
+// DocumentBuilder builds consensus documents. The zero value is not
+// usable, use NewDocumentBuilder.
+type DocumentBuilder struct {
+	epoch        uint64
+	seed         []byte
+	sharedRandom []byte
+
+	layers   int
+	perLayer int
+	mixOpts  []DescriptorOption
+
+	providers    int
+	providerOpts []DescriptorOption
+	kaetzchen    map[string]map[string]interface{}
+}
+
+// NewDocumentBuilder returns a DocumentBuilder of documents for the given
+// epoch with 3 layers of 2 mixes each and a single provider.
+func NewDocumentBuilder(epoch uint64) *DocumentBuilder {
+	return &DocumentBuilder{
+		epoch:     epoch,
+		seed:      []byte(DefaultSeed),
+		layers:    3,
+		perLayer:  2,
+		providers: 1,
+	}
+}
+
+// WithSeed sets the seed all keys are derived from.
+func (b *DocumentBuilder) WithSeed(seed []byte) *DocumentBuilder {
+	b.seed = seed
+	return b
+}
+
+// WithSharedRandom sets the seed the SharedRandomValue is derived from,
+// which by default is derived from the builder's seed.
+func (b *DocumentBuilder) WithSharedRandom(seed []byte) *DocumentBuilder {
+	b.sharedRandom = seed
+	return b
+}
+
+// WithMixLayers sets the number of topology layers and the number of
+// mixes per layer, the options are applied to every mix.
+func (b *DocumentBuilder) WithMixLayers(layers, perLayer int, opts ...DescriptorOption) *DocumentBuilder {
+	b.layers = layers
+	b.perLayer = perLayer
+	b.mixOpts = opts
+	return b
+}
+
+// WithProviders sets the number of providers, the options are applied to
+// every provider.
+func (b *DocumentBuilder) WithProviders(n int, opts ...DescriptorOption) *DocumentBuilder {
+	b.providers = n
+	b.providerOpts = opts
+	return b
+}
+
+// WithKaetzchen adds a Kaetzchen capability to every provider. The
+// endpoint parameter defaults to "+" followed by the capability.
+func (b *DocumentBuilder) WithKaetzchen(capability string, params map[string]interface{}) *DocumentBuilder {
+	if b.kaetzchen == nil {
+		b.kaetzchen = make(map[string]map[string]interface{})
+	}
+	p := map[string]interface{}{"endpoint": "+" + capability}
+	for k, v := range params {
+		p[k] = v
+	}
+	b.kaetzchen[capability] = p
+	return b
+}
+
+// MixName returns the name of the idx-th mix of a topology layer.
+func MixName(layer, idx int) string {
+	return fmt.Sprintf("mix%d-%d.example.net", layer, idx)
+}
+
+// ProviderName returns the name of the idx-th provider.
+func ProviderName(idx int) string {
+	return fmt.Sprintf("provider%d.example.net", idx)
+}
+
+// Build returns a new document, which passes pki.IsDocumentWellFormed
+// without verifiers, of signed descriptors which pass
+// pki.IsDescriptorWellFormed. Signing fails if the epoch is in the past.
+func (b *DocumentBuilder) Build() (*pki.Document, error) {
+	doc := &pki.Document{
+		Epoch:             b.epoch,
+		GenesisEpoch:      b.epoch,
+		SendRatePerMinute: 100,
+		Mu:                0.001,
+		MuMaxDelay:        9000,
+		LambdaP:           0.002,
+		LambdaPMaxDelay:   1000,
+		LambdaL:           0.0005,
+		LambdaLMaxDelay:   1000,
+		LambdaD:           0.0005,
+		LambdaDMaxDelay:   3000,
+		LambdaM:           0.0005,
+		LambdaMMaxDelay:   100,
+		Topology:          make([][]*pki.MixDescriptor, b.layers),
+		SharedRandomValue: b.sharedRandomValue(),
+		Version:           pki.DocumentVersion,
+	}
+
+	addr := 1
+	for l := 0; l < b.layers; l++ {
+		for i := 0; i < b.perLayer; i++ {
+			desc, err := b.descriptor(MixName(l, i), addr, false, b.mixOpts)
+			if err != nil {
+				return nil, err
+			}
+			doc.Topology[l] = append(doc.Topology[l], desc)
+			addr++
+		}
+	}
+	for i := 0; i < b.providers; i++ {
+		desc, err := b.descriptor(ProviderName(i), addr, true, b.providerOpts)
+		if err != nil {
+			return nil, err
+		}
+		doc.Providers = append(doc.Providers, desc)
+		addr++
+	}
+
+	if err := pki.IsDocumentWellFormed(doc, nil); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (b *DocumentBuilder) descriptor(name string, addr int, provider bool, opts []DescriptorOption) (*pki.MixDescriptor, error) {
+	if addr > 254 {
+		return nil, fmt.Errorf("pkitest: too many nodes")
+	}
+	identityPub, identityPriv, err := b.Identity(name)
+	if err != nil {
+		return nil, err
+	}
+	d := &pki.MixDescriptor{
+		Name:     name,
+		Epoch:    b.epoch,
+		Provider: provider,
+		Addresses: map[pki.Transport][]string{
+			pki.TransportTCPv4: []string{fmt.Sprintf("192.0.2.%d:%d", addr, mixPort)},
+		},
+		MixKeys: make(map[uint64][]byte),
+		Version: pki.DescriptorVersion,
+	}
+	if d.IdentityKey, err = identityPub.MarshalBinary(); err != nil {
+		return nil, err
+	}
+	if d.LinkKey, err = b.linkKey(name); err != nil {
+		return nil, err
+	}
+	for e := b.epoch; e < b.epoch+MixKeyEpochs; e++ {
+		if d.MixKeys[e], err = b.mixKey(name, e); err != nil {
+			return nil, err
+		}
+	}
+	if provider && len(b.kaetzchen) > 0 {
+		d.Kaetzchen = make(map[string]map[string]interface{})
+		for capa, params := range b.kaetzchen {
+			d.Kaetzchen[capa] = make(map[string]interface{})
+			for k, v := range params {
+				d.Kaetzchen[capa][k] = v
+			}
+		}
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	if err := pki.IsDescriptorWellFormed(d, b.epoch); err != nil {
+		return nil, err
+	}
+	if _, err := pki.SignDescriptor(identityPriv, identityPub, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Identity returns the identity key pair of the named node.
+func (b *DocumentBuilder) Identity(name string) (sign.PublicKey, sign.PrivateKey, error) {
+	identitiesLock.Lock()
+	defer identitiesLock.Unlock()
+
+	key := fmt.Sprintf("%x %s", b.seed, name)
+	id, ok := identities[key]
+	if !ok {
+		pub, priv, err := cert.Scheme.GenerateKey()
+		if err != nil {
+			return nil, nil, err
+		}
+		id = &identity{pub: pub, priv: priv}
+		identities[key] = id
+	}
+	return id.pub, id.priv, nil
+}
+
+func (b *DocumentBuilder) linkKey(name string) ([]byte, error) {
+	seed, err := b.derive(wire.DefaultScheme.SeedSize(), "link", []byte(name))
+	if err != nil {
+		return nil, err
+	}
+	pub, _ := wire.DefaultScheme.DeriveKeyPair(seed)
+	return pub.MarshalBinary()
+}
+
+func (b *DocumentBuilder) mixKey(name string, epoch uint64, info ...[]byte) ([]byte, error) {
+	var rawEpoch [8]byte
+	binary.BigEndian.PutUint64(rawEpoch[:], epoch)
+	rng, err := b.reader("mix", append([][]byte{[]byte(name), rawEpoch[:]}, info...)...)
+	if err != nil {
+		return nil, err
+	}
+	pub, _, err := mixKeyScheme.GenerateKeyPairFromEntropy(rng)
+	if err != nil {
+		return nil, err
+	}
+	return pub.Bytes(), nil
+}
+
+func (b *DocumentBuilder) sharedRandomValue() []byte {
+	seed := b.sharedRandom
+	if seed == nil {
+		seed = append([]byte("shared random "), b.seed...)
+	}
+	srv := hash.Sum256(seed)
+	return srv[:]
+}
+
+// reader returns a deterministic entropy source for the given purpose.
+func (b *DocumentBuilder) reader(purpose string, info ...[]byte) (io.Reader, error) {
+	var buf []byte
+	for _, v := range append([][]byte{b.seed, []byte(purpose)}, info...) {
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(v)))
+		buf = append(buf, v...)
+	}
+	key := hash.Sum256(buf)
+	return rand.NewDeterministicRandReader(key[:])
+}
+
+func (b *DocumentBuilder) derive(size int, purpose string, info ...[]byte) ([]byte, error) {
+	rng, err := b.reader(purpose, info...)
+	if err != nil {
+		return nil, err
+	}
+	seed := make([]byte, size)
+	if _, err := io.ReadFull(rng, seed); err != nil {
+		return nil, err
+	}
+	return seed, nil
+}
+
+// RemoveProvider removes the named provider from a built document.
+func (b *DocumentBuilder) RemoveProvider(doc *pki.Document, name string) error {
+	for i, desc := range doc.Providers {
+		if desc.Name == name {
+			doc.Providers = append(doc.Providers[:i:i], doc.Providers[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("pkitest: no provider %s", name)
+}
+
+// RotateMixKey replaces the mix key for the epoch of the named node in a
+// built document with a new key, and signs the descriptor again.
+func (b *DocumentBuilder) RotateMixKey(doc *pki.Document, name string, epoch uint64) error {
+	desc, err := findNode(doc, name)
+	if err != nil {
+		return err
+	}
+	old, ok := desc.MixKeys[epoch]
+	if !ok {
+		return fmt.Errorf("pkitest: node %s has no mix key for epoch %d", name, epoch)
+	}
+	if desc.MixKeys[epoch], err = b.mixKey(name, epoch, old); err != nil {
+		return err
+	}
+	identityPub, identityPriv, err := b.Identity(name)
+	if err != nil {
+		return err
+	}
+	_, err = pki.SignDescriptor(identityPriv, identityPub, desc)
+	return err
+}
+
+func findNode(doc *pki.Document, name string) (*pki.MixDescriptor, error) {
+	for _, layer := range doc.Topology {
+		for _, desc := range layer {
+			if desc.Name == name {
+				return desc, nil
+			}
+		}
+	}
+	for _, desc := range doc.Providers {
+		if desc.Name == name {
+			return desc, nil
+		}
+	}
+	return nil, fmt.Errorf("pkitest: no node %s", name)
+}
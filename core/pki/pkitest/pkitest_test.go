@@ -0,0 +1,176 @@
+// pkitest_test.go - Consensus document test fixture tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pkitest
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/hpqc/hash"
+
+	"github.com/katzenpost/katzenpost/core/cert"
+	"github.com/katzenpost/katzenpost/core/pki"
+)
+
+const testEpoch = 0xFFFFFFFF
+
+// goldenHash is the hash of the nodes of the default document, it only
+// changes if the fixtures are changed deliberately.
+const goldenHash = "ae4ab39b4b40d184c2015c20789180456397d17c84cbd75898194bdd8abac181"
+
+// fixtureDigest hashes the parts of a document derived from the seed,
+// which are all but the identity keys and descriptor signatures.
+func fixtureDigest(doc *pki.Document) string {
+	var b []byte
+	node := func(d *pki.MixDescriptor) {
+		b = append(b, fmt.Sprintf("%s %v %v\n", d.Name, d.Provider, d.Addresses)...)
+		b = append(b, d.LinkKey...)
+		epochs := make([]uint64, 0, len(d.MixKeys))
+		for e := range d.MixKeys {
+			epochs = append(epochs, e)
+		}
+		sort.Slice(epochs, func(i, j int) bool { return epochs[i] < epochs[j] })
+		for _, e := range epochs {
+			b = append(b, fmt.Sprintf("%d ", e)...)
+			b = append(b, d.MixKeys[e]...)
+		}
+	}
+	for _, layer := range doc.Topology {
+		for _, d := range layer {
+			node(d)
+		}
+	}
+	for _, d := range doc.Providers {
+		node(d)
+	}
+	b = append(b, doc.SharedRandomValue...)
+	h := hash.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func TestBuildGolden(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	doc, err := NewDocumentBuilder(testEpoch).Build()
+	require.NoError(err)
+	require.Equal(goldenHash, fixtureDigest(doc))
+
+	// Building again yields the same nodes.
+	again, err := NewDocumentBuilder(testEpoch).Build()
+	require.NoError(err)
+	require.True(pki.DiffDocuments(doc, again).IsEmpty())
+
+	other, err := NewDocumentBuilder(testEpoch).WithSeed([]byte("other")).WithMixLayers(1, 1).Build()
+	require.NoError(err)
+	require.NotEqual(goldenHash, fixtureDigest(other))
+}
+
+func TestBuild(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	b := NewDocumentBuilder(testEpoch).
+		WithMixLayers(2, 2).
+		WithProviders(2, WithCapacity(1024, pki.UtilizationLow)).
+		WithKaetzchen("echo", nil).
+		WithKaetzchen("keyserver", map[string]interface{}{"maxKeys": 23}).
+		WithSharedRandom([]byte("srv"))
+	doc, err := b.Build()
+	require.NoError(err)
+	require.NoError(pki.IsDocumentWellFormed(doc, nil))
+
+	require.Len(doc.Topology, 2)
+	for l, layer := range doc.Topology {
+		require.Len(layer, 2)
+		for i, desc := range layer {
+			require.Equal(MixName(l, i), desc.Name)
+			require.False(desc.Provider)
+			require.Nil(desc.Kaetzchen)
+		}
+	}
+	require.Len(doc.Providers, 2)
+	for i, desc := range doc.Providers {
+		require.Equal(ProviderName(i), desc.Name)
+		require.NoError(pki.IsDescriptorWellFormed(desc, testEpoch))
+		require.Equal(uint64(1024), desc.MaxPacketRate)
+		require.Equal(map[string]map[string]interface{}{
+			"echo":      {"endpoint": "+echo"},
+			"keyserver": {"endpoint": "+keyserver", "maxKeys": 23},
+		}, desc.Kaetzchen)
+		require.Len(desc.MixKeys, MixKeyEpochs)
+		require.Len(desc.Signatures, 1)
+
+		require.NoError(desc.Verify())
+
+		identityPub, _, err := b.Identity(desc.Name)
+		require.NoError(err)
+		rawIdentity, err := identityPub.MarshalBinary()
+		require.NoError(err)
+		require.Equal(rawIdentity, desc.IdentityKey)
+	}
+	srv := hash.Sum256([]byte("srv"))
+	require.Equal(srv[:], doc.SharedRandomValue)
+
+	// The document survives serialization.
+	authPub, authPriv, err := cert.Scheme.GenerateKey()
+	require.NoError(err)
+	raw, err := pki.SignDocument(authPriv, authPub, doc)
+	require.NoError(err)
+	parsed, err := pki.ParseDocument(raw)
+	require.NoError(err)
+	require.True(pki.DiffDocuments(doc, parsed).IsEmpty())
+
+	// Options which do not yield a well formed document fail.
+	_, err = NewDocumentBuilder(testEpoch).WithProviders(0).Build()
+	require.Error(err)
+	_, err = NewDocumentBuilder(testEpoch).WithMixLayers(3, 1, WithAddresses(nil)).Build()
+	require.Error(err)
+}
+
+func TestMutations(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	b := NewDocumentBuilder(testEpoch).WithMixLayers(2, 1).WithProviders(2)
+	old, err := b.Build()
+	require.NoError(err)
+	doc, err := b.Build()
+	require.NoError(err)
+
+	require.NoError(b.RemoveProvider(doc, ProviderName(0)))
+	require.Error(b.RemoveProvider(doc, ProviderName(0)))
+	require.NoError(b.RotateMixKey(doc, MixName(1, 0), testEpoch+1))
+	require.Error(b.RotateMixKey(doc, MixName(1, 0), testEpoch+MixKeyEpochs))
+	require.Error(b.RotateMixKey(doc, "nonexistent", testEpoch))
+	require.NoError(pki.IsDocumentWellFormed(doc, nil))
+
+	diff := pki.DiffDocuments(old, doc)
+	require.Len(diff.Removed, 1)
+	require.Equal(ProviderName(0), diff.Removed[0].Name)
+	require.Len(diff.Modified, 1)
+	require.Equal(MixName(1, 0), diff.Modified[0].Name)
+	require.Len(diff.Modified[0].Changes, 1)
+	require.Equal(fmt.Sprintf("MixKeys[%d]", testEpoch+1), diff.Modified[0].Changes[0].Field)
+
+	// Removing the last provider yields a malformed document.
+	require.NoError(b.RemoveProvider(doc, ProviderName(1)))
+	require.Error(pki.IsDocumentWellFormed(doc, nil))
+}
@@ -0,0 +1,222 @@
+// verify.go - Standalone consensus document verification.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package verify provides a minimal consensus document verifier which
+// can be embedded in tools that do not want to depend on the client
+// or server code.
+package verify
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/katzenpost/hpqc/hash"
+	"github.com/katzenpost/hpqc/sign"
+
+	"github.com/katzenpost/katzenpost/core/cert"
+	"github.com/katzenpost/katzenpost/core/pki"
+)
+
+// Reason is the reason code of a verification Failure.
+type Reason uint8
+
+const (
+	// MissingSignature indicates that an authority did not sign the document.
+	MissingSignature Reason = iota
+
+	// BadSignature indicates that an authority signature does not verify.
+	BadSignature
+
+	// ThresholdNotMet indicates that there are not enough valid
+	// authority signatures.
+	ThresholdNotMet
+
+	// MalformedDocument indicates that the document could not be parsed
+	// or is not well formed.
+	MalformedDocument
+
+	// MalformedDescriptor indicates that a descriptor contained in the
+	// document is not well formed.
+	MalformedDescriptor
+)
+
+// String returns a human readable Reason.
+func (r Reason) String() string {
+	switch r {
+	case MissingSignature:
+		return "missing signature"
+	case BadSignature:
+		return "bad signature"
+	case ThresholdNotMet:
+		return "threshold not met"
+	case MalformedDocument:
+		return "malformed document"
+	case MalformedDescriptor:
+		return "malformed descriptor"
+	default:
+		return fmt.Sprintf("[unknown Reason: %d]", r)
+	}
+}
+
+// Failure describes a single verification failure.
+type Failure struct {
+	// Reason is the reason code of the failure.
+	Reason Reason
+
+	// KeyHash is the hash of the authority or node identity key the
+	// failure pertains to, or all zeros if not applicable.
+	KeyHash [hash.HashSize]byte
+
+	// Err is the underlying error.
+	Err error
+}
+
+// String returns a human readable Failure.
+func (f *Failure) String() string {
+	var zero [hash.HashSize]byte
+	if f.KeyHash == zero {
+		return fmt.Sprintf("%s: %v", f.Reason, f.Err)
+	}
+	return fmt.Sprintf("%s (%x): %v", f.Reason, f.KeyHash, f.Err)
+}
+
+// Error is the error returned when a document fails verification.
+type Error struct {
+	// Failures is the list of failures which caused the document to
+	// be rejected.
+	Failures []*Failure
+}
+
+// Error implements the error interface.
+func (e *Error) Error() string {
+	s := make([]string, 0, len(e.Failures))
+	for _, f := range e.Failures {
+		s = append(s, f.String())
+	}
+	return fmt.Sprintf("verify: invalid document: %s", strings.Join(s, ", "))
+}
+
+// Has returns true if any of the failures has the given Reason.
+func (e *Error) Has(reason Reason) bool {
+	for _, f := range e.Failures {
+		if f.Reason == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// Result is the result of a successful verification.
+type Result struct {
+	// Document is the parsed and verified Document.
+	Document *pki.Document
+
+	// Good is the list of authorities with a valid signature.
+	Good []sign.PublicKey
+
+	// Failures lists the signature failures which did not prevent the
+	// document from meeting the threshold.
+	Failures []*Failure
+}
+
+// Verifier verifies consensus documents against a set of authority keys.
+type Verifier struct {
+	verifiers []sign.PublicKey
+	threshold int
+}
+
+// New returns a new Verifier. A threshold of 0 selects a majority of the
+// given verifiers.
+func New(verifiers []sign.PublicKey, threshold int) (*Verifier, error) {
+	if len(verifiers) == 0 {
+		return nil, errors.New("verify: no verifiers")
+	}
+	if threshold == 0 {
+		threshold = len(verifiers)/2 + 1
+	}
+	if threshold < 0 || threshold > len(verifiers) {
+		return nil, cert.ErrInvalidThreshold
+	}
+	return &Verifier{
+		verifiers: verifiers,
+		threshold: threshold,
+	}, nil
+}
+
+// Threshold returns the number of valid signatures required.
+func (v *Verifier) Threshold() int {
+	return v.threshold
+}
+
+// Verify parses and verifies the raw document, returning the Result
+// or an *Error listing the verification failures.
+func (v *Verifier) Verify(raw []byte) (*Result, error) {
+	doc, err := pki.ParseDocument(raw)
+	if err != nil {
+		return nil, &Error{Failures: []*Failure{{Reason: MalformedDocument, Err: err}}}
+	}
+
+	res := &Result{}
+	for _, verifier := range v.verifiers {
+		_, err := cert.Verify(verifier, raw)
+		switch err {
+		case nil:
+			res.Good = append(res.Good, verifier)
+		case cert.ErrIdentitySignatureNotFound:
+			res.Failures = append(res.Failures, &Failure{Reason: MissingSignature, KeyHash: hash.Sum256From(verifier), Err: err})
+		default:
+			res.Failures = append(res.Failures, &Failure{Reason: BadSignature, KeyHash: hash.Sum256From(verifier), Err: err})
+		}
+	}
+
+	var failures []*Failure
+	if len(res.Good) < v.threshold {
+		failures = append(failures, res.Failures...)
+		failures = append(failures, &Failure{
+			Reason: ThresholdNotMet,
+			Err:    fmt.Errorf("%d of %d required signatures: %w", len(res.Good), v.threshold, cert.ErrThresholdNotMet),
+		})
+	}
+	failures = append(failures, checkDescriptors(doc)...)
+	if len(failures) == 0 {
+		if err := pki.IsDocumentWellFormed(doc, v.verifiers); err != nil {
+			failures = append(failures, &Failure{Reason: MalformedDocument, Err: err})
+		}
+	}
+	if len(failures) != 0 {
+		return nil, &Error{Failures: failures}
+	}
+	res.Document = doc
+	return res, nil
+}
+
+func checkDescriptors(doc *pki.Document) []*Failure {
+	var failures []*Failure
+	check := func(desc *pki.MixDescriptor) {
+		if err := pki.IsDescriptorWellFormed(desc, doc.Epoch); err != nil {
+			failures = append(failures, &Failure{Reason: MalformedDescriptor, KeyHash: hash.Sum256(desc.IdentityKey), Err: err})
+		}
+	}
+	for _, layer := range doc.Topology {
+		for _, desc := range layer {
+			check(desc)
+		}
+	}
+	for _, desc := range doc.Providers {
+		check(desc)
+	}
+	return failures
+}
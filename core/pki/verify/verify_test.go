@@ -0,0 +1,276 @@
+// verify_test.go - Consensus document verification tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package verify
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/hpqc/hash"
+	"github.com/katzenpost/hpqc/sign"
+	signpem "github.com/katzenpost/hpqc/sign/pem"
+
+	"github.com/katzenpost/katzenpost/core/cert"
+	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/pki/pkitest"
+)
+
+const (
+	testEpoch = 0xFFFFFFFF
+
+	validVectorFile        = "testdata/valid.cbor"
+	insufficientVectorFile = "testdata/insufficient.cbor"
+	forgedVectorFile       = "testdata/forged.cbor"
+)
+
+func vectorAuthorityFile(i int) string {
+	return fmt.Sprintf("testdata/authority-%d.pem", i)
+}
+
+func genDocument(require *require.Assertions) (*pki.Document, *pkitest.DocumentBuilder) {
+	b := pkitest.NewDocumentBuilder(testEpoch).WithKaetzchen("echo", nil)
+	doc, err := b.Build()
+	require.NoError(err)
+	return doc, b
+}
+
+type authority struct {
+	pub  sign.PublicKey
+	priv sign.PrivateKey
+}
+
+func genAuthorities(require *require.Assertions, n int) ([]*authority, []sign.PublicKey) {
+	auths := make([]*authority, n)
+	verifiers := make([]sign.PublicKey, n)
+	for i := 0; i < n; i++ {
+		pub, priv, err := cert.Scheme.GenerateKey()
+		require.NoError(err)
+		auths[i] = &authority{pub: pub, priv: priv}
+		verifiers[i] = pub
+	}
+	return auths, verifiers
+}
+
+func signDocument(require *require.Assertions, doc *pki.Document, signers []*authority) []byte {
+	var raw []byte
+	var err error
+	for _, a := range signers {
+		raw, err = pki.SignDocument(a.priv, a.pub, doc)
+		require.NoError(err)
+	}
+	return raw
+}
+
+func TestVerifyValid(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	auths, verifiers := genAuthorities(require, 3)
+	doc, _ := genDocument(require)
+	raw := signDocument(require, doc, auths)
+
+	v, err := New(verifiers, 0)
+	require.NoError(err)
+	require.Equal(2, v.Threshold())
+
+	res, err := v.Verify(raw)
+	require.NoError(err)
+	require.Equal(uint64(testEpoch), res.Document.Epoch)
+	require.Len(res.Good, 3)
+	require.Len(res.Failures, 0)
+
+	// A threshold of signatures is sufficient.
+	doc, _ = genDocument(require)
+	raw = signDocument(require, doc, auths[:2])
+	res, err = v.Verify(raw)
+	require.NoError(err)
+	require.Len(res.Good, 2)
+	require.Len(res.Failures, 1)
+	require.Equal(MissingSignature, res.Failures[0].Reason)
+	require.Equal(hash.Sum256From(auths[2].pub), res.Failures[0].KeyHash)
+}
+
+func TestVerifyInsufficient(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	auths, verifiers := genAuthorities(require, 3)
+	doc, _ := genDocument(require)
+	raw := signDocument(require, doc, auths[:1])
+
+	v, err := New(verifiers, 0)
+	require.NoError(err)
+
+	res, err := v.Verify(raw)
+	require.Nil(res)
+	verr, ok := err.(*Error)
+	require.True(ok)
+	require.True(verr.Has(ThresholdNotMet))
+	require.True(verr.Has(MissingSignature))
+	require.False(verr.Has(BadSignature))
+}
+
+func TestVerifyForged(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	auths, verifiers := genAuthorities(require, 3)
+	doc, _ := genDocument(require)
+	signDocument(require, doc, auths)
+
+	// Replace two of the signatures with garbage.
+	for _, a := range auths[1:] {
+		id := hash.Sum256From(a.pub)
+		sig := doc.Signatures[id]
+		sig.Payload = make([]byte, len(sig.Payload))
+		doc.Signatures[id] = sig
+	}
+	raw, err := doc.MarshalBinary()
+	require.NoError(err)
+
+	v, err := New(verifiers, 0)
+	require.NoError(err)
+
+	_, err = v.Verify(raw)
+	verr, ok := err.(*Error)
+	require.True(ok)
+	require.True(verr.Has(ThresholdNotMet))
+	require.True(verr.Has(BadSignature))
+
+	// A single forged signature is reported but tolerated.
+	v, err = New(verifiers, 1)
+	require.NoError(err)
+	res, err := v.Verify(raw)
+	require.NoError(err)
+	require.Len(res.Good, 1)
+	require.Len(res.Failures, 2)
+	for _, f := range res.Failures {
+		require.Equal(BadSignature, f.Reason)
+	}
+}
+
+func TestVerifyMalformed(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	auths, verifiers := genAuthorities(require, 1)
+	doc, b := genDocument(require)
+	bad := doc.Topology[1][0]
+	bad.Addresses = nil
+
+	// Descriptor signatures are checked upon parsing, so re-sign it.
+	identityPub, identityPriv, err := b.Identity(bad.Name)
+	require.NoError(err)
+	_, err = pki.SignDescriptor(identityPriv, identityPub, bad)
+	require.NoError(err)
+	raw := signDocument(require, doc, auths)
+
+	v, err := New(verifiers, 0)
+	require.NoError(err)
+
+	_, err = v.Verify(raw)
+	verr, ok := err.(*Error)
+	require.True(ok)
+	require.Len(verr.Failures, 1)
+	require.Equal(MalformedDescriptor, verr.Failures[0].Reason)
+	require.Equal(hash.Sum256(bad.IdentityKey), verr.Failures[0].KeyHash)
+
+	_, err = v.Verify([]byte("not a document"))
+	verr, ok = err.(*Error)
+	require.True(ok)
+	require.True(verr.Has(MalformedDocument))
+}
+
+// NoTestBuildFileVectorVerify writes the golden documents and authority
+// keys of TestVectorVerify to testdata.
+func NoTestBuildFileVectorVerify(t *testing.T) {
+	require := require.New(t)
+
+	auths, verifiers := genAuthorities(require, 3)
+	for i, v := range verifiers {
+		err := os.WriteFile(vectorAuthorityFile(i), []byte(signpem.ToPublicPEMString(v)), 0644)
+		require.NoError(err)
+	}
+	genVectorDocument := func() *pki.Document {
+		doc, err := pkitest.NewDocumentBuilder(testEpoch).WithMixLayers(1, 1).Build()
+		require.NoError(err)
+		return doc
+	}
+
+	err := os.WriteFile(validVectorFile, signDocument(require, genVectorDocument(), auths), 0644)
+	require.NoError(err)
+	err = os.WriteFile(insufficientVectorFile, signDocument(require, genVectorDocument(), auths[:1]), 0644)
+	require.NoError(err)
+
+	doc := genVectorDocument()
+	signDocument(require, doc, auths)
+	for _, a := range auths[1:] {
+		id := hash.Sum256From(a.pub)
+		sig := doc.Signatures[id]
+		sig.Payload = make([]byte, len(sig.Payload))
+		doc.Signatures[id] = sig
+	}
+	forged, err := doc.MarshalBinary()
+	require.NoError(err)
+	err = os.WriteFile(forgedVectorFile, forged, 0644)
+	require.NoError(err)
+}
+
+func TestVectorVerify(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	var verifiers []sign.PublicKey
+	for i := 0; i < 3; i++ {
+		verifier, err := signpem.FromPublicPEMFile(vectorAuthorityFile(i), cert.Scheme)
+		require.NoError(err)
+		verifiers = append(verifiers, verifier)
+	}
+	v, err := New(verifiers, 0)
+	require.NoError(err)
+	verify := func(fn string) (*Result, *Error) {
+		raw, err := os.ReadFile(fn)
+		require.NoError(err)
+		res, err := v.Verify(raw)
+		if err == nil {
+			return res, nil
+		}
+		verr, ok := err.(*Error)
+		require.True(ok)
+		return nil, verr
+	}
+
+	res, verr := verify(validVectorFile)
+	require.Nil(verr)
+	require.Len(res.Good, 3)
+	require.Empty(res.Failures)
+	require.Equal(uint64(testEpoch), res.Document.Epoch)
+
+	_, verr = verify(insufficientVectorFile)
+	require.NotNil(verr)
+	require.True(verr.Has(ThresholdNotMet))
+	require.True(verr.Has(MissingSignature))
+	require.False(verr.Has(BadSignature))
+
+	_, verr = verify(forgedVectorFile)
+	require.NotNil(verr)
+	require.True(verr.Has(ThresholdNotMet))
+	require.True(verr.Has(BadSignature))
+	require.False(verr.Has(MissingSignature))
+}
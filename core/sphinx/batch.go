@@ -0,0 +1,90 @@
+// batch.go - Sphinx packet batch unwrapping.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sphinx
+
+import (
+	"errors"
+	"runtime"
+	"sync"
+
+	"github.com/katzenpost/katzenpost/core/sphinx/commands"
+)
+
+// UnwrapResult is the result of unwrapping a single packet of a batch,
+// with the values returned by Unwrap.
+type UnwrapResult struct {
+	// Payload is the payload, if applicable.
+	Payload []byte
+
+	// ReplayTag is the replay tag.
+	ReplayTag []byte
+
+	// Commands is the routing info command vector.
+	Commands []commands.RoutingCommand
+
+	// Err is the error unwrapping the packet, if any.
+	Err error
+}
+
+// UnwrapBatch unwraps each of the provided Sphinx packets in-place like
+// Unwrap, using the NIKE or KEM private key of the same index. The
+// packets are unwrapped concurrently by up to GOMAXPROCS workers, and the
+// results are returned in the order of the packets. A packet failing to
+// unwrap only sets the Err of its result, the returned error is only
+// set if the batch itself is invalid.
+func (s *Sphinx) UnwrapBatch(privKeys []interface{}, pkts [][]byte) ([]UnwrapResult, error) {
+	return s.unwrapBatch(privKeys, pkts, runtime.GOMAXPROCS(0))
+}
+
+func (s *Sphinx) unwrapBatch(privKeys []interface{}, pkts [][]byte, nrWorkers int) ([]UnwrapResult, error) {
+	if len(privKeys) != len(pkts) {
+		return nil, errors.New("sphinx: batch private key and packet count mismatch")
+	}
+
+	results := make([]UnwrapResult, len(pkts))
+	unwrap := func(i int) {
+		r := &results[i]
+		r.Payload, r.ReplayTag, r.Commands, r.Err = s.Unwrap(privKeys[i], pkts[i])
+	}
+
+	if nrWorkers > len(pkts) {
+		nrWorkers = len(pkts)
+	}
+	if nrWorkers <= 1 {
+		for i := range pkts {
+			unwrap(i)
+		}
+		return results, nil
+	}
+
+	ch := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(nrWorkers)
+	for w := 0; w < nrWorkers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range ch {
+				unwrap(i)
+			}
+		}()
+	}
+	for i := range pkts {
+		ch <- i
+	}
+	close(ch)
+	wg.Wait()
+	return results, nil
+}
@@ -0,0 +1,156 @@
+// batch_test.go - Sphinx packet batch unwrapping tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sphinx
+
+import (
+	"crypto/rand"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	ecdh "github.com/katzenpost/hpqc/nike/x25519"
+
+	"github.com/katzenpost/katzenpost/core/sphinx/geo"
+)
+
+const batchTestPayloadLength = 512
+
+// newTestBatch returns n packets, alternating between packets whose first
+// hop is the terminal hop and packets with further hops, along with the
+// private keys of their first hops.
+func newTestBatch(require *require.Assertions, n int) (*Sphinx, []interface{}, [][]byte) {
+	mynike := ecdh.Scheme(rand.Reader)
+	g := geo.GeometryFromUserForwardPayloadLength(mynike, batchTestPayloadLength, false, 5)
+	s := NewSphinx(g)
+
+	privKeys := make([]interface{}, n)
+	pkts := make([][]byte, n)
+	for i := range pkts {
+		nrHops := 1 + 4*(i%2)
+		nodes, path := newNikePathVector(require, mynike, nrHops, false)
+		payload := make([]byte, batchTestPayloadLength)
+		copy(payload, fmt.Sprintf("packet %d", i))
+		pkt, err := s.NewPacket(rand.Reader, path, payload)
+		require.NoError(err)
+		privKeys[i] = nodes[0].privateKey
+		pkts[i] = pkt
+	}
+	return s, privKeys, pkts
+}
+
+func copyPackets(pkts [][]byte) [][]byte {
+	c := make([][]byte, len(pkts))
+	for i, pkt := range pkts {
+		c[i] = append([]byte{}, pkt...)
+	}
+	return c
+}
+
+func TestUnwrapBatch(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	s, privKeys, pkts := newTestBatch(require, 17)
+
+	// Corrupt the header of a packet, which must not affect the others.
+	pkts[3][40] ^= 0xff
+
+	sequential := copyPackets(pkts)
+	for i := range sequential {
+		s.Unwrap(privKeys[i], sequential[i])
+	}
+	for _, nrWorkers := range []int{1, 4} {
+		testUnwrapBatch(require, s, privKeys, pkts, sequential, nrWorkers)
+	}
+
+	// A batch of one is unwrapped in place.
+	results, err := s.UnwrapBatch(privKeys[:1], pkts[:1])
+	require.NoError(err)
+	require.NoError(results[0].Err)
+	require.Equal(sequential[0], pkts[0])
+
+	results, err = s.UnwrapBatch(nil, nil)
+	require.NoError(err)
+	require.Len(results, 0)
+
+	_, err = s.UnwrapBatch(privKeys[:1], pkts)
+	require.Error(err)
+}
+
+// testUnwrapBatch checks that the batch unwraps to the same packets and
+// results as unwrapping each packet sequentially.
+func testUnwrapBatch(require *require.Assertions, s *Sphinx, privKeys []interface{}, pkts, sequential [][]byte, nrWorkers int) {
+	batch := copyPackets(pkts)
+	results, err := s.unwrapBatch(privKeys, batch, nrWorkers)
+	require.NoError(err)
+	require.Len(results, len(pkts))
+
+	for i, r := range results {
+		payload, tag, cmds, err := s.Unwrap(privKeys[i], copyPackets(pkts[i : i+1])[0])
+		require.Equal(payload, r.Payload, i)
+		require.Equal(tag, r.ReplayTag, i)
+		require.Equal(cmds, r.Commands, i)
+		require.Equal(err, r.Err, i)
+		require.Equal(sequential[i], batch[i], i)
+
+		switch {
+		case i == 3:
+			require.Error(r.Err)
+		case i%2 == 0:
+			require.NoError(r.Err)
+			prefix := fmt.Sprintf("packet %d", i)
+			require.Equal(prefix, string(r.Payload[:len(prefix)]))
+		default:
+			require.NoError(r.Err)
+			require.Nil(r.Payload)
+		}
+	}
+}
+
+const benchBatchSize = 64
+
+func BenchmarkUnwrapBatch(b *testing.B) {
+	s, privKeys, pkts := newTestBatch(require.New(b), benchBatchSize)
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		batch := copyPackets(pkts)
+		b.StartTimer()
+		_, err := s.UnwrapBatch(privKeys, batch)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+func BenchmarkUnwrapSequential(b *testing.B) {
+	s, privKeys, pkts := newTestBatch(require.New(b), benchBatchSize)
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		batch := copyPackets(pkts)
+		b.StartTimer()
+		for i, pkt := range batch {
+			_, _, _, err := s.Unwrap(privKeys[i], pkt)
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+}
@@ -97,6 +97,13 @@ func (g *Geometry) NIKE() nike.Scheme {
 	return schemes.ByName(g.NIKEName)
 }
 
+// bytes returns the canonical serialization of the Geometry, which is
+// the CBOR map of all of the Geometry fields, keyed by field name, in
+// the canonical encoding of RFC 7049 section 3.9: integers and lengths
+// use their shortest form and map keys are sorted by length first and
+// bytewise second. The serialization therefore includes the NIKEName
+// and KEMName and changes if and only if a field is added, removed,
+// renamed or changes value.
 func (g *Geometry) bytes() []byte {
 	blob, err := ccbor.Marshal(g)
 	if err != nil {
@@ -105,6 +112,10 @@ func (g *Geometry) bytes() []byte {
 	return blob
 }
 
+// Hash returns the BLAKE2b-256 digest of the canonical serialization of
+// the Geometry. It is published in the PKI document as the
+// SphinxGeometryHash and is how nodes and clients check that they share
+// the geometry of the network.
 func (g *Geometry) Hash() []byte {
 	h, err := blake2b.New256(nil)
 	if err != nil {
@@ -117,9 +128,11 @@ func (g *Geometry) Hash() []byte {
 	return h.Sum(nil)
 }
 
-// Validate returns an error if one of it's validation checks fails. Note however
-// that currently we only validate a few of the Geometry fields. This is not meant
-// to be exhaustive, but more checks could be added.
+// Validate returns an error if the Geometry is not internally consistent,
+// that is if any of its derived lengths differ from those derived from the
+// NIKE or KEM scheme, NrHops and UserForwardPayloadLength as done by
+// GeometryFromUserForwardPayloadLength and
+// KEMGeometryFromUserForwardPayloadLength.
 func (g *Geometry) Validate() error {
 	if g == nil {
 		return errors.New("geometry reference is nil")
@@ -130,14 +143,21 @@ func (g *Geometry) Validate() error {
 	if g.NIKEName != "" && g.KEMName != "" {
 		return errors.New("geometry NIKEName and KEMName must not both be set")
 	}
+	f := &geometryFactory{
+		nrHops:                      g.NrHops,
+		forwardPayloadLength:        g.ForwardPayloadLength,
+		sprpKeyMaterialLength:       crypto.SPRPKeyLength + crypto.SPRPIVLength,
+		sphinxPlaintextHeaderLength: sphinxPlaintextHeaderLength,
+		nextNodeHopLength:           constants.CommandTagLength + constants.NodeIDLength + crypto.MACLength,
+	}
 	if g.NIKEName != "" {
-		mynike := schemes.ByName(g.NIKEName)
-		if mynike == nil {
+		f.nike = schemes.ByName(g.NIKEName)
+		if f.nike == nil {
 			return fmt.Errorf("geometry has invalid NIKE Scheme %s", g.NIKEName)
 		}
 	} else {
-		mykem := kemschemes.ByName(g.KEMName)
-		if mykem == nil {
+		f.kem = kemschemes.ByName(g.KEMName)
+		if f.kem == nil {
 			return fmt.Errorf("geometry has invalid KEM Scheme %s", g.KEMName)
 		}
 	}
@@ -156,6 +176,47 @@ func (g *Geometry) Validate() error {
 	if g.PerHopRoutingInfoLength == 0 {
 		return errors.New("geometry has PerHopRoutingInfoLength of 0")
 	}
+
+	// The constant lengths.
+	if g.PayloadTagLength != payloadTagLength {
+		return fmt.Errorf("geometry has PayloadTagLength of %d, expected %d", g.PayloadTagLength, payloadTagLength)
+	}
+	if g.SphinxPlaintextHeaderLength != f.sphinxPlaintextHeaderLength {
+		return fmt.Errorf("geometry has SphinxPlaintextHeaderLength of %d, expected %d", g.SphinxPlaintextHeaderLength, f.sphinxPlaintextHeaderLength)
+	}
+	if g.SPRPKeyMaterialLength != f.sprpKeyMaterialLength {
+		return fmt.Errorf("geometry has SPRPKeyMaterialLength of %d, expected %d", g.SPRPKeyMaterialLength, f.sprpKeyMaterialLength)
+	}
+	if g.NextNodeHopLength != f.nextNodeHopLength {
+		return fmt.Errorf("geometry has NextNodeHopLength of %d, expected %d", g.NextNodeHopLength, f.nextNodeHopLength)
+	}
+
+	// The lengths derived from the scheme and the number of hops.
+	if l := f.perHopRoutingInfoLength(); g.PerHopRoutingInfoLength != l {
+		return fmt.Errorf("geometry has PerHopRoutingInfoLength of %d, expected %d for the %s scheme", g.PerHopRoutingInfoLength, l, g.schemeName())
+	}
+	if l := f.routingInfoLength(); g.RoutingInfoLength != l {
+		return fmt.Errorf("geometry has RoutingInfoLength of %d, expected %d for %d hops", g.RoutingInfoLength, l, g.NrHops)
+	}
+	if l := f.headerLength(); g.HeaderLength != l {
+		return fmt.Errorf("geometry has HeaderLength of %d, expected %d for the %s scheme and %d hops", g.HeaderLength, l, g.schemeName(), g.NrHops)
+	}
+	if l := f.surbLength(); g.SURBLength != l {
+		return fmt.Errorf("geometry has SURBLength of %d, expected %d for a %d byte header", g.SURBLength, l, g.HeaderLength)
+	}
+
+	// The payload lengths, the forward payload contains the user forward
+	// payload, optionally preceded by a SURB.
+	if g.UserForwardPayloadLength == 0 {
+		return errors.New("geometry has UserForwardPayloadLength of 0")
+	}
+	withSURB := f.deriveForwardPayloadLength(g.UserForwardPayloadLength)
+	if g.ForwardPayloadLength != g.UserForwardPayloadLength && g.ForwardPayloadLength != withSURB {
+		return fmt.Errorf("geometry has ForwardPayloadLength of %d, expected %d, or %d with a SURB", g.ForwardPayloadLength, g.UserForwardPayloadLength, withSURB)
+	}
+	if l := f.packetLength(); g.PacketLength != l {
+		return fmt.Errorf("geometry has PacketLength of %d, expected %d for a %d byte header and %d byte forward payload", g.PacketLength, l, g.HeaderLength, g.ForwardPayloadLength)
+	}
 	return nil
 }
 
@@ -183,6 +244,62 @@ func (g *Geometry) String() string {
 	return b.String()
 }
 
+// Summary returns a one line human readable summary of the Geometry
+// followed by its Hash, suitable for logging.
+func (g *Geometry) Summary() string {
+	return fmt.Sprintf("%s, %d hops, %d byte packets, %d byte user forward payload, hash %x",
+		g.schemeName(), g.NrHops, g.PacketLength, g.UserForwardPayloadLength, g.Hash())
+}
+
+// Explain returns a human readable breakdown of the byte cost of each
+// component of a Sphinx packet of the Geometry. The breakdown of a
+// Geometry which fails Validate will not add up.
+func (g *Geometry) Explain() string {
+	keyName, keyLength := "NIKE public key", 0
+	if s := schemes.ByName(g.NIKEName); s != nil {
+		keyLength = s.PublicKeySize()
+	}
+	if g.KEMName != "" {
+		keyName, keyLength = "KEM ciphertext", 0
+		if k := kemschemes.ByName(g.KEMName); k != nil {
+			keyLength = k.CiphertextSize()
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "sphinx packet (%s): %d bytes\n", g.schemeName(), g.PacketLength)
+	fmt.Fprintf(&b, "  header: %d bytes\n", g.HeaderLength)
+	fmt.Fprintf(&b, "    additional data: %d bytes\n", adLength)
+	fmt.Fprintf(&b, "    %s: %d bytes\n", keyName, keyLength)
+	fmt.Fprintf(&b, "    routing info: %d bytes, %d hops of %d bytes\n", g.RoutingInfoLength, g.NrHops, g.PerHopRoutingInfoLength)
+	fmt.Fprintf(&b, "      next node hop: %d bytes\n", g.NextNodeHopLength)
+	fmt.Fprintf(&b, "      SURB reply: %d bytes\n", surbReplyLength)
+	if g.KEMName != "" {
+		fmt.Fprintf(&b, "      %s: %d bytes\n", keyName, keyLength)
+	}
+	fmt.Fprintf(&b, "    MAC: %d bytes\n", crypto.MACLength)
+	fmt.Fprintf(&b, "  payload tag: %d bytes\n", g.PayloadTagLength)
+	fmt.Fprintf(&b, "  forward payload: %d bytes\n", g.ForwardPayloadLength)
+	if g.ForwardPayloadLength != g.UserForwardPayloadLength {
+		fmt.Fprintf(&b, "    plaintext header: %d bytes\n", g.SphinxPlaintextHeaderLength)
+		fmt.Fprintf(&b, "    SURB: %d bytes\n", g.SURBLength)
+		fmt.Fprintf(&b, "      header: %d bytes\n", g.HeaderLength)
+		fmt.Fprintf(&b, "      first hop node ID: %d bytes\n", constants.NodeIDLength)
+		fmt.Fprintf(&b, "      SPRP key material: %d bytes\n", g.SPRPKeyMaterialLength)
+	}
+	fmt.Fprintf(&b, "    user forward payload: %d bytes\n", g.UserForwardPayloadLength)
+	return b.String()
+}
+
+func (g *Geometry) schemeName() string {
+	if g.KEMName != "" {
+		return "KEM " + g.KEMName
+	}
+	return "NIKE " + g.NIKEName
+}
+
+// Display returns the Geometry encoded as TOML, suitable for the
+// SphinxGeometry section of the configuration files.
 func (g *Geometry) Display() string {
 	buf := new(bytes.Buffer)
 	encoder := toml.NewEncoder(buf)
@@ -0,0 +1,147 @@
+// geo_test.go - Sphinx geometry tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package geo
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	kemschemes "github.com/katzenpost/hpqc/kem/schemes"
+	"github.com/katzenpost/hpqc/nike/schemes"
+)
+
+// goldenGeometry must never change, the golden values below pin its
+// canonical serialization and Hash.
+var goldenGeometry = &Geometry{
+	PacketLength:                3082,
+	NrHops:                      5,
+	HeaderLength:                476,
+	RoutingInfoLength:           410,
+	PerHopRoutingInfoLength:     82,
+	SURBLength:                  572,
+	SphinxPlaintextHeaderLength: 2,
+	PayloadTagLength:            32,
+	ForwardPayloadLength:        2606,
+	UserForwardPayloadLength:    2000,
+	NextNodeHopLength:           65,
+	SPRPKeyMaterialLength:       64,
+	NIKEName:                    "x25519",
+}
+
+func TestGeometryGolden(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	const (
+		goldenBytes = "ae664e72486f707305674b454d4e616d6560684e494b454e616d65667832353531396a535552424c656e67746819023c6c4865616465724c656e6774681901dc6c5061636b65744c656e677468190c0a705061796c6f61645461674c656e6774681820714e6578744e6f6465486f704c656e677468184171526f7574696e67496e666f4c656e67746819019a74466f72776172645061796c6f61644c656e677468190a2e75535052504b65794d6174657269616c4c656e677468184077506572486f70526f7574696e67496e666f4c656e6774681852781855736572466f72776172645061796c6f61644c656e6774681907d0781b537068696e78506c61696e746578744865616465724c656e67746802"
+		goldenHash  = "f5d1e425d67fb40879cedbe57ff04bd66f8d7243e99a51e28779eaa714c9f0e8"
+	)
+
+	require.Equal(goldenBytes, hex.EncodeToString(goldenGeometry.bytes()))
+	require.Equal(goldenHash, hex.EncodeToString(goldenGeometry.Hash()))
+	require.Equal("NIKE x25519, 5 hops, 3082 byte packets, 2000 byte user forward payload, hash "+goldenHash, goldenGeometry.Summary())
+}
+
+func TestGeometryHash(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	g := *goldenGeometry
+	require.Equal(goldenGeometry.Hash(), g.Hash())
+
+	// Every field is covered by the Hash.
+	g.NrHops++
+	require.NotEqual(goldenGeometry.Hash(), g.Hash())
+	g = *goldenGeometry
+	g.NIKEName = ""
+	g.KEMName = "x25519"
+	require.NotEqual(goldenGeometry.Hash(), g.Hash())
+	require.Equal("KEM x25519, 5 hops, 3082 byte packets, 2000 byte user forward payload, hash "+hex.EncodeToString(g.Hash()), g.Summary())
+}
+
+func TestGeometryValidate(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	nikeGeo := GeometryFromUserForwardPayloadLength(schemes.ByName("x25519"), 2000, true, 5)
+	require.NoError(nikeGeo.Validate())
+	require.NoError(GeometryFromUserForwardPayloadLength(schemes.ByName("x25519"), 2000, false, 5).Validate())
+	kemGeo := KEMGeometryFromUserForwardPayloadLength(kemschemes.ByName("Kyber768-X25519"), 2000, true, 5)
+	require.NoError(kemGeo.Validate())
+
+	vectors := []struct {
+		name   string
+		geo    *Geometry
+		mutate func(g *Geometry)
+		reason string
+	}{
+		{"no scheme", nikeGeo, func(g *Geometry) { g.NIKEName = "" }, "NIKEName or KEMName must be set"},
+		{"both schemes", nikeGeo, func(g *Geometry) { g.KEMName = kemGeo.KEMName }, "must not both be set"},
+		{"unknown scheme", kemGeo, func(g *Geometry) { g.KEMName = "miau" }, "invalid KEM Scheme"},
+		{"payload tag", nikeGeo, func(g *Geometry) { g.PayloadTagLength = 16 }, "PayloadTagLength of 16"},
+		{"plaintext header", nikeGeo, func(g *Geometry) { g.SphinxPlaintextHeaderLength = 1 }, "SphinxPlaintextHeaderLength of 1"},
+		{"SPRP key material", nikeGeo, func(g *Geometry) { g.SPRPKeyMaterialLength = 32 }, "SPRPKeyMaterialLength of 32"},
+		{"next node hop", nikeGeo, func(g *Geometry) { g.NextNodeHopLength = 33 }, "NextNodeHopLength of 33"},
+		{"per hop routing info of another scheme", kemGeo, func(g *Geometry) {
+			g.PerHopRoutingInfoLength = nikeGeo.PerHopRoutingInfoLength
+		}, "PerHopRoutingInfoLength of 82"},
+		{"routing info for hop count", nikeGeo, func(g *Geometry) { g.NrHops = 6 }, "RoutingInfoLength of 410, expected 492 for 6 hops"},
+		{"header of another scheme", nikeGeo, func(g *Geometry) {
+			g.NIKEName = "CTIDH1024"
+		}, "HeaderLength of 476"},
+		{"SURB", nikeGeo, func(g *Geometry) { g.SURBLength-- }, "SURBLength"},
+		{"forward payload", nikeGeo, func(g *Geometry) { g.UserForwardPayloadLength = 1000 }, "ForwardPayloadLength of 2574, expected 1000, or 1574 with a SURB"},
+		{"packet", kemGeo, func(g *Geometry) { g.PacketLength++ }, "PacketLength"},
+	}
+	for _, v := range vectors {
+		g := *v.geo
+		v.mutate(&g)
+		require.ErrorContains(g.Validate(), v.reason, v.name)
+	}
+
+	var g *Geometry
+	require.Error(g.Validate())
+}
+
+func TestGeometryExplain(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	g := GeometryFromUserForwardPayloadLength(schemes.ByName("x25519"), 2000, true, 5)
+	require.Equal(`sphinx packet (NIKE x25519): 3082 bytes
+  header: 476 bytes
+    additional data: 2 bytes
+    NIKE public key: 32 bytes
+    routing info: 410 bytes, 5 hops of 82 bytes
+      next node hop: 65 bytes
+      SURB reply: 17 bytes
+    MAC: 32 bytes
+  payload tag: 32 bytes
+  forward payload: 2574 bytes
+    plaintext header: 2 bytes
+    SURB: 572 bytes
+      header: 476 bytes
+      first hop node ID: 32 bytes
+      SPRP key material: 64 bytes
+    user forward payload: 2000 bytes
+`, g.Explain())
+
+	g = KEMGeometryFromUserForwardPayloadLength(kemschemes.ByName("Kyber768-X25519"), 2000, false, 5)
+	require.Contains(g.Explain(), "      KEM ciphertext: 1120 bytes\n")
+	require.NotContains(g.Explain(), "SURB:")
+}
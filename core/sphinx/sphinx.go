@@ -51,8 +51,12 @@ type Sphinx struct {
 	geometry *geo.Geometry
 }
 
-// FromGeometry returns Sphinx type given a valid Geometry.
+// FromGeometry returns Sphinx type given a valid Geometry, or an error
+// if the Geometry fails validation.
 func FromGeometry(geometry *geo.Geometry) (*Sphinx, error) {
+	if err := geometry.Validate(); err != nil {
+		return nil, fmt.Errorf("sphinx: %v", err)
+	}
 	if geometry.NIKEName != "" {
 		mynike := schemes.ByName(geometry.NIKEName)
 		if mynike == nil {
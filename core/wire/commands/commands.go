@@ -240,11 +240,15 @@ func (c *Commands) messageMsgPaddingLength() int {
 }
 
 // NoOp is a de-serialized noop command.
-type NoOp struct{}
+type NoOp struct {
+	// Padding is the number of zero bytes appended to the command, which
+	// allows NoOps of any length to be sent as cover traffic.
+	Padding int
+}
 
 // ToBytes serializes the NoOp and returns the resulting slice.
 func (c *NoOp) ToBytes() []byte {
-	out := make([]byte, cmdOverhead)
+	out := make([]byte, cmdOverhead+c.Padding)
 	out[0] = byte(noOp)
 	return out
 }
@@ -855,7 +859,7 @@ func (c *Commands) FromBytes(b []byte) (Command, error) {
 	if cmdLen == 0 {
 		switch commandID(id) {
 		case noOp:
-			return &NoOp{}, nil
+			return &NoOp{Padding: len(padding)}, nil
 		case disconnect:
 			return &Disconnect{}, nil
 		case sendPacket, postDescriptor:
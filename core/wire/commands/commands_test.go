@@ -51,6 +51,18 @@ func TestNoOp(t *testing.T) {
 	c, err := cmds.FromBytes(b)
 	require.NoError(err, "NoOp: FromBytes() failed")
 	require.IsType(cmd, c, "NoOp: FromBytes() invalid type")
+
+	cmd = &NoOp{Padding: 42}
+	b = cmd.ToBytes()
+	require.Equal(cmdOverhead+42, len(b), "NoOp: ToBytes() padded length")
+
+	c, err = cmds.FromBytes(b)
+	require.NoError(err, "NoOp: FromBytes() padded failed")
+	require.Equal(cmd, c, "NoOp: FromBytes() padded")
+
+	b[len(b)-1] = 1
+	_, err = cmds.FromBytes(b)
+	require.Error(err, "NoOp: FromBytes() non-zero padding")
 }
 
 func TestDisconnect(t *testing.T) {
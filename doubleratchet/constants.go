@@ -36,6 +36,10 @@ const (
 	// we'll keep track of.
 	MaxMissingMessages = 8
 
+	// MaxSavedKeys is the maximum number of saved message keys of
+	// missing messages, from all chains, that we'll keep.
+	MaxSavedKeys = 1024
+
 	// RatchetKeyMaxLifetime is the maximum lifetime of the ratchet
 	RatchetKeyMaxLifetime = time.Hour * 672
 
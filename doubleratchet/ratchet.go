@@ -12,10 +12,12 @@ package ratchet
 import (
 	"bytes"
 	"crypto/hmac"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"hash"
 	"io"
+	"sort"
 	"time"
 
 	"golang.org/x/crypto/curve25519"
@@ -55,7 +57,10 @@ var (
 	ErrCSIDHPublicExport                      = errors.New("Ratchet: CSIDH: failed to export public key")
 	ErrCSIDHPublicImport                      = errors.New("Ratchet: CSIDH: failed to import public key")
 	ErrCSIDHInvalidPublicKey                  = errors.New("Ratchet: CSIDH public key validation failure")
-	ErrInconsistentState                       = errors.New("Ratchet: the state is inconsistent")
+	ErrInconsistentState                      = errors.New("Ratchet: the state is inconsistent")
+	ErrCannotDecryptState                     = errors.New("Ratchet: cannot decrypt state")
+	ErrStateTooLarge                          = errors.New("Ratchet: serialized state exceeds StateSize")
+	ErrSavedKeysEvicted                       = errors.New("Ratchet: saved message key was evicted")
 
 	// These constants are used as the label argument to deriveKey to derive
 	// independent keys from a master key.
@@ -159,11 +164,16 @@ type state struct {
 	PQPrivate0           []byte
 	PQPrivate1           []byte
 	Ratchet              bool
+	MaxMissingMessages   uint32
+	SavedKeyLifetime     time.Duration
+	StateSize            int
+	MaxSavedKeys         int
 }
 
 // savedKey contains a message key and timestamp for a message which has not
 // been received. The timestamp comes from the message by which we learn of the
-// missing message.
+// missing message. The key is nil if it was evicted to respect MaxSavedKeys,
+// so that the message can be reported as lost.
 type savedKey struct {
 	key       *memguard.LockedBuffer
 	timestamp time.Time
@@ -175,6 +185,24 @@ type Ratchet struct {
 	// time. If nil, time.Now is used.
 	Now func() time.Time
 
+	// MaxMissingMessages is the maximum number of missing messages that
+	// we'll keep track of. If zero, the MaxMissingMessages constant is used.
+	MaxMissingMessages uint32
+
+	// SavedKeyLifetime is the maximum lifetime of saved message keys.
+	// If zero, RatchetKeyMaxLifetime is used.
+	SavedKeyLifetime time.Duration
+
+	// StateSize is the fixed size to which Save pads the serialized
+	// state, so that the size does not reveal the number of saved keys.
+	// If zero, the state is not padded.
+	StateSize int
+
+	// MaxSavedKeys is the maximum number of saved message keys, the
+	// oldest keys are evicted when it is exceeded. If zero, the
+	// MaxSavedKeys constant is used.
+	MaxSavedKeys int
+
 	// rootKey gets updated by the DH ratchet.
 	rootKey *memguard.LockedBuffer // 32 bytes long
 	// Header keys are used to encrypt message headers.
@@ -216,6 +244,34 @@ type Ratchet struct {
 	rand io.Reader
 }
 
+func (r *Ratchet) now() time.Time {
+	if r.Now == nil {
+		return time.Now()
+	}
+	return r.Now()
+}
+
+func (r *Ratchet) maxMissingMessages() uint32 {
+	if r.MaxMissingMessages == 0 {
+		return MaxMissingMessages
+	}
+	return r.MaxMissingMessages
+}
+
+func (r *Ratchet) savedKeyLifetime() time.Duration {
+	if r.SavedKeyLifetime == 0 {
+		return RatchetKeyMaxLifetime
+	}
+	return r.SavedKeyLifetime
+}
+
+func (r *Ratchet) maxSavedKeys() int {
+	if r.MaxSavedKeys == 0 {
+		return MaxSavedKeys
+	}
+	return r.MaxSavedKeys
+}
+
 func (r *Ratchet) randBytes(buf []byte) {
 	if _, err := io.ReadFull(r.rand, buf); err != nil {
 		panic(err)
@@ -229,7 +285,8 @@ func (r *Ratchet) randBytes(buf []byte) {
 func NewRatchetFromBytes(rand io.Reader, data []byte) (*Ratchet, error) {
 	defer utils.ExplicitBzero(data)
 	state := state{}
-	if err := cbor.Unmarshal(data, &state); err != nil {
+	// ignore the padding following the serialized state
+	if _, err := cbor.UnmarshalFirst(data, &state); err != nil {
 		return nil, err
 	}
 	return newRatchetFromState(rand, &state)
@@ -239,12 +296,16 @@ func NewRatchetFromBytes(rand io.Reader, data []byte) (*Ratchet, error) {
 // state's fields are wiped in the process of copying them.
 func newRatchetFromState(rand io.Reader, s *state) (*Ratchet, error) {
 	r := &Ratchet{
-		rand:          rand,
-		saved:         make(map[*memguard.LockedBuffer]map[uint32]savedKey),
-		sendCount:     s.SendCount,
-		recvCount:     s.RecvCount,
-		prevSendCount: s.PrevSendCount,
-		ratchet:       s.Ratchet,
+		MaxMissingMessages: s.MaxMissingMessages,
+		SavedKeyLifetime:   s.SavedKeyLifetime,
+		StateSize:          s.StateSize,
+		MaxSavedKeys:       s.MaxSavedKeys,
+		rand:               rand,
+		saved:              make(map[*memguard.LockedBuffer]map[uint32]savedKey),
+		sendCount:          s.SendCount,
+		recvCount:          s.RecvCount,
+		prevSendCount:      s.PrevSendCount,
+		ratchet:            s.Ratchet,
 	}
 	if s.RootKey != nil {
 		r.rootKey = memguard.NewBufferFromBytes(s.RootKey)
@@ -329,7 +390,7 @@ func newRatchetFromState(rand io.Reader, s *state) (*Ratchet, error) {
 			messageKeys[messageKey.Num] = savedKey
 		}
 
-		r.saved[saved.HeaderKey] = messageKeys
+		r.addSavedKeys(saved.HeaderKey, messageKeys)
 	}
 	return r, nil
 }
@@ -647,7 +708,16 @@ func (r *Ratchet) trySavedKeys(ciphertext []byte) ([]byte, error) {
 			// This is a fairly common case: the message key might
 			// not have been saved because it's the next message
 			// key.
-			return nil, nil
+			continue
+		}
+
+		if msgKey.key == nil {
+			delete(messageKeys, msgNum)
+			if len(messageKeys) == 0 {
+				delete(r.saved, headerKey)
+				headerKey.Destroy()
+			}
+			return nil, ErrSavedKeysEvicted
 		}
 
 		sealedMessage := ciphertext[sealedHeaderSize:]
@@ -684,22 +754,17 @@ func (r *Ratchet) saveKeys(headerKey, recvChainKey *memguard.LockedBuffer, messa
 	}
 
 	missingMessages := messageNum - receivedCount
-	if missingMessages > MaxMissingMessages {
+	if missingMessages > r.maxMissingMessages() {
 		err = ErrMessageExceedsReorderingLimit
 		return
 	}
 
 	// messageKeys maps from message number to message key.
 	var messageKeys map[uint32]savedKey
-	var now time.Time
 	if missingMessages > 0 {
 		messageKeys = make(map[uint32]savedKey)
 	}
-	if r.Now == nil {
-		now = time.Now()
-	} else {
-		now = r.Now()
-	}
+	now := r.now()
 
 	provisionalChainKey = memguard.NewBuffer(keySize)
 	provisionalChainKey.Copy(recvChainKey.Bytes())
@@ -729,28 +794,110 @@ func (r *Ratchet) saveKeys(headerKey, recvChainKey *memguard.LockedBuffer, messa
 // into r.saved.
 func (r *Ratchet) mergeSavedKeys(newKeys map[*memguard.LockedBuffer]map[uint32]savedKey) {
 	for headerKey, newMessageKeys := range newKeys {
-		messageKeys, ok := r.saved[headerKey]
-		if ok {
-			// We already have it so Destroy the new copy.
-			headerKey.Destroy()
-			for _, messageKey := range newMessageKeys {
-				messageKey.key.Destroy()
-			}
-		} else {
-			r.saved[headerKey] = newMessageKeys
+		r.addSavedKeys(headerKey, newMessageKeys)
+	}
+	r.evictSavedKeys()
+}
+
+// addSavedKeys adds message keys saved under a header key to r.saved,
+// which holds a single entry per header key. If the header key is already
+// saved the message keys are merged into its entry and the new copy of
+// the header key is destroyed.
+func (r *Ratchet) addSavedKeys(headerKey *memguard.LockedBuffer, newMessageKeys map[uint32]savedKey) {
+	for savedHeaderKey, messageKeys := range r.saved {
+		if !hmac.Equal(savedHeaderKey.Bytes(), headerKey.Bytes()) {
 			continue
 		}
-
+		headerKey.Destroy()
 		for n, messageKey := range newMessageKeys {
+			if old, ok := messageKeys[n]; ok && old.key != nil {
+				old.key.Destroy()
+			}
 			messageKeys[n] = messageKey
 		}
+		return
 	}
+	r.saved[headerKey] = newMessageKeys
+}
+
+// evictSavedKeys destroys the oldest saved message keys in excess of
+// MaxSavedKeys. The message numbers of the evicted keys are remembered,
+// without a key, until they expire so that Decrypt returns
+// ErrSavedKeysEvicted for them.
+func (r *Ratchet) evictSavedKeys() {
+	type savedKeyRef struct {
+		messageKeys map[uint32]savedKey
+		num         uint32
+		timestamp   time.Time
+	}
+	var refs []savedKeyRef
+	for _, messageKeys := range r.saved {
+		for n, savedKey := range messageKeys {
+			if savedKey.key != nil {
+				refs = append(refs, savedKeyRef{messageKeys, n, savedKey.timestamp})
+			}
+		}
+	}
+	excess := len(refs) - r.maxSavedKeys()
+	if excess <= 0 {
+		return
+	}
+	sort.Slice(refs, func(i, j int) bool {
+		if !refs[i].timestamp.Equal(refs[j].timestamp) {
+			return refs[i].timestamp.Before(refs[j].timestamp)
+		}
+		return refs[i].num < refs[j].num
+	})
+	for _, ref := range refs[:excess] {
+		ref.messageKeys[ref.num].key.Destroy()
+		ref.messageKeys[ref.num] = savedKey{timestamp: ref.timestamp}
+	}
+}
+
+// SavedKeyCount returns the number of message keys saved for messages
+// which were skipped and not received yet.
+func (r *Ratchet) SavedKeyCount() int {
+	count := 0
+	for _, messageKeys := range r.saved {
+		for _, savedKey := range messageKeys {
+			if savedKey.key != nil {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// PruneSavedKeys destroys the saved message keys which are older than
+// lifetime at the time now, and returns the number of keys removed.
+// Expired keys are otherwise only dropped when the Ratchet is saved.
+func (r *Ratchet) PruneSavedKeys(now time.Time, lifetime time.Duration) int {
+	removed := 0
+	for headerKey, messageKeys := range r.saved {
+		for n, savedKey := range messageKeys {
+			if now.Sub(savedKey.timestamp) <= lifetime {
+				continue
+			}
+			if savedKey.key != nil {
+				savedKey.key.Destroy()
+				removed++
+			}
+			delete(messageKeys, n)
+		}
+		if len(messageKeys) == 0 {
+			delete(r.saved, headerKey)
+			headerKey.Destroy()
+		}
+	}
+	return removed
 }
 
 func (r *Ratchet) wipeSavedKeys() {
 	for headerKey, keys := range r.saved {
 		for _, savedKey := range keys {
-			savedKey.key.Destroy()
+			if savedKey.key != nil {
+				savedKey.key.Destroy()
+			}
 		}
 		delete(r.saved, headerKey)
 		headerKey.Destroy()
@@ -893,13 +1040,74 @@ func (r *Ratchet) Decrypt(ciphertext []byte) ([]byte, error) {
 	return msg, nil
 }
 
-// Save transforms the object into a stream
+// Save transforms the object into a stream. If StateSize is set the
+// stream is padded to StateSize bytes, or ErrStateTooLarge is returned
+// if the serialized state does not fit.
 func (r *Ratchet) Save() (data []byte, err error) {
-	s, err := r.marshal(time.Now(), RatchetKeyMaxLifetime)
+	s, err := r.marshal(r.now(), r.savedKeyLifetime())
+	if err != nil {
+		return nil, err
+	}
+	data, err = cbor.Marshal(s)
+	if err != nil || r.StateSize == 0 {
+		return data, err
+	}
+	if len(data) > r.StateSize {
+		utils.ExplicitBzero(data)
+		return nil, ErrStateTooLarge
+	}
+	padded := make([]byte, r.StateSize)
+	copy(padded, data)
+	utils.ExplicitBzero(data)
+	return padded, nil
+}
+
+// MarshalBinaryEncrypted is like Save except that the serialized state
+// is encrypted with the given key using secretbox. The random nonce is
+// prepended to the ciphertext.
+func (r *Ratchet) MarshalBinaryEncrypted(key *[32]byte) ([]byte, error) {
+	plaintext, err := r.Save()
 	if err != nil {
 		return nil, err
 	}
-	return cbor.Marshal(s)
+	defer utils.ExplicitBzero(plaintext)
+	nonce := [nonceSize]byte{}
+	if _, err := io.ReadFull(r.rand, nonce[:]); err != nil {
+		return nil, err
+	}
+	return secretbox.Seal(nonce[:], plaintext, &nonce, key), nil
+}
+
+// UnmarshalBinaryEncrypted decrypts data with the given key and loads
+// the resulting state into r, replacing any previous state.
+// ErrCannotDecryptState is returned if the ciphertext is corrupted
+// or the key is wrong.
+func (r *Ratchet) UnmarshalBinaryEncrypted(key *[32]byte, data []byte) error {
+	if len(data) < nonceSize+secretbox.Overhead {
+		return ErrCannotDecryptState
+	}
+	nonce := [nonceSize]byte{}
+	copy(nonce[:], data[:nonceSize])
+	plaintext, ok := secretbox.Open(nil, data[nonceSize:], &nonce, key)
+	if !ok {
+		return ErrCannotDecryptState
+	}
+	defer utils.ExplicitBzero(plaintext)
+	rng := r.rand
+	if rng == nil {
+		rng = rand.Reader
+	}
+	newR, err := NewRatchetFromBytes(rng, plaintext)
+	if err != nil {
+		return err
+	}
+	newR.Now = r.Now
+	// destroy the key material of the replaced state
+	if r.rootKey != nil {
+		DestroyRatchet(r)
+	}
+	*r = *newR
+	return nil
 }
 
 // Marshal transforms the object into a stream
@@ -918,6 +1126,10 @@ func (r *Ratchet) marshal(now time.Time, lifetime time.Duration) (*state, error)
 		RecvCount:          r.recvCount,
 		PrevSendCount:      r.prevSendCount,
 		Ratchet:            r.ratchet,
+		MaxMissingMessages: r.MaxMissingMessages,
+		SavedKeyLifetime:   r.SavedKeyLifetime,
+		StateSize:          r.StateSize,
+		MaxSavedKeys:       r.MaxSavedKeys,
 	}
 
 	s.SendPQRatchetPrivate = make([]byte, csidh.PrivateKeySize)
@@ -943,7 +1155,7 @@ func (r *Ratchet) marshal(now time.Time, lifetime time.Duration) (*state, error)
 	for headerKey, messageKeys := range r.saved {
 		keys := make([]*messageKey, 0, len(messageKeys))
 		for messageNum, savedKey := range messageKeys {
-			if now.Sub(savedKey.timestamp) > lifetime {
+			if savedKey.key == nil || now.Sub(savedKey.timestamp) > lifetime {
 				continue
 			}
 			keys = append(keys, &messageKey{
@@ -952,6 +1164,9 @@ func (r *Ratchet) marshal(now time.Time, lifetime time.Duration) (*state, error)
 				CreationTime: savedKey.timestamp.UnixNano(),
 			})
 		}
+		if len(keys) == 0 {
+			continue
+		}
 		s.SavedKeys = append(s.SavedKeys, &savedKeys{
 			HeaderKey:   headerKey,
 			MessageKeys: keys,
@@ -4,7 +4,9 @@ import (
 	"crypto/rand"
 	"fmt"
 	"testing"
+	"time"
 
+	"github.com/fxamacker/cbor/v2"
 	"github.com/stretchr/testify/require"
 )
 
@@ -346,3 +348,340 @@ func Test_RatchetDuplicateMessage(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, msg3, result)
 }
+
+func Test_SerializationEncrypted(t *testing.T) {
+	a, b := pairedRatchet(t)
+
+	msg := []byte("test message")
+	encrypted, err := a.Encrypt(nil, msg)
+	require.NoError(t, err)
+	result, err := b.Decrypt(encrypted)
+	require.NoError(t, err)
+	require.Equal(t, msg, result)
+
+	key := &[32]byte{}
+	_, err = rand.Reader.Read(key[:])
+	require.NoError(t, err)
+
+	serialized, err := a.MarshalBinaryEncrypted(key)
+	require.NoError(t, err)
+
+	r, err := InitRatchet(rand.Reader)
+	require.NoError(t, err)
+	oldRootKey, oldKxPrivate0 := r.rootKey, r.kxPrivate0
+	err = r.UnmarshalBinaryEncrypted(key, serialized)
+	require.NoError(t, err)
+
+	// The key material of the replaced state is destroyed.
+	require.False(t, oldRootKey.IsAlive())
+	require.False(t, oldKxPrivate0.IsAlive())
+	require.True(t, r.rootKey.IsAlive())
+
+	msg2 := []byte("test message number two")
+	encrypted, err = r.Encrypt(nil, msg2)
+	require.NoError(t, err)
+	result, err = b.Decrypt(encrypted)
+	require.NoError(t, err)
+	require.Equal(t, msg2, result)
+
+	DestroyRatchet(a)
+	DestroyRatchet(b)
+	DestroyRatchet(r)
+}
+
+func Test_SerializationEncryptedWrongKey(t *testing.T) {
+	a, err := InitRatchet(rand.Reader)
+	require.NoError(t, err)
+
+	key := &[32]byte{}
+	_, err = rand.Reader.Read(key[:])
+	require.NoError(t, err)
+	serialized, err := a.MarshalBinaryEncrypted(key)
+	require.NoError(t, err)
+
+	wrongKey := &[32]byte{}
+	_, err = rand.Reader.Read(wrongKey[:])
+	require.NoError(t, err)
+
+	r := new(Ratchet)
+	err = r.UnmarshalBinaryEncrypted(wrongKey, serialized)
+	require.Equal(t, ErrCannotDecryptState, err)
+
+	serialized[len(serialized)-1] ^= 0xff
+	err = r.UnmarshalBinaryEncrypted(key, serialized)
+	require.Equal(t, ErrCannotDecryptState, err)
+}
+
+func Test_SerializationEncryptedTruncated(t *testing.T) {
+	a, err := InitRatchet(rand.Reader)
+	require.NoError(t, err)
+
+	key := &[32]byte{}
+	_, err = rand.Reader.Read(key[:])
+	require.NoError(t, err)
+	serialized, err := a.MarshalBinaryEncrypted(key)
+	require.NoError(t, err)
+
+	r := new(Ratchet)
+	for _, n := range []int{0, nonceSize, nonceSize + 10, len(serialized) - 1} {
+		err = r.UnmarshalBinaryEncrypted(key, serialized[:n])
+		require.Equal(t, ErrCannotDecryptState, err)
+	}
+}
+
+func Test_RatchetMaxMissingMessages(t *testing.T) {
+	a, b := pairedRatchet(t)
+	b.MaxMissingMessages = 3
+
+	msg := []byte("test message")
+	for i := 0; i < 5; i++ {
+		_, err := a.Encrypt(nil, msg)
+		require.NoError(t, err)
+	}
+	encrypted, err := a.Encrypt(nil, msg)
+	require.NoError(t, err)
+	_, err = b.Decrypt(encrypted)
+	require.Equal(t, ErrMessageExceedsReorderingLimit, err)
+
+	DestroyRatchet(a)
+	DestroyRatchet(b)
+}
+
+func Test_SerializationLimits(t *testing.T) {
+	a, _ := pairedRatchet(t)
+	a.MaxMissingMessages = 3
+	a.SavedKeyLifetime = time.Hour
+	a.MaxSavedKeys = 10
+
+	serialized, err := a.Save()
+	require.NoError(t, err)
+	r, err := NewRatchetFromBytes(rand.Reader, serialized)
+	require.NoError(t, err)
+	require.Equal(t, uint32(3), r.MaxMissingMessages)
+	require.Equal(t, time.Hour, r.SavedKeyLifetime)
+	require.Equal(t, 10, r.MaxSavedKeys)
+
+	DestroyRatchet(a)
+	DestroyRatchet(r)
+}
+
+func Test_SerializationPadded(t *testing.T) {
+	a, b := pairedRatchet(t)
+	b.StateSize = 16384
+
+	empty, err := b.Save()
+	require.NoError(t, err)
+	require.Len(t, empty, b.StateSize)
+
+	// Skip some messages so that b saves their keys.
+	msg := []byte("test message")
+	var last []byte
+	for i := 0; i < 5; i++ {
+		last, err = a.Encrypt(nil, msg)
+		require.NoError(t, err)
+	}
+	result, err := b.Decrypt(last)
+	require.NoError(t, err)
+	require.Equal(t, msg, result)
+	require.NotEmpty(t, b.saved)
+
+	saved, err := b.Save()
+	require.NoError(t, err)
+	require.Len(t, saved, len(empty))
+
+	r, err := NewRatchetFromBytes(rand.Reader, saved)
+	require.NoError(t, err)
+	require.Equal(t, 16384, r.StateSize)
+	require.Len(t, r.saved, len(b.saved))
+	encrypted, err := a.Encrypt(nil, msg)
+	require.NoError(t, err)
+	result, err = r.Decrypt(encrypted)
+	require.NoError(t, err)
+	require.Equal(t, msg, result)
+
+	// The state may fill the StateSize exactly.
+	for {
+		s, err := r.marshal(r.now(), r.savedKeyLifetime())
+		require.NoError(t, err)
+		unpadded, err := cbor.Marshal(s)
+		require.NoError(t, err)
+		if len(unpadded) == r.StateSize {
+			break
+		}
+		r.StateSize = len(unpadded)
+	}
+	exact, err := r.Save()
+	require.NoError(t, err)
+	require.Len(t, exact, r.StateSize)
+	r2, err := NewRatchetFromBytes(rand.Reader, exact)
+	require.NoError(t, err)
+
+	r.StateSize--
+	_, err = r.Save()
+	require.ErrorIs(t, err, ErrStateTooLarge)
+
+	DestroyRatchet(a)
+	DestroyRatchet(b)
+	DestroyRatchet(r)
+	DestroyRatchet(r2)
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func reinitRatchetWithClock(t *testing.T, r *Ratchet, clock *fakeClock) *Ratchet {
+	newR := reinitRatchet(t, r)
+	newR.Now = clock.Now
+	return newR
+}
+
+func Test_RatchetFakeClockSavedKeyExpiry(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	a, b := pairedRatchet(t)
+	a.Now = clock.Now
+	b.Now = clock.Now
+
+	msg := []byte("test message")
+	encrypted := make([][]byte, 4)
+	for i := range encrypted {
+		var err error
+		encrypted[i], err = a.Encrypt(nil, msg)
+		require.NoError(t, err)
+	}
+
+	// Skip the first three messages, saving their keys.
+	result, err := b.Decrypt(encrypted[3])
+	require.NoError(t, err)
+	require.Equal(t, msg, result)
+
+	// Still within the saved key lifetime.
+	clock.Advance(RatchetKeyMaxLifetime - time.Hour)
+	b = reinitRatchetWithClock(t, b, clock)
+	result, err = b.Decrypt(encrypted[0])
+	require.NoError(t, err)
+	require.Equal(t, msg, result)
+
+	// Duplicate messages are rejected.
+	_, err = b.Decrypt(encrypted[0])
+	require.Equal(t, ErrDuplicateOrDelayed, err)
+	_, err = b.Decrypt(encrypted[3])
+	require.Equal(t, ErrDuplicateOrDelayed, err)
+
+	// Past the saved key lifetime the remaining keys are dropped.
+	clock.Advance(2 * time.Hour)
+	b = reinitRatchetWithClock(t, b, clock)
+	_, err = b.Decrypt(encrypted[1])
+	require.Equal(t, ErrDuplicateOrDelayed, err)
+	_, err = b.Decrypt(encrypted[2])
+	require.Equal(t, ErrDuplicateOrDelayed, err)
+
+	DestroyRatchet(a)
+	DestroyRatchet(b)
+}
+
+func Test_RatchetFakeClockSavedKeyLifetime(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	a, b := pairedRatchet(t)
+	a.Now = clock.Now
+	b.Now = clock.Now
+	b.SavedKeyLifetime = time.Minute
+
+	msg := []byte("test message")
+	delayed, err := a.Encrypt(nil, msg)
+	require.NoError(t, err)
+	encrypted, err := a.Encrypt(nil, msg)
+	require.NoError(t, err)
+	_, err = b.Decrypt(encrypted)
+	require.NoError(t, err)
+
+	// The delayed message arrives after the configured lifetime.
+	clock.Advance(2 * time.Minute)
+	b = reinitRatchetWithClock(t, b, clock)
+	_, err = b.Decrypt(delayed)
+	require.Equal(t, ErrDuplicateOrDelayed, err)
+
+	// Messages delivered in order are unaffected by the clock.
+	encrypted, err = a.Encrypt(nil, msg)
+	require.NoError(t, err)
+	result, err := b.Decrypt(encrypted)
+	require.NoError(t, err)
+	require.Equal(t, msg, result)
+
+	DestroyRatchet(a)
+	DestroyRatchet(b)
+}
+
+func Test_RatchetSavedKeys(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1700000000, 0)}
+	a, b := pairedRatchet(t)
+	a.Now = clock.Now
+	b.Now = clock.Now
+	b.MaxSavedKeys = 10
+	require.Equal(t, 0, b.SavedKeyCount())
+
+	msg := []byte("test message")
+	var encrypted [][]byte
+	skip := func(n int) {
+		for i := 0; i <= n; i++ {
+			ciphertext, err := a.Encrypt(nil, msg)
+			require.NoError(t, err)
+			encrypted = append(encrypted, ciphertext)
+		}
+		result, err := b.Decrypt(encrypted[len(encrypted)-1])
+		require.NoError(t, err)
+		require.Equal(t, msg, result)
+	}
+
+	// Skip messages 0 to 6, and an hour later 8 to 13.
+	skip(7)
+	require.Equal(t, 7, b.SavedKeyCount())
+	clock.Advance(time.Hour)
+	skip(6)
+
+	// The keys of both batches are saved under the same header key.
+	require.Len(t, b.saved, 1)
+
+	// The oldest keys were evicted.
+	require.Equal(t, 10, b.SavedKeyCount())
+	for i := 0; i < 3; i++ {
+		_, err := b.Decrypt(encrypted[i])
+		require.Equal(t, ErrSavedKeysEvicted, err)
+	}
+	_, err := b.Decrypt(encrypted[0])
+	require.Equal(t, ErrDuplicateOrDelayed, err)
+	result, err := b.Decrypt(encrypted[3])
+	require.NoError(t, err)
+	require.Equal(t, msg, result)
+	require.Equal(t, 9, b.SavedKeyCount())
+
+	// Pruning removes the remaining keys of the first batch.
+	clock.Advance(30 * time.Minute)
+	require.Equal(t, 3, b.PruneSavedKeys(clock.Now(), time.Hour))
+	require.Equal(t, 6, b.SavedKeyCount())
+	require.Equal(t, 0, b.PruneSavedKeys(clock.Now(), time.Hour))
+	_, err = b.Decrypt(encrypted[4])
+	require.Equal(t, ErrDuplicateOrDelayed, err)
+
+	// The remaining keys survive serialization.
+	b = reinitRatchetWithClock(t, b, clock)
+	require.Equal(t, 6, b.SavedKeyCount())
+	for i := 8; i < 14; i++ {
+		result, err := b.Decrypt(encrypted[i])
+		require.NoError(t, err)
+		require.Equal(t, msg, result)
+	}
+	require.Equal(t, 0, b.SavedKeyCount())
+	require.Empty(t, b.saved)
+
+	DestroyRatchet(a)
+	DestroyRatchet(b)
+}
@@ -72,6 +72,7 @@ type katzenpost struct {
 	clientIdx   int
 	providerIdx int
 	hasPanda    bool
+	echoPlugin  bool
 }
 
 type AuthById []*vConfig.Authority
@@ -223,10 +224,24 @@ func (s *katzenpost) genNodeConfig(isProvider bool, isVoting bool) error {
 			}
 		}
 
-		echoCfg := new(sConfig.Kaetzchen)
-		echoCfg.Capability = "echo"
-		echoCfg.Endpoint = "+echo"
-		cfg.Provider.Kaetzchen = append(cfg.Provider.Kaetzchen, echoCfg)
+		if s.echoPlugin {
+			echoCfg := &sConfig.CBORPluginKaetzchen{
+				Capability:     "echo",
+				Endpoint:       "+echo",
+				Command:        s.baseDir + "/echo_server" + s.binSuffix,
+				MaxConcurrency: 1,
+				Config: map[string]interface{}{
+					"log_dir":   s.baseDir + "/" + cfg.Server.Identifier,
+					"log_level": s.logLevel,
+				},
+			}
+			cfg.Provider.CBORPluginKaetzchen = append(cfg.Provider.CBORPluginKaetzchen, echoCfg)
+		} else {
+			echoCfg := new(sConfig.Kaetzchen)
+			echoCfg.Capability = "echo"
+			echoCfg.Endpoint = "+echo"
+			cfg.Provider.Kaetzchen = append(cfg.Provider.Kaetzchen, echoCfg)
+		}
 
 		/*
 			keysvrCfg := new(sConfig.Kaetzchen)
@@ -342,6 +357,7 @@ func main() {
 	binSuffix := flag.String("S", "", "suffix for binaries in docker-compose.yml")
 	logLevel := flag.String("log_level", "DEBUG", "logging level could be set to: DEBUG, INFO, NOTICE, WARNING, ERROR, CRITICAL")
 	omitTopology := flag.Bool("D", false, "Dynamic topology (omit fixed topology definition)")
+	echoPlugin := flag.Bool("echoPlugin", false, "Run the echo service as an external cbor plugin instead of the built-in Kaetzchen")
 	kem := flag.String("kem", "", "Name of the KEM Scheme to be used with Sphinx")
 	nike := flag.String("nike", "x25519", "Name of the NIKE Scheme to be used with Sphinx")
 	UserForwardPayloadLength := flag.Int("UserForwardPayloadLength", 2000, "UserForwardPayloadLength")
@@ -390,6 +406,7 @@ func main() {
 	s.lastPort = s.basePort + 1
 	s.bindAddr = *bindAddr
 	s.logLevel = *logLevel
+	s.echoPlugin = *echoPlugin
 
 	nrHops := *nrLayers + 2
 
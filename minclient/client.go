@@ -116,6 +116,28 @@ type ClientConfig struct {
 	// EnableTimeSync enables the use of skewed remote provider time
 	// instead of system time when available.
 	EnableTimeSync bool
+
+	// DocumentRetention is the number of past epochs for which PKI
+	// documents are retained.  If left unset, only the documents for
+	// the current and future epochs are retained.
+	DocumentRetention int
+
+	// EnableLinkCover enables sending every command to the Provider on
+	// a Poisson schedule, with randomly padded NoOp commands sent as
+	// cover traffic when no real command is queued, so that the rate of
+	// commands on the link does not reveal the real traffic.
+	EnableLinkCover bool
+
+	// LinkCoverLambda is the inverse of the mean of the exponential
+	// distribution that the delay in milliseconds between commands sent
+	// to the Provider is sampled from when EnableLinkCover is set.  If
+	// left unset, the LambdaP of the current PKI document will be used.
+	LinkCoverLambda float64
+
+	// LinkCoverMaxDelay is the maximum delay in milliseconds between
+	// commands sent to the Provider when EnableLinkCover is set.  If left
+	// unset, the LambdaPMaxDelay of the current PKI document will be used.
+	LinkCoverMaxDelay uint64
 }
 
 func (cfg *ClientConfig) validate() error {
@@ -141,6 +163,9 @@ func (cfg *ClientConfig) validate() error {
 	if cfg.PKIClient == nil {
 		return fmt.Errorf("minclient: no PKIClient provided")
 	}
+	if cfg.DocumentRetention < 0 {
+		return fmt.Errorf("minclient: invalid DocumentRetention: %v", cfg.DocumentRetention)
+	}
 	return nil
 }
 
@@ -153,6 +153,16 @@ func (c *Client) ForceFetchPKI() {
 	}
 }
 
+// maxPollInterval returns the upper bound of the adaptive poll interval,
+// derived from the LambdaP parameters of the current PKI document.
+func (c *connection) maxPollInterval() time.Duration {
+	doc := c.c.CurrentDocument()
+	if doc == nil {
+		return c.c.getPollInterval()
+	}
+	return time.Duration(doc.LambdaPMaxDelay) * time.Millisecond
+}
+
 func (c *connection) onPKIFetch() {
 	doc := c.c.CurrentDocument()
 	if doc != nil {
@@ -405,7 +415,15 @@ func (c *connection) onTCPConn(conn net.Conn) {
 	c.onWireConn(w)
 }
 
-func (c *connection) onWireConn(w *wire.Session) {
+// wireSession is the part of a wire.Session used once the handshake
+// completed.
+type wireSession interface {
+	commandSender
+	RecvCommand() (commands.Command, error)
+	PeerCredentials() (*wire.PeerCredentials, error)
+}
+
+func (c *connection) onWireConn(w wireSession) {
 	c.onConnStatusChange(nil)
 
 	var wireErr error
@@ -479,7 +497,11 @@ func (c *connection) onWireConn(w *wire.Session) {
 		}
 	}()
 
+	cover := c.newLinkCover()
+	defer cover.stop(ErrNotConnected)
+
 	var fetchDelay time.Duration
+	var poll pollSchedule
 	var selectAt time.Time
 	adjFetchDelay := func() {
 		sendAt := time.Now()
@@ -515,9 +537,7 @@ func (c *connection) onWireConn(w *wire.Session) {
 				cmd := &commands.GetConsensus{
 					Epoch: ctx.epoch,
 				}
-				wireErr = w.SendCommand(cmd)
-				ctx.doneFn(wireErr)
-				if wireErr != nil {
+				if wireErr = cover.sendCommand(w, cmd, ctx.doneFn); wireErr != nil {
 					c.log.Debugf("Failed to send GetConsensus: %v", wireErr)
 					return
 				}
@@ -531,14 +551,21 @@ func (c *connection) onWireConn(w *wire.Session) {
 			cmd := &commands.SendPacket{
 				SphinxPacket: ctx.pkt,
 			}
-			wireErr = w.SendCommand(cmd)
-			ctx.doneFn(wireErr)
-			if wireErr != nil {
+			if wireErr = cover.sendCommand(w, cmd, ctx.doneFn); wireErr != nil {
 				c.log.Debugf("Failed to send SendPacket: %v", wireErr)
 				return
 			}
 			c.log.Debugf("Sent SendPacket.")
 
+			adjFetchDelay()
+			continue
+		case <-cover.C():
+			if wireErr = cover.send(w); wireErr != nil {
+				c.log.Debugf("Failed to send on the cover schedule: %v", wireErr)
+				return
+			}
+			c.log.Debugf("Sent on the cover schedule.")
+
 			adjFetchDelay()
 			continue
 		case tmp, ok := <-cmdCh:
@@ -567,14 +594,15 @@ func (c *connection) onWireConn(w *wire.Session) {
 				cmd := &commands.RetrieveMessage{
 					Sequence: seq,
 				}
-				if wireErr = w.SendCommand(cmd); wireErr != nil {
+				if wireErr = cover.sendCommand(w, cmd, nil); wireErr != nil {
 					c.log.Debugf("Failed to send RetrieveMessage: %v", wireErr)
 					return
 				}
 				c.log.Debugf("Sent RetrieveMessage: %d", seq)
 				nrReqs++
 			}
-			fetchDelay = c.c.getPollInterval()
+			poll.onFetch()
+			fetchDelay = poll.next(c.c.getPollInterval(), c.maxPollInterval())
 			adjFetchDelay()
 			continue
 		}
@@ -607,6 +635,8 @@ func (c *connection) onWireConn(w *wire.Session) {
 				return
 			}
 			nrResps++
+			poll.onEmpty()
+			fetchDelay = poll.next(c.c.getPollInterval(), c.maxPollInterval())
 			if wireErr = dispatchOnEmpty(); wireErr != nil {
 				return
 			}
@@ -628,6 +658,8 @@ func (c *connection) onWireConn(w *wire.Session) {
 				}()
 			}
 			seq++
+			poll.onMessage(cmd.QueueSizeHint)
+			fetchDelay = poll.next(c.c.getPollInterval(), c.maxPollInterval())
 			if cmd.QueueSizeHint == 0 {
 				c.log.Debugf("QueueSizeHint indicates empty queue, calling dispatchOnEmpty.")
 				if wireErr = dispatchOnEmpty(); wireErr != nil {
@@ -653,6 +685,8 @@ func (c *connection) onWireConn(w *wire.Session) {
 				}()
 			}
 			seq++
+			poll.onMessage(cmd.QueueSizeHint)
+			fetchDelay = poll.next(c.c.getPollInterval(), c.maxPollInterval())
 		case *commands.Consensus:
 			if consensusCtx != nil {
 				c.log.Debugf("Received Consensus: ErrorCode: %v, Payload %v bytes", cmd.ErrorCode, len(cmd.Payload))
@@ -731,7 +765,7 @@ func (c *connection) sendPacket(pkt []byte) error {
 	}
 	c.Unlock()
 
-	errCh := make(chan error)
+	errCh := make(chan error, 1)
 	select {
 	case c.sendCh <- &connSendCtx{
 		pkt: pkt,
@@ -760,7 +794,7 @@ func (c *connection) getConsensus(ctx context.Context, epoch uint64) (*commands.
 	}
 	c.Unlock()
 
-	errCh := make(chan error)
+	errCh := make(chan error, 1)
 	replyCh := make(chan interface{})
 	select {
 	case c.getConsensusCh <- &getConsensusCtx{
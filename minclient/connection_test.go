@@ -0,0 +1,189 @@
+// connection_test.go - Connection loop tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minclient
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/hpqc/hash"
+
+	"github.com/katzenpost/katzenpost/core/epochtime"
+	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/core/pki/pkitest"
+	"github.com/katzenpost/katzenpost/core/wire"
+	"github.com/katzenpost/katzenpost/core/wire/commands"
+)
+
+// fakeWire is a wire session to a Provider which answers each
+// RetrieveMessage with the next of its responses, and MessageEmpty once
+// they are used up.
+type fakeWire struct {
+	sync.Mutex
+
+	creds     *wire.PeerCredentials
+	responses []func(seq uint32) commands.Command
+	recvCh    chan commands.Command
+	closeCh   chan struct{}
+
+	fetches []time.Time
+	sent    []commands.Command
+	sentAt  []time.Time
+}
+
+func (w *fakeWire) SendCommand(cmd commands.Command) error {
+	w.Lock()
+	w.sent = append(w.sent, cmd)
+	w.sentAt = append(w.sentAt, time.Now())
+	r, ok := cmd.(*commands.RetrieveMessage)
+	if !ok {
+		w.Unlock()
+		return nil
+	}
+	w.fetches = append(w.fetches, time.Now())
+	var reply commands.Command = &commands.MessageEmpty{Sequence: r.Sequence}
+	if len(w.responses) > 0 {
+		reply = w.responses[0](r.Sequence)
+		w.responses = w.responses[1:]
+	}
+	w.Unlock()
+	go func() {
+		select {
+		case w.recvCh <- reply:
+		case <-w.closeCh:
+		}
+	}()
+	return nil
+}
+
+func (w *fakeWire) RecvCommand() (commands.Command, error) {
+	select {
+	case cmd := <-w.recvCh:
+		return cmd, nil
+	case <-w.closeCh:
+		return nil, errors.New("session closed")
+	}
+}
+
+func (w *fakeWire) PeerCredentials() (*wire.PeerCredentials, error) {
+	return w.creds, nil
+}
+
+func (w *fakeWire) fetchTimes() []time.Time {
+	w.Lock()
+	defer w.Unlock()
+	return append([]time.Time{}, w.fetches...)
+}
+
+func (w *fakeWire) sentCommands() ([]commands.Command, []time.Time) {
+	w.Lock()
+	defer w.Unlock()
+	return append([]commands.Command{}, w.sent...), append([]time.Time{}, w.sentAt...)
+}
+
+// newTestWireConn returns a connection to the Provider of a test
+// document and a fakeWire session to it.  configure may adjust the
+// client configuration, including the cached document.
+func newTestWireConn(t *testing.T, configure func(*ClientConfig)) (*connection, *fakeWire) {
+	require := require.New(t)
+
+	epoch, _, _ := epochtime.Now()
+	b := pkitest.NewDocumentBuilder(epoch).WithMixLayers(1, 1).WithProviders(1)
+	doc, err := b.Build()
+	require.NoError(err)
+	provider := doc.Providers[0]
+	identityKey, _, err := b.Identity(provider.Name)
+	require.NoError(err)
+	linkKey, err := wire.DefaultScheme.UnmarshalBinaryPublicKey(provider.LinkKey)
+	require.NoError(err)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	cfg := &ClientConfig{
+		Provider:       provider.Name,
+		ProviderKeyPin: identityKey,
+		LogBackend:     logBackend,
+		CachedDocument: doc,
+	}
+	configure(cfg)
+	c := &Client{cfg: cfg}
+	c.pki = newPKI(c)
+	conn := newConnection(c)
+
+	identityHash := hash.Sum256(provider.IdentityKey)
+	w := &fakeWire{
+		creds: &wire.PeerCredentials{
+			AdditionalData: identityHash[:],
+			PublicKey:      linkKey,
+		},
+		recvCh:  make(chan commands.Command),
+		closeCh: make(chan struct{}),
+	}
+	return conn, w
+}
+
+// runWireConn runs the connection loop on w until the returned function
+// is called.
+func runWireConn(conn *connection, w *fakeWire) func() {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn.onWireConn(w)
+	}()
+	return func() {
+		conn.Halt()
+		<-done
+		close(w.closeCh)
+	}
+}
+
+func queuedMessage(seq uint32) commands.Command {
+	return &commands.Message{Sequence: seq, QueueSizeHint: 1}
+}
+
+func TestOnWireConnPollSchedule(t *testing.T) {
+	require := require.New(t)
+
+	const pollInterval = 100 * time.Millisecond
+	conn, w := newTestWireConn(t, func(cfg *ClientConfig) {
+		cfg.MessagePollInterval = pollInterval
+		// back off up to 4 times the poll interval
+		cfg.CachedDocument.LambdaPMaxDelay = uint64(4 * pollInterval / time.Millisecond)
+	})
+	// two queued messages are drained without delay
+	w.responses = []func(uint32) commands.Command{queuedMessage, queuedMessage}
+
+	stop := runWireConn(conn, w)
+	require.Eventually(func() bool {
+		return len(w.fetchTimes()) >= 7
+	}, 5*time.Second, 10*time.Millisecond)
+	stop()
+
+	// The first fetch is immediate, the queued messages are fetched
+	// right after each other, and consecutive empty responses back off
+	// up to the maximum.
+	fetches := w.fetchTimes()
+	expected := []time.Duration{0, 0, pollInterval, pollInterval, 2 * pollInterval, 4 * pollInterval}
+	for i, delay := range expected {
+		interval := fetches[i+1].Sub(fetches[i])
+		require.GreaterOrEqual(interval, delay-10*time.Millisecond, "fetch %d", i+1)
+		require.Less(interval, delay+pollInterval/2, "fetch %d", i+1)
+	}
+}
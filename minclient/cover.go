@@ -0,0 +1,196 @@
+// cover.go - Link cover traffic.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minclient
+
+import (
+	"math"
+	mRand "math/rand"
+	"time"
+
+	"github.com/katzenpost/hpqc/rand"
+
+	"github.com/katzenpost/katzenpost/core/wire/commands"
+)
+
+type commandSender interface {
+	SendCommand(commands.Command) error
+}
+
+// linkCover sends every command to the Provider on a single Poisson
+// schedule, so that the rate of commands on the link does not depend on
+// the real traffic.  Each time the timer fires, the oldest queued command
+// is sent, or a randomly padded NoOp if there is none.  Real commands are
+// delayed until the next time the timer fires in exchange.
+//
+// A nil linkCover sends commands right away, and its channel never fires.
+type linkCover struct {
+	rng        *mRand.Rand
+	params     func() (lambda float64, maxDelay time.Duration)
+	maxPadding int
+	timer      *time.Timer
+	scheduled  bool
+	queue      []*coverCmd
+}
+
+type coverCmd struct {
+	cmd    commands.Command
+	doneFn func(error)
+}
+
+// newLinkCover returns a linkCover whose delay is parameterized by the
+// given function, and whose NoOps are padded with up to maxPadding bytes.
+func newLinkCover(params func() (float64, time.Duration), maxPadding int) *linkCover {
+	l := &linkCover{
+		rng:        rand.NewMath(),
+		params:     params,
+		maxPadding: maxPadding,
+		timer:      time.NewTimer(time.Hour),
+	}
+	l.reset()
+	return l
+}
+
+// C returns the channel that fires when a command is due.
+func (l *linkCover) C() <-chan time.Time {
+	if l == nil {
+		return nil
+	}
+	return l.timer.C
+}
+
+// nextDelay returns the delay before the next command, or false if the
+// parameters do not allow for cover traffic.
+func (l *linkCover) nextDelay() (time.Duration, bool) {
+	lambda, maxDelay := l.params()
+	if lambda <= 0 {
+		return maxDelay, maxDelay > 0
+	}
+	delay := rand.Exp(l.rng, lambda) * float64(time.Millisecond)
+	if maxDelay > 0 && delay > float64(maxDelay) {
+		return maxDelay, true
+	}
+	if delay > float64(math.MaxInt64) {
+		return math.MaxInt64, true
+	}
+	return time.Duration(delay), true
+}
+
+// reset reschedules the next command.
+func (l *linkCover) reset() {
+	if !l.timer.Stop() {
+		select {
+		case <-l.timer.C:
+		default:
+		}
+	}
+	var delay time.Duration
+	if delay, l.scheduled = l.nextDelay(); l.scheduled {
+		l.timer.Reset(delay)
+	}
+}
+
+// sendCommand queues cmd to be sent the next time the timer fires, and
+// calls doneFn once it was sent.  The command is sent right away if l is
+// nil, or if the parameters do not allow for cover traffic.
+func (l *linkCover) sendCommand(w commandSender, cmd commands.Command, doneFn func(error)) error {
+	if l != nil && !l.scheduled {
+		// The parameters may have changed since.
+		l.reset()
+	}
+	next := &coverCmd{cmd: cmd, doneFn: doneFn}
+	if l == nil || !l.scheduled {
+		return next.send(w)
+	}
+	l.queue = append(l.queue, next)
+	return nil
+}
+
+// send sends the oldest queued command, or a randomly padded NoOp if
+// there is none, and reschedules the next one.  The remaining queued
+// commands are sent right away if the parameters no longer allow for
+// cover traffic.
+func (l *linkCover) send(w commandSender) error {
+	next := &coverCmd{
+		cmd: &commands.NoOp{
+			Padding: l.rng.Intn(l.maxPadding + 1),
+		},
+	}
+	if len(l.queue) > 0 {
+		next = l.pop()
+	}
+	if err := next.send(w); err != nil {
+		return err
+	}
+	l.reset()
+	for !l.scheduled && len(l.queue) > 0 {
+		if err := l.pop().send(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *linkCover) pop() *coverCmd {
+	next := l.queue[0]
+	l.queue[0] = nil
+	l.queue = l.queue[1:]
+	return next
+}
+
+func (c *coverCmd) send(w commandSender) error {
+	err := w.SendCommand(c.cmd)
+	if c.doneFn != nil {
+		c.doneFn(err)
+	}
+	return err
+}
+
+// stop stops the timer and fails the commands still queued with err.
+func (l *linkCover) stop(err error) {
+	if l == nil {
+		return
+	}
+	l.timer.Stop()
+	l.scheduled = false
+	for _, queued := range l.queue {
+		if queued.doneFn != nil {
+			queued.doneFn(err)
+		}
+	}
+	l.queue = nil
+}
+
+func (c *connection) newLinkCover() *linkCover {
+	if !c.c.cfg.EnableLinkCover {
+		return nil
+	}
+	return newLinkCover(c.linkCoverParams, c.c.cfg.SphinxGeometry.PacketLength)
+}
+
+// linkCoverParams returns the configured link cover parameters, falling
+// back to the LambdaP parameters of the current PKI document.
+func (c *connection) linkCoverParams() (float64, time.Duration) {
+	lambda, maxDelay := c.c.cfg.LinkCoverLambda, c.c.cfg.LinkCoverMaxDelay
+	if doc := c.c.CurrentDocument(); doc != nil {
+		if lambda == 0 {
+			lambda = doc.LambdaP
+		}
+		if maxDelay == 0 {
+			maxDelay = doc.LambdaPMaxDelay
+		}
+	}
+	return lambda, time.Duration(maxDelay) * time.Millisecond
+}
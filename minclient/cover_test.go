@@ -0,0 +1,193 @@
+// cover_test.go - Link cover traffic tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minclient
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	ecdh "github.com/katzenpost/hpqc/nike/x25519"
+	"github.com/katzenpost/hpqc/rand"
+
+	"github.com/katzenpost/katzenpost/core/sphinx/geo"
+	"github.com/katzenpost/katzenpost/core/wire/commands"
+)
+
+// fakeSession records the commands sent.
+type fakeSession struct {
+	cmds []commands.Command
+}
+
+func (s *fakeSession) SendCommand(cmd commands.Command) error {
+	s.cmds = append(s.cmds, cmd)
+	return nil
+}
+
+func coverParams(lambda float64, maxDelay time.Duration) func() (float64, time.Duration) {
+	return func() (float64, time.Duration) {
+		return lambda, maxDelay
+	}
+}
+
+func TestLinkCoverDelay(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	const samples = 10000
+	l := newLinkCover(coverParams(0.01, 0), 100)
+	defer l.stop(nil)
+	var sum time.Duration
+	for i := 0; i < samples; i++ {
+		delay, ok := l.nextDelay()
+		require.True(ok)
+		sum += delay
+	}
+	require.InDelta(100*time.Millisecond, sum/samples, float64(10*time.Millisecond))
+
+	l.params = coverParams(0.01, 150*time.Millisecond)
+	for i := 0; i < samples; i++ {
+		delay, ok := l.nextDelay()
+		require.True(ok)
+		require.LessOrEqual(delay, 150*time.Millisecond)
+	}
+
+	// Without parameters there is no cover traffic.
+	l.params = coverParams(0, 0)
+	_, ok := l.nextDelay()
+	require.False(ok)
+	l.reset()
+	select {
+	case <-l.C():
+		t.Fatal("cover fired without parameters")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// A nil linkCover never fires.
+	var nilCover *linkCover
+	nilCover.stop(nil)
+	require.Nil(nilCover.C())
+}
+
+func TestLinkCoverQueue(t *testing.T) {
+	t.Parallel()
+	require := require.New(t)
+
+	var done []error
+	doneFn := func(err error) {
+		done = append(done, err)
+	}
+	w := new(fakeSession)
+	l := newLinkCover(coverParams(1e-9, time.Hour), 0)
+	defer l.stop(nil)
+
+	// Commands are queued until the timer fires, and NoOps are sent
+	// when there is none.
+	retrieve := &commands.RetrieveMessage{}
+	sendPacket := &commands.SendPacket{}
+	require.NoError(l.sendCommand(w, retrieve, nil))
+	require.NoError(l.sendCommand(w, sendPacket, doneFn))
+	require.Empty(w.cmds)
+	for i := 0; i < 3; i++ {
+		require.NoError(l.send(w))
+	}
+	require.Equal([]commands.Command{retrieve, sendPacket, &commands.NoOp{}}, w.cmds)
+	require.Equal([]error{nil}, done)
+
+	// Once the parameters no longer allow for cover traffic, the queued
+	// commands are sent right away, and so are new ones.
+	w.cmds = nil
+	require.NoError(l.sendCommand(w, retrieve, nil))
+	require.NoError(l.sendCommand(w, sendPacket, doneFn))
+	l.params = coverParams(0, 0)
+	require.NoError(l.send(w))
+	require.NoError(l.sendCommand(w, sendPacket, doneFn))
+	require.Equal([]commands.Command{retrieve, sendPacket, sendPacket}, w.cmds)
+	require.Equal([]error{nil, nil, nil}, done)
+
+	// Commands still queued fail when the connection closes.
+	l.params = coverParams(1e-9, time.Hour)
+	require.NoError(l.sendCommand(w, sendPacket, doneFn))
+	errClosed := errors.New("closed")
+	l.stop(errClosed)
+	require.Equal([]error{nil, nil, nil, errClosed}, done)
+
+	// Without a linkCover, commands are sent right away.
+	var nilCover *linkCover
+	w.cmds = nil
+	require.NoError(nilCover.sendCommand(w, sendPacket, doneFn))
+	require.Equal([]commands.Command{sendPacket}, w.cmds)
+}
+
+func TestOnWireConnLinkCover(t *testing.T) {
+	require := require.New(t)
+
+	// one command every 20ms on average
+	const lambda = 0.05
+	const phase = time.Second
+	geometry := geo.GeometryFromUserForwardPayloadLength(ecdh.Scheme(rand.Reader), 2000, true, 5)
+	conn, w := newTestWireConn(t, func(cfg *ClientConfig) {
+		cfg.SphinxGeometry = geometry
+		cfg.MessagePollInterval = time.Hour
+		cfg.EnableLinkCover = true
+		cfg.LinkCoverLambda = lambda
+		cfg.LinkCoverMaxDelay = uint64(phase / time.Millisecond)
+	})
+	stop := runWireConn(conn, w)
+
+	// Send packets as fast as the link allows, then stay idle for as
+	// long.
+	start := time.Now()
+	sending := make(chan struct{})
+	go func() {
+		defer close(sending)
+		for time.Since(start) < phase {
+			conn.sendPacket(make([]byte, geometry.PacketLength))
+		}
+	}()
+	<-sending
+	time.Sleep(phase - time.Since(start))
+	time.Sleep(phase)
+	stop()
+
+	// The link carries the same rate of commands whether or not packets
+	// are sent, the packets only take the place of NoOps.
+	var busy, idle, packets int
+	paddings := make(map[int]bool)
+	cmds, sentAt := w.sentCommands()
+	for i, cmd := range cmds {
+		if sentAt[i].Sub(start) < phase {
+			busy++
+		} else {
+			idle++
+		}
+		switch cmd := cmd.(type) {
+		case *commands.SendPacket:
+			packets++
+			require.Less(sentAt[i].Sub(start), phase+time.Second/10)
+		case *commands.NoOp:
+			require.LessOrEqual(cmd.Padding, geometry.PacketLength)
+			paddings[cmd.Padding] = true
+		}
+	}
+	expected := lambda * float64(phase/time.Millisecond)
+	require.InDelta(expected, busy, expected/2)
+	require.InDelta(expected, idle, expected/2)
+	require.Greater(packets, int(expected/2))
+	require.Greater(len(paddings), 1)
+}
@@ -21,6 +21,7 @@ import (
 	"crypto/hmac"
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
@@ -35,12 +36,22 @@ import (
 var (
 	errGetConsensusCanceled = errors.New("minclient/pki: consensus fetch canceled")
 	errConsensusNotFound    = errors.New("minclient/pki: consensus not ready yet")
+	errConsensusGone        = errors.New("minclient/pki: consensus gone")
 	PublishDeadline         = vServer.PublishConsensusDeadline
 	mixServerCacheDelay     = epochtime.Period / 16
 	nextFetchTill           = epochtime.Period - (PublishDeadline + mixServerCacheDelay)
 	recheckInterval         = epochtime.Period / 16
 	// WarpedEpoch is a build time flag that accelerates the recheckInterval
 	WarpedEpoch = "false"
+
+	// ErrDocumentNotPublished is the error returned when the document for
+	// the requested epoch has not been published yet.
+	ErrDocumentNotPublished = cpki.ErrDocumentNotPublished
+
+	// ErrDocumentExpired is the error returned when the document for the
+	// requested epoch is older than the DocumentRetention, or was garbage
+	// collected by the Provider or the authorities.
+	ErrDocumentExpired = cpki.ErrDocumentExpired
 )
 
 type pki struct {
@@ -75,6 +86,21 @@ func (c *Client) CurrentDocument() *cpki.Document {
 	return c.pki.currentDocument()
 }
 
+// GetDocumentForEpoch returns the pki.Document for the given epoch, fetching
+// it if it is not cached.  ErrDocumentNotPublished is returned if the
+// document is not available yet, and ErrDocumentExpired if the epoch is older
+// than the configured DocumentRetention.  The caller MUST NOT modify the
+// returned object in any way.
+func (c *Client) GetDocumentForEpoch(ctx context.Context, epoch uint64) (*cpki.Document, error) {
+	return c.pki.getDocumentForEpoch(ctx, epoch)
+}
+
+// CachedEpochs returns the sorted list of epochs for which a pki.Document
+// is cached.
+func (c *Client) CachedEpochs() []uint64 {
+	return c.pki.cachedEpochs()
+}
+
 func (p *pki) setClockSkew(skew int64) {
 	p.log.Debugf("New clock skew: %v sec", skew)
 	p.Lock()
@@ -107,6 +133,42 @@ func (p *pki) currentDocument() *cpki.Document {
 	return nil
 }
 
+func (p *pki) getDocumentForEpoch(ctx context.Context, epoch uint64) (*cpki.Document, error) {
+	if d, ok := p.docs.Load(epoch); ok {
+		return d.(*cpki.Document), nil
+	}
+	now, _, _ := epochtime.FromUnix(p.skewedUnixTime())
+	if epoch+uint64(p.c.cfg.DocumentRetention) < now {
+		return nil, ErrDocumentExpired
+	}
+
+	d, err := p.getDocument(ctx, epoch)
+	switch err {
+	case nil:
+	case errConsensusNotFound:
+		return nil, ErrDocumentNotPublished
+	case errConsensusGone:
+		return nil, ErrDocumentExpired
+	default:
+		return nil, err
+	}
+	if !hmac.Equal(d.SphinxGeometryHash, p.c.cfg.SphinxGeometry.Hash()) {
+		return nil, fmt.Errorf("minclient/pki: Sphinx Geometry mismatch for epoch %v", epoch)
+	}
+	p.docs.Store(epoch, d)
+	return d, nil
+}
+
+func (p *pki) cachedEpochs() []uint64 {
+	epochs := []uint64{}
+	p.docs.Range(func(key, value interface{}) bool {
+		epochs = append(epochs, key.(uint64))
+		return true
+	})
+	sort.Slice(epochs, func(i, j int) bool { return epochs[i] < epochs[j] })
+	return epochs
+}
+
 func (p *pki) worker() {
 	timer := time.NewTimer(0)
 	defer func() {
@@ -166,8 +228,8 @@ func (p *pki) worker() {
 			if err != nil {
 				p.log.Warningf("Failed to fetch PKI for epoch %v: %v", epoch, err)
 				switch err {
-				case cpki.ErrNoDocument:
-					p.failedFetches[epoch] = err
+				case cpki.ErrNoDocument, errConsensusGone:
+					p.failedFetches[epoch] = cpki.ErrNoDocument
 				case errGetConsensusCanceled:
 					return
 				default:
@@ -222,7 +284,7 @@ func (p *pki) getDocument(ctx context.Context, epoch uint64) (*cpki.Document, er
 	switch resp.ErrorCode {
 	case commands.ConsensusOk:
 	case commands.ConsensusGone:
-		return nil, cpki.ErrNoDocument
+		return nil, errConsensusGone
 	case commands.ConsensusNotFound:
 		return nil, errConsensusNotFound
 	default:
@@ -245,20 +307,26 @@ func (p *pki) getDocument(ctx context.Context, epoch uint64) (*cpki.Document, er
 func (p *pki) getDocumentDirect(ctx context.Context, epoch uint64) (*cpki.Document, error) {
 	p.log.Debugf("Fetching PKI doc for epoch %v directly from authority.", epoch)
 
-	d, _, err := p.c.cfg.PKIClient.Get(ctx, epoch)
+	d, err := p.c.cfg.PKIClient.GetDocumentForEpoch(ctx, epoch)
 	select {
 	case <-ctx.Done():
 		// Canceled mid-fetch.
 		return nil, errGetConsensusCanceled
 	default:
 	}
+	switch err {
+	case cpki.ErrDocumentExpired:
+		return nil, errConsensusGone
+	case cpki.ErrDocumentNotPublished:
+		return nil, errConsensusNotFound
+	}
 	return d, err
 }
 
 func (p *pki) pruneDocuments(now uint64) {
 	p.docs.Range(func(key, value interface{}) bool {
 		epoch := key.(uint64)
-		if epoch < now {
+		if epoch+uint64(p.c.cfg.DocumentRetention) < now {
 			p.log.Debugf("Discarding PKI for epoch: %v", epoch)
 			p.docs.Delete(epoch)
 		}
@@ -0,0 +1,152 @@
+// pki_test.go - PKI document cache tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minclient
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/hpqc/sign"
+
+	"github.com/katzenpost/katzenpost/core/epochtime"
+	"github.com/katzenpost/katzenpost/core/log"
+	cpki "github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/wire/commands"
+)
+
+// fakePKIClient answers every fetch with err, and fails to deserialize.
+type fakePKIClient struct {
+	err error
+}
+
+func (c *fakePKIClient) Get(ctx context.Context, epoch uint64) (*cpki.Document, []byte, error) {
+	return nil, nil, c.err
+}
+
+func (c *fakePKIClient) GetDocumentForEpoch(ctx context.Context, epoch uint64) (*cpki.Document, error) {
+	return nil, c.err
+}
+
+func (c *fakePKIClient) Post(ctx context.Context, epoch uint64, signingPrivateKey sign.PrivateKey, signingPublicKey sign.PublicKey, d *cpki.MixDescriptor) error {
+	return c.err
+}
+
+func (c *fakePKIClient) Deserialize(raw []byte) (*cpki.Document, error) {
+	return nil, errors.New("fake: invalid document")
+}
+
+// serveConsensus connects p to a Provider which answers every
+// GetConsensus with the given error code.
+func serveConsensus(t *testing.T, p *pki, errorCode uint8) {
+	conn := &connection{
+		isConnected:    true,
+		getConsensusCh: make(chan *getConsensusCtx),
+	}
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(t, err)
+	conn.log = logBackend.GetLogger("minclient/conn")
+	p.c.conn = conn
+	go func() {
+		for {
+			select {
+			case <-conn.HaltCh():
+				return
+			case ctx := <-conn.getConsensusCh:
+				ctx.doneFn(nil)
+				ctx.replyCh <- &commands.Consensus{ErrorCode: errorCode}
+			}
+		}
+	}()
+	t.Cleanup(conn.Halt)
+}
+
+func newTestPKI(t *testing.T, retention int) *pki {
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(t, err)
+	return &pki{
+		c:   &Client{cfg: &ClientConfig{DocumentRetention: retention}},
+		log: logBackend.GetLogger("minclient/pki"),
+	}
+}
+
+func TestPKIDocumentRetention(t *testing.T) {
+	require := require.New(t)
+
+	p := newTestPKI(t, 2)
+	now, _, _ := epochtime.Now()
+	for epoch := now - 4; epoch <= now+2; epoch++ {
+		p.docs.Store(epoch, &cpki.Document{Epoch: epoch})
+	}
+	p.pruneDocuments(now)
+	require.Equal([]uint64{now - 2, now - 1, now, now + 1, now + 2}, p.cachedEpochs())
+
+	// A past epoch within the retention window is served from the cache.
+	d, err := p.getDocumentForEpoch(context.Background(), now-2)
+	require.NoError(err)
+	require.Equal(now-2, d.Epoch)
+
+	// A future epoch that was prefetched is served from the cache.
+	d, err = p.getDocumentForEpoch(context.Background(), now+2)
+	require.NoError(err)
+	require.Equal(now+2, d.Epoch)
+
+	// Epochs beyond the retention window are not fetched.
+	_, err = p.getDocumentForEpoch(context.Background(), now-3)
+	require.ErrorIs(err, ErrDocumentExpired)
+
+	p = newTestPKI(t, 0)
+	for epoch := now - 1; epoch <= now+1; epoch++ {
+		p.docs.Store(epoch, &cpki.Document{Epoch: epoch})
+	}
+	p.pruneDocuments(now)
+	require.Equal([]uint64{now, now + 1}, p.cachedEpochs())
+	_, err = p.getDocumentForEpoch(context.Background(), now-1)
+	require.ErrorIs(err, ErrDocumentExpired)
+}
+
+func TestPKIDocumentForEpochErrors(t *testing.T) {
+	require := require.New(t)
+
+	now, _, _ := epochtime.Now()
+	newPKI := func(errorCode uint8, pkiErr error) *pki {
+		p := newTestPKI(t, 2)
+		p.c.cfg.PKIClient = &fakePKIClient{err: pkiErr}
+		serveConsensus(t, p, errorCode)
+		return p
+	}
+
+	// A document garbage collected by the Provider is expired, which is
+	// distinct from one that is not published yet or fails to deserialize.
+	_, err := newPKI(commands.ConsensusGone, nil).getDocumentForEpoch(context.Background(), now)
+	require.ErrorIs(err, ErrDocumentExpired)
+	_, err = newPKI(commands.ConsensusNotFound, nil).getDocumentForEpoch(context.Background(), now)
+	require.ErrorIs(err, ErrDocumentNotPublished)
+	_, err = newPKI(commands.ConsensusOk, nil).getDocumentForEpoch(context.Background(), now)
+	require.ErrorIs(err, cpki.ErrNoDocument)
+
+	// The same holds for documents fetched from the authorities when the
+	// Provider is not connected.
+	for _, pkiErr := range []error{cpki.ErrDocumentExpired, cpki.ErrDocumentNotPublished} {
+		p := newTestPKI(t, 2)
+		p.c.cfg.PKIClient = &fakePKIClient{err: pkiErr}
+		p.c.conn = &connection{}
+		_, err = p.getDocumentForEpoch(context.Background(), now)
+		require.ErrorIs(err, pkiErr)
+	}
+}
@@ -0,0 +1,69 @@
+// poll.go - Adaptive message polling.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minclient
+
+import "time"
+
+// pollBackoffThreshold is the number of consecutive MessageEmpty responses
+// after which the poll interval starts to back off.
+const pollBackoffThreshold = 2
+
+// pollSchedule adapts the delay between RetrieveMessage commands to the
+// state of the user's server side spool.  The delay is zero while the
+// Provider indicates that more messages are queued, and doubles after
+// consecutive empty responses up to a maximum.
+type pollSchedule struct {
+	drain   bool
+	empties int
+}
+
+// onMessage updates the schedule upon receiving a Message or MessageACK
+// with the given QueueSizeHint.
+func (s *pollSchedule) onMessage(queueSizeHint uint8) {
+	s.drain = queueSizeHint > 0
+	s.empties = 0
+}
+
+// onFetch updates the schedule upon sending a RetrieveMessage, the queue
+// is only drained further once the response reports more messages.
+func (s *pollSchedule) onFetch() {
+	s.drain = false
+}
+
+// onEmpty updates the schedule upon receiving a MessageEmpty.
+func (s *pollSchedule) onEmpty() {
+	s.drain = false
+	s.empties++
+}
+
+// next returns the delay before the next fetch given the base poll
+// interval and the maximum poll interval.
+func (s *pollSchedule) next(base, max time.Duration) time.Duration {
+	if s.drain {
+		return 0
+	}
+	if max < base {
+		max = base
+	}
+	delay := base
+	for i := pollBackoffThreshold; i < s.empties && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
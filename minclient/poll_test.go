@@ -0,0 +1,68 @@
+// poll_test.go - Adaptive message polling tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minclient
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPollSchedule(t *testing.T) {
+	require := require.New(t)
+
+	const base = time.Second
+	const max = 10 * time.Second
+	var s pollSchedule
+	require.Equal(base, s.next(base, max))
+
+	// Drain the queue while the Provider reports queued messages.
+	s.onMessage(3)
+	require.Equal(time.Duration(0), s.next(base, max))
+	s.onMessage(1)
+	require.Equal(time.Duration(0), s.next(base, max))
+	s.onMessage(0)
+	require.Equal(base, s.next(base, max))
+
+	// A fetch while draining waits for its response.
+	s.onMessage(2)
+	s.onFetch()
+	require.Equal(base, s.next(base, max))
+
+	// Back off exponentially after consecutive empty responses.
+	expected := []time.Duration{base, base, 2 * base, 4 * base, 8 * base, max, max}
+	for _, delay := range expected {
+		s.onEmpty()
+		require.Equal(delay, s.next(base, max))
+	}
+
+	// A message resets the backoff.
+	s.onMessage(0)
+	require.Equal(base, s.next(base, max))
+	s.onEmpty()
+	require.Equal(base, s.next(base, max))
+
+	// The maximum never lowers the poll interval.
+	for i := 0; i < 4; i++ {
+		s.onEmpty()
+	}
+	require.Equal(base, s.next(base, base/2))
+
+	// Reconnecting starts with a fresh schedule.
+	s = pollSchedule{}
+	require.Equal(base, s.next(base, max))
+}
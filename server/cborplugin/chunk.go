@@ -0,0 +1,157 @@
+// chunk.go - multi-part responses for the cbor plugin system
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cborplugin
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// DefaultChunkTimeout is the default time allowed for all chunks of a
+	// multi-part Response to arrive.
+	DefaultChunkTimeout = 30 * time.Second
+
+	// DefaultMaxResponseSize is the default maximum size of a reassembled
+	// multi-part Response.
+	DefaultMaxResponseSize = 1 << 20
+)
+
+var (
+	// ErrChunkTimeout is the error used when not all chunks of a multi-part
+	// Response arrived in time.
+	ErrChunkTimeout = errors.New("cborplugin: timeout waiting for response chunks")
+
+	// ErrResponseTooLarge is the error used when a multi-part Response
+	// exceeds the maximum response size.
+	ErrResponseTooLarge = errors.New("cborplugin: reassembled response too large")
+
+	// ErrInvalidChunk is the error used when a chunk has invalid indices.
+	ErrInvalidChunk = errors.New("cborplugin: invalid response chunk")
+)
+
+// ResponseChunk is one part of a multi-part Response to the Request
+// with the same ID.
+type ResponseChunk struct {
+	ID      uint64
+	Index   uint32
+	Total   uint32
+	Payload []byte
+}
+
+type partialResponse struct {
+	chunks   [][]byte
+	received uint32
+	size     int
+	deadline time.Time
+}
+
+// reassembler collects the chunks of multi-part Responses.
+type reassembler struct {
+	timeout time.Duration
+	maxSize int
+	partial map[uint64]*partialResponse
+}
+
+func newReassembler(timeout time.Duration, maxSize int) *reassembler {
+	return &reassembler{
+		timeout: timeout,
+		maxSize: maxSize,
+		partial: make(map[uint64]*partialResponse),
+	}
+}
+
+// add adds a chunk and returns the complete Response once all of its
+// chunks were received, or a RequestError.
+func (r *reassembler) add(chunk *ResponseChunk, now time.Time) Command {
+	p, ok := r.partial[chunk.ID]
+	if !ok {
+		if chunk.Total == 0 || int64(chunk.Total) > int64(r.maxSize) {
+			return &RequestError{ID: chunk.ID, Err: ErrInvalidChunk}
+		}
+		p = &partialResponse{
+			chunks:   make([][]byte, chunk.Total),
+			deadline: now.Add(r.timeout),
+		}
+		r.partial[chunk.ID] = p
+	}
+	if chunk.Total != uint32(len(p.chunks)) || chunk.Index >= chunk.Total {
+		delete(r.partial, chunk.ID)
+		return &RequestError{ID: chunk.ID, Err: ErrInvalidChunk}
+	}
+	if p.chunks[chunk.Index] != nil {
+		// duplicate chunk
+		return nil
+	}
+	p.size += len(chunk.Payload)
+	if p.size > r.maxSize {
+		delete(r.partial, chunk.ID)
+		return &RequestError{ID: chunk.ID, Err: ErrResponseTooLarge}
+	}
+	p.chunks[chunk.Index] = append([]byte{}, chunk.Payload...)
+	p.received++
+	if p.received < chunk.Total {
+		return nil
+	}
+
+	delete(r.partial, chunk.ID)
+	payload := make([]byte, 0, p.size)
+	for _, b := range p.chunks {
+		payload = append(payload, b...)
+	}
+	return &Response{ID: chunk.ID, Payload: payload}
+}
+
+// expire returns a RequestError for each multi-part Response whose
+// deadline has passed.
+func (r *reassembler) expire(now time.Time) []Command {
+	var expired []Command
+	for id, p := range r.partial {
+		if now.After(p.deadline) {
+			delete(r.partial, id)
+			expired = append(expired, &RequestError{ID: id, Err: ErrChunkTimeout})
+		}
+	}
+	return expired
+}
+
+// WriteChunked splits the payload into chunks of at most chunkSize bytes
+// and writes them as a multi-part Response to the Request with the given ID.
+func (s *Server) WriteChunked(id uint64, payload []byte, chunkSize int) error {
+	if chunkSize <= 0 {
+		return fmt.Errorf("cborplugin: invalid chunk size: %d", chunkSize)
+	}
+	total := (len(payload) + chunkSize - 1) / chunkSize
+	if total == 0 {
+		total = 1
+	}
+	for i := 0; i < total; i++ {
+		end := (i + 1) * chunkSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+		s.Write(&Response{
+			Chunk: &ResponseChunk{
+				ID:      id,
+				Index:   uint32(i),
+				Total:   uint32(total),
+				Payload: payload[i*chunkSize : end],
+			},
+		})
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+// chunk_test.go - multi-part response tests
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cborplugin
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/core/log"
+)
+
+const testChunkSize = 100
+
+type chunkedPlugin struct {
+	server *Server
+}
+
+func (p *chunkedPlugin) OnCommand(cmd Command) (Command, error) {
+	r, ok := cmd.(*Request)
+	if !ok {
+		return nil, errors.New("invalid Command type")
+	}
+	switch string(r.Payload[:4]) {
+	case "full":
+		return &Response{Payload: r.Payload}, nil
+	case "drop":
+		// only send the first of two chunks
+		p.server.Write(&Response{Chunk: &ResponseChunk{ID: r.ID, Index: 0, Total: 2, Payload: r.Payload}})
+		return nil, nil
+	default:
+		return nil, p.server.WriteChunked(r.ID, r.Payload, testChunkSize)
+	}
+}
+
+func (p *chunkedPlugin) RegisterConsumer(s *Server) {
+	p.server = s
+}
+
+func newTestClientServer(t *testing.T) *Client {
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(t, err)
+
+	socketFile := filepath.Join(t.TempDir(), "plugin.sock")
+	server := NewServer(logBackend.GetLogger("server"), socketFile, new(RequestFactory), new(chunkedPlugin))
+	go server.Accept()
+	t.Cleanup(server.Halt)
+
+	client := NewClient(logBackend, "test", "+test", new(ResponseFactory))
+	client.SetChunkLimits(200*time.Millisecond, 10*testChunkSize)
+	client.socketFile = socketFile
+	client.dial()
+	t.Cleanup(client.Halt)
+	return client
+}
+
+func readResponse(t *testing.T, client *Client) Command {
+	select {
+	case cmd := <-client.ReadChan():
+		return cmd
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "timeout waiting for response")
+	}
+	return nil
+}
+
+func TestChunkedResponse(t *testing.T) {
+	require := require.New(t)
+	client := newTestClientServer(t)
+
+	// A regular single part response is passed through.
+	client.WriteChan() <- &Request{ID: 1, Payload: []byte("full response")}
+	r, ok := readResponse(t, client).(*Response)
+	require.True(ok)
+	require.Nil(r.Chunk)
+	require.Equal([]byte("full response"), r.Payload)
+
+	payload := append([]byte("many"), bytes.Repeat([]byte{0x42}, 5*testChunkSize+17)...)
+	client.WriteChan() <- &Request{ID: 2, Payload: payload}
+	r, ok = readResponse(t, client).(*Response)
+	require.True(ok)
+	require.Nil(r.Chunk)
+	require.Equal(payload, r.Payload)
+
+	// Responses larger than the maximum size are rejected.
+	payload = append([]byte("huge"), bytes.Repeat([]byte{0x42}, 10*testChunkSize)...)
+	client.WriteChan() <- &Request{ID: 3, Payload: payload}
+	e, ok := readResponse(t, client).(*RequestError)
+	require.True(ok)
+	require.Equal(uint64(3), e.ID)
+	require.ErrorIs(e, ErrResponseTooLarge)
+}
+
+func TestChunkedResponseTimeout(t *testing.T) {
+	require := require.New(t)
+	client := newTestClientServer(t)
+
+	client.WriteChan() <- &Request{ID: 7, Payload: []byte("drop")}
+	e, ok := readResponse(t, client).(*RequestError)
+	require.True(ok)
+	require.Equal(uint64(7), e.ID)
+	require.ErrorIs(e, ErrChunkTimeout)
+}
+
+func TestChunkedResponseCorrelation(t *testing.T) {
+	require := require.New(t)
+	client := newTestClientServer(t)
+
+	// The Response to Request 8 arrives while Request 7 still waits for
+	// its missing chunk, it must not be taken for the answer to Request 7.
+	client.WriteChan() <- &Request{ID: 7, Payload: []byte("drop")}
+	client.WriteChan() <- &Request{ID: 8, Payload: []byte("full response")}
+	r, ok := readResponse(t, client).(*Response)
+	require.True(ok)
+	require.Equal(uint64(8), r.ID)
+	require.Equal([]byte("full response"), r.Payload)
+
+	e, ok := readResponse(t, client).(*RequestError)
+	require.True(ok)
+	require.Equal(uint64(7), e.ID)
+	require.ErrorIs(e, ErrChunkTimeout)
+
+	client.Lock()
+	defer client.Unlock()
+	require.Empty(client.pending)
+}
+
+func TestReassemblerInvalidChunk(t *testing.T) {
+	require := require.New(t)
+
+	r := newReassembler(time.Minute, 1024)
+	now := time.Now()
+	require.Nil(r.add(&ResponseChunk{ID: 1, Index: 1, Total: 2, Payload: []byte("b")}, now))
+	// duplicates are ignored
+	require.Nil(r.add(&ResponseChunk{ID: 1, Index: 1, Total: 2, Payload: []byte("b")}, now))
+	resp := r.add(&ResponseChunk{ID: 1, Index: 0, Total: 2, Payload: []byte("a")}, now)
+	require.Equal(&Response{ID: 1, Payload: []byte("ab")}, resp)
+
+	e, ok := r.add(&ResponseChunk{ID: 2, Index: 2, Total: 2}, now).(*RequestError)
+	require.True(ok)
+	require.ErrorIs(e, ErrInvalidChunk)
+	e, ok = r.add(&ResponseChunk{ID: 3, Index: 0, Total: 0}, now).(*RequestError)
+	require.True(ok)
+	require.ErrorIs(e, ErrInvalidChunk)
+	require.Len(r.partial, 0)
+}
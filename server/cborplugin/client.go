@@ -25,10 +25,13 @@ package cborplugin
 
 import (
 	"bufio"
+	"fmt"
 	"io"
 	//"net"
 	"os/exec"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/fxamacker/cbor/v2"
 	"github.com/katzenpost/katzenpost/core/log"
@@ -42,6 +45,10 @@ type Request struct {
 	Payload      []byte
 	ResponseSize int
 	HasSURB      bool
+
+	// HealthCheck is set instead of the other fields if the Request
+	// is a health check, which is answered by the Server.
+	HealthCheck *HealthCheck `cbor:",omitempty"`
 }
 
 // Marshal serializes Request
@@ -65,7 +72,48 @@ func (r *RequestFactory) Build() Command {
 
 // Response is the response received after sending a Request to the plugin.
 type Response struct {
+	// ID is the ID of the Request answered by the Response. Plugins
+	// which leave it at 0 must answer Requests in the order they were
+	// received.
+	ID uint64 `cbor:",omitempty"`
+
 	Payload []byte
+
+	// Chunk is set instead of Payload if the Response is one part of
+	// a multi-part Response.
+	Chunk *ResponseChunk `cbor:",omitempty"`
+
+	// HealthCheck is set instead of Payload if the Response answers
+	// a health check.
+	HealthCheck *HealthCheck `cbor:",omitempty"`
+}
+
+// RequestError is handed to the reader of the Client ReadChan in place
+// of a Response when the plugin failed to answer the Request with the
+// given ID. It is never sent over the socket.
+type RequestError struct {
+	ID  uint64
+	Err error
+}
+
+// Error implements error.
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("cborplugin: request %d failed: %s", e.ID, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// Marshal implements Command and always fails.
+func (e *RequestError) Marshal() ([]byte, error) {
+	return nil, e
+}
+
+// Unmarshal implements Command and always fails.
+func (e *RequestError) Unmarshal(b []byte) error {
+	return e
 }
 
 // Marshal serializes Response
@@ -124,6 +172,7 @@ type ServicePlugin interface {
 // external plugin program.
 
 type Client struct {
+	sync.Mutex
 	worker.Worker
 
 	socket *CommandIO
@@ -133,12 +182,28 @@ type Client struct {
 
 	socketFile string
 	cmd        *exec.Cmd
+	stderrDone chan struct{}
+	restarting bool
+	ready      bool
 	//conn       net.Conn
 
+	command string
+	args    []string
+
 	commandBuilder CommandBuilder
 
 	capability string
 	endpoint   string
+
+	readCh      chan Command
+	writeCh     chan Command
+	restartCh   chan struct{}
+	pending     []uint64
+	reassembler *reassembler
+
+	healthCheck healthCheckConfig
+	healthCh    chan *HealthCheck
+	parameters  Parameters
 }
 
 // New creates a new plugin client instance which represents the single execution
@@ -152,15 +217,34 @@ func NewClient(logBackend *log.Backend, capability, endpoint string, commandBuil
 		commandBuilder: commandBuilder,
 		capability:     capability,
 		endpoint:       endpoint,
+		readCh:         make(chan Command),
+		writeCh:        make(chan Command),
+		restartCh:      make(chan struct{}, 1),
+		reassembler:    newReassembler(DefaultChunkTimeout, DefaultMaxResponseSize),
+		healthCh:       make(chan *HealthCheck, 1),
 	}
 }
 
+// SetChunkLimits sets the time allowed for all chunks of a multi-part
+// Response to arrive and the maximum size of the reassembled Response.
+// It must be called before Start.
+func (c *Client) SetChunkLimits(timeout time.Duration, maxSize int) {
+	c.reassembler = newReassembler(timeout, maxSize)
+}
+
 func (c *Client) Capability() string {
 	return c.capability
 }
 
+// GetParameters returns the endpoint and the Parameters the plugin sent
+// with its last answer to a health check since it was last launched.
 func (c *Client) GetParameters() *map[string]interface{} {
 	responseParams := make(map[string]interface{})
+	c.Lock()
+	for key, value := range c.parameters {
+		responseParams[key] = value
+	}
+	c.Unlock()
 	responseParams["endpoint"] = c.endpoint
 	return &responseParams
 }
@@ -169,50 +253,221 @@ func (c *Client) GetParameters() *map[string]interface{} {
 // on the halt chan sends a TERM signal to the plugin if the shutdown
 // even is dispatched.
 func (c *Client) Start(command string, args []string) error {
-	err := c.launch(command, args)
+	c.command = command
+	c.args = args
+	err := c.launch()
 	if err != nil {
 		return err
 	}
 	c.Go(c.reaper)
-	c.socket.Start(true, c.socketFile, c.commandBuilder)
+	if err := c.dial(); err != nil {
+		c.Halt()
+		return err
+	}
+	if c.healthCheck.interval > 0 {
+		c.Go(c.healthChecker)
+	} else {
+		// plugins which do not answer health checks are ready at once
+		c.setReady(true)
+	}
 	return nil
 }
 
+func (c *Client) dial() error {
+	if err := c.socket.dial(c.socketFile, c.commandBuilder); err != nil {
+		return err
+	}
+	c.Go(c.reader)
+	c.Go(c.writer)
+	return nil
+}
+
+func (c *Client) currentSocket() *CommandIO {
+	c.Lock()
+	defer c.Unlock()
+	return c.socket
+}
+
+// reader reassembles multi-part Responses read from the socket.
+func (c *Client) reader() {
+	ticker := time.NewTicker(c.reassembler.timeout / 2)
+	defer ticker.Stop()
+	for {
+		var out []Command
+		socket := c.currentSocket()
+		select {
+		case <-c.HaltCh():
+			return
+		case <-socket.HaltCh():
+			// the socket is replaced if the plugin is restarted
+			select {
+			case <-c.HaltCh():
+				return
+			case <-c.restartCh:
+			}
+			continue
+		case now := <-ticker.C:
+			out = c.reassembler.expire(now)
+		case cmd := <-socket.ReadChan():
+			r, ok := cmd.(*Response)
+			switch {
+			case ok && r.HealthCheck != nil:
+				select {
+				case c.healthCh <- r.HealthCheck:
+				default:
+				}
+			case ok && r.Chunk != nil:
+				complete := c.reassembler.add(r.Chunk, time.Now())
+				if resp, ok := complete.(*Response); ok && !c.removePending(resp.ID) {
+					c.log.Debugf("dropping Response to Request %d which is not pending", resp.ID)
+					break
+				}
+				if complete != nil {
+					out = append(out, complete)
+				}
+			case ok && r.ID != 0:
+				if !c.removePending(r.ID) {
+					c.log.Debugf("dropping Response to Request %d which is not pending", r.ID)
+					break
+				}
+				out = append(out, cmd)
+			case c.healthCheck.interval > 0:
+				// plugins answering health checks set the ID, this
+				// could be a health check answered as a Request
+				c.log.Debugf("dropping Response without an ID")
+			default:
+				if !c.popPending() {
+					c.log.Debugf("dropping Response while no Request is pending")
+					break
+				}
+				out = append(out, cmd)
+			}
+		}
+		for _, cmd := range out {
+			if e, ok := cmd.(*RequestError); ok {
+				if !c.removePending(e.ID) {
+					continue
+				}
+				c.log.Errorf("%s", e)
+			}
+			select {
+			case <-c.HaltCh():
+				return
+			case c.readCh <- cmd:
+			}
+		}
+	}
+}
+
+// writer forwards Requests to the current socket.
+func (c *Client) writer() {
+	for {
+		var cmd Command
+		select {
+		case <-c.HaltCh():
+			return
+		case cmd = <-c.writeCh:
+		}
+		r, isRequest := cmd.(*Request)
+		if isRequest {
+			c.Lock()
+			c.pending = append(c.pending, r.ID)
+			c.Unlock()
+		}
+		socket := c.currentSocket()
+		select {
+		case <-c.HaltCh():
+			return
+		case socket.WriteChan() <- cmd:
+		case <-socket.HaltCh():
+			c.log.Debugf("plugin socket closed, dropping command")
+			if isRequest {
+				c.failPending(r.ID, ErrPluginRestarted)
+			}
+		}
+	}
+}
+
+// popPending forgets the oldest pending Request, Responses without an ID
+// are answered in order. It returns false if no Request is pending.
+func (c *Client) popPending() bool {
+	c.Lock()
+	defer c.Unlock()
+	if len(c.pending) == 0 {
+		return false
+	}
+	c.pending = c.pending[1:]
+	return true
+}
+
+func (c *Client) removePending(id uint64) bool {
+	c.Lock()
+	defer c.Unlock()
+	for i, p := range c.pending {
+		if p == id {
+			c.pending = append(c.pending[:i], c.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// failPending hands a RequestError to the reader of ReadChan if the
+// Request is still pending.
+func (c *Client) failPending(id uint64, err error) {
+	if !c.removePending(id) {
+		return
+	}
+	select {
+	case <-c.HaltCh():
+	case c.readCh <- &RequestError{ID: id, Err: err}:
+	}
+}
+
 func (c *Client) reaper() {
 	<-c.HaltCh()
-	err := c.cmd.Process.Signal(syscall.SIGTERM)
+	c.Lock()
+	cmd := c.cmd
+	c.Unlock()
+	err := cmd.Process.Signal(syscall.SIGTERM)
 	if err != nil {
 		c.log.Errorf("CBOR plugin worker, error sending SIGTERM: %s\n", err)
 	}
-	err = c.cmd.Wait()
+	err = cmd.Wait()
 	if err != nil {
 		c.log.Errorf("CBOR plugin worker, command exec error: %s\n", err)
 	}
 }
 
-func (c *Client) logPluginStderr(stderr io.ReadCloser) {
-	logWriter := c.logBackend.GetLogWriter(c.cmd.Path, "DEBUG")
+func (c *Client) logPluginStderr(cmd *exec.Cmd, stderr io.ReadCloser) {
+	logWriter := c.logBackend.GetLogWriter(cmd.Path, "DEBUG")
 	_, err := io.Copy(logWriter, stderr)
 	if err != nil {
 		c.log.Errorf("Failed to proxy cborplugin stderr to DEBUG log: %s", err)
 	}
-	c.Halt()
+	c.Lock()
+	restarting := c.restarting
+	c.Unlock()
+	if !restarting {
+		// Halt waits for this goroutine to return.
+		go c.Halt()
+	}
 }
 
-func (c *Client) launch(command string, args []string) error {
+func (c *Client) launch() error {
 	// exec plugin
-	c.cmd = exec.Command(command, args...)
-	stdout, err := c.cmd.StdoutPipe()
+	cmd := exec.Command(c.command, c.args...)
+	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		c.log.Debugf("pipe failure: %s", err)
 		return err
 	}
-	stderr, err := c.cmd.StderrPipe()
+	stderr, err := cmd.StderrPipe()
 	if err != nil {
 		c.log.Debugf("pipe failure: %s", err)
 		return err
 	}
-	err = c.cmd.Start()
+	err = cmd.Start()
 	if err != nil {
 		c.log.Debugf("failed to exec: %s", err)
 		return err
@@ -220,22 +475,28 @@ func (c *Client) launch(command string, args []string) error {
 
 	// proxy stderr to our debug log
 	// also calls Halt() when stderr closes, if the program crashes or is killed
+	stderrDone := make(chan struct{})
 	c.Go(func() {
-		c.logPluginStderr(stderr)
+		defer close(stderrDone)
+		c.logPluginStderr(cmd, stderr)
 	})
 
 	// read and decode plugin stdout
 	stdoutScanner := bufio.NewScanner(stdout)
 	stdoutScanner.Scan()
+	c.Lock()
+	c.cmd = cmd
+	c.stderrDone = stderrDone
 	c.socketFile = stdoutScanner.Text()
+	c.Unlock()
 	c.log.Debugf("plugin socket path:'%s'\n", c.socketFile)
 	return nil
 }
 
 func (c *Client) ReadChan() chan Command {
-	return c.socket.ReadChan()
+	return c.readCh
 }
 
 func (c *Client) WriteChan() chan Command {
-	return c.socket.WriteChan()
+	return c.writeCh
 }
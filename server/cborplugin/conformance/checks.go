@@ -0,0 +1,289 @@
+// checks.go - the conformance checks of cbor plugins
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package conformance
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/katzenpost/katzenpost/server/cborplugin"
+)
+
+const (
+	testResponseSize  = 1024
+	oversizedPayload  = 1 << 20
+	pipelinedRequests = 16
+
+	// socketCloseGrace is the time a plugin may take to exit after its
+	// socket was closed before it must exit upon SIGTERM instead.
+	socketCloseGrace = 500 * time.Millisecond
+)
+
+// Check is a single behavior expected from plugins by the Provider.
+type Check struct {
+	// Name is the short name of the Check.
+	Name string
+
+	// Description describes the expected behavior.
+	Description string
+
+	// Run runs the Check against a newly launched plugin.
+	Run func(*Plugin) error
+}
+
+// Checks is the battery of Checks run by default, new protocol features
+// are covered by adding Checks.
+var Checks = []*Check{
+	{
+		Name:        "request",
+		Description: "a Request is answered with a Response no larger than the ResponseSize",
+		Run:         checkRequest,
+	},
+	{
+		Name:        "oversized_payload",
+		Description: "a Request with an oversized payload does not break the plugin",
+		Run:         checkOversizedPayload,
+	},
+	{
+		Name:        "pipelined_requests",
+		Description: "Requests written without waiting for Responses are all answered",
+		Run:         checkPipelinedRequests,
+	},
+	{
+		Name:        "shutdown",
+		Description: "the plugin exits upon SIGTERM",
+		Run:         checkShutdown,
+	},
+	{
+		Name:        "socket_close",
+		Description: "the plugin does not crash when the socket is closed abruptly",
+		Run:         checkSocketClose,
+	},
+}
+
+// HealthChecks are the Checks run in addition to Checks for plugins which
+// support health checks, which the Provider only sends to plugins
+// configured with a HealthCheckInterval.
+var HealthChecks = []*Check{
+	{
+		Name:        "health_check",
+		Description: "a health check Request is answered with the same health check",
+		Run:         checkHealthCheck,
+	},
+	{
+		Name:        "response_id",
+		Description: "a Response has the ID of the Request it answers",
+		Run:         checkResponseID,
+	},
+}
+
+// readAnswer reads the Response to the Request with the given ID, and
+// reassembles it if it is a multi-part Response.
+func readAnswer(p *Plugin, id uint64) ([]byte, error) {
+	var chunks [][]byte
+	received := 0
+	for {
+		r, err := p.Read()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case r.HealthCheck != nil:
+			return nil, errors.New("unexpected health check Response")
+		case r.Chunk == nil:
+			if r.ID != 0 && r.ID != id {
+				return nil, fmt.Errorf("Response for Request %d, expected %d", r.ID, id)
+			}
+			if chunks != nil {
+				return nil, errors.New("Response interleaved with the chunks of a multi-part Response")
+			}
+			return r.Payload, nil
+		}
+
+		c := r.Chunk
+		if c.ID != id {
+			return nil, fmt.Errorf("Response chunk for Request %d, expected %d", c.ID, id)
+		}
+		if c.Total == 0 || c.Index >= c.Total || (chunks != nil && int(c.Total) != len(chunks)) {
+			return nil, fmt.Errorf("invalid Response chunk %d of %d", c.Index, c.Total)
+		}
+		if chunks == nil {
+			chunks = make([][]byte, c.Total)
+		}
+		if chunks[c.Index] != nil {
+			return nil, fmt.Errorf("duplicate Response chunk %d", c.Index)
+		}
+		chunks[c.Index] = append([]byte{}, c.Payload...)
+		received++
+		if received == len(chunks) {
+			var payload []byte
+			for _, chunk := range chunks {
+				payload = append(payload, chunk...)
+			}
+			return payload, nil
+		}
+	}
+}
+
+// readHealthCheck reads Responses until the answer to the health check
+// with the given ID, skipping at most skip other Responses.
+func readHealthCheck(p *Plugin, id uint64, skip int) error {
+	for i := 0; i <= skip; i++ {
+		r, err := p.Read()
+		if err != nil {
+			return err
+		}
+		if r.HealthCheck == nil {
+			continue
+		}
+		if r.HealthCheck.ID != id {
+			return fmt.Errorf("health check %d answered, expected %d", r.HealthCheck.ID, id)
+		}
+		if len(r.Payload) != 0 || r.Chunk != nil {
+			return errors.New("health check Response must only have the HealthCheck set")
+		}
+		return nil
+	}
+	return errors.New("health check not answered")
+}
+
+func checkRequest(p *Plugin) error {
+	err := p.Write(&cborplugin.Request{
+		ID:           1,
+		Payload:      []byte("conformance"),
+		ResponseSize: testResponseSize,
+		HasSURB:      true,
+	})
+	if err != nil {
+		return err
+	}
+	payload, err := readAnswer(p, 1)
+	if err != nil {
+		return err
+	}
+	if len(payload) > testResponseSize {
+		return fmt.Errorf("Response payload of %d bytes exceeds the ResponseSize of %d", len(payload), testResponseSize)
+	}
+	return nil
+}
+
+func checkHealthCheck(p *Plugin) error {
+	if err := p.Write(&cborplugin.Request{HealthCheck: &cborplugin.HealthCheck{ID: 42}}); err != nil {
+		return err
+	}
+	return readHealthCheck(p, 42, 0)
+}
+
+func checkOversizedPayload(p *Plugin) error {
+	err := p.Write(&cborplugin.Request{
+		ID:           1,
+		Payload:      make([]byte, oversizedPayload),
+		ResponseSize: testResponseSize,
+		HasSURB:      true,
+	})
+	if err != nil {
+		return err
+	}
+	err = p.Write(&cborplugin.Request{
+		ID:           2,
+		Payload:      []byte("conformance"),
+		ResponseSize: testResponseSize,
+		HasSURB:      true,
+	})
+	if err != nil {
+		return err
+	}
+	// the oversized Request may or may not be answered, Responses without
+	// an ID can not be told apart so any of them will do
+	for {
+		r, err := p.Read()
+		if err != nil {
+			return err
+		}
+		if r.Chunk != nil {
+			if r.Chunk.ID == 2 {
+				return nil
+			}
+			continue
+		}
+		if r.ID == 0 || r.ID == 2 {
+			return nil
+		}
+	}
+}
+
+func checkResponseID(p *Plugin) error {
+	const id = 7
+	err := p.Write(&cborplugin.Request{
+		ID:           id,
+		Payload:      []byte("conformance"),
+		ResponseSize: testResponseSize,
+		HasSURB:      true,
+	})
+	if err != nil {
+		return err
+	}
+	r, err := p.Read()
+	if err != nil {
+		return err
+	}
+	switch {
+	case r.Chunk != nil && r.Chunk.ID != id:
+		return fmt.Errorf("Response chunk for Request %d, expected %d", r.Chunk.ID, id)
+	case r.Chunk == nil && r.ID != id:
+		return fmt.Errorf("Response for Request %d, expected %d", r.ID, id)
+	}
+	return nil
+}
+
+func checkPipelinedRequests(p *Plugin) error {
+	for id := uint64(1); id <= pipelinedRequests; id++ {
+		err := p.Write(&cborplugin.Request{
+			ID:           id,
+			Payload:      []byte(fmt.Sprintf("request %d", id)),
+			ResponseSize: testResponseSize,
+			HasSURB:      true,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// Responses without an ID must be written in the order of the
+	// Requests.
+	for id := uint64(1); id <= pipelinedRequests; id++ {
+		if _, err := readAnswer(p, id); err != nil {
+			return fmt.Errorf("Response %d of %d: %w", id, pipelinedRequests, err)
+		}
+	}
+	return nil
+}
+
+func checkShutdown(p *Plugin) error {
+	return p.Shutdown()
+}
+
+func checkSocketClose(p *Plugin) error {
+	p.CloseSocket()
+	exited, err := p.Exited(socketCloseGrace)
+	if exited {
+		if err != nil {
+			return fmt.Errorf("plugin crashed when the socket was closed: %w", err)
+		}
+		return nil
+	}
+	return p.Shutdown()
+}
@@ -0,0 +1,336 @@
+// conformance.go - conformance tests for cbor plugin implementations
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package conformance checks that a cbor plugin program behaves as the
+// Provider expects, independently of the language it is written in.
+package conformance
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+
+	"github.com/katzenpost/katzenpost/server/cborplugin"
+)
+
+const (
+	// DefaultTimeout is the default time allowed for each step of a Check.
+	DefaultTimeout = 5 * time.Second
+
+	maxDumpLength = 256
+)
+
+var (
+	// ErrTimeout is the error used when the plugin did not act in time.
+	ErrTimeout = errors.New("conformance: timeout")
+
+	// ErrNotRunning is the error used when the plugin exited unexpectedly.
+	ErrNotRunning = errors.New("conformance: plugin is not running")
+
+	strictDecMode cbor.DecMode
+	encMode       cbor.EncMode
+)
+
+func init() {
+	var err error
+	strictDecMode, err = cbor.DecOptions{
+		ExtraReturnErrors: cbor.ExtraDecErrorUnknownField,
+		DupMapKey:         cbor.DupMapKeyEnforcedAPF,
+	}.DecMode()
+	if err != nil {
+		panic(err)
+	}
+	encMode, err = cbor.EncOptions{}.EncMode()
+	if err != nil {
+		panic(err)
+	}
+}
+
+// FramingError is the error used when the plugin wrote a CBOR item which
+// is not a valid Response.
+type FramingError struct {
+	// Raw is the CBOR item written by the plugin.
+	Raw []byte
+
+	// Expected is the encoding of the Response the Provider would decode
+	// from Raw, ignoring the errors, or nil if Raw can not be decoded at
+	// all.
+	Expected []byte
+
+	// Err is the decoding error, if any.
+	Err error
+}
+
+// Error implements the error interface, the message includes a byte-level
+// diff of the received and expected encodings.
+func (e *FramingError) Error() string {
+	b := new(strings.Builder)
+	fmt.Fprintf(b, "conformance: invalid Response: %v\n", e.Err)
+	fmt.Fprintf(b, "received:\n%s", dump(e.Raw))
+	if e.Expected != nil {
+		fmt.Fprintf(b, "expected:\n%s", dump(e.Expected))
+		if off := firstDifference(e.Raw, e.Expected); off >= 0 {
+			fmt.Fprintf(b, "first difference at offset %#x", off)
+		}
+	}
+	return b.String()
+}
+
+// dump returns the hex dump of at most maxDumpLength bytes of b.
+func dump(b []byte) string {
+	if len(b) <= maxDumpLength {
+		return hex.Dump(b)
+	}
+	return fmt.Sprintf("%s... (%d bytes total)\n", hex.Dump(b[:maxDumpLength]), len(b))
+}
+
+func firstDifference(a, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return len(a)
+		}
+		return len(b)
+	}
+	return -1
+}
+
+// Plugin is a plugin program launched the same way as by the Provider.
+type Plugin struct {
+	cmd     *exec.Cmd
+	conn    net.Conn
+	dec     *cbor.Decoder
+	stderr  *bytes.Buffer
+	exitCh  chan struct{}
+	exitErr error
+	timeout time.Duration
+}
+
+// Launch executes the plugin command, reads the path of its socket from
+// the first line of its stdout and connects to it.
+func Launch(command string, args []string, timeout time.Duration) (*Plugin, error) {
+	p := &Plugin{
+		cmd:     exec.Command(command, args...),
+		stderr:  new(bytes.Buffer),
+		exitCh:  make(chan struct{}),
+		timeout: timeout,
+	}
+	p.cmd.Stderr = p.stderr
+	stdout, err := p.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	lineCh := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(stdout).ReadString('\n')
+		lineCh <- line
+		// keep draining stdout so the plugin never blocks on writes
+		io.Copy(io.Discard, stdout)
+	}()
+	go func() {
+		p.exitErr = p.cmd.Wait()
+		close(p.exitCh)
+	}()
+
+	var line string
+	select {
+	case line = <-lineCh:
+	case <-time.After(timeout):
+		p.Kill()
+		return nil, fmt.Errorf("%w: no socket path written to stdout", ErrTimeout)
+	}
+	socketFile := strings.TrimSpace(line)
+	if socketFile == "" {
+		p.Kill()
+		return nil, errors.New("conformance: the first line of stdout must be the socket path")
+	}
+	p.conn, err = net.DialTimeout("unix", socketFile, timeout)
+	if err != nil {
+		p.Kill()
+		return nil, fmt.Errorf("conformance: failed to connect to socket '%s': %w", socketFile, err)
+	}
+	p.dec = cbor.NewDecoder(p.conn)
+	return p, nil
+}
+
+// Write writes the Command to the plugin socket.
+func (p *Plugin) Write(cmd cborplugin.Command) error {
+	raw, err := encMode.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	return p.WriteRaw(raw)
+}
+
+// WriteRaw writes the bytes to the plugin socket.
+func (p *Plugin) WriteRaw(raw []byte) error {
+	p.conn.SetWriteDeadline(time.Now().Add(p.timeout))
+	_, err := p.conn.Write(raw)
+	return err
+}
+
+// Read reads a Response from the plugin socket.  A *FramingError is
+// returned if the CBOR item is not a Response, or has unknown or
+// duplicate fields.
+func (p *Plugin) Read() (*cborplugin.Response, error) {
+	p.conn.SetReadDeadline(time.Now().Add(p.timeout))
+	var raw cbor.RawMessage
+	if err := p.dec.Decode(&raw); err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, fmt.Errorf("%w: no Response", ErrTimeout)
+		}
+		return nil, err
+	}
+	r := new(cborplugin.Response)
+	if err := strictDecMode.Unmarshal(raw, r); err != nil {
+		// show what the Provider would make of the item, if anything
+		lenient := new(cborplugin.Response)
+		if cbor.Unmarshal(raw, lenient) != nil {
+			return nil, &FramingError{Raw: raw, Err: err}
+		}
+		expected, _ := encMode.Marshal(lenient)
+		return nil, &FramingError{Raw: raw, Expected: expected, Err: err}
+	}
+	return r, nil
+}
+
+// CloseSocket abruptly closes the connection to the plugin socket.
+func (p *Plugin) CloseSocket() {
+	p.conn.Close()
+}
+
+// Shutdown sends SIGTERM to the plugin like the Provider does when it
+// halts, and waits for the plugin to exit.
+func (p *Plugin) Shutdown() error {
+	if err := p.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		return fmt.Errorf("%w: %v", ErrNotRunning, err)
+	}
+	select {
+	case <-p.exitCh:
+		return nil
+	case <-time.After(p.timeout):
+		return fmt.Errorf("%w: plugin did not exit upon SIGTERM", ErrTimeout)
+	}
+}
+
+// Exited returns true and the exit error if the plugin exited within the
+// duration.
+func (p *Plugin) Exited(d time.Duration) (bool, error) {
+	select {
+	case <-p.exitCh:
+		return true, p.exitErr
+	case <-time.After(d):
+		return false, nil
+	}
+}
+
+// Kill kills the plugin and waits for it to exit.
+func (p *Plugin) Kill() {
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	p.cmd.Process.Kill()
+	<-p.exitCh
+}
+
+// Stderr returns what the plugin wrote to stderr, it must only be called
+// once the plugin exited.
+func (p *Plugin) Stderr() string {
+	return p.stderr.String()
+}
+
+// Result is the outcome of a Check.
+type Result struct {
+	Check  *Check
+	Err    error
+	Stderr string
+}
+
+// Passed returns true if the Check passed.
+func (r *Result) Passed() bool {
+	return r.Err == nil
+}
+
+// Report is the list of Results of a conformance run.
+type Report struct {
+	Results []*Result
+}
+
+// Passed returns true if all of the Checks passed.
+func (r *Report) Passed() bool {
+	for _, result := range r.Results {
+		if !result.Passed() {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteTo writes a human readable report.
+func (r *Report) WriteTo(w io.Writer) (int64, error) {
+	b := new(bytes.Buffer)
+	passed := 0
+	for _, result := range r.Results {
+		if result.Passed() {
+			passed++
+			fmt.Fprintf(b, "PASS %s\n", result.Check.Name)
+			continue
+		}
+		fmt.Fprintf(b, "FAIL %s: %s\n", result.Check.Name, result.Check.Description)
+		fmt.Fprintf(b, "    %s\n", strings.ReplaceAll(result.Err.Error(), "\n", "\n    "))
+		if result.Stderr != "" {
+			fmt.Fprintf(b, "    stderr:\n    %s\n", strings.ReplaceAll(strings.TrimSpace(result.Stderr), "\n", "\n    "))
+		}
+	}
+	fmt.Fprintf(b, "%d of %d checks passed\n", passed, len(r.Results))
+	return b.WriteTo(w)
+}
+
+// Run runs each of the Checks against a new instance of the plugin.
+func Run(command string, args []string, checks []*Check, timeout time.Duration) *Report {
+	report := new(Report)
+	for _, check := range checks {
+		result := &Result{Check: check}
+		p, err := Launch(command, args, timeout)
+		if err != nil {
+			result.Err = err
+		} else {
+			result.Err = check.Run(p)
+			p.Kill()
+			result.Stderr = p.Stderr()
+		}
+		report.Results = append(report.Results, result)
+	}
+	return report
+}
@@ -0,0 +1,146 @@
+// conformance_test.go - conformance tests of the reference cbor plugin
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package conformance
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/server/cborplugin"
+	"github.com/katzenpost/katzenpost/server_plugins/cbor_plugins/echo-go/echo"
+)
+
+const (
+	helperPluginEnv  = "CONFORMANCE_TEST_HELPER"
+	helperPluginKind = "CONFORMANCE_TEST_PLUGIN"
+	helperPluginRun  = "-test.run=^TestHelperPlugin$"
+)
+
+// brokenResponse is a Response with a field unknown to the Provider.
+type brokenResponse struct {
+	Payload []byte
+	Padding int
+}
+
+func (r *brokenResponse) Marshal() ([]byte, error) {
+	return cbor.Marshal(r)
+}
+
+func (r *brokenResponse) Unmarshal(b []byte) error {
+	return cbor.Unmarshal(b, r)
+}
+
+// brokenPlugin answers Requests with brokenResponses.
+type brokenPlugin struct{}
+
+func (p *brokenPlugin) OnCommand(cmd cborplugin.Command) (cborplugin.Command, error) {
+	r, ok := cmd.(*cborplugin.Request)
+	if !ok {
+		return nil, errors.New("invalid Command type")
+	}
+	return &brokenResponse{Payload: r.Payload, Padding: 1}, nil
+}
+
+func (p *brokenPlugin) RegisterConsumer(s *cborplugin.Server) {}
+
+// TestHelperPlugin is not a real test, it is the plugin program
+// executed by the conformance tests.
+func TestHelperPlugin(t *testing.T) {
+	if os.Getenv(helperPluginEnv) == "" {
+		t.Skip("only run as a plugin by other tests")
+	}
+	var plugin cborplugin.ServerPlugin = new(echo.Echo)
+	if os.Getenv(helperPluginKind) == "broken" {
+		plugin = new(brokenPlugin)
+	}
+	// each launch of the plugin listens on a new socket
+	dir, err := os.MkdirTemp(os.Getenv(helperPluginEnv), "plugin")
+	require.NoError(t, err)
+	// stdout is reserved for the socket path
+	logBackend, err := log.New(filepath.Join(dir, "plugin.log"), "DEBUG", false)
+	require.NoError(t, err)
+	socketFile := filepath.Join(dir, "plugin.sock")
+	server := cborplugin.NewServer(logBackend.GetLogger("server"), socketFile, new(cborplugin.RequestFactory), plugin)
+	fmt.Printf("%s\n", socketFile)
+	server.Accept()
+	select {}
+}
+
+func TestEchoConformance(t *testing.T) {
+	require := require.New(t)
+	t.Setenv(helperPluginEnv, t.TempDir())
+
+	checks := append(append([]*Check{}, Checks...), HealthChecks...)
+	report := Run(os.Args[0], []string{helperPluginRun}, checks, DefaultTimeout)
+	out := new(bytes.Buffer)
+	_, err := report.WriteTo(out)
+	require.NoError(err)
+	require.True(report.Passed(), out.String())
+	require.Len(report.Results, len(checks))
+}
+
+func TestBrokenPluginConformance(t *testing.T) {
+	require := require.New(t)
+	t.Setenv(helperPluginEnv, t.TempDir())
+	t.Setenv(helperPluginKind, "broken")
+
+	report := Run(os.Args[0], []string{helperPluginRun}, Checks, DefaultTimeout)
+	require.False(report.Passed())
+	failed := make(map[string]error)
+	for _, result := range report.Results {
+		if !result.Passed() {
+			failed[result.Check.Name] = result.Err
+		}
+	}
+	require.Len(failed, 3, "%v", failed)
+	var framingErr *FramingError
+	require.ErrorAs(failed["oversized_payload"], &framingErr)
+	require.Contains(framingErr.Error(), "bytes total")
+	require.ErrorAs(failed["pipelined_requests"], &framingErr)
+	require.ErrorAs(failed["request"], &framingErr)
+	require.NotNil(framingErr.Expected)
+	require.Contains(framingErr.Error(), "first difference at offset 0x0")
+
+	out := new(bytes.Buffer)
+	_, err := report.WriteTo(out)
+	require.NoError(err)
+	require.Contains(out.String(), "FAIL request")
+	require.Contains(out.String(), "2 of 5 checks passed")
+
+	// The health checks themselves are answered by the Server, but the
+	// Responses of the broken plugin are still invalid.
+	report = Run(os.Args[0], []string{helperPluginRun}, HealthChecks, DefaultTimeout)
+	failed = make(map[string]error)
+	for _, result := range report.Results {
+		if !result.Passed() {
+			failed[result.Check.Name] = result.Err
+		}
+	}
+	require.Len(failed, 1, "%v", failed)
+	require.ErrorAs(failed["response_id"], &framingErr)
+
+	// A plugin which never writes its socket path fails every check.
+	report = Run("true", nil, Checks[:1], DefaultTimeout)
+	require.False(report.Passed())
+}
@@ -0,0 +1,264 @@
+// health.go - health checks and restarts for cbor plugins
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cborplugin
+
+import (
+	"errors"
+	"time"
+)
+
+// DefaultHealthCheckFailures is the default number of consecutive
+// unanswered health checks after which a plugin is restarted.
+const DefaultHealthCheckFailures = 3
+
+const (
+	// DefaultReadinessInterval is the interval at which a plugin which is
+	// not ready yet is checked again, unless it sends a RetryAfter hint.
+	DefaultReadinessInterval = time.Second
+
+	// DefaultReadinessTimeout is the time allowed to answer a health
+	// check if no timeout was set.
+	DefaultReadinessTimeout = 5 * time.Second
+)
+
+// ErrPluginRestarted is the error used for Requests which were pending
+// when the plugin was restarted.
+var ErrPluginRestarted = errors.New("cborplugin: plugin restarted")
+
+// HealthCheck is sent by the Client to check that the plugin is still
+// answering, the Server echoes it back in a Response.
+type HealthCheck struct {
+	ID uint64
+
+	// NotReady is set by the Server if the plugin is still initializing.
+	NotReady bool `cbor:",omitempty"`
+
+	// RetryAfter is the number of milliseconds after which a plugin which
+	// is NotReady should be checked again, or 0 for the default.
+	RetryAfter uint64 `cbor:",omitempty"`
+
+	// Parameters is set by the Server to the Parameters of plugins which
+	// implement ParametersPlugin.
+	Parameters Parameters `cbor:",omitempty"`
+}
+
+// ReadyPlugin is implemented by ServerPlugins which take a while to
+// initialize after they are launched, such as to load a database. If
+// health checks are enabled, the capability of a plugin is only advertised
+// in the PKI after it reports that it is ready; plugins which do not
+// implement ReadyPlugin are ready as soon as they answer a HealthCheck.
+type ReadyPlugin interface {
+	// Ready returns true if the plugin is ready to answer Requests,
+	// otherwise it may return when to check again.
+	Ready() (bool, time.Duration)
+}
+
+// ParametersPlugin is implemented by ServerPlugins which publish
+// Parameters in the Provider's descriptor. The Parameters are sent with
+// each answer to a health check, so that they are refreshed when the
+// plugin is restarted.
+type ParametersPlugin interface {
+	GetParameters() *Parameters
+}
+
+type healthCheckConfig struct {
+	interval    time.Duration
+	timeout     time.Duration
+	maxFailures int
+}
+
+// SetHealthCheck enables periodic health checks of the plugin. The plugin
+// is killed and launched again after maxFailures consecutive health checks
+// were not answered within timeout. It must be called before Start.
+func (c *Client) SetHealthCheck(interval, timeout time.Duration, maxFailures int) {
+	if maxFailures <= 0 {
+		maxFailures = DefaultHealthCheckFailures
+	}
+	c.healthCheck = healthCheckConfig{
+		interval:    interval,
+		timeout:     timeout,
+		maxFailures: maxFailures,
+	}
+}
+
+// Ready returns true if the plugin answered a health check reporting that
+// it is ready since it was last launched. Without health checks, plugins
+// are ready as soon as they were launched.
+func (c *Client) Ready() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.ready
+}
+
+func (c *Client) setReady(ready bool) {
+	c.Lock()
+	changed := c.ready != ready
+	c.ready = ready
+	c.Unlock()
+	if changed && ready {
+		c.log.Noticef("%s: plugin is ready", c.capability)
+	}
+}
+
+func (c *Client) setParameters(params Parameters) {
+	c.Lock()
+	defer c.Unlock()
+	c.parameters = params
+}
+
+// healthChecker waits for the plugin to report that it is ready, and
+// then checks its health periodically. It only runs if health checks are
+// enabled.
+func (c *Client) healthChecker() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	var id uint64
+	failures := 0
+	for {
+		select {
+		case <-c.HaltCh():
+			return
+		case <-timer.C:
+		}
+
+		id++
+		hc := c.checkHealth(id)
+		switch {
+		case hc == nil:
+			failures++
+			c.log.Warningf("%s: health check %d not answered (%d/%d)", c.capability, id, failures, c.healthCheck.maxFailures)
+			if failures < c.healthCheck.maxFailures {
+				break
+			}
+			failures = 0
+			if err := c.restart(); err != nil {
+				c.log.Errorf("%s: failed to restart plugin: %s", c.capability, err)
+				go c.Halt()
+				return
+			}
+		case hc.NotReady:
+			failures = 0
+			c.setParameters(hc.Parameters)
+			c.setReady(false)
+			c.log.Debugf("%s: plugin is not ready yet", c.capability)
+		default:
+			failures = 0
+			c.setParameters(hc.Parameters)
+			c.setReady(true)
+		}
+
+		next := c.healthCheck.interval
+		if !c.Ready() {
+			next = DefaultReadinessInterval
+			if hc != nil && hc.RetryAfter > 0 {
+				next = time.Duration(hc.RetryAfter) * time.Millisecond
+			}
+		}
+		timer.Reset(next)
+	}
+}
+
+// checkHealth returns the answer to the health check, or nil if it was
+// not answered in time.
+func (c *Client) checkHealth(id uint64) *HealthCheck {
+	timeout := c.healthCheck.timeout
+	if timeout <= 0 {
+		timeout = DefaultReadinessTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	socket := c.currentSocket()
+	select {
+	case <-c.HaltCh():
+		return &HealthCheck{ID: id}
+	case <-timer.C:
+		return nil
+	case socket.WriteChan() <- &Request{HealthCheck: &HealthCheck{ID: id}}:
+	}
+	for {
+		select {
+		case <-c.HaltCh():
+			return &HealthCheck{ID: id}
+		case <-timer.C:
+			return nil
+		case got := <-c.healthCh:
+			if got.ID == id {
+				return got
+			}
+		}
+	}
+}
+
+// restart kills the plugin with SIGKILL and launches it again with the
+// same command and arguments. Requests which were pending are answered
+// with a RequestError wrapping ErrPluginRestarted.
+func (c *Client) restart() error {
+	c.Lock()
+	c.restarting = true
+	c.ready = false
+	c.parameters = nil
+	cmd, stderrDone, socket := c.cmd, c.stderrDone, c.socket
+	c.Unlock()
+	defer func() {
+		c.Lock()
+		c.restarting = false
+		c.Unlock()
+	}()
+
+	c.log.Warningf("%s: restarting plugin %s (pid %d)", c.capability, c.command, cmd.Process.Pid)
+	if err := cmd.Process.Kill(); err != nil {
+		c.log.Errorf("%s: failed to kill plugin: %s", c.capability, err)
+	}
+	<-stderrDone
+	if err := cmd.Wait(); err != nil {
+		c.log.Debugf("%s: plugin exited: %s", c.capability, err)
+	}
+	socket.close()
+
+	if err := c.launch(); err != nil {
+		return err
+	}
+	c.Lock()
+	socketFile := c.socketFile
+	c.Unlock()
+	newSocket := NewCommandIO(c.logBackend.GetLogger("client_socket"))
+	if err := newSocket.dial(socketFile, c.commandBuilder); err != nil {
+		return err
+	}
+
+	c.Lock()
+	c.socket = newSocket
+	pending := c.pending
+	c.pending = nil
+	pid := c.cmd.Process.Pid
+	c.Unlock()
+	select {
+	case c.restartCh <- struct{}{}:
+	default:
+	}
+	c.log.Noticef("%s: restarted plugin %s (pid %d)", c.capability, c.command, pid)
+
+	for _, id := range pending {
+		select {
+		case <-c.HaltCh():
+			return nil
+		case c.readCh <- &RequestError{ID: id, Err: ErrPluginRestarted}:
+		}
+	}
+	return nil
+}
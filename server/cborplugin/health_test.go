@@ -0,0 +1,285 @@
+// health_test.go - health check tests
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cborplugin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/core/log"
+)
+
+const (
+	helperPluginEnv      = "CBORPLUGIN_TEST_HELPER"
+	helperPluginReadyEnv = "CBORPLUGIN_TEST_HELPER_READY"
+	helperPluginRun      = "-test.run=^TestHelperPlugin$"
+)
+
+// helperPlugin echoes Requests and never answers the payload "wedge".
+// The payload "busy <n>" is answered once n processes are busy, see
+// waitBusy. It is not ready until readyAt.
+type helperPlugin struct {
+	readyAt time.Time
+}
+
+func (p *helperPlugin) Ready() (bool, time.Duration) {
+	if time.Now().Before(p.readyAt) {
+		return false, 20 * time.Millisecond
+	}
+	return true, 0
+}
+
+func (p *helperPlugin) OnCommand(cmd Command) (Command, error) {
+	r, ok := cmd.(*Request)
+	if !ok {
+		return nil, errors.New("invalid Command type")
+	}
+	switch {
+	case string(r.Payload) == "wedge":
+		select {}
+	case bytes.HasPrefix(r.Payload, []byte("busy ")):
+		want, err := strconv.Atoi(string(r.Payload[len("busy "):]))
+		if err != nil {
+			return nil, err
+		}
+		peak, err := waitBusy(r.ID, want)
+		if err != nil {
+			return nil, err
+		}
+		return &Response{Payload: []byte(strconv.Itoa(peak))}, nil
+	}
+	return &Response{Payload: r.Payload}, nil
+}
+
+// waitBusy is a barrier across the plugin processes of a test: it marks
+// the Request busy in a directory shared by the processes until want
+// Requests are busy at once, and returns the most it saw. Once the
+// barrier is reached it stays open, and it gives up after a few seconds
+// so that a test expecting too much concurrency fails rather than hangs.
+func waitBusy(id uint64, want int) (int, error) {
+	dir := filepath.Join(os.Getenv(helperPluginEnv), fmt.Sprintf("busy-%d", want))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return 0, err
+	}
+	released := filepath.Join(dir, "released")
+	marker := filepath.Join(dir, strconv.FormatUint(id, 10))
+	if err := os.WriteFile(marker, nil, 0600); err != nil {
+		return 0, err
+	}
+	defer os.Remove(marker)
+
+	peak := 0
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(released); err == nil {
+			return peak, nil
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return 0, err
+		}
+		busy := 0
+		for _, entry := range entries {
+			if entry.Name() != filepath.Base(released) {
+				busy++
+			}
+		}
+		if busy > peak {
+			peak = busy
+		}
+		if peak >= want {
+			return peak, os.WriteFile(released, nil, 0600)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return peak, nil
+}
+
+func (p *helperPlugin) GetParameters() *Parameters {
+	return &Parameters{"pid": strconv.Itoa(os.Getpid())}
+}
+
+func (p *helperPlugin) RegisterConsumer(s *Server) {}
+
+// TestHelperPlugin is not a real test, it is the plugin program
+// executed by the tests which Start a Client.
+func TestHelperPlugin(t *testing.T) {
+	if os.Getenv(helperPluginEnv) == "" {
+		t.Skip("only run as a plugin by other tests")
+	}
+	// each launch of the plugin listens on a new socket
+	dir, err := os.MkdirTemp(os.Getenv(helperPluginEnv), "plugin")
+	require.NoError(t, err)
+	// stdout is reserved for the socket path
+	logBackend, err := log.New(filepath.Join(dir, "plugin.log"), "DEBUG", false)
+	require.NoError(t, err)
+	socketFile := filepath.Join(dir, "plugin.sock")
+	plugin := new(helperPlugin)
+	if delay := os.Getenv(helperPluginReadyEnv); delay != "" {
+		d, err := time.ParseDuration(delay)
+		require.NoError(t, err)
+		plugin.readyAt = time.Now().Add(d)
+	}
+	server := NewServer(logBackend.GetLogger("server"), socketFile, new(RequestFactory), plugin)
+	fmt.Printf("%s\n", socketFile)
+	server.Accept()
+	select {}
+}
+
+func TestHealthCheckRestart(t *testing.T) {
+	require := require.New(t)
+	t.Setenv(helperPluginEnv, t.TempDir())
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	client := NewClient(logBackend, "test", "+test", new(ResponseFactory))
+	client.SetHealthCheck(50*time.Millisecond, 50*time.Millisecond, 2)
+	err = client.Start(os.Args[0], []string{helperPluginRun})
+	require.NoError(err)
+	t.Cleanup(client.Halt)
+
+	client.WriteChan() <- &Request{ID: 1, Payload: []byte("hello")}
+	r, ok := readResponse(t, client).(*Response)
+	require.True(ok)
+	require.Equal([]byte("hello"), r.Payload)
+
+	client.Lock()
+	pid := client.cmd.Process.Pid
+	client.Unlock()
+	pluginPid := func() interface{} {
+		return (*client.GetParameters())["pid"]
+	}
+	require.Eventually(func() bool {
+		return pluginPid() == strconv.Itoa(pid)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The wedged plugin is restarted and the pending request fails.
+	client.WriteChan() <- &Request{ID: 2, Payload: []byte("wedge")}
+	e, ok := readResponse(t, client).(*RequestError)
+	require.True(ok)
+	require.Equal(uint64(2), e.ID)
+	require.ErrorIs(e, ErrPluginRestarted)
+
+	client.Lock()
+	newPid := client.cmd.Process.Pid
+	client.Unlock()
+	require.NotEqual(pid, newPid)
+
+	// The Parameters are refreshed from the new plugin process.
+	require.Eventually(func() bool {
+		return pluginPid() == strconv.Itoa(newPid)
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal("+test", (*client.GetParameters())["endpoint"])
+
+	client.WriteChan() <- &Request{ID: 3, Payload: []byte("hello again")}
+	r, ok = readResponse(t, client).(*Response)
+	require.True(ok)
+	require.Equal([]byte("hello again"), r.Payload)
+}
+
+func TestReadiness(t *testing.T) {
+	require := require.New(t)
+	t.Setenv(helperPluginEnv, t.TempDir())
+	t.Setenv(helperPluginReadyEnv, "500ms")
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	client := NewClient(logBackend, "test", "+test", new(ResponseFactory))
+	client.SetHealthCheck(50*time.Millisecond, 50*time.Millisecond, 2)
+	err = client.Start(os.Args[0], []string{helperPluginRun})
+	require.NoError(err)
+	t.Cleanup(client.Halt)
+
+	// The slow starting plugin only becomes ready after its delay.
+	start := time.Now()
+	require.False(client.Ready())
+	require.Eventually(client.Ready, 5*time.Second, 10*time.Millisecond)
+	require.GreaterOrEqual(time.Since(start), 500*time.Millisecond)
+
+	// The plugin is not ready while it is started again after a crash.
+	client.WriteChan() <- &Request{ID: 1, Payload: []byte("wedge")}
+	e, ok := readResponse(t, client).(*RequestError)
+	require.True(ok)
+	require.ErrorIs(e, ErrPluginRestarted)
+	require.False(client.Ready())
+	require.Eventually(client.Ready, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestReadinessWithoutHealthCheck(t *testing.T) {
+	require := require.New(t)
+	t.Setenv(helperPluginEnv, t.TempDir())
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	pool := NewClientPool(logBackend, "test", "+test", 2)
+	err = pool.Start(os.Args[0], []string{helperPluginRun})
+	require.NoError(err)
+	t.Cleanup(pool.Halt)
+
+	// Without health checks the plugins are ready once they were
+	// launched, and are never sent a health check.
+	require.True(pool.Ready())
+	cmd, err := pool.Call(&Request{ID: 1, Payload: []byte("hello")})
+	require.NoError(err)
+	r, ok := cmd.(*Response)
+	require.True(ok)
+	require.Equal([]byte("hello"), r.Payload)
+}
+
+func TestUnmatchedResponse(t *testing.T) {
+	require := require.New(t)
+	client := newTestClientServer(t)
+
+	// Responses which no Request is waiting for are dropped.
+	client.currentSocket().readCh <- &Response{Payload: []byte("stray")}
+	client.currentSocket().readCh <- &Response{ID: 23, Payload: []byte("stray")}
+	client.WriteChan() <- &Request{ID: 1, Payload: []byte("full response")}
+	r, ok := readResponse(t, client).(*Response)
+	require.True(ok)
+	require.Equal(uint64(1), r.ID)
+	require.Equal([]byte("full response"), r.Payload)
+
+	// With health checks enabled, Responses must have an ID.
+	client.SetHealthCheck(time.Hour, time.Hour, 0)
+	client.Lock()
+	client.pending = append(client.pending, 2)
+	client.Unlock()
+	client.currentSocket().readCh <- &Response{Payload: []byte("probe")}
+	client.currentSocket().readCh <- &Response{ID: 2, Payload: []byte("answer")}
+	r, ok = readResponse(t, client).(*Response)
+	require.True(ok)
+	require.Equal([]byte("answer"), r.Payload)
+}
+
+func TestStartDialError(t *testing.T) {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	client := NewClient(logBackend, "test", "+test", new(ResponseFactory))
+	// echo prints a socket path nobody listens on
+	err = client.Start("echo", []string{filepath.Join(t.TempDir(), "missing.sock")})
+	require.Error(err)
+	client.Wait()
+}
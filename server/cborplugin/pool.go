@@ -0,0 +1,185 @@
+// pool.go - pools of cbor plugin processes
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cborplugin
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gopkg.in/op/go-logging.v1"
+
+	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/core/worker"
+)
+
+// ErrPoolHalted is the error returned by ClientPool.Call when the pool
+// was halted before the Request was answered.
+var ErrPoolHalted = errors.New("cborplugin: client pool halted")
+
+// ClientPool runs several identical plugin processes for one capability
+// and spreads Requests across them. Each process is given one Request at
+// a time, so Requests go to the process with no outstanding Request and
+// answers cannot be confused between callers. If any of the processes
+// halts, the whole pool halts.
+type ClientPool struct {
+	worker.Worker
+
+	log *logging.Logger
+
+	clients []*Client
+	idle    chan *Client
+}
+
+// NewClientPool creates a new pool of n plugin clients.
+func NewClientPool(logBackend *log.Backend, capability, endpoint string, n int) *ClientPool {
+	if n < 1 {
+		n = 1
+	}
+	p := &ClientPool{
+		log:     logBackend.GetLogger(fmt.Sprintf("client_pool %s", capability)),
+		clients: make([]*Client, n),
+		idle:    make(chan *Client, n),
+	}
+	for i := range p.clients {
+		p.clients[i] = NewClient(logBackend, capability, endpoint, &ResponseFactory{})
+	}
+	return p
+}
+
+// SetHealthCheck enables health checks on every plugin process of the pool,
+// see Client.SetHealthCheck. It must be called before Start.
+func (p *ClientPool) SetHealthCheck(interval, timeout time.Duration, maxFailures int) {
+	for _, c := range p.clients {
+		c.SetHealthCheck(interval, timeout, maxFailures)
+	}
+}
+
+// SetChunkLimits sets the limits of multi-part Responses on every plugin
+// process of the pool, see Client.SetChunkLimits. It must be called before
+// Start.
+func (p *ClientPool) SetChunkLimits(timeout time.Duration, maxSize int) {
+	for _, c := range p.clients {
+		c.SetChunkLimits(timeout, maxSize)
+	}
+}
+
+// Start execs all the plugin processes of the pool.
+func (p *ClientPool) Start(command string, args []string) error {
+	for i, c := range p.clients {
+		if err := c.Start(command, args); err != nil {
+			for _, started := range p.clients[:i] {
+				started.Halt()
+			}
+			return err
+		}
+		p.idle <- c
+	}
+	for _, c := range p.clients {
+		c := c
+		p.Go(func() {
+			select {
+			case <-p.HaltCh():
+			case <-c.HaltCh():
+				p.log.Errorf("plugin client halted, halting pool")
+				// Halt waits for this goroutine to return.
+				go p.Halt()
+			}
+		})
+	}
+	p.Go(p.reaper)
+	return nil
+}
+
+func (p *ClientPool) reaper() {
+	<-p.HaltCh()
+	for _, c := range p.clients {
+		c.Halt()
+	}
+}
+
+// Call sends the Request to an idle plugin process and returns its
+// answer, which is either a Response or a RequestError. Answers to other
+// Requests, such as late Responses to Requests which already failed, are
+// discarded.
+func (p *ClientPool) Call(r *Request) (Command, error) {
+	var c *Client
+	select {
+	case <-p.HaltCh():
+		return nil, ErrPoolHalted
+	case c = <-p.idle:
+	}
+	defer func() {
+		p.idle <- c
+	}()
+
+	select {
+	case <-p.HaltCh():
+		return nil, ErrPoolHalted
+	case c.WriteChan() <- r:
+	}
+	for {
+		select {
+		case <-p.HaltCh():
+			return nil, ErrPoolHalted
+		case cmd := <-c.ReadChan():
+			if answers(cmd, r.ID) {
+				return cmd, nil
+			}
+			p.log.Debugf("discarding answer to another Request than %d", r.ID)
+		}
+	}
+}
+
+// answers returns true if the Command answers the Request with the given
+// ID, Responses without an ID answer the Request in flight.
+func answers(cmd Command, id uint64) bool {
+	switch r := cmd.(type) {
+	case *Response:
+		return r.ID == 0 || r.ID == id
+	case *RequestError:
+		return r.ID == id
+	default:
+		return true
+	}
+}
+
+// Size returns the number of plugin processes in the pool.
+func (p *ClientPool) Size() int {
+	return len(p.clients)
+}
+
+// Ready returns true if every plugin process of the pool is ready, see
+// Client.Ready.
+func (p *ClientPool) Ready() bool {
+	for _, c := range p.clients {
+		if !c.Ready() {
+			return false
+		}
+	}
+	return true
+}
+
+// Capability returns the capability of the plugin.
+func (p *ClientPool) Capability() string {
+	return p.clients[0].Capability()
+}
+
+// GetParameters returns the parameters of the first plugin process, all
+// processes of the pool run the same program.
+func (p *ClientPool) GetParameters() *map[string]interface{} {
+	return p.clients[0].GetParameters()
+}
@@ -0,0 +1,81 @@
+// pool_test.go - client pool tests
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cborplugin
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/katzenpost/core/log"
+)
+
+// callConcurrently makes n concurrent Calls which each wait for want
+// plugin processes to be busy, and returns the most busy processes seen.
+func callConcurrently(t *testing.T, pool *ClientPool, n, want int) int {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		peak int
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cmd, err := pool.Call(&Request{ID: uint64(i + 1), Payload: []byte(fmt.Sprintf("busy %d", want))})
+			require.NoError(t, err)
+			r, ok := cmd.(*Response)
+			require.True(t, ok)
+			busy, err := strconv.Atoi(string(r.Payload))
+			require.NoError(t, err)
+			mu.Lock()
+			if busy > peak {
+				peak = busy
+			}
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	return peak
+}
+
+func TestClientPool(t *testing.T) {
+	require := require.New(t)
+	t.Setenv(helperPluginEnv, t.TempDir())
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+
+	for _, n := range []int{1, 4} {
+		pool := NewClientPool(logBackend, "test", "+test", n)
+		require.Equal(n, pool.Size())
+		err = pool.Start(os.Args[0], []string{helperPluginRun})
+		require.NoError(err)
+		require.Equal("test", pool.Capability())
+		require.Equal("+test", (*pool.GetParameters())["endpoint"])
+
+		// Every process of the pool serves a Request at the same time.
+		require.Equal(n, callConcurrently(t, pool, 8, n))
+		pool.Halt()
+
+		_, err = pool.Call(&Request{ID: 42, Payload: []byte("late")})
+		require.ErrorIs(err, ErrPoolHalted)
+	}
+}
@@ -18,6 +18,7 @@ package cborplugin
 
 import (
 	//"net"
+	"time"
 
 	"gopkg.in/op/go-logging.v1"
 
@@ -62,10 +63,39 @@ func (s *Server) worker() {
 		case <-s.HaltCh():
 			return
 		case cmd := <-s.socket.ReadChan():
+			if r, ok := cmd.(*Request); ok && r.HealthCheck != nil {
+				// answered by this worker so that a wedged plugin fails it
+				hc := *r.HealthCheck
+				if p, ok := s.plugin.(ReadyPlugin); ok {
+					ready, retryAfter := p.Ready()
+					hc.NotReady = !ready
+					hc.RetryAfter = uint64(retryAfter / time.Millisecond)
+				}
+				if p, ok := s.plugin.(ParametersPlugin); ok {
+					if params := p.GetParameters(); params != nil {
+						hc.Parameters = *params
+					}
+				}
+				select {
+				case <-s.HaltCh():
+					return
+				case s.socket.WriteChan() <- &Response{HealthCheck: &hc}:
+				}
+				continue
+			}
 			reply, err := s.plugin.OnCommand(cmd)
 			if err != nil {
 				s.log.Debugf("plugin returned err: %s", err)
 			}
+			if reply == nil && err == nil {
+				// the plugin replies asynchronously with Write or WriteChunked
+				continue
+			}
+			if resp, ok := reply.(*Response); ok && resp.ID == 0 {
+				if r, ok := cmd.(*Request); ok {
+					resp.ID = r.ID
+				}
+			}
 			select {
 			case <-s.HaltCh():
 				return
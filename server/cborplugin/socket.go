@@ -69,12 +69,10 @@ func (c *CommandIO) Start(initiator bool, socketFile string, commandBuilder Comm
 	c.commandBuilder = commandBuilder
 
 	if initiator {
-		err := c.dial(socketFile)
+		err := c.dial(socketFile, commandBuilder)
 		if err != nil {
 			panic(err)
 		}
-		c.Go(c.reader)
-		c.Go(c.writer)
 	} else {
 		c.log.Debugf("listening to unix domain socket file: %s", socketFile)
 		var err error
@@ -97,17 +95,27 @@ func (c *CommandIO) Accept() {
 	c.Go(c.writer)
 }
 
-func (c *CommandIO) dial(socketFile string) error {
+func (c *CommandIO) dial(socketFile string, commandBuilder CommandBuilder) error {
 	c.log.Debugf("dialing unix domain socket file: %s", socketFile)
+	c.commandBuilder = commandBuilder
 	var err error
 	c.conn, err = net.Dial("unix", socketFile)
 	if err != nil {
 		return err
 	}
 
+	c.Go(c.reader)
+	c.Go(c.writer)
 	return nil
 }
 
+func (c *CommandIO) close() {
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	c.Halt()
+}
+
 func (c *CommandIO) ReadChan() chan Command {
 	return c.readCh
 }
@@ -122,7 +130,8 @@ func (c *CommandIO) reader() {
 		cmd := c.commandBuilder.Build()
 		err := dec.Decode(cmd)
 		if err != nil {
-			c.Halt()
+			// Halt waits for this goroutine to return.
+			go c.Halt()
 			return
 		}
 		select {
@@ -142,7 +151,7 @@ func (c *CommandIO) writer() {
 		case cmd := <-c.writeCh:
 			err := enc.Encode(cmd)
 			if err != nil {
-				c.Halt()
+				go c.Halt()
 				return
 			}
 		}
@@ -0,0 +1,70 @@
+// main.go - cbor plugin conformance tester.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+
+	"github.com/katzenpost/katzenpost/server/cborplugin/conformance"
+)
+
+func main() {
+	timeout := flag.Duration("timeout", conformance.DefaultTimeout, "Time allowed for each step of a check.")
+	run := flag.String("run", "", "Only run the checks matching the regular expression.")
+	list := flag.Bool("list", false, "List the checks and exit.")
+	healthCheck := flag.Bool("health_check", false, "Also run the checks for plugins which support health checks.")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] plugin [plugin args...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	all := conformance.Checks
+	if *healthCheck {
+		all = append(all, conformance.HealthChecks...)
+	}
+	if *list {
+		for _, check := range all {
+			fmt.Printf("%s: %s\n", check.Name, check.Description)
+		}
+		return
+	}
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	re, err := regexp.Compile(*run)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid -run regular expression: %v\n", err)
+		os.Exit(2)
+	}
+	var checks []*conformance.Check
+	for _, check := range all {
+		if re.MatchString(check.Name) {
+			checks = append(checks, check)
+		}
+	}
+
+	report := conformance.Run(flag.Arg(0), flag.Args()[1:], checks, *timeout)
+	report.WriteTo(os.Stdout)
+	if !report.Passed() {
+		os.Exit(1)
+	}
+}
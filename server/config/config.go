@@ -29,6 +29,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"golang.org/x/net/idna"
 	"golang.org/x/text/secure/precis"
@@ -37,6 +38,7 @@ import (
 	"github.com/fxamacker/cbor/v2"
 
 	"github.com/katzenpost/katzenpost/authority/voting/server/config"
+	"github.com/katzenpost/katzenpost/core/epochtime"
 	"github.com/katzenpost/katzenpost/core/pki"
 	"github.com/katzenpost/katzenpost/core/sphinx/geo"
 	"github.com/katzenpost/katzenpost/core/utils"
@@ -60,6 +62,7 @@ const (
 	defaultUserDB              = "users.db"
 	defaultSpoolDB             = "spool.db"
 	defaultManagementSocket    = "management_sock"
+	defaultReplayCacheSize     = 1 << 16
 
 	backendPgx = "pgx"
 
@@ -226,6 +229,11 @@ type Debug struct {
 	// be considered lost.
 	DecoySlack int
 
+	// DecoyRecipientRotation is the interval at which the recipient ID of
+	// the decoy loop SURB Replies is rotated in milliseconds, defaulting
+	// to once per epoch.
+	DecoyRecipientRotation int
+
 	// ConnectTimeout specifies the maximum time a connection can take to
 	// establish a TCP/IP connection in milliseconds.
 	ConnectTimeout int
@@ -294,6 +302,9 @@ func (dCfg *Debug) applyDefaults() {
 	if dCfg.DecoySlack <= 0 {
 		dCfg.DecoySlack = defaultDecoySlack
 	}
+	if dCfg.DecoyRecipientRotation <= 0 {
+		dCfg.DecoyRecipientRotation = int(epochtime.Period / time.Millisecond)
+	}
 	if dCfg.ConnectTimeout <= 0 {
 		dCfg.ConnectTimeout = defaultConnectTimeout
 	}
@@ -363,6 +374,25 @@ type Provider struct {
 	// on first use. If set to true then first seen keys cause an entry in the userDB
 	// to be created. It will later be garbage collected.
 	TrustOnFirstUse bool
+
+	// KaetzchenReplayWindow is the time window in milliseconds during which
+	// duplicate requests to CBOR plugin Kaetzchen are dropped before being
+	// dispatched to the plugin. Requests are duplicates if they have the
+	// same recipient, SURB and payload, so retransmissions with a fresh
+	// SURB are dispatched. A value <= 0 disables replay suppression.
+	KaetzchenReplayWindow int
+
+	// KaetzchenReplayCacheSize is the maximum number of requests remembered
+	// for replay suppression, the oldest are forgotten first.
+	KaetzchenReplayCacheSize int
+
+	// MaxPacketRate is the number of packets per second the Provider can
+	// handle. If set, it is published coarsely in the descriptor along
+	// with a utilization band derived from the connected clients and the
+	// network send rate limit, so that clients can avoid saturated
+	// Providers. The band reveals a coarse count of the connected
+	// clients. A value of 0 publishes no capacity hints.
+	MaxPacketRate int
 }
 
 // SQLDB is the SQL database backend configuration.
@@ -493,10 +523,19 @@ type CBORPluginKaetzchen struct {
 	// that implements this Kaetzchen service.
 	Command string
 
-	// MaxConcurrency is the number of worker goroutines to start
-	// for this service.
+	// MaxConcurrency is the number of plugin processes and worker
+	// goroutines to start for this service.
 	MaxConcurrency int
 
+	// HealthCheckInterval is the interval between health checks of the
+	// plugin in milliseconds, the plugin is restarted if it stops
+	// answering them.  The capability is only advertised once the plugin
+	// reports that it is ready.  Only plugins which answer health checks
+	// and set the ID of their Responses, such as those built with the
+	// cborplugin Server, may enable them.  A value of 0 disables health
+	// checks.
+	HealthCheckInterval int
+
 	// Disable disabled a configured agent.
 	Disable bool
 }
@@ -520,11 +559,17 @@ func (kCfg *CBORPluginKaetzchen) validate() error {
 	if _, err = mail.ParseAddress(kCfg.Endpoint + "@test.invalid"); err != nil {
 		return fmt.Errorf("config: Kaetzchen: '%v' has non local-part endpoint '%v': %v", kCfg.Capability, kCfg.Endpoint, err)
 	}
+	if kCfg.HealthCheckInterval < 0 {
+		return fmt.Errorf("config: Kaetzchen: '%v' has invalid HealthCheckInterval: %v", kCfg.Capability, kCfg.HealthCheckInterval)
+	}
 
 	return nil
 }
 
 func (pCfg *Provider) applyDefaults(sCfg *Server) {
+	if pCfg.KaetzchenReplayCacheSize <= 0 {
+		pCfg.KaetzchenReplayCacheSize = defaultReplayCacheSize
+	}
 	if pCfg.UserDB == nil {
 		pCfg.UserDB = &UserDB{}
 	}
@@ -591,6 +636,10 @@ func (pCfg *Provider) validate() error {
 		}
 	}
 
+	if pCfg.MaxPacketRate < 0 {
+		return fmt.Errorf("config: Provider: MaxPacketRate %v is invalid", pCfg.MaxPacketRate)
+	}
+
 	if pCfg.SQLDB != nil {
 		if err := pCfg.SQLDB.validate(); err != nil {
 			return err
@@ -290,6 +290,14 @@ func (w *Worker) worker() {
 			continue
 		}
 
+		// SURB Replies to the loops sent by the Provider's own decoy
+		// traffic never reach the provider backend.
+		if pkt.IsSURBReply() && w.glue.Decoy().IsDecoyRecipient(&pkt.Recipient.ID) {
+			w.log.Debugf("Handing off decoy response packet: %v", pkt.ID)
+			w.glue.Decoy().OnPacket(pkt)
+			continue
+		}
+
 		// Toss the packets over to the provider backend.
 		// Note: Callee takes ownership of pkt.
 		if pkt.IsToUser() || pkt.IsUnreliableToUser() || pkt.IsSURBReply() {
@@ -18,6 +18,7 @@
 package decoy
 
 import (
+	"bytes"
 	"crypto/subtle"
 	"encoding/binary"
 	"errors"
@@ -25,9 +26,15 @@ import (
 	"io"
 	"math"
 	mRand "math/rand"
+	"os"
+	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/fxamacker/cbor/v2"
+
+	"github.com/katzenpost/hpqc/hash"
 	"github.com/katzenpost/hpqc/rand"
 	"github.com/katzenpost/katzenpost/core/epochtime"
 	"github.com/katzenpost/katzenpost/core/pki"
@@ -39,6 +46,7 @@ import (
 	"github.com/katzenpost/katzenpost/core/worker"
 	"github.com/katzenpost/katzenpost/server/internal/glue"
 	"github.com/katzenpost/katzenpost/server/internal/instrument"
+	"github.com/katzenpost/katzenpost/server/internal/loops"
 	"github.com/katzenpost/katzenpost/server/internal/packet"
 	"github.com/katzenpost/katzenpost/server/internal/pkicache"
 	"github.com/katzenpost/katzenpost/server/internal/provider/kaetzchen"
@@ -46,18 +54,48 @@ import (
 	"gopkg.in/op/go-logging.v1"
 )
 
-const maxAttempts = 3
+const (
+	maxAttempts = 3
+
+	// loopStatsFile is the name of the loop statistics checkpoint file
+	// in the DataDir.
+	loopStatsFile = "decoy_loops.cbor"
+
+	// loopStatsRetention is the number of epochs preceding the current
+	// one for which loop statistics are retained.
+	loopStatsRetention = 3
+
+	// loopStatsCheckpointInterval is the minimum interval between loop
+	// statistics checkpoints.
+	loopStatsCheckpointInterval = 5 * time.Minute
+
+	// maxRecentTrials is the number of recently finished loops used to
+	// identify the nodes suspected of dropping packets.
+	maxRecentTrials = 256
+)
 
 var errMaxAttempts = errors.New("decoy: max path selection attempts exceeded")
 
 type surbCtx struct {
 	id      uint64
+	epoch   uint64
 	eta     time.Time
 	sprpKey []byte
 
+	// nodes are the IDs of the nodes on the loop's forward and reply
+	// paths, excluding this node.
+	nodes [][sConstants.NodeIDLength]byte
+
 	etaNode *avl.Node
 }
 
+// trial is the outcome of a finished loop.
+type trial struct {
+	epoch uint64
+	nodes [][sConstants.NodeIDLength]byte
+	lost  bool
+}
+
 type decoy struct {
 	worker.Worker
 	sync.Mutex
@@ -68,19 +106,85 @@ type decoy struct {
 	glue glue.Glue
 	log  *logging.Logger
 
-	recipient []byte
-	rng       *mRand.Rand
-	docCh     chan *pkicache.Entry
+	// recipient is the current recipient ID of the SURB Replies, and
+	// prevRecipient the one it replaced, which is accepted until
+	// prevRecipientExpiry so that loops in flight are not lost.
+	recipient           []byte
+	prevRecipient       []byte
+	prevRecipientExpiry time.Time
+	recipientRotatedAt  time.Time
+	latestETA           time.Time
+
+	rng   *mRand.Rand
+	docCh chan *pkicache.Entry
 
 	surbETAs   *avl.Tree
 	surbStore  map[uint64]*surbCtx
 	surbIDBase uint64
+
+	now            func() time.Time
+	loopStats      map[uint64]*loops.LoopStats
+	loopStatsSaved time.Time
+	recentTrials   []trial
+
+	// inFlight is the number of loops in flight per epoch.
+	inFlight map[uint64]uint64
 }
 
 func (d *decoy) OnNewDocument(ent *pkicache.Entry) {
 	d.docCh <- ent
 }
 
+// IsDecoyRecipient returns true if the recipient is the one of the SURB
+// Replies of this decoy instance, either the current one or the previous
+// one until it expires.
+func (d *decoy) IsDecoyRecipient(recipient *[sConstants.RecipientIDLength]byte) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	isDecoy := subtle.ConstantTimeCompare(recipient[:], d.recipient)
+	if d.prevRecipient != nil && d.now().Before(d.prevRecipientExpiry) {
+		isDecoy |= subtle.ConstantTimeCompare(recipient[:], d.prevRecipient)
+	}
+	return isDecoy == 1
+}
+
+// currentRecipient returns the recipient ID to use for new SURB Replies.
+func (d *decoy) currentRecipient() []byte {
+	d.Lock()
+	defer d.Unlock()
+	return d.recipient
+}
+
+// rotateRecipient replaces the recipient ID of the SURB Replies once it
+// is older than the configured rotation interval, such that the decoy
+// sink can not be identified by observing the recipient IDs at this
+// Provider over a long period.  The previous recipient ID is accepted
+// until the latest ETA of the loops sent with it plus the decoy slack.
+func (d *decoy) rotateRecipient() error {
+	cfg := d.glue.Config().Debug
+	interval := time.Duration(cfg.DecoyRecipientRotation) * time.Millisecond
+	slack := time.Duration(cfg.DecoySlack) * time.Millisecond
+
+	d.Lock()
+	defer d.Unlock()
+
+	now := d.now()
+	if now.Sub(d.recipientRotatedAt) < interval {
+		return nil
+	}
+	recipient := make([]byte, sConstants.RecipientIDLength)
+	if _, err := io.ReadFull(rand.Reader, recipient); err != nil {
+		return err
+	}
+	d.prevRecipient = d.recipient
+	d.prevRecipientExpiry = d.latestETA.Add(slack)
+	d.recipient = recipient
+	d.recipientRotatedAt = now
+	d.log.Noticef("Rotated the decoy recipient, the previous recipient expires at: %v", d.prevRecipientExpiry)
+	return nil
+}
+
 func (d *decoy) OnPacket(pkt *packet.Packet) {
 	// Note: This is called from the crypto worker context, which is "fine".
 	defer pkt.Dispose()
@@ -92,7 +196,7 @@ func (d *decoy) OnPacket(pkt *packet.Packet) {
 	// Ensure that the SURB Reply is destined for the correct recipient,
 	// and that it was generated by this decoy instance.  Note that neither
 	// fields are visible to any other party involved.
-	if subtle.ConstantTimeCompare(pkt.Recipient.ID[:], d.recipient) != 1 {
+	if !d.IsDecoyRecipient(&pkt.Recipient.ID) {
 		d.log.Debugf("Dropping packet: %v (Invalid recipient)", pkt.ID)
 		instrument.PacketsDropped()
 		return
@@ -117,26 +221,119 @@ func (d *decoy) OnPacket(pkt *packet.Packet) {
 	if _, err := d.sphinx.DecryptSURBPayload(pkt.Payload, ctx.sprpKey); err != nil {
 		d.log.Debugf("Dropping packet: %v (SURB ID: 0x08x%): %v", pkt.ID, id, err)
 		instrument.PacketsDropped()
+		// the SURB context is gone, so the loop can only be lost
+		d.Lock()
+		d.finishLoop(ctx, true)
+		d.Unlock()
 		return
 	}
 
-	// TODO: At some point, this should do more than just log.
 	d.log.Debugf("Response packet: %v (SURB ID: 0x%08x): ETA: %v, Actual: %v (DeltaT: %v)", pkt.ID, id, ctx.eta, pkt.RecvAt, pkt.RecvAt.Sub(ctx.eta))
+
+	d.Lock()
+	d.finishLoop(ctx, false)
+	d.Unlock()
+}
+
+// finishLoop accounts for a loop which completed or was lost.  The caller
+// must hold the lock.
+func (d *decoy) finishLoop(ctx *surbCtx, lost bool) {
+	if lost {
+		d.loopStatsFor(ctx.epoch).Lost++
+	} else {
+		d.loopStatsFor(ctx.epoch).Completed++
+	}
+	d.recordTrial(ctx, lost)
+	if d.inFlight[ctx.epoch]--; d.inFlight[ctx.epoch] == 0 {
+		delete(d.inFlight, ctx.epoch)
+	}
+}
+
+// GetLoopStats returns a copy of the loop statistics of the given epoch,
+// if any.  The statistics keep changing until they are Final.
+func (d *decoy) GetLoopStats(epoch uint64) (*loops.LoopStats, bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	stats, ok := d.loopStats[epoch]
+	if !ok {
+		return nil, false
+	}
+	statsCopy := *stats
+	statsCopy.SuspectNodes = d.suspectNodes(epoch)
+	statsCopy.Final = epoch < d.epoch() && d.inFlight[epoch] == 0
+	return &statsCopy, true
+}
+
+// recordTrial adds the outcome of the loop to the window of recently
+// finished loops.  The caller must hold the lock.
+func (d *decoy) recordTrial(ctx *surbCtx, lost bool) {
+	if len(d.recentTrials) == maxRecentTrials {
+		d.recentTrials[0] = trial{}
+		d.recentTrials = d.recentTrials[1:]
+	}
+	d.recentTrials = append(d.recentTrials, trial{epoch: ctx.epoch, nodes: ctx.nodes, lost: lost})
+}
+
+// suspectNodes returns the nodes on the paths of the recently lost loops
+// of the epoch, ordered by the number of lost loops through them, then by
+// the fewest completed loops through them.  The caller must hold the lock.
+func (d *decoy) suspectNodes(epoch uint64) []loops.NodeFailureCount {
+	counts := make(map[[sConstants.NodeIDLength]byte]*loops.NodeFailureCount)
+	for _, t := range d.recentTrials {
+		if t.epoch != epoch {
+			continue
+		}
+		for _, id := range t.nodes {
+			c, ok := counts[id]
+			if !ok {
+				c = &loops.NodeFailureCount{ID: id}
+				counts[id] = c
+			}
+			if t.lost {
+				c.Failures++
+			} else {
+				c.Successes++
+			}
+		}
+	}
+
+	var suspects []loops.NodeFailureCount
+	for _, c := range counts {
+		if c.Failures > 0 {
+			suspects = append(suspects, *c)
+		}
+	}
+	sort.Slice(suspects, func(i, j int) bool {
+		a, b := suspects[i], suspects[j]
+		if a.Failures != b.Failures {
+			return a.Failures > b.Failures
+		}
+		if a.Successes != b.Successes {
+			return a.Successes < b.Successes
+		}
+		return bytes.Compare(a.ID[:], b.ID[:]) < 0
+	})
+	return suspects
 }
 
 func (d *decoy) worker() {
 	const maxDuration = math.MaxInt64
 
-	wakeInterval := time.Duration(maxDuration)
-	timer := time.NewTimer(wakeInterval)
-	defer timer.Stop()
+	// Loop and discard decoy packets are sent on independent schedules,
+	// each with its own timer.
+	loopTimer := time.NewTimer(maxDuration)
+	defer loopTimer.Stop()
+	discardTimer := time.NewTimer(maxDuration)
+	defer discardTimer.Stop()
 
 	var docCache *pkicache.Entry
 	for {
-		var timerFired bool
+		var loopFired, discardFired, newDoc bool
 		select {
 		case <-d.HaltCh():
 			d.log.Debugf("Terminating gracefully.")
+			d.saveLoopStats()
 			return
 		case newEnt := <-d.docCh:
 			if !d.glue.Config().Debug.SendDecoyTraffic {
@@ -151,63 +348,86 @@ func (d *decoy) worker() {
 				instrument.IgnoredPKIDocs()
 				continue
 			}
-			if d.glue.Config().Server.IsProvider {
-				d.log.Debugf("Received PKI document when Provider, ignoring (not supported yet).")
-				instrument.IgnoredPKIDocs()
-				continue
-			}
 			d.log.Debugf("Received new PKI document for epoch: %v", now)
 			instrument.PKIDocs(fmt.Sprintf("%v", now))
 			docCache = newEnt
-		case <-timer.C:
-			timerFired = true
+			newDoc = true
+		case <-loopTimer.C:
+			loopFired = true
+		case <-discardTimer.C:
+			discardFired = true
 		}
 
 		now, _, _ := epochtime.Now()
 		if docCache == nil || docCache.Epoch() != now {
 			d.log.Debugf("Suspending operation till the next PKI document.")
-			wakeInterval = time.Duration(maxDuration)
-		} else {
-			// The timer fired, and there is a valid document for this epoch.
-			if timerFired {
-				d.sendDecoyPacket(docCache)
-			}
+			resetTimer(loopTimer, maxDuration, loopFired)
+			resetTimer(discardTimer, maxDuration, discardFired)
+			continue
+		}
 
-			// Schedule the next decoy packet.
-			//
-			// This closely follows how the mailproxy worker schedules
-			// outgoing sends, except that the SendShift value is ignored.
-			//
-			// TODO: Eventually this should use separate parameters.
-			doc := docCache.Document()
-			wakeMsec := uint64(rand.Exp(d.rng, doc.LambdaM))
-			if wakeMsec > doc.LambdaMMaxDelay {
-				wakeMsec = doc.LambdaMMaxDelay
-			}
-			wakeInterval = time.Duration(wakeMsec) * time.Millisecond
-			d.log.Debugf("Next wakeInterval: %v", wakeInterval)
+		if err := d.rotateRecipient(); err != nil {
+			d.log.Errorf("Failed to rotate the decoy recipient: %v", err)
+		}
+
+		// The timer fired, and there is a valid document for this epoch.
+		if loopFired {
+			d.sendDecoyPacket(docCache, true)
+		}
+		if discardFired {
+			d.sendDecoyPacket(docCache, false)
+		}
 
-			d.sweepSURBCtxs()
+		// Schedule the next decoy packets.  A timer that did not fire
+		// keeps its schedule, unless there is a new document.
+		//
+		// This closely follows how the mailproxy worker schedules
+		// outgoing sends, except that the SendShift value is ignored.
+		doc := docCache.Document()
+		if loopFired || newDoc {
+			wakeInterval := d.decoyInterval(doc.LambdaM, doc.LambdaMMaxDelay)
+			d.log.Debugf("Next loop wakeInterval: %v", wakeInterval)
+			resetTimer(loopTimer, wakeInterval, loopFired)
 		}
-		if !timerFired && !timer.Stop() {
-			<-timer.C
+		if discardFired || newDoc {
+			wakeInterval := time.Duration(maxDuration)
+			if doc.LambdaD > 0 {
+				wakeInterval = d.decoyInterval(doc.LambdaD, doc.LambdaDMaxDelay)
+			}
+			d.log.Debugf("Next discard wakeInterval: %v", wakeInterval)
+			resetTimer(discardTimer, wakeInterval, discardFired)
+		}
+
+		d.sweepSURBCtxs()
+		if d.now().Sub(d.loopStatsSaved) >= loopStatsCheckpointInterval {
+			d.saveLoopStats()
 		}
-		timer.Reset(wakeInterval)
 	}
 }
 
-func (d *decoy) sendDecoyPacket(ent *pkicache.Entry) {
-	// TODO: (#52) Do nothing if the rate limiter would discard the packet(?).
+func (d *decoy) decoyInterval(lambda float64, maxDelay uint64) time.Duration {
+	wakeMsec := uint64(rand.Exp(d.rng, lambda))
+	if wakeMsec > maxDelay {
+		wakeMsec = maxDelay
+	}
+	return time.Duration(wakeMsec) * time.Millisecond
+}
+
+// resetTimer resets the timer to fire after interval, draining it first
+// unless its value was already received.
+func resetTimer(timer *time.Timer, interval time.Duration, fired bool) {
+	if !fired && !timer.Stop() {
+		<-timer.C
+	}
+	timer.Reset(interval)
+}
 
-	// TODO: Determine if this should be a loop or discard packet.
-	isLoopPkt := true // HACK HACK HACK HACK.
+func (d *decoy) sendDecoyPacket(ent *pkicache.Entry, isLoopPkt bool) {
+	// TODO: (#52) Do nothing if the rate limiter would discard the packet(?).
 
+	// Provider generated loops start at the first mix layer, and the SURB
+	// Reply comes back to the decoy recipient on this Provider.
 	selfDesc := ent.Self()
-	if selfDesc.Provider {
-		// The code doesn't handle this correctly yet.  It does need to
-		// happen eventually though.
-		panic("BUG: Provider generated decoy traffic not supported yet")
-	}
 	doc := ent.Document()
 
 	// TODO: The path selection maybe should be more strategic/systematic
@@ -244,6 +464,7 @@ func (d *decoy) sendDecoyPacket(ent *pkicache.Entry) {
 func (d *decoy) sendLoopPacket(doc *pki.Document, recipient []byte, src, dst *pki.MixDescriptor) {
 	var surbID [sConstants.SURBIDLength]byte
 	d.makeSURBID(&surbID)
+	decoyRecipient := d.currentRecipient()
 
 	for attempts := 0; attempts < maxAttempts; attempts++ {
 		now := time.Now()
@@ -254,7 +475,7 @@ func (d *decoy) sendLoopPacket(doc *pki.Document, recipient []byte, src, dst *pk
 			return
 		}
 
-		revPath, then, err := path.New(d.rng, d.geo, doc, d.recipient, dst, src, &surbID, then, false, false)
+		revPath, then, err := path.New(d.rng, d.geo, doc, decoyRecipient, dst, src, &surbID, then, false, false)
 		if err != nil {
 			d.log.Debugf("Failed to select reverse path: %v", err)
 			return
@@ -272,13 +493,11 @@ func (d *decoy) sendLoopPacket(doc *pki.Document, recipient []byte, src, dst *pk
 			payload = append(payload, surb...)
 			payload = append(payload, zeroBytes...)
 
-			// TODO: This should probably also store path information,
-			// so that it's possible to figure out which links/nodes
-			// are causing issues.
 			ctx := &surbCtx{
 				id:      binary.BigEndian.Uint64(surbID[8:]),
 				eta:     time.Now().Add(deltaT),
 				sprpKey: k,
+				nodes:   loopNodes(src, fwdPath, revPath),
 			}
 			d.storeSURBCtx(ctx)
 
@@ -327,6 +546,24 @@ func (d *decoy) sendDiscardPacket(doc *pki.Document, recipient []byte, src, dst
 	d.log.Debugf("Failed to generate discard decoy packet: %v", errMaxAttempts)
 }
 
+// loopNodes returns the IDs of the nodes on the loop's paths, excluding
+// the source which is on every loop.
+func loopNodes(src *pki.MixDescriptor, paths ...[]*sphinx.PathHop) [][sConstants.NodeIDLength]byte {
+	srcID := hash.Sum256(src.IdentityKey)
+	seen := make(map[[sConstants.NodeIDLength]byte]bool)
+	var nodes [][sConstants.NodeIDLength]byte
+	for _, p := range paths {
+		for _, hop := range p {
+			if hop.ID == srcID || seen[hop.ID] {
+				continue
+			}
+			seen[hop.ID] = true
+			nodes = append(nodes, hop.ID)
+		}
+	}
+	return nodes
+}
+
 func (d *decoy) dispatchPacket(fwdPath []*sphinx.PathHop, raw []byte) {
 	pkt, err := packet.New(raw, d.geo)
 	if err != nil {
@@ -365,12 +602,19 @@ func (d *decoy) storeSURBCtx(ctx *surbCtx) {
 	d.Lock()
 	defer d.Unlock()
 
+	ctx.epoch = d.epoch()
+	d.loopStatsFor(ctx.epoch).Sent++
+	d.inFlight[ctx.epoch]++
+
 	ctx.etaNode = d.surbETAs.Insert(ctx)
 	if ctx.etaNode.Value.(*surbCtx) != ctx {
 		panic("inserting surbCtx failed, duplicate eta+id?")
 	}
 
 	d.surbStore[ctx.id] = ctx
+	if ctx.eta.After(d.latestETA) {
+		d.latestETA = ctx.eta
+	}
 }
 
 func (d *decoy) loadAndDeleteSURBCtx(id uint64) *surbCtx {
@@ -393,12 +637,13 @@ func (d *decoy) sweepSURBCtxs() {
 	d.Lock()
 	defer d.Unlock()
 
+	d.pruneLoopStats()
 	if d.surbETAs.Len() == 0 {
 		d.log.Debugf("Sweep: No outstanding SURBs.")
 		return
 	}
 
-	now := time.Now()
+	now := d.now()
 	slack := time.Duration(d.glue.Config().Debug.DecoySlack) * time.Millisecond
 	// instead of if ctx.eta + slack > now { break } in each loop iteration
 	// we precompute it:
@@ -413,6 +658,7 @@ func (d *decoy) sweepSURBCtxs() {
 		}
 
 		delete(d.surbStore, ctx.id)
+		d.finishLoop(ctx, true)
 
 		// TODO: At some point, this should do more than just log.
 		d.log.Debugf("Sweep: Lost SURB ID: 0x%08x ETA: %v (DeltaT: %v)", ctx.id, ctx.eta, now.Sub(ctx.eta))
@@ -422,7 +668,89 @@ func (d *decoy) sweepSURBCtxs() {
 		d.surbETAs.Remove(node)
 	}
 
-	d.log.Debugf("Sweep: Count: %v (Removed: %v, Elapsed: %v)", len(d.surbStore), swept, time.Now().Sub(now))
+	d.log.Debugf("Sweep: Count: %v (Removed: %v, Elapsed: %v)", len(d.surbStore), swept, d.now().Sub(now))
+}
+
+func (d *decoy) epoch() uint64 {
+	epoch, _, _ := epochtime.FromUnix(d.now().Unix())
+	return epoch
+}
+
+// loopStatsFor returns the loop statistics of the epoch, creating them
+// if needed.  The caller must hold the lock.
+func (d *decoy) loopStatsFor(epoch uint64) *loops.LoopStats {
+	stats, ok := d.loopStats[epoch]
+	if !ok {
+		stats = &loops.LoopStats{Epoch: epoch}
+		d.loopStats[epoch] = stats
+	}
+	return stats
+}
+
+// pruneLoopStats discards the loop statistics of epochs older than
+// loopStatsRetention.  The caller must hold the lock.
+func (d *decoy) pruneLoopStats() {
+	now := d.epoch()
+	for epoch := range d.loopStats {
+		if epoch+loopStatsRetention < now {
+			delete(d.loopStats, epoch)
+		}
+	}
+}
+
+func (d *decoy) loopStatsPath() string {
+	return filepath.Join(d.glue.Config().Server.DataDir, loopStatsFile)
+}
+
+func (d *decoy) loadLoopStats() error {
+	b, err := os.ReadFile(d.loopStatsPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	stats := make(map[uint64]*loops.LoopStats)
+	if err := cbor.Unmarshal(b, &stats); err != nil {
+		return err
+	}
+	for _, s := range stats {
+		if finished := s.Completed + s.Lost + s.Abandoned; s.Sent > finished {
+			s.Abandoned += s.Sent - finished
+		}
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	d.loopStats = stats
+	d.pruneLoopStats()
+	return nil
+}
+
+// saveLoopStats checkpoints the loop statistics to the DataDir, such that
+// they survive restarts.  Loops in flight are not saved, as their SURB
+// replies can not be matched after a restart, they are accounted as
+// Abandoned when the statistics are loaded.
+func (d *decoy) saveLoopStats() {
+	d.Lock()
+	b, err := cbor.Marshal(d.loopStats)
+	d.Unlock()
+	if err != nil {
+		d.log.Errorf("Failed to serialize loop statistics: %v", err)
+		return
+	}
+
+	fn := d.loopStatsPath()
+	tmpFn := fn + ".tmp"
+	if err := os.WriteFile(tmpFn, b, 0600); err != nil {
+		d.log.Errorf("Failed to write loop statistics: %v", err)
+		return
+	}
+	if err := os.Rename(tmpFn, fn); err != nil {
+		d.log.Errorf("Failed to write loop statistics: %v", err)
+		return
+	}
+	d.loopStatsSaved = d.now()
 }
 
 // New constructs a new decoy instance.
@@ -456,10 +784,18 @@ func New(glue glue.Glue) (glue.Decoy, error) {
 		}),
 		surbStore:  make(map[uint64]*surbCtx),
 		surbIDBase: uint64(time.Now().Unix()),
+		now:        time.Now,
+		loopStats:  make(map[uint64]*loops.LoopStats),
+		inFlight:   make(map[uint64]uint64),
 	}
 	if _, err := io.ReadFull(rand.Reader, d.recipient); err != nil {
 		return nil, err
 	}
+	d.recipientRotatedAt = d.now()
+	if err := d.loadLoopStats(); err != nil {
+		d.log.Warningf("Failed to load loop statistics, starting afresh: %v", err)
+	}
+	d.loopStatsSaved = d.now()
 
 	d.Go(d.worker)
 	return d, nil
@@ -0,0 +1,485 @@
+// decoy_test.go - Katzenpost server decoy traffic tests.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package decoy
+
+import (
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/katzenpost/hpqc/hash"
+	"github.com/katzenpost/hpqc/kem"
+	ecdh "github.com/katzenpost/hpqc/nike/x25519"
+	"github.com/katzenpost/hpqc/rand"
+	"github.com/katzenpost/hpqc/sign"
+
+	"github.com/katzenpost/katzenpost/core/epochtime"
+	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/core/pki"
+	"github.com/katzenpost/katzenpost/core/pki/pkitest"
+	"github.com/katzenpost/katzenpost/core/sphinx"
+	"github.com/katzenpost/katzenpost/core/sphinx/commands"
+	sConstants "github.com/katzenpost/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/katzenpost/core/sphinx/geo"
+	"github.com/katzenpost/katzenpost/core/thwack"
+	"github.com/katzenpost/katzenpost/server/config"
+	"github.com/katzenpost/katzenpost/server/internal/glue"
+	"github.com/katzenpost/katzenpost/server/internal/loops"
+	"github.com/katzenpost/katzenpost/server/internal/packet"
+	"github.com/katzenpost/katzenpost/server/internal/pkicache"
+	"github.com/katzenpost/katzenpost/server/internal/provider/kaetzchen"
+)
+
+type mockConnector struct {
+	sync.Mutex
+	dispatched []*packet.Packet
+}
+
+func (c *mockConnector) Halt() {}
+
+func (c *mockConnector) DispatchPacket(pkt *packet.Packet) {
+	c.Lock()
+	defer c.Unlock()
+	c.dispatched = append(c.dispatched, pkt)
+}
+
+func (c *mockConnector) count() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.dispatched)
+}
+
+func (c *mockConnector) IsValidForwardDest(*[sConstants.NodeIDLength]byte) bool {
+	return true
+}
+
+func (c *mockConnector) ForceUpdate() {}
+
+type mockGlue struct {
+	cfg        *config.Config
+	logBackend *log.Backend
+	connector  *mockConnector
+}
+
+func (g *mockGlue) Config() *config.Config            { return g.cfg }
+func (g *mockGlue) LogBackend() *log.Backend          { return g.logBackend }
+func (g *mockGlue) IdentityKey() sign.PrivateKey      { return nil }
+func (g *mockGlue) IdentityPublicKey() sign.PublicKey { return nil }
+func (g *mockGlue) LinkKey() kem.PrivateKey           { return nil }
+func (g *mockGlue) Management() *thwack.Server        { return nil }
+func (g *mockGlue) MixKeys() glue.MixKeys             { return nil }
+func (g *mockGlue) PKI() glue.PKI                     { return nil }
+func (g *mockGlue) Provider() glue.Provider           { return nil }
+func (g *mockGlue) Scheduler() glue.Scheduler         { return nil }
+func (g *mockGlue) Connector() glue.Connector         { return g.connector }
+func (g *mockGlue) Listeners() []glue.Listener        { return nil }
+func (g *mockGlue) Decoy() glue.Decoy                 { return nil }
+func (g *mockGlue) ReshadowCryptoWorkers()            {}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (f *fakeClock) Now() time.Time {
+	return f.now
+}
+
+func newTestDecoy(t *testing.T, dataDir string, clock *fakeClock) *decoy {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	g := &mockGlue{
+		cfg: &config.Config{
+			Server: &config.Server{DataDir: dataDir},
+			Debug: &config.Debug{
+				DecoySlack:             1000,
+				DecoyRecipientRotation: int(epochtime.Period / time.Millisecond),
+			},
+			SphinxGeometry: geo.GeometryFromUserForwardPayloadLength(
+				ecdh.Scheme(rand.Reader),
+				2000,
+				true,
+				5,
+			),
+		},
+		logBackend: logBackend,
+		connector:  new(mockConnector),
+	}
+	d, err := New(g)
+	require.NoError(err)
+	d.(*decoy).now = clock.Now
+	d.(*decoy).recipientRotatedAt = clock.Now()
+	return d.(*decoy)
+}
+
+// sendTestLoop registers a loop with a single hop SURB, and returns the
+// SURB Reply packet the hop would have sent back to the decoy.
+func sendTestLoop(t *testing.T, d *decoy, eta time.Time, nodes ...[sConstants.NodeIDLength]byte) *packet.Packet {
+	require := require.New(t)
+
+	nodePub, nodePriv, err := ecdh.Scheme(rand.Reader).GenerateKeyPair()
+	require.NoError(err)
+	var surbID [sConstants.SURBIDLength]byte
+	d.makeSURBID(&surbID)
+	recipient := &commands.Recipient{}
+	copy(recipient.ID[:], d.recipient)
+	path := []*sphinx.PathHop{
+		{
+			NIKEPublicKey: nodePub,
+			Commands:      []commands.RoutingCommand{recipient, &commands.SURBReply{ID: surbID}},
+		},
+	}
+	surb, k, err := d.sphinx.NewSURB(rand.Reader, path)
+	require.NoError(err)
+	d.storeSURBCtx(&surbCtx{
+		id:      binary.BigEndian.Uint64(surbID[8:]),
+		eta:     eta,
+		sprpKey: k,
+		nodes:   nodes,
+	})
+
+	raw, _, err := d.sphinx.NewPacketFromSURB(surb, make([]byte, d.geo.ForwardPayloadLength))
+	require.NoError(err)
+	payload, _, cmds, err := d.sphinx.Unwrap(nodePriv, raw)
+	require.NoError(err)
+	pkt, err := packet.New(raw, d.geo)
+	require.NoError(err)
+	require.NoError(pkt.Set(payload, cmds))
+	pkt.RecvAt = d.now()
+	return pkt
+}
+
+func TestLoopStatsPersistence(t *testing.T) {
+	require := require.New(t)
+
+	dataDir := t.TempDir()
+	clock := &fakeClock{now: time.Now()}
+	epoch, _, _ := epochtime.FromUnix(clock.now.Unix())
+
+	d := newTestDecoy(t, dataDir, clock)
+	_, ok := d.GetLoopStats(epoch)
+	require.False(ok)
+
+	// Two loops complete, one is lost.
+	for i := 0; i < 2; i++ {
+		d.OnPacket(sendTestLoop(t, d, clock.now.Add(time.Second)))
+	}
+	sendTestLoop(t, d, clock.now.Add(time.Second))
+	d.sweepSURBCtxs()
+	clock.now = clock.now.Add(time.Minute)
+	d.sweepSURBCtxs()
+
+	// Loops of an epoch past the retention are pruned on sweep.
+	d.Lock()
+	d.loopStatsFor(epoch-loopStatsRetention-1).Sent++
+	d.Unlock()
+	d.sweepSURBCtxs()
+	_, ok = d.GetLoopStats(epoch - loopStatsRetention - 1)
+	require.False(ok)
+
+	stats, ok := d.GetLoopStats(epoch)
+	require.True(ok)
+	require.Equal(uint64(3), stats.Sent)
+	require.Equal(uint64(2), stats.Completed)
+	require.Equal(uint64(1), stats.Lost)
+	require.InDelta(2.0/3.0, stats.SuccessRatio(), 0.0001)
+
+	// Halting checkpoints the stats, which are reloaded on startup.
+	d.Lock()
+	d.loopStatsFor(epoch-loopStatsRetention-1).Sent++
+	d.Unlock()
+	d.Halt()
+
+	d = newTestDecoy(t, dataDir, clock)
+	defer d.Halt()
+	reloaded, ok := d.GetLoopStats(epoch)
+	require.True(ok)
+	require.Equal(stats, reloaded)
+	_, ok = d.GetLoopStats(epoch - loopStatsRetention - 1)
+	require.False(ok)
+}
+
+func TestLoopStatsRestart(t *testing.T) {
+	require := require.New(t)
+
+	dataDir := t.TempDir()
+	epoch, _, till := epochtime.Now()
+	clock := &fakeClock{now: time.Now()}
+	d := newTestDecoy(t, dataDir, clock)
+	d.OnPacket(sendTestLoop(t, d, clock.now.Add(time.Minute)))
+	sendTestLoop(t, d, clock.now.Add(time.Minute))
+	d.Halt()
+
+	// The loop in flight is abandoned by the restart, it is not reported
+	// as lost once the epoch is over.
+	clock.now = clock.now.Add(till + time.Minute)
+	for i := 0; i < 2; i++ {
+		d = newTestDecoy(t, dataDir, clock)
+		stats, ok := d.GetLoopStats(epoch)
+		require.True(ok)
+		require.True(stats.Final)
+		require.Equal(uint64(2), stats.Sent)
+		require.Equal(uint64(1), stats.Completed)
+		require.Equal(uint64(0), stats.Lost)
+		require.Equal(uint64(1), stats.Abandoned)
+		require.Empty(stats.SuspectNodes)
+		require.InDelta(1.0, stats.SuccessRatio(), 0.0001)
+		d.Halt()
+	}
+}
+
+func TestLoopStatsEpochBoundary(t *testing.T) {
+	require := require.New(t)
+
+	// Loops are sent a minute before the end of the epoch.
+	epoch, _, till := epochtime.Now()
+	clock := &fakeClock{now: time.Now().Add(till - time.Minute)}
+	d := newTestDecoy(t, t.TempDir(), clock)
+	defer d.Halt()
+
+	completed := sendTestLoop(t, d, clock.now.Add(2*time.Minute))
+	sendTestLoop(t, d, clock.now.Add(2*time.Minute))
+	stats, ok := d.GetLoopStats(epoch)
+	require.True(ok)
+	require.False(stats.Final)
+
+	// The epoch is over, but its loops are still in flight.
+	clock.now = clock.now.Add(90 * time.Second)
+	require.Equal(epoch+1, d.epoch())
+	d.sweepSURBCtxs()
+	stats, ok = d.GetLoopStats(epoch)
+	require.True(ok)
+	require.False(stats.Final)
+	require.Equal(uint64(2), stats.Sent)
+
+	clock.now = clock.now.Add(time.Minute)
+	d.OnPacket(completed)
+	stats, ok = d.GetLoopStats(epoch)
+	require.True(ok)
+	require.False(stats.Final)
+	require.Equal(uint64(1), stats.Completed)
+
+	// Once every loop finished the statistics are final and match the
+	// outcome of the loops.
+	clock.now = clock.now.Add(time.Minute)
+	d.sweepSURBCtxs()
+	stats, ok = d.GetLoopStats(epoch)
+	require.True(ok)
+	require.True(stats.Final)
+	require.Equal(uint64(2), stats.Sent)
+	require.Equal(uint64(1), stats.Completed)
+	require.Equal(uint64(1), stats.Lost)
+	require.InDelta(0.5, stats.SuccessRatio(), 0.0001)
+
+	// The statistics of the current epoch are not final.
+	sendTestLoop(t, d, clock.now)
+	clock.now = clock.now.Add(time.Minute)
+	d.sweepSURBCtxs()
+	stats, ok = d.GetLoopStats(epoch + 1)
+	require.True(ok)
+	require.Equal(uint64(1), stats.Lost)
+	require.False(stats.Final)
+}
+
+// genDocument returns a document with a single mix per layer and a single
+// Provider, and the identity key of the Provider.
+func genDocument(t *testing.T, epoch uint64) (*pki.Document, sign.PublicKey) {
+	require := require.New(t)
+
+	b := pkitest.NewDocumentBuilder(epoch).
+		WithMixLayers(3, 1).
+		WithKaetzchen(kaetzchen.EchoCapability, nil)
+	doc, err := b.Build()
+	require.NoError(err)
+	selfIdentity, _, err := b.Identity(pkitest.ProviderName(0))
+	require.NoError(err)
+	return doc, selfIdentity
+}
+
+func TestProviderDecoyTraffic(t *testing.T) {
+	require := require.New(t)
+
+	clock := &fakeClock{now: time.Now()}
+	epoch, _, _ := epochtime.FromUnix(clock.now.Unix())
+	doc, selfIdentity := genDocument(t, epoch)
+	ent, err := pkicache.New(doc, selfIdentity, true)
+	require.NoError(err)
+
+	d := newTestDecoy(t, t.TempDir(), clock)
+	defer d.Halt()
+	d.glue.Config().Server.IsProvider = true
+
+	d.sendDecoyPacket(ent, true)
+
+	// The loop starts at the first mix layer, not at the Provider.
+	connector := d.glue.(*mockGlue).connector
+	require.Len(connector.dispatched, 1)
+	firstHop := hash.Sum256(doc.Topology[0][0].IdentityKey)
+	require.Equal(firstHop, connector.dispatched[0].NextNodeHop.ID)
+	require.Len(d.surbStore, 1)
+	stats, ok := d.GetLoopStats(epoch)
+	require.True(ok)
+	require.Equal(uint64(1), stats.Sent)
+
+	// SURB Replies addressed to the decoy are recognized for dispatch to
+	// the decoy rather than the provider backend.
+	var recipient [sConstants.RecipientIDLength]byte
+	copy(recipient[:], d.recipient)
+	require.True(d.IsDecoyRecipient(&recipient))
+	copy(recipient[:], "alice")
+	require.False(d.IsDecoyRecipient(&recipient))
+}
+
+func TestDecoyTrafficSchedule(t *testing.T) {
+	require := require.New(t)
+
+	clock := &fakeClock{now: time.Now()}
+	epoch, _, _ := epochtime.Now()
+	doc, selfIdentity := genDocument(t, epoch)
+	doc.LambdaM = 1.0 / 100
+	doc.LambdaMMaxDelay = 100
+	doc.LambdaD = 1.0 / 400
+	doc.LambdaDMaxDelay = 400
+	ent, err := pkicache.New(doc, selfIdentity, true)
+	require.NoError(err)
+
+	d := newTestDecoy(t, t.TempDir(), clock)
+	d.glue.Config().Server.IsProvider = true
+	d.glue.Config().Debug.SendDecoyTraffic = true
+	d.OnNewDocument(ent)
+	time.Sleep(2 * time.Second)
+	d.Halt()
+
+	// The max delays bound the intervals, so both kinds of packets are
+	// sent, and loops about four times as often as discards.
+	dispatched := d.glue.(*mockGlue).connector.count()
+	stats, ok := d.GetLoopStats(epoch)
+	require.True(ok)
+	sent := int(stats.Sent)
+	discards := dispatched - sent
+	require.GreaterOrEqual(discards, 3)
+	require.Greater(sent, discards)
+}
+
+func TestSuspectNodes(t *testing.T) {
+	require := require.New(t)
+
+	clock := &fakeClock{now: time.Now()}
+	epoch, _, _ := epochtime.FromUnix(clock.now.Unix())
+	d := newTestDecoy(t, t.TempDir(), clock)
+	defer d.Halt()
+
+	var a, b, c, e, f [sConstants.NodeIDLength]byte
+	for i, id := range []*[sConstants.NodeIDLength]byte{&a, &b, &c, &e, &f} {
+		id[0] = byte(i + 1)
+	}
+
+	// Three lost loops overlap on a, the second most suspect node is b
+	// which is on two lost loops, but also on a completed one.
+	for i, nodes := range [][][sConstants.NodeIDLength]byte{{a, b, c}, {e, a, b}, {f, c, a}} {
+		d.storeSURBCtx(&surbCtx{
+			id:    uint64(i),
+			eta:   clock.now,
+			nodes: nodes,
+		})
+	}
+	d.OnPacket(sendTestLoop(t, d, clock.now, b, e, f))
+	clock.now = clock.now.Add(time.Minute)
+	d.sweepSURBCtxs()
+
+	stats, ok := d.GetLoopStats(epoch)
+	require.True(ok)
+	require.Equal(uint64(3), stats.Lost)
+	require.Equal(uint64(1), stats.Completed)
+	require.Len(stats.SuspectNodes, 5)
+	require.Equal(loops.NodeFailureCount{ID: a, Failures: 3}, stats.SuspectNodes[0])
+	require.Equal(loops.NodeFailureCount{ID: c, Failures: 2}, stats.SuspectNodes[1])
+	require.Equal(loops.NodeFailureCount{ID: b, Failures: 2, Successes: 1}, stats.SuspectNodes[2])
+
+	// Loops of other epochs are not counted.
+	d.Lock()
+	require.Len(d.suspectNodes(epoch+1), 0)
+	d.Unlock()
+
+	// The window of recently finished loops is bounded.
+	for i := 0; i < 2*maxRecentTrials; i++ {
+		d.Lock()
+		d.recordTrial(&surbCtx{epoch: epoch, nodes: [][sConstants.NodeIDLength]byte{e}}, false)
+		d.Unlock()
+	}
+	d.Lock()
+	require.Len(d.recentTrials, maxRecentTrials)
+	require.Len(d.suspectNodes(epoch), 0)
+	d.Unlock()
+}
+
+func TestDecoyRecipientRotation(t *testing.T) {
+	require := require.New(t)
+
+	clock := &fakeClock{now: time.Now()}
+	start := clock.now
+	d := newTestDecoy(t, t.TempDir(), clock)
+	defer d.Halt()
+
+	isDecoyRecipient := func(recipient []byte) bool {
+		var id [sConstants.RecipientIDLength]byte
+		copy(id[:], recipient)
+		return d.IsDecoyRecipient(&id)
+	}
+
+	// The recipient is not rotated before the interval elapses.
+	first := d.currentRecipient()
+	require.NoError(d.rotateRecipient())
+	require.Equal(first, d.currentRecipient())
+
+	// Loops in flight over the rotation.
+	completed := sendTestLoop(t, d, start.Add(epochtime.Period+time.Minute))
+	late := sendTestLoop(t, d, start.Add(epochtime.Period+30*time.Second))
+
+	clock.now = start.Add(epochtime.Period)
+	require.NoError(d.rotateRecipient())
+	second := d.currentRecipient()
+	require.NotEqual(first, second)
+	current := sendTestLoop(t, d, clock.now.Add(time.Minute))
+	require.Len(d.surbStore, 3)
+
+	// The previous recipient is accepted until the latest ETA of its
+	// loops plus the slack.
+	require.True(isDecoyRecipient(first))
+	require.True(isDecoyRecipient(second))
+	d.OnPacket(completed)
+	require.Len(d.surbStore, 2)
+
+	clock.now = start.Add(epochtime.Period + time.Minute + 2*time.Second)
+	require.False(isDecoyRecipient(first))
+	require.True(isDecoyRecipient(second))
+	d.OnPacket(late)
+	require.Len(d.surbStore, 2)
+	d.OnPacket(current)
+	require.Len(d.surbStore, 1)
+
+	// Without loops in flight the previous recipient is retired
+	// immediately.
+	clock.now = start.Add(2 * epochtime.Period)
+	require.NoError(d.rotateRecipient())
+	require.False(isDecoyRecipient(first))
+	require.False(isDecoyRecipient(second))
+	require.True(isDecoyRecipient(d.currentRecipient()))
+}
@@ -93,6 +93,12 @@ var (
 			Help: "Number of total dropped kaetzchen requests",
 		},
 	)
+	kaetzchenRequestsReplayed = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "katzenpost_kaetzchen_replayed_requests_total",
+			Help: "Number of total replayed kaetzchen requests",
+		},
+	)
 	kaetzchenRequestsFailed = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: "katzenpost_kaetzchen_failed_requests_total",
@@ -151,6 +157,13 @@ var (
 		},
 		[]string{"epoch"},
 	)
+	sphinxGeometry = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "katzenpost_sphinx_geometry_info",
+			Help: "Sphinx geometry of the server, labeled with its hash",
+		},
+		[]string{"hash"},
+	)
 	invalidPKICache = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "katzenpost_invalid_pki_cache_per_epoch_total",
@@ -177,6 +190,7 @@ func StartPrometheusListener(glue glue.Glue) {
 	prometheus.MustRegister(kaetzchenRequestsDropped)
 	prometheus.MustRegister(kaetzchenRequestsDuration)
 	prometheus.MustRegister(kaetzchenRequestsFailed)
+	prometheus.MustRegister(kaetzchenRequestsReplayed)
 	prometheus.MustRegister(mixPacketsDropped)
 	prometheus.MustRegister(mixQueueSize)
 	prometheus.MustRegister(pkiDocs)
@@ -186,6 +200,9 @@ func StartPrometheusListener(glue glue.Glue) {
 	prometheus.MustRegister(failedFetchPKIDocs)
 	prometheus.MustRegister(failedPKICacheGeneration)
 	prometheus.MustRegister(invalidPKICache)
+	prometheus.MustRegister(sphinxGeometry)
+
+	sphinxGeometry.With(prometheus.Labels{"hash": fmt.Sprintf("%x", glue.Config().SphinxGeometry.Hash())}).Set(1)
 
 	metricsAddress := glue.Config().Server.MetricsAddress
 	if metricsAddress != "" {
@@ -241,6 +258,11 @@ func KaetzchenRequestsDropped(dropCounter uint64) {
 	kaetzchenRequestsDropped.Add(float64(dropCounter))
 }
 
+// KaetzchenRequestsReplayed increments the counter for the number of replayed kaetzchen requests
+func KaetzchenRequestsReplayed() {
+	kaetzchenRequestsReplayed.Inc()
+}
+
 // KaetzchenRequestsFailed increments the counter for the number of failed kaetzchen requests
 func KaetzchenRequestsFailed() {
 	kaetzchenRequestsFailed.Inc()
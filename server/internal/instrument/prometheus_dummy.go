@@ -44,6 +44,9 @@ func TimeKaetzchenRequestsDuration() {}
 // KaetzchenRequestsDropped increments the counter for the number of dropped kaetzchen requests
 func KaetzchenRequestsDropped(dropCounter uint64) {}
 
+// KaetzchenRequestsReplayed increments the counter for the number of replayed kaetzchen requests
+func KaetzchenRequestsReplayed() {}
+
 // KaetzchenRequestsFailed increments the counter for the number of failed kaetzchen requests
 func KaetzchenRequestsFailed() {}
 
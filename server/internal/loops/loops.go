@@ -0,0 +1,76 @@
+// loops.go - Katzenpost server decoy loop statistics.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package loops implements the statistics gathered from decoy loops.
+package loops
+
+import "github.com/katzenpost/katzenpost/core/sphinx/constants"
+
+// LoopStats are the decoy loop statistics of a single epoch.
+type LoopStats struct {
+	// Epoch is the epoch the loops were sent in.
+	Epoch uint64
+
+	// Sent is the number of loops sent.
+	Sent uint64
+
+	// Completed is the number of loops whose SURB reply was received.
+	Completed uint64
+
+	// Lost is the number of loops whose SURB reply did not arrive in
+	// time. Loops which are neither completed, lost nor abandoned are
+	// still in flight.
+	Lost uint64
+
+	// Abandoned is the number of loops which were in flight when the
+	// server restarted.  Their SURB replies can not be matched after the
+	// restart, so their outcome is unknown and they count neither as
+	// completed nor as lost.
+	Abandoned uint64
+
+	// Final is true if the epoch is over and none of its loops are in
+	// flight anymore, so that the statistics no longer change.  Loops
+	// sent near the end of an epoch finish during the next epoch, so
+	// statistics should only be reported once they are Final.
+	Final bool
+
+	// SuspectNodes are the nodes on the paths of recently lost loops,
+	// most suspect first.  They are derived from a bounded window of
+	// recently finished loops, and are not persisted.
+	SuspectNodes []NodeFailureCount
+}
+
+// NodeFailureCount is the number of recently finished loops through a node
+// which were lost or completed.
+type NodeFailureCount struct {
+	// ID is the hash of the node's identity key.
+	ID [constants.NodeIDLength]byte
+
+	// Failures is the number of lost loops through the node.
+	Failures uint64
+
+	// Successes is the number of completed loops through the node.
+	Successes uint64
+}
+
+// SuccessRatio returns the fraction of finished loops which completed,
+// or 0 if no loop has finished yet.
+func (s *LoopStats) SuccessRatio() float64 {
+	finished := s.Completed + s.Lost
+	if finished == 0 {
+		return 0
+	}
+	return float64(s.Completed) / float64(finished)
+}
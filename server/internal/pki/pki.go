@@ -406,6 +406,14 @@ func (p *pki) publishDescriptorIfNeeded(pkiCtx context.Context) error {
 		} else {
 			desc.AuthenticationType = cpki.OutOfBandAuth
 		}
+
+		// Publish the optional capacity hints.
+		if rate := p.glue.Config().Provider.MaxPacketRate; rate > 0 {
+			desc.MaxPacketRate = cpki.CoarsePacketRate(uint64(rate))
+			if load, ok := p.expectedLoad(epoch); ok {
+				desc.Utilization = cpki.UtilizationFor(load, uint64(rate))
+			}
+		}
 	}
 	desc.MixKeys = make(map[uint64][]byte)
 
@@ -460,6 +468,27 @@ func (p *pki) publishDescriptorIfNeeded(pkiCtx context.Context) error {
 	return err
 }
 
+// expectedLoad returns the number of packets per second the connected
+// clients may send under the per client rate limit, if there is one.
+func (p *pki) expectedLoad(epoch uint64) (uint64, bool) {
+	if p.glue.Config().Debug.DisableRateLimit {
+		return 0, false
+	}
+	ent := p.entryForEpoch(epoch)
+	if ent == nil || ent.SendRatePerMinute() == 0 {
+		return 0, false
+	}
+	clients := 0
+	for _, l := range p.glue.Listeners() {
+		ids, err := l.GetConnIdentities()
+		if err != nil {
+			continue
+		}
+		clients += len(ids)
+	}
+	return (uint64(clients)*ent.SendRatePerMinute() + 59) / 60, true
+}
+
 func (p *pki) entryForEpoch(epoch uint64) *pkicache.Entry {
 	p.RLock()
 	defer p.RUnlock()
@@ -52,6 +52,13 @@ type PluginParameters = map[PluginName]interface{}
 // parameters.
 type ServiceMap = map[PluginName]PluginParameters
 
+// pluginCaller dispatches requests to a plugin, it is implemented by
+// cborplugin.ClientPool.
+type pluginCaller interface {
+	Capability() string
+	Call(*cborplugin.Request) (cborplugin.Command, error)
+}
+
 // CBORPluginWorker is similar to Kaetzchen worker but uses
 // CBOR over UNIX domain socket to talk to plugins.
 type CBORPluginWorker struct {
@@ -64,7 +71,8 @@ type CBORPluginWorker struct {
 
 	haltOnce    sync.Once
 	pluginChans PluginChans
-	clients     []*cborplugin.Client
+	clients     []*cborplugin.ClientPool
+	replay      *replayFilter
 }
 
 // OnKaetzchen enqueues the pkt for processing by our thread pool of plugins.
@@ -79,7 +87,7 @@ func (k *CBORPluginWorker) OnKaetzchen(pkt *packet.Packet) {
 	handlerCh.In() <- pkt
 }
 
-func (k *CBORPluginWorker) worker(recipient [constants.RecipientIDLength]byte, pluginClient *cborplugin.Client) {
+func (k *CBORPluginWorker) worker(recipient [constants.RecipientIDLength]byte, pluginClient *cborplugin.ClientPool) {
 	// Kaetzchen delay is our max dwell time.
 	maxDwell := time.Duration(k.glue.Config().Debug.KaetzchenDelay) * time.Millisecond
 
@@ -121,7 +129,7 @@ func (k *CBORPluginWorker) haltAllClients() {
 	}
 }
 
-func (k *CBORPluginWorker) processKaetzchen(pkt *packet.Packet, pluginClient *cborplugin.Client) {
+func (k *CBORPluginWorker) processKaetzchen(pkt *packet.Packet, pluginClient pluginCaller) {
 	defer pkt.Dispose()
 	pluginCap := pluginClient.Capability()
 	payload, surb, err := packet.ParseForwardPacket(pkt)
@@ -130,14 +138,23 @@ func (k *CBORPluginWorker) processKaetzchen(pkt *packet.Packet, pluginClient *cb
 		instrument.KaetzchenRequestsDropped(1)
 		return
 	}
+	if k.replay != nil && k.replay.IsReplay(requestID(&pkt.Recipient.ID, surb, payload), time.Now()) {
+		k.log.Debugf("%v: Dropping replayed Kaetzchen request: %v", pluginCap, pkt.ID)
+		instrument.KaetzchenRequestsReplayed()
+		return
+	}
 
-	pluginClient.WriteChan() <- &cborplugin.Request{
+	cborResponse, err := pluginClient.Call(&cborplugin.Request{
 		ID:           pkt.ID,
 		Payload:      payload,
 		ResponseSize: k.geo.UserForwardPayloadLength,
 		HasSURB:      surb != nil,
+	})
+	if err != nil {
+		k.log.Debugf("%v: Dropping Kaetzchen request: %v (%v)", pluginCap, pkt.ID, err)
+		instrument.KaetzchenRequestsDropped(1)
+		return
 	}
-	cborResponse := <-pluginClient.ReadChan()
 	switch r := cborResponse.(type) {
 	case *cborplugin.Response:
 		if len(r.Payload) > k.geo.UserForwardPayloadLength {
@@ -160,6 +177,10 @@ func (k *CBORPluginWorker) processKaetzchen(pkt *packet.Packet, pluginClient *cb
 			return
 		}
 		k.log.Debugf("No SURB provided: %v", pkt.ID)
+	case *cborplugin.RequestError:
+		k.log.Debugf("%v: Failed to handle Kaetzchen request: %v (%v)", pluginCap, pkt.ID, r)
+		instrument.KaetzchenRequestsDropped(1)
+		return
 	default:
 		// received some unknown command type
 		k.log.Errorf("%v: Failed to handle Kaetzchen request: %v (%v), response: %s", pluginCap, pkt.ID, err, cborResponse)
@@ -169,18 +190,24 @@ func (k *CBORPluginWorker) processKaetzchen(pkt *packet.Packet, pluginClient *cb
 }
 
 // KaetzchenForPKI returns the plugins Parameters map for publication in the PKI doc.
+// Plugins which are not ready, because they are still initializing or were
+// restarted, are omitted until they report that they are ready.
 func (k *CBORPluginWorker) KaetzchenForPKI() ServiceMap {
 	s := make(ServiceMap)
 	k.Lock()
 	defer k.Unlock()
-	for _, k := range k.clients {
-		capa := k.Capability()
+	for _, client := range k.clients {
+		capa := client.Capability()
 		if _, ok := s[capa]; ok {
 			// skip adding twice
 			continue
 		}
+		if !client.Ready() {
+			k.log.Noticef("%v: plugin is not ready, not advertising capability", capa)
+			continue
+		}
 		params := make(PluginParameters)
-		p := k.GetParameters()
+		p := client.GetParameters()
 		if p != nil {
 			for key, value := range *p {
 				params[key] = value
@@ -199,14 +226,22 @@ func (k *CBORPluginWorker) IsKaetzchen(recipient [constants.RecipientIDLength]by
 	return ok
 }
 
-func (k *CBORPluginWorker) launch(command, capability, endpoint string, args []string) (*cborplugin.Client, error) {
-	k.log.Debugf("Launching plugin: %s", command)
-	plugin := cborplugin.NewClient(k.glue.LogBackend(), capability, endpoint, &cborplugin.ResponseFactory{})
+func (k *CBORPluginWorker) launch(command, capability, endpoint string, args []string, concurrency, healthCheckInterval int) (*cborplugin.ClientPool, error) {
+	k.log.Debugf("Launching %d instances of plugin: %s", concurrency, command)
+	plugin := cborplugin.NewClientPool(k.glue.LogBackend(), capability, endpoint, concurrency)
+	if k.geo != nil {
+		// multi-part Responses must still fit in a single SURB-Reply
+		plugin.SetChunkLimits(cborplugin.DefaultChunkTimeout, k.geo.UserForwardPayloadLength)
+	}
+	if healthCheckInterval > 0 {
+		interval := time.Duration(healthCheckInterval) * time.Millisecond
+		plugin.SetHealthCheck(interval, interval, cborplugin.DefaultHealthCheckFailures)
+	}
 	err := plugin.Start(command, args)
 	return plugin, err
 }
 
-func (k *CBORPluginWorker) unregister(endpoint [constants.RecipientIDLength]byte, pluginClient *cborplugin.Client) {
+func (k *CBORPluginWorker) unregister(endpoint [constants.RecipientIDLength]byte, pluginClient *cborplugin.ClientPool) {
 	k.log.Debugf("Unregistering %s", pluginClient.Capability())
 	k.Lock()
 	defer k.Unlock()
@@ -233,7 +268,10 @@ func NewCBORPluginWorker(glue glue.Glue) (*CBORPluginWorker, error) {
 		glue:        glue,
 		log:         glue.LogBackend().GetLogger("CBOR plugin worker"),
 		pluginChans: make(PluginChans),
-		clients:     make([]*cborplugin.Client, 0),
+		clients:     make([]*cborplugin.ClientPool, 0),
+	}
+	if window := glue.Config().Provider.KaetzchenReplayWindow; window > 0 {
+		kaetzchenWorker.replay = newReplayFilter(time.Duration(window)*time.Millisecond, glue.Config().Provider.KaetzchenReplayCacheSize)
 	}
 
 	// hold lock while mutating pluginChans and clients
@@ -285,7 +323,7 @@ func NewCBORPluginWorker(glue glue.Glue) (*CBORPluginWorker, error) {
 			}
 		}
 
-		pluginClient, err := kaetzchenWorker.launch(pluginConf.Command, pluginConf.Capability, pluginConf.Endpoint, args)
+		pluginClient, err := kaetzchenWorker.launch(pluginConf.Command, pluginConf.Capability, pluginConf.Endpoint, args, pluginConf.MaxConcurrency, pluginConf.HealthCheckInterval)
 		if err != nil {
 			kaetzchenWorker.log.Error("Failed to start a plugin client: %s", err)
 			return nil, err
@@ -296,9 +334,11 @@ func NewCBORPluginWorker(glue glue.Glue) (*CBORPluginWorker, error) {
 
 		// Start the workers _after_ we have added all of the entries to pluginChans
 		// otherwise the worker() goroutines race this thread.
-		defer kaetzchenWorker.Go(func() {
-			kaetzchenWorker.worker(endpoint, pluginClient)
-		})
+		for i := 0; i < pluginClient.Size(); i++ {
+			defer kaetzchenWorker.Go(func() {
+				kaetzchenWorker.worker(endpoint, pluginClient)
+			})
+		}
 
 		// Unregister pluginClient when it halts
 		defer kaetzchenWorker.Go(func() {
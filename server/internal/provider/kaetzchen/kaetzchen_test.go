@@ -40,6 +40,7 @@ import (
 	"github.com/katzenpost/katzenpost/core/wire"
 	"github.com/katzenpost/katzenpost/server/config"
 	"github.com/katzenpost/katzenpost/server/internal/glue"
+	"github.com/katzenpost/katzenpost/server/internal/loops"
 	"github.com/katzenpost/katzenpost/server/internal/packet"
 	"github.com/katzenpost/katzenpost/server/internal/pkicache"
 	"github.com/katzenpost/katzenpost/server/spool"
@@ -129,6 +130,14 @@ func (d *mockDecoy) OnNewDocument(*pkicache.Entry) {}
 
 func (d *mockDecoy) OnPacket(*packet.Packet) {}
 
+func (d *mockDecoy) IsDecoyRecipient(*[constants.RecipientIDLength]byte) bool {
+	return false
+}
+
+func (d *mockDecoy) GetLoopStats(uint64) (*loops.LoopStats, bool) {
+	return nil, false
+}
+
 type mockServer struct {
 	cfg               *config.Config
 	logBackend        *log.Backend
@@ -17,19 +17,29 @@
 package kaetzchen
 
 import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/katzenpost/hpqc/kem"
+	"github.com/katzenpost/hpqc/rand"
 	"github.com/katzenpost/hpqc/sign"
 
 	"github.com/katzenpost/katzenpost/core/cert"
 	"github.com/katzenpost/katzenpost/core/log"
 	"github.com/katzenpost/katzenpost/core/wire"
+	"github.com/katzenpost/katzenpost/server/cborplugin"
 	"github.com/katzenpost/katzenpost/server/config"
+	"github.com/katzenpost/katzenpost/server_plugins/cbor_plugins/echo-go/echo"
 )
 
+const echoPluginEnv = "KAETZCHEN_TEST_ECHO_PLUGIN"
+
 func getGlue(logBackend *log.Backend, provider *mockProvider, linkKey kem.PrivateKey, idKey sign.PrivateKey) *mockGlue {
 	goo := &mockGlue{
 		s: &mockServer{
@@ -85,3 +95,84 @@ func TestCBORInvalidCommandWithPluginKaetzchenWorker(t *testing.T) {
 	_, err = NewCBORPluginWorker(goo)
 	require.Error(err)
 }
+
+// TestEchoPluginHelper is not a real test, it is the external echo plugin
+// executed by TestEchoConformance.
+func TestEchoPluginHelper(t *testing.T) {
+	dir := os.Getenv(echoPluginEnv)
+	if dir == "" {
+		t.Skip("only run as a plugin by TestEchoConformance")
+	}
+	// stdout is reserved for the socket path
+	logBackend, err := log.New(filepath.Join(dir, "echo.log"), "DEBUG", false)
+	require.NoError(t, err)
+	socketFile := filepath.Join(dir, "echo.socket")
+	server := cborplugin.NewServer(logBackend.GetLogger("echo_server"), socketFile, new(cborplugin.RequestFactory), new(echo.Echo))
+	fmt.Printf("%s\n", socketFile)
+	server.Accept()
+	server.Wait()
+}
+
+// testEchoConformance checks the behavior shared by both forms of the echo
+// service, the built-in Kaetzchen and the external cbor plugin.
+func testEchoConformance(t *testing.T, endpoint string, call func(id uint64, payload []byte) ([]byte, error)) {
+	require := require.New(t)
+	require.Equal("+echo", endpoint)
+
+	full := make([]byte, 2000)
+	_, err := io.ReadFull(rand.Reader, full)
+	require.NoError(err)
+	for i, payload := range [][]byte{[]byte("hello"), full} {
+		reply, err := call(uint64(i), payload)
+		require.NoError(err)
+		require.Equal(payload, reply)
+	}
+}
+
+func TestEchoConformance(t *testing.T) {
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(t, err)
+
+	t.Run("built-in", func(t *testing.T) {
+		goo := &mockGlue{s: &mockServer{logBackend: logBackend}}
+		k, err := NewEcho(&config.Kaetzchen{Capability: EchoCapability, Endpoint: "+echo"}, goo)
+		require.NoError(t, err)
+		defer k.Halt()
+
+		require.Equal(t, EchoCapability, k.Capability())
+		testEchoConformance(t, k.Parameters()[ParameterEndpoint].(string), func(id uint64, payload []byte) ([]byte, error) {
+			return k.OnRequest(id, payload, true)
+		})
+	})
+
+	t.Run("plugin", func(t *testing.T) {
+		t.Setenv(echoPluginEnv, t.TempDir())
+		pool := cborplugin.NewClientPool(logBackend, EchoCapability, "+echo", 1)
+		err := pool.Start(os.Args[0], []string{"-test.run=^TestEchoPluginHelper$"})
+		require.NoError(t, err)
+		defer pool.Halt()
+
+		// The capability is advertised once the plugin is ready.
+		k := &CBORPluginWorker{
+			log:     logBackend.GetLogger("cbor_plugin_worker"),
+			clients: []*cborplugin.ClientPool{pool},
+		}
+		require.Eventually(t, func() bool {
+			_, ok := k.KaetzchenForPKI()[EchoCapability]
+			return ok
+		}, 5*time.Second, 10*time.Millisecond)
+
+		require.Equal(t, EchoCapability, pool.Capability())
+		testEchoConformance(t, (*pool.GetParameters())["endpoint"].(string), func(id uint64, payload []byte) ([]byte, error) {
+			cmd, err := pool.Call(&cborplugin.Request{ID: id, Payload: payload, HasSURB: true})
+			if err != nil {
+				return nil, err
+			}
+			r, ok := cmd.(*cborplugin.Response)
+			if !ok {
+				return nil, fmt.Errorf("unexpected answer: %v", cmd)
+			}
+			return r.Payload, nil
+		})
+	})
+}
@@ -0,0 +1,103 @@
+// replay.go - replay suppression for kaetzchen requests
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+
+	"github.com/katzenpost/katzenpost/core/sphinx/constants"
+)
+
+type replayEntry struct {
+	id [blake2b.Size256]byte
+	at time.Time
+}
+
+// replayFilter remembers recently seen requests within a sliding time
+// window so that duplicates can be dropped before plugin dispatch.
+// The number of remembered requests is bounded by maxSize.
+type replayFilter struct {
+	sync.Mutex
+
+	window  time.Duration
+	maxSize int
+
+	seen  map[[blake2b.Size256]byte]time.Time
+	queue []replayEntry
+}
+
+func newReplayFilter(window time.Duration, maxSize int) *replayFilter {
+	if maxSize <= 0 {
+		maxSize = 1
+	}
+	return &replayFilter{
+		window:  window,
+		maxSize: maxSize,
+		seen:    make(map[[blake2b.Size256]byte]time.Time),
+	}
+}
+
+// requestID returns the identifier used to detect replayed requests. The
+// Sphinx packet ID is assigned locally upon receipt and is therefore unique
+// per packet, so requests are identified by their recipient, SURB and
+// payload. A SURB can only be used once, so a client retransmitting a
+// request with a fresh SURB, such as a spool read with a deterministic
+// signature or a retry after the plugin restarted, is not a replay.
+func requestID(recipient *[constants.RecipientIDLength]byte, surb, payload []byte) [blake2b.Size256]byte {
+	h, err := blake2b.New256(nil)
+	if err != nil {
+		panic(err)
+	}
+	h.Write(recipient[:])
+	h.Write(surb)
+	h.Write(payload)
+	var id [blake2b.Size256]byte
+	h.Sum(id[:0])
+	return id
+}
+
+// IsReplay returns true if the request id was already seen within the
+// window preceding now, otherwise the request is remembered.
+func (f *replayFilter) IsReplay(id [blake2b.Size256]byte, now time.Time) bool {
+	f.Lock()
+	defer f.Unlock()
+
+	f.expire(now)
+	if _, ok := f.seen[id]; ok {
+		return true
+	}
+	for len(f.queue) >= f.maxSize {
+		f.evictOldest()
+	}
+	f.seen[id] = now
+	f.queue = append(f.queue, replayEntry{id: id, at: now})
+	return false
+}
+
+func (f *replayFilter) expire(now time.Time) {
+	for len(f.queue) > 0 && now.Sub(f.queue[0].at) > f.window {
+		f.evictOldest()
+	}
+}
+
+func (f *replayFilter) evictOldest() {
+	delete(f.seen, f.queue[0].id)
+	f.queue[0] = replayEntry{}
+	f.queue = f.queue[1:]
+}
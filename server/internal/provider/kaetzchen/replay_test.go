@@ -0,0 +1,142 @@
+// replay_test.go - Tests for kaetzchen replay suppression.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	ecdh "github.com/katzenpost/hpqc/nike/x25519"
+	"github.com/katzenpost/hpqc/rand"
+
+	"github.com/katzenpost/katzenpost/core/log"
+	"github.com/katzenpost/katzenpost/core/sphinx/commands"
+	"github.com/katzenpost/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/katzenpost/core/sphinx/geo"
+	"github.com/katzenpost/katzenpost/server/cborplugin"
+	"github.com/katzenpost/katzenpost/server/internal/packet"
+)
+
+// countingCaller records the payloads of the requests dispatched to it.
+type countingCaller struct {
+	sync.Mutex
+	payloads [][]byte
+}
+
+func (c *countingCaller) Capability() string {
+	return "test"
+}
+
+func (c *countingCaller) Call(r *cborplugin.Request) (cborplugin.Command, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.payloads = append(c.payloads, r.Payload)
+	return &cborplugin.Response{ID: r.ID}, nil
+}
+
+func TestReplayFilter(t *testing.T) {
+	require := require.New(t)
+
+	var recipient [constants.RecipientIDLength]byte
+	copy(recipient[:], "+echo")
+	a := requestID(&recipient, nil, []byte("request a"))
+	b := requestID(&recipient, nil, []byte("request b"))
+	require.NotEqual(a, b)
+
+	// A retransmission with a fresh SURB is a different request.
+	surb := []byte("surb a")
+	require.NotEqual(a, requestID(&recipient, surb, []byte("request a")))
+	require.NotEqual(requestID(&recipient, surb, []byte("request a")), requestID(&recipient, []byte("surb b"), []byte("request a")))
+	require.Equal(requestID(&recipient, surb, []byte("request a")), requestID(&recipient, surb, []byte("request a")))
+
+	f := newReplayFilter(time.Minute, 16)
+	now := time.Now()
+
+	require.False(f.IsReplay(a, now))
+	require.True(f.IsReplay(a, now.Add(time.Second)))
+	require.False(f.IsReplay(b, now.Add(time.Second)))
+
+	// Requests seen outside of the window are accepted again.
+	later := now.Add(2 * time.Minute)
+	require.False(f.IsReplay(a, later))
+	require.False(f.IsReplay(b, later))
+	require.True(f.IsReplay(b, later))
+}
+
+func TestReplayFilterMaxSize(t *testing.T) {
+	require := require.New(t)
+
+	var recipient [constants.RecipientIDLength]byte
+	f := newReplayFilter(time.Hour, 2)
+	now := time.Now()
+
+	ids := [][32]byte{
+		requestID(&recipient, nil, []byte{0}),
+		requestID(&recipient, nil, []byte{1}),
+		requestID(&recipient, nil, []byte{2}),
+	}
+	for _, id := range ids {
+		require.False(f.IsReplay(id, now))
+	}
+	require.Len(f.seen, 2)
+	require.Len(f.queue, 2)
+
+	// The oldest request was forgotten to bound memory use.
+	require.False(f.IsReplay(ids[0], now))
+	require.True(f.IsReplay(ids[2], now))
+}
+
+func TestProcessKaetzchenReplay(t *testing.T) {
+	require := require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	g := geo.GeometryFromUserForwardPayloadLength(ecdh.Scheme(rand.Reader), 2000, true, 5)
+	newPacket := func(recipient string, body []byte) *packet.Packet {
+		pkt, err := packet.New(make([]byte, g.PacketLength), g)
+		require.NoError(err)
+		pkt.Recipient = new(commands.Recipient)
+		copy(pkt.Recipient.ID[:], recipient)
+		pkt.Payload = make([]byte, g.ForwardPayloadLength)
+		copy(pkt.Payload[g.SphinxPlaintextHeaderLength+g.SURBLength:], body)
+		return pkt
+	}
+	dispatch := func(k *CBORPluginWorker) int {
+		caller := new(countingCaller)
+		for i := 0; i < 3; i++ {
+			k.processKaetzchen(newPacket("+test", []byte("request a")), caller)
+		}
+		k.processKaetzchen(newPacket("+test", []byte("request b")), caller)
+		k.processKaetzchen(newPacket("+other", []byte("request a")), caller)
+		return len(caller.payloads)
+	}
+
+	// Replays of a request are dropped before they reach the plugin, the
+	// same payload to another recipient is a different request.
+	k := &CBORPluginWorker{
+		log:    logBackend.GetLogger("cbor_plugin_worker"),
+		geo:    g,
+		replay: newReplayFilter(time.Minute, 16),
+	}
+	require.Equal(3, dispatch(k))
+
+	// Without replay suppression every request is dispatched.
+	k.replay = nil
+	require.Equal(5, dispatch(k))
+}
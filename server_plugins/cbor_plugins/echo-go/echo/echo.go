@@ -0,0 +1,41 @@
+// echo.go - echo service using cbor plugin system
+// Copyright (C) 2018  David Stainton.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package echo implements the echo service as a cbor plugin, it answers
+// every Request with its own payload like the built-in echo Kaetzchen.
+package echo
+
+import (
+	"errors"
+
+	"github.com/katzenpost/katzenpost/server/cborplugin"
+)
+
+// Echo is the ServerPlugin of the echo service.
+type Echo struct{}
+
+func (e *Echo) OnCommand(cmd cborplugin.Command) (cborplugin.Command, error) {
+	switch r := cmd.(type) {
+	case *cborplugin.Request:
+		return &cborplugin.Response{Payload: r.Payload}, nil
+	default:
+		return nil, errors.New("echo-plugin: Invalid Command type")
+	}
+}
+
+func (e *Echo) RegisterConsumer(s *cborplugin.Server) {
+	// noop
+}
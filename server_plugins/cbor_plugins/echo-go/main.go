@@ -17,7 +17,6 @@
 package main
 
 import (
-	"errors"
 	"flag"
 	"fmt"
 	"os"
@@ -26,23 +25,9 @@ import (
 
 	"github.com/katzenpost/katzenpost/core/log"
 	"github.com/katzenpost/katzenpost/server/cborplugin"
+	"github.com/katzenpost/katzenpost/server_plugins/cbor_plugins/echo-go/echo"
 )
 
-type Echo struct{}
-
-func (e *Echo) OnCommand(cmd cborplugin.Command) (cborplugin.Command, error) {
-	switch r := cmd.(type) {
-	case *cborplugin.Request:
-		return &cborplugin.Response{Payload: r.Payload}, nil
-	default:
-		return nil, errors.New("echo-plugin: Invalid Command type")
-	}
-}
-
-func (e *Echo) RegisterConsumer(s *cborplugin.Server) {
-	// noop
-}
-
 func main() {
 	var logLevel string
 	var logDir string
@@ -75,10 +60,8 @@ func main() {
 		panic(err)
 	}
 	socketFile := filepath.Join(tmpDir, fmt.Sprintf("%d.echo.socket", os.Getpid()))
-	echo := new(Echo)
-
 	var server *cborplugin.Server
-	server = cborplugin.NewServer(serverLog, socketFile, new(cborplugin.RequestFactory), echo)
+	server = cborplugin.NewServer(serverLog, socketFile, new(cborplugin.RequestFactory), new(echo.Echo))
 	fmt.Printf("%s\n", socketFile)
 	server.Accept()
 	server.Wait()